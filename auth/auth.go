@@ -16,7 +16,11 @@
 package auth
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/rakyll/drivefuse/config"
@@ -38,6 +42,13 @@ const (
 	AccessType = "offline"
 )
 
+var (
+	// Returned by the requests when the access token can't be refreshed,
+	// e.g. if the refresh token is revoked or expired. The account has
+	// to be authorized again, see the wizard.
+	ErrAuth = errors.New("auth: the authorization is revoked or expired, run the wizard to authorize again")
+)
+
 func newConfig(cfg *config.Account) *oauth.Config {
 	return &oauth.Config{
 		ClientId:     cfg.ClientId,
@@ -50,12 +61,116 @@ func newConfig(cfg *config.Account) *oauth.Config {
 	}
 }
 
+// Transport authorizes the requests with the access token of an
+// account, refreshed once it expires. A request rejected as
+// unauthorized, e.g. if the token was revoked before it expired, is
+// retried once with a refreshed token. Safe for concurrent use.
+type Transport struct {
+	*oauth.Transport
+
+	mu sync.Mutex // guards the token
+}
+
 // NewTransport creates a Transport for a given account, suitable for use by
 // API clients.
-func NewTransport(cfg *config.Account) *oauth.Transport {
-	return &oauth.Transport{
+func NewTransport(cfg *config.Account) *Transport {
+	return &Transport{Transport: &oauth.Transport{
 		Config:    newConfig(cfg),
 		Transport: http.DefaultTransport,
 		Token:     &oauth.Token{RefreshToken: cfg.RefreshToken, Expiry: time.Now()},
+	}}
+}
+
+// Client returns an HTTP client authorized by the transport.
+func (t *Transport) Client() *http.Client {
+	return &http.Client{Transport: t}
+}
+
+// RoundTrip authorizes and sends the request. Fails with ErrAuth if the
+// access token can't be refreshed.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	accessToken, err := t.accessToken()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.send(req, req.Body, accessToken)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || (req.Body != nil && req.GetBody == nil) {
+		// the body of the others can't be sent again
+		return resp, err
+	}
+	body := req.Body
+	if req.GetBody != nil {
+		if body, err = req.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+	resp.Body.Close()
+	if accessToken, err = t.refresh(accessToken); err != nil {
+		if body != nil {
+			body.Close()
+		}
+		return nil, err
+	}
+	return t.send(req, body, accessToken)
+}
+
+// Sends a copy of the request with the body, authorized by the token.
+func (t *Transport) send(req *http.Request, body io.ReadCloser, accessToken string) (*http.Response, error) {
+	authorized := req.Clone(req.Context())
+	authorized.Body = body
+	authorized.Header.Set("Authorization", "Bearer "+accessToken)
+	transport := t.Transport.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return transport.RoundTrip(authorized)
+}
+
+// Returns the access token, refreshed first if it expired.
+func (t *Transport) accessToken() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Token == nil || t.Expired() {
+		if err := t.refreshLocked(); err != nil {
+			return "", err
+		}
+	}
+	return t.AccessToken, nil
+}
+
+// Refreshes the access token if it is still the rejected one, rather
+// than refreshed by another request meanwhile, and returns it.
+func (t *Transport) refresh(rejected string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Token != nil && t.AccessToken != rejected {
+		return t.AccessToken, nil
+	}
+	if err := t.refreshLocked(); err != nil {
+		return "", err
+	}
+	return t.AccessToken, nil
+}
+
+// Reauthorize refreshes the access token, e.g. once a request that
+// can't be retried by the transport is rejected as unauthorized. Fails
+// with ErrAuth if the token can't be refreshed.
+func (t *Transport) Reauthorize() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.refreshLocked()
+}
+
+func (t *Transport) refreshLocked() error {
+	if t.Token == nil {
+		t.Token = &oauth.Token{}
+	}
+	err := t.Refresh()
+	var oauthErr oauth.OAuthError
+	if errors.As(err, &oauthErr) {
+		// rejected by the token endpoint, or no refresh token at all;
+		// network errors are returned as they are and retried later
+		return fmt.Errorf("%w: %v", ErrAuth, err)
 	}
+	return err
 }
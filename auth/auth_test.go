@@ -0,0 +1,115 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rakyll/drivefuse/config"
+	"github.com/rakyll/drivefuse/third_party/code.google.com/p/goauth2/oauth"
+	T "github.com/rakyll/drivefuse/third_party/launchpad.net/gocheck"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { T.TestingT(t) }
+
+type AuthSuite struct{}
+
+var _ = T.Suite(&AuthSuite{})
+
+// fakeServer serves the token endpoint and an API accepting the last
+// access token it issued.
+type fakeServer struct {
+	mu         sync.Mutex
+	refreshes  int
+	refuse     bool     // if set, the refresh token is rejected
+	bodies     []string // of the API requests
+	authorized []bool   // of the API requests
+}
+
+func (f *fakeServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if req.URL.String() == GoogleOAuth2TokenURL {
+		if f.refuse {
+			return response(http.StatusBadRequest, `{"error":"invalid_grant"}`), nil
+		}
+		f.refreshes++
+		return response(http.StatusOK, fmt.Sprintf(`{"access_token":"token%d","expires_in":3600}`, f.refreshes)), nil
+	}
+	body := ""
+	if req.Body != nil {
+		content, _ := ioutil.ReadAll(req.Body)
+		body = string(content)
+	}
+	authorized := req.Header.Get("Authorization") == fmt.Sprintf("Bearer token%d", f.refreshes)
+	f.bodies = append(f.bodies, body)
+	f.authorized = append(f.authorized, authorized)
+	if !authorized {
+		return response(http.StatusUnauthorized, "{}"), nil
+	}
+	return response(http.StatusOK, "{}"), nil
+}
+
+func response(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// Returns a transport holding an access token the server doesn't
+// accept anymore, although it hasn't expired yet.
+func newRevokedTransport(server *fakeServer) *Transport {
+	t := NewTransport(&config.Account{ClientId: "id", ClientSecret: "secret", RefreshToken: "refresh"})
+	t.Transport.Transport = server
+	t.Token = &oauth.Token{AccessToken: "revoked", RefreshToken: "refresh", Expiry: time.Now().Add(time.Hour)}
+	return t
+}
+
+func (s *AuthSuite) TestUnauthorizedRequestsAreRetriedWithARefreshedToken(c *T.C) {
+	server := &fakeServer{}
+	client := newRevokedTransport(server).Client()
+	resp, err := client.Post("https://www.googleapis.com/drive/v2/files", "application/json", strings.NewReader(`{"title":"a"}`))
+	c.Assert(err, T.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, T.Equals, http.StatusOK)
+	c.Assert(server.refreshes, T.Equals, 1)
+	c.Assert(server.authorized, T.DeepEquals, []bool{false, true})
+	// the body is sent again
+	c.Assert(server.bodies, T.DeepEquals, []string{`{"title":"a"}`, `{"title":"a"}`})
+
+	// the refreshed token is used from then on
+	resp, err = client.Get("https://www.googleapis.com/drive/v2/about")
+	c.Assert(err, T.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, T.Equals, http.StatusOK)
+	c.Assert(server.refreshes, T.Equals, 1)
+}
+
+func (s *AuthSuite) TestFailedRefreshesAreAuthErrors(c *T.C) {
+	server := &fakeServer{refuse: true}
+	_, err := newRevokedTransport(server).Client().Get("https://www.googleapis.com/drive/v2/about")
+	c.Assert(errors.Is(err, ErrAuth), T.Equals, true)
+	c.Assert(server.authorized, T.DeepEquals, []bool{false})
+}
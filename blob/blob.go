@@ -16,95 +16,1075 @@ package blob
 
 import (
 	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/rakyll/drivefuse/logger"
 )
 
+const (
+	// Number of inodes that should remain free after a blob is saved.
+	minFreeInodes = 16
+
+	// Number of bytes that should remain free after a blob is saved.
+	minFreeSpace = 1 << 20
+
+	// Permission bits of the blobs and of the directories holding
+	// them, see Options.FileMode.
+	DefaultFileMode os.FileMode = 0640
+	DefaultDirMode  os.FileMode = 0750
+)
+
+var (
+	ErrNoInodes  = errors.New("blob: out of inodes")
+	ErrCacheMiss = errors.New("blob: cache miss")
+
+	// The disk has no room left for the content saved, even after the
+	// least recently used blobs are evicted.
+	ErrInsufficientSpace = errors.New("blob: insufficient disk space")
+
+	// The content saved doesn't match its md5 checksum, e.g. the
+	// download is corrupted.
+	ErrChecksumMismatch = errors.New("blob: checksum mismatch")
+)
+
+// Sized is implemented by the contents of a known length, e.g. the
+// bodies of the downloads. Saves check that there is room on the disk
+// for them before they read them, see ErrInsufficientSpace.
+type Sized interface {
+	// Returns the number of bytes left to read, negative if unknown.
+	Remaining() int64
+}
+
+// Returns the number of bytes left to read from r, negative if unknown.
+func remaining(r io.Reader) int64 {
+	if s, ok := r.(Sized); ok {
+		return s.Remaining()
+	}
+	return -1
+}
+
+// Returns ErrInsufficientSpace in place of the error of a write to a
+// full disk.
+func spaceErr(err error) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		return ErrInsufficientSpace
+	}
+	return err
+}
+
+// RangeFetcher retrieves length bytes of the remote content of the
+// file identified by id, starting at offset. It may return fewer
+// bytes than requested at the end of the file.
+type RangeFetcher func(id string, offset int64, length int) ([]byte, error)
+
+// SyncPolicy controls when the blob writes are synced to disk.
+type SyncPolicy int
+
+const (
+	// Syncs a blob once it is written, before it is renamed into
+	// place. The default.
+	SyncOnClose SyncPolicy = iota
+
+	// Never syncs, leaves it to the operating system.
+	SyncNone
+
+	// Syncs after each write, and once the blob is renamed into place
+	// also its directory.
+	SyncAlways
+)
+
+var syncPolicyNames = map[string]SyncPolicy{
+	"onclose": SyncOnClose,
+	"none":    SyncNone,
+	"always":  SyncAlways,
+}
+
+// Parses a sync policy name, one of none, onclose or always.
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	policy, ok := syncPolicyNames[name]
+	if !ok {
+		return SyncOnClose, errors.New("blob: unknown sync policy " + name)
+	}
+	return policy, nil
+}
+
+// Parses octal permission bits such as "0640", e.g. of Options.FileMode.
+// Zero is rejected, the options would fall back to the default.
+func ParseMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode == 0 || os.FileMode(mode)&^os.ModePerm != 0 {
+		return 0, errors.New("blob: invalid permission bits " + value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// Options configures a Manager.
+type Options struct {
+	// If set, blobs are never persisted to disk, reads are proxied
+	// to the fetcher instead.
+	PassThrough RangeFetcher
+
+	// Minimum number of bytes requested from the fetcher in
+	// pass-through mode. The last fetched window is kept in memory
+	// to serve subsequent reads in the same range.
+	PassThroughBufferSize int
+
+	// When the writes are synced to disk. Defaults to SyncOnClose.
+	Sync SyncPolicy
+
+	// If set, I/O errors reading a blob are treated as cache misses
+	// rather than returned: the blob is removed, Heal is called to
+	// fetch it again and ErrCacheMiss is returned.
+	Heal func(id string)
+
+	// If set, OnWatermark is called with high set once the total size
+	// of the blobs grows to HighWatermark bytes or more, and with high
+	// unset once it shrinks back to LowWatermark bytes or less. It is
+	// not called again until the size crosses the other watermark, so
+	// that a size hovering around one doesn't fire it repeatedly.
+	HighWatermark int64
+	LowWatermark  int64
+	OnWatermark   func(size int64, high bool)
+
+	// If set, the least recently used blobs are evicted once the total
+	// size of the blobs grows over MaxSize bytes. Blobs being read are
+	// not evicted. Zero means no limit.
+	MaxSize int64
+
+	// If set, the OS is advised to read ahead the blobs read
+	// sequentially in large chunks. Only supported on Linux, a no-op
+	// elsewhere.
+	ReadAhead bool
+
+	// If set, a read continuing the previous read of a blob reads
+	// ReadAheadBuffer bytes from the disk at once, and the following
+	// sequential reads are served from memory, e.g. the small reads of
+	// a file system. Random reads are not read ahead. Up to a few
+	// buffers are kept, each for a short while.
+	ReadAheadBuffer int
+
+	// If set, blobs are stored gzip-compressed, in chunks that can be
+	// read independently. Blobs that don't compress well, e.g. media,
+	// are stored as they are. Blobs stored by earlier runs are read in
+	// either form.
+	Compress bool
+
+	// The blobs are stored in ShardLevels levels of shard directories
+	// under the blob directory, each named after ShardChars characters
+	// of the end of the ids, e.g. the blobs of the id "abcdef" in
+	// "ef/cd" with two levels of two characters. Defaults to one level
+	// of two characters. NoSharding stores the blobs in the blob
+	// directory itself. The blobs stored in another layout by earlier
+	// runs are moved by LoadIndex, they are not found until then.
+	ShardLevels int
+	ShardChars  int
+
+	// If set, blobs with the same md5 checksum, e.g. of copied files,
+	// share their content on disk: the blob of a file is a hard link
+	// to the stored blob of another file with the checksum. The content
+	// is removed along with its last blob, and counts once into the
+	// size of the cache. Blobs are copied if the filesystem doesn't
+	// support hard links.
+	Dedup bool
+
+	// If set, blobs are stored encrypted with AES-GCM under the key,
+	// see DeriveKey, in chunks that can be decrypted independently.
+	// Each read decrypts the whole chunks of its range and each save
+	// encrypts the content, which costs CPU time, most noticeably on
+	// small random reads of large files. Unencrypted blobs stored by
+	// earlier runs are still read.
+	Key []byte
+
+	// If set, the blobs are stored in a directory of their own under
+	// the blob directory, e.g. of one of several Drive accounts sharing
+	// it, see namespaceDir. Managers of different namespaces don't see
+	// each other's blobs, nor the blobs stored without a namespace.
+	Namespace string
+
+	// If set, the blobs saved by SaveLazy are sparse: their content is
+	// fetched from Lazy on demand, in chunks of LazyChunkSize bytes, by
+	// the reads of the ranges not fetched yet. The chunks fetched are
+	// kept on disk, the blob is stored whole once all of them are.
+	// LazyChunkSize defaults to DefaultLazyChunkSize. Ignored if the
+	// blobs are encrypted, see Key.
+	Lazy          RangeFetcher
+	LazyChunkSize int
+
+	// If set, the blobs being saved are written to temporary files in
+	// StagingPath, e.g. on a faster disk than the blob directory, then
+	// moved into place. By default they are written next to the blobs.
+	// Staged blobs are renamed into place if StagingPath is on the
+	// device of the blob directory, copied and synced there otherwise,
+	// see checkStaging, which is not atomic for the blob directory.
+	StagingPath string
+
+	// Permission bits of the blobs and of the directories holding them,
+	// e.g. wider ones for a cache shared with the users of a group. The
+	// bits of the umask of the process are cleared, whatever creates
+	// the files. Zero modes default to DefaultFileMode and
+	// DefaultDirMode.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+
+	// Receives the logs of the manager. Defaults to logger.Default.
+	Logger logger.Logger
+}
+
 type Manager struct {
 	blobPath string
+	opts     Options
+	statfs   func(path string, stat *syscall.Statfs_t) error
+	rename   func(oldpath string, newpath string) error
+	hardLink func(oldpath string, newpath string) error
+	fsync    func(file *os.File) error
+	advise   func(file *os.File, offset int64, length int64) error
+	readDir  func(dirname string) ([]os.FileInfo, error)
+	log      logger.Logger
+
+	// the staging directory is not on the device of the blob directory,
+	// see Options.StagingPath
+	crossDevice bool
+
+	// layout of the shard directories, see Options.ShardLevels
+	shardLevels int
+	shardChars  int
+
+	// permission bits less the umask, see Options.FileMode
+	fileMode os.FileMode
+	dirMode  os.FileMode
+
+	mu  sync.Mutex
+	buf *window // last window fetched in pass-through mode
+
+	index *index
+
+	muWrites sync.Mutex // serializes WriteAt
+
+	muLazy sync.Mutex // serializes the lazy reads, see Options.Lazy
+
+	muWatermark sync.Mutex
+	aboveHigh   bool // the size has crossed the high watermark
+
+	muReads  sync.Mutex
+	readEnds map[string]int64        // end offsets of the last reads, keyed by id
+	ahead    map[string]*aheadBuffer // contents read ahead, keyed by id
+
+	muRetained sync.Mutex
+	retained   map[string]string // checksums of the blobs kept, keyed by id, see Retain
 }
 
-func New(blobPath string) *Manager {
-	return &Manager{blobPath: blobPath}
+// A range of remote content held in memory.
+type window struct {
+	id       string
+	checksum string // version of the content
+	offset   int64
+	data     []byte
 }
 
+// Creates a new Manager storing blobs under blobPath. A nil opts
+// uses the default options.
+func New(blobPath string, opts *Options) *Manager {
+	m := &Manager{blobPath: path.Clean(blobPath), statfs: syscall.Statfs, rename: os.Rename, hardLink: os.Link, fsync: (*os.File).Sync, advise: adviseWillNeed, readDir: ioutil.ReadDir, index: newIndex(), readEnds: make(map[string]int64), ahead: make(map[string]*aheadBuffer), retained: make(map[string]string)}
+	if opts != nil {
+		m.opts = *opts
+	}
+	if m.log = m.opts.Logger; m.log == nil {
+		m.log = logger.Default
+	}
+	if m.opts.Namespace != "" {
+		m.blobPath = path.Join(m.blobPath, namespaceDir(m.opts.Namespace))
+	}
+	m.shardLevels, m.shardChars = m.opts.ShardLevels, m.opts.ShardChars
+	if m.shardLevels == 0 {
+		m.shardLevels = DefaultShardLevels
+	}
+	if m.shardChars <= 0 {
+		m.shardChars = DefaultShardChars
+	}
+	m.fileMode, m.dirMode = DefaultFileMode, DefaultDirMode
+	if m.opts.FileMode != 0 {
+		m.fileMode = m.opts.FileMode.Perm()
+	}
+	if m.opts.DirMode != 0 {
+		m.dirMode = m.opts.DirMode.Perm()
+	}
+	mask := processUmask()
+	m.fileMode &^= mask
+	m.dirMode &^= mask
+	return m
+}
+
+var (
+	umaskOnce sync.Once
+	umask     os.FileMode
+)
+
+// Returns the umask of the process, read once, by the first manager.
+// It is read from /proc if the kernel reports it there. Otherwise it
+// can only be read by setting it, the files the other threads create
+// in the meantime get no umask.
+func processUmask() os.FileMode {
+	umaskOnce.Do(func() {
+		if status, err := ioutil.ReadFile("/proc/self/status"); err == nil {
+			for _, line := range strings.Split(string(status), "\n") {
+				if value, ok := strings.CutPrefix(line, "Umask:"); ok {
+					if mask, err := strconv.ParseUint(strings.TrimSpace(value), 8, 32); err == nil {
+						umask = os.FileMode(mask)
+						return
+					}
+				}
+			}
+		}
+		mask := syscall.Umask(0)
+		syscall.Umask(mask)
+		umask = os.FileMode(mask)
+	})
+	return umask
+}
+
+// Returns true if blobs are not cached locally.
+func (f *Manager) IsPassThrough() bool {
+	return f.opts.PassThrough != nil
+}
+
+// Saves the content read from rc as the blob of id with the checksum.
+// Md5 checksums are verified, content not matching its checksum is not
+// saved and ErrChecksumMismatch is returned. If Options.Dedup is set
+// and a blob of another id has the same md5 checksum, it is linked
+// instead and rc is not read. If there is no room on the disk for the
+// content, ErrInsufficientSpace is returned, before rc is read if it is
+// Sized, nothing is saved.
 func (f *Manager) Save(id string, checksum string, rc io.ReadCloser) error {
-	f.cleanup(id, checksum)
-	if err := os.MkdirAll(f.getBlobDir(id), 0750); err != nil {
+	return f.SaveContext(context.Background(), id, checksum, rc)
+}
+
+// SaveContext is like Save, but stops reading rc once ctx is done and
+// returns the error of ctx, nothing is saved. A read of rc blocked
+// meanwhile returns first, unless rc is tied to ctx, as the body of a
+// request made with ctx is.
+func (f *Manager) SaveContext(ctx context.Context, id string, checksum string, rc io.ReadCloser) error {
+	_, err := f.SaveContextMd5(ctx, id, checksum, rc)
+	return err
+}
+
+// SaveContextMd5 is like SaveContext, but also returns the md5 checksum
+// of the content saved, computed while it is written, e.g. to record
+// the checksum of a file Drive doesn't provide one for. The content is
+// read only once. The checksum is the one given if the blob is linked.
+func (f *Manager) SaveContextMd5(ctx context.Context, id string, checksum string, rc io.ReadCloser) (string, error) {
+	if f.IsPassThrough() {
+		return "", nil
+	}
+	f.dropAhead(id)
+	if !f.isStored(id, checksum) {
+		// the blobs of other checksums are removed once the save of
+		// this one starts, there are none left by a save again but the
+		// retained one
+		f.cleanup(id, checksum)
+	}
+	if linked, err := f.link(id, checksum); err != nil {
+		return "", err
+	} else if linked {
+		// linked to a blob of the same md5 checksum
+		return strings.ToLower(checksum), nil
+	}
+	if err := f.checkSpace(id, remaining(rc)); err != nil {
+		return "", err
+	}
+	dir, file, err := f.tempBlob(id, checksum)
+	if err != nil {
+		return "", err
+	}
+	// the content never reaches the disk unencrypted
+	form := blobForm{encrypted: f.opts.Key != nil}
+	var w io.WriteCloser = nopWriteCloser{file}
+	if form.encrypted {
+		if w, err = newEncrypter(file, f.opts.Key); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return "", err
+		}
+	}
+	hash := md5.New()
+	if err = f.copyBlob(file, w, io.TeeReader(contextReader{ctx, rc}, hash)); err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", spaceErr(err)
+	}
+	digest := hex.EncodeToString(hash.Sum(nil))
+	if isMd5(checksum) && !strings.EqualFold(digest, checksum) {
+		f.log.V("checksum mismatch of blob", id, checksum)
+		file.Close()
+		os.Remove(file.Name())
+		return "", ErrChecksumMismatch
+	}
+	if err = f.store(id, checksum, dir, file, form); err != nil {
+		return "", spaceErr(err)
+	}
+	return digest, nil
+}
+
+// Creates a temporary file to write the blob of id with the checksum
+// to, returns the directory of the blob. The file is next to the blob,
+// so that it can be atomically renamed into place even if the blob
+// directory is on another device than the rest of the data, unless it
+// is staged, see Options.StagingPath.
+func (f *Manager) tempBlob(id string, checksum string) (string, *os.File, error) {
+	dir, err := f.checkInodes(id)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := os.MkdirAll(dir, f.dirMode); err != nil {
+		return "", nil, err
+	}
+	if f.opts.StagingPath != "" {
+		file, err := f.stagingFile(f.getBlobName(id, checksum) + ".tmp")
+		return dir, file, err
+	}
+	file, err := ioutil.TempFile(dir, f.getBlobName(id, checksum)+".tmp")
+	if os.IsNotExist(err) {
+		// the shard was emptied and removed by a concurrent delete
+		if err = os.MkdirAll(dir, f.dirMode); err == nil {
+			file, err = ioutil.TempFile(dir, f.getBlobName(id, checksum)+".tmp")
+		}
+	}
+	return dir, file, err
+}
+
+// Stores the content written to file, a temporary file in dir, as the
+// blob of id with the checksum. The file is in form, compressed first
+// if the options ask for it, then renamed into place.
+func (f *Manager) store(id string, checksum string, dir string, file *os.File, form blobForm) (err error) {
+	// dirty blobs are written in place, see WriteAt
+	if f.opts.Compress && checksum != dirtyChecksum {
+		var gz *os.File
+		if gz, err = f.compressBlob(dir, f.getBlobName(id, checksum), file); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return err
+		}
+		if gz != nil {
+			file.Close()
+			os.Remove(file.Name())
+			file, form.compressed = gz, true
+		}
+	}
+	// temporary files are created private
+	err = file.Chmod(f.fileMode)
+	if err == nil && f.opts.Sync != SyncNone {
+		err = f.fsync(file)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
 		return err
 	}
-	file, err := os.OpenFile(f.getBlobPath(id, checksum), os.O_CREATE|os.O_RDWR, 0750)
-	if file == nil && err != nil {
+	blobPath := path.Join(dir, f.getBlobName(id, checksum)+form.suffix())
+	if err = f.moveStaged(file.Name(), blobPath); err != nil {
+		os.Remove(file.Name())
 		return err
 	}
-	defer file.Close()
+	return f.stored(id, checksum, dir, form)
+}
+
+// Indexes the blob of id with the checksum stored in form in dir, once
+// it is in place.
+func (f *Manager) stored(id string, checksum string, dir string, form blobForm) error {
+	name := f.getBlobName(id, checksum)
+	blobPath := path.Join(dir, name+form.suffix())
+	// the same content may have been stored in another form before,
+	// partially or sparse
+	os.Remove(path.Join(dir, name+sparseSuffix))
+	os.Remove(path.Join(dir, name+sparseSuffix+rangesSuffix))
+	for _, other := range blobForms {
+		if other != form {
+			os.Remove(path.Join(dir, name+other.suffix()))
+		}
+		if !other.compressed {
+			os.Remove(path.Join(dir, name+other.suffix()+partialSuffix))
+		}
+	}
+	if info, statErr := os.Stat(blobPath); statErr == nil {
+		f.index.add(&Entry{Id: id, Checksum: checksum, Path: blobPath, Size: info.Size(), Compressed: form.compressed, Encrypted: form.encrypted, LastAccess: time.Now(), file: fileKeyOf(info)})
+		f.evict(id)
+		f.checkWatermarks()
+	}
+	if f.opts.Sync == SyncAlways {
+		return f.syncDir(dir)
+	}
+	return nil
+}
+
+// Returns true if the checksum is an md5 digest in hex, as Drive
+// reports them. Other checksums, such as the ones of exported docs,
+// can't be verified.
+func isMd5(checksum string) bool {
+	if len(checksum) != 2*md5.Size {
+		return false
+	}
+	_, err := hex.DecodeString(checksum)
+	return err == nil
+}
+
+// Syncs the directory, so that the renames in it are persisted.
+func (f *Manager) syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return f.fsync(d)
+}
 
-	reader := bufio.NewReader(rc)
-	writer := bufio.NewWriter(file)
+// Copies the content read from r to the file through w, e.g. an
+// encrypter writing to the file.
+func (f *Manager) copyBlob(file *os.File, w io.Writer, r io.Reader) error {
+	reader := bufio.NewReader(r)
+	writer := bufio.NewWriter(w)
 	p := make([]byte, 4096)
 	for {
 		n, err := reader.Read(p)
+		if n > 0 {
+			if _, writeErr := writer.Write(p[:n]); writeErr != nil {
+				return writeErr
+			}
+			if f.opts.Sync == SyncAlways {
+				// the buffered data has to reach the file before it is synced
+				if writeErr := writer.Flush(); writeErr != nil {
+					return writeErr
+				}
+				if writeErr := f.fsync(file); writeErr != nil {
+					return writeErr
+				}
+			}
+		}
 		if err == io.EOF {
 			break
 		}
-		_, err = writer.Write(p[:n])
 		if err != nil {
+			// e.g. the download timed out, keep the content read so
+			// far for SaveFrom to resume from
+			writer.Flush()
 			return err
 		}
 	}
-	return nil
+	return writer.Flush()
 }
 
+// contextReader fails the reads with the error of ctx once it is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// Reads up to l bytes of the blob of id with the checksum, starting at
+// seek. Returns a buffer of l bytes, size of which are read; fewer than
+// l only at the end of the blob.
 func (f *Manager) Read(id string, checksum string, seek int64, l int) (blob []byte, size int64, err error) {
+	return f.ReadContext(context.Background(), id, checksum, seek, l)
+}
+
+// ReadContext is like Read, but returns the error of ctx once ctx is
+// done, e.g. if the read is interrupted. The read itself can't be
+// interrupted, it finishes in the background, e.g. fetching the range
+// in pass-through mode.
+func (f *Manager) ReadContext(ctx context.Context, id string, checksum string, seek int64, l int) ([]byte, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	if ctx.Done() == nil {
+		// never done
+		return f.read(id, checksum, seek, l)
+	}
+	type result struct {
+		blob []byte
+		size int64
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		blob, size, err := f.read(id, checksum, seek, l)
+		done <- result{blob, size, err}
+	}()
+	select {
+	case r := <-done:
+		return r.blob, r.size, r.err
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+}
+
+func (f *Manager) read(id string, checksum string, seek int64, l int) (blob []byte, size int64, err error) {
+	if f.IsPassThrough() {
+		blob, err = f.readRemote(id, checksum, seek, l)
+		return blob, int64(len(blob)), err
+	}
+	if e, ok := f.index.get(id); ok && e.IsDirty() {
+		// written locally, the content is not the one of checksum anymore
+		checksum = dirtyChecksum
+	}
+	f.index.startRead(id)
+	defer f.index.endRead(id)
+	sequential := f.recordRead(id, seek, l)
+	if blob, size, ok := f.readBuffered(id, checksum, seek, l, sequential); ok {
+		f.touch(id)
+		return blob, size, nil
+	}
 	var file *os.File
-	file, err = os.Open(f.getBlobPath(id, checksum))
+	var form blobForm
+	if file, form, err = f.openBlob(id, checksum); os.IsNotExist(err) && checksum != dirtyChecksum && f.IsLazy() {
+		if blob, size, ok, lazyErr := f.readLazy(id, checksum, seek, l); ok {
+			return blob, size, lazyErr
+		}
+	}
 	if err != nil {
 		return
 	}
 	defer file.Close()
 
-	blob = make([]byte, l)
-	file.Seek(seek, 0)
+	if f.opts.ReadAhead && sequential && l >= minSequentialRead {
+		f.advise(file, seek+int64(l), int64(l)*readAheadFactor)
+	}
+	n := l
+	if sequential && f.opts.ReadAheadBuffer > l {
+		n = f.opts.ReadAheadBuffer
+	}
+	blob = make([]byte, n)
+	// unlike Read, ReadAt fills the whole range unless it fails or
+	// reaches the end of the blob
 	var s int
-	s, err = file.Read(blob)
+	s, err = f.readContent(file, form, blob, seek)
+	eof := err == io.EOF
+	if eof {
+		// a read past the end is short, not failed
+		err = nil
+	}
+	if err == nil && n > l {
+		if s > l {
+			f.keepAhead(id, checksum, seek+int64(l), append([]byte(nil), blob[l:s]...), eof)
+			s = l
+		}
+		blob = blob[:l]
+	}
+	if err != nil && f.opts.Heal != nil {
+		f.log.V("error reading blob", id, err, "fetching it again")
+		// only the broken blob, a download of the file may be writing
+		// its temporary file next to it
+		os.RemoveAll(file.Name())
+		f.index.remove(id, file.Name())
+		f.dropAhead(id)
+		f.checkWatermarks()
+		f.opts.Heal(id)
+		return nil, 0, ErrCacheMiss
+	}
+	if err == nil {
+		f.touch(id)
+	}
 	return blob, int64(s), err
 }
 
+// Marks the blob of id as read now, see index.touch.
+func (f *Manager) touch(id string) {
+	if p, stale := f.index.touch(id); stale {
+		now := time.Now()
+		os.Chtimes(p, now, now)
+	}
+}
+
 func (f *Manager) Delete(id string) error {
-	// TODO(burcud): rm directory if not required anymore
-	return f.cleanup(id, "*")
+	if f.IsPassThrough() {
+		// the id may be reused if the file is restored, don't serve
+		// its old content
+		f.mu.Lock()
+		if f.buf != nil && f.buf.id == id {
+			f.buf = nil
+		}
+		f.mu.Unlock()
+		return nil
+	}
+	f.dropAhead(id)
+	f.muRetained.Lock()
+	delete(f.retained, id)
+	f.muRetained.Unlock()
+	err := f.cleanup(id, "*")
+	f.removeShard(id)
+	f.checkWatermarks()
+	return err
 }
 
-func (f *Manager) cleanup(id string, checksum string) (err error) {
-	var blobs []os.FileInfo
-	if blobs, err = ioutil.ReadDir(f.getBlobDir(id)); err != nil {
+// Keeps the blob of id with the checksum while the content of another
+// checksum is saved, e.g. the stale content of a file read while its
+// new content is downloaded, until Release or Delete is called for id.
+func (f *Manager) Retain(id string, checksum string) {
+	f.muRetained.Lock()
+	defer f.muRetained.Unlock()
+	f.retained[id] = checksum
+}
+
+// Stops keeping the blob retained for id, see Retain, and removes the
+// blobs of id but the one of the checksum, the content it switched to.
+func (f *Manager) Release(id string, checksum string) error {
+	f.muRetained.Lock()
+	_, ok := f.retained[id]
+	delete(f.retained, id)
+	f.muRetained.Unlock()
+	if !ok || f.IsPassThrough() {
+		return nil
+	}
+	return f.cleanup(id, checksum)
+}
+
+// Removes all of the blobs, along with the temporary and partial
+// blobs of the saves in progress. Reads in progress may fail.
+func (f *Manager) Clear() error {
+	if f.IsPassThrough() {
+		f.mu.Lock()
+		f.buf = nil
+		f.mu.Unlock()
+		return nil
+	}
+	dirs, err := f.blobDirs()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f.log.V("Clearing blobs")
+	f.muReads.Lock()
+	f.readEnds = make(map[string]int64)
+	f.ahead = make(map[string]*aheadBuffer)
+	f.muReads.Unlock()
+	// the deepest shards first, so that their parents are emptied
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dir := dirs[i]
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			// the salt of the key and the other markers are kept
+			if file.IsDir() || !strings.Contains(file.Name(), blobNameSeparator) {
+				continue
+			}
+			if err = os.Remove(path.Join(dir, file.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if dir != f.blobPath {
+			os.Remove(dir)
+		}
+	}
+	f.index.clear()
+	f.checkWatermarks()
+	return nil
+}
+
+// Calls OnWatermark if the total size of the blobs has crossed a
+// watermark since the last call.
+func (f *Manager) checkWatermarks() {
+	if f.opts.OnWatermark == nil || f.opts.HighWatermark <= 0 {
 		return
 	}
-	for _, file := range blobs {
-		if file.Name() != f.getBlobName(id, checksum) && strings.Contains(file.Name(), f.getBlobName(id, "")) {
-			logger.V("Deleting blob", file.Name())
-			// errors are not show stoppers here, they will cost additional disk space
-			// we can get rid of on the next removal try.
-			if rmErr := os.Remove(path.Join(f.getBlobDir(id), file.Name())); rmErr != nil {
-				logger.V(rmErr)
+	f.muWatermark.Lock()
+	size := f.CacheSize()
+	crossed := false
+	switch {
+	case !f.aboveHigh && size >= f.opts.HighWatermark:
+		f.aboveHigh, crossed = true, true
+	case f.aboveHigh && size <= f.opts.LowWatermark:
+		f.aboveHigh, crossed = false, true
+	}
+	high := f.aboveHigh
+	f.muWatermark.Unlock()
+	// outside of the lock, the callback may delete blobs to free space
+	if crossed {
+		f.opts.OnWatermark(size, high)
+	}
+}
+
+// Reads a range of remote content, serving it from the in-memory
+// window if it was fetched before for the same version of the file.
+func (f *Manager) readRemote(id string, checksum string, seek int64, l int) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if w := f.buf; w != nil && w.id == id && w.checksum == checksum && seek >= w.offset &&
+		seek+int64(l) <= w.offset+int64(len(w.data)) {
+		start := seek - w.offset
+		return w.data[start : start+int64(l)], nil
+	}
+	size := l
+	if f.opts.PassThroughBufferSize > size {
+		size = f.opts.PassThroughBufferSize
+	}
+	data, err := f.opts.PassThrough(id, seek, size)
+	if err != nil {
+		return nil, err
+	}
+	f.buf = &window{id: id, checksum: checksum, offset: seek, data: data}
+	if len(data) > l {
+		data = data[:l]
+	}
+	return data, nil
+}
+
+// Verifies there are enough free inodes to store the blob for id,
+// returns the directory to store it in. The shard directory of id is
+// preferred; if it doesn't exist yet and there are not enough inodes
+// left to create it, the blob directory itself is reused. Filesystems
+// that don't report inode counts are not checked.
+func (f *Manager) checkInodes(id string) (string, error) {
+	dirs := f.getBlobDirs(id)
+	var stat syscall.Statfs_t
+	if err := f.statfs(f.blobPath, &stat); err != nil || stat.Files == 0 {
+		return dirs[0], nil
+	}
+	for _, dir := range dirs {
+		required := uint64(minFreeInodes+1) + uint64(f.missingShards(dir))
+		if uint64(stat.Ffree) >= required {
+			return dir, nil
+		}
+	}
+	return "", ErrNoInodes
+}
+
+// Verifies there is room on the disk for size more bytes of blobs,
+// evicting the least recently used blobs other than the ones of id if
+// there isn't. Returns ErrInsufficientSpace if there still isn't room.
+// Contents of unknown size, and filesystems that don't report their
+// free space, are not checked.
+func (f *Manager) checkSpace(id string, size int64) error {
+	if size < 0 {
+		return nil
+	}
+	if f.opts.Compress {
+		// the compressed copy is written next to the content first
+		size *= 2
+	}
+	required := size + minFreeSpace
+	free, ok := f.freeSpace()
+	if !ok || free >= required {
+		return nil
+	}
+	f.log.V("Evicting blobs to make room for", id, size, "bytes")
+	f.evictTo(f.CacheSize()-(required-free), id)
+	f.checkWatermarks()
+	if free, _ = f.freeSpace(); free >= required {
+		return nil
+	}
+	f.log.V("no room for blob", id, size, "bytes, only", free, "bytes free")
+	return ErrInsufficientSpace
+}
+
+// Returns the number of bytes free on the disk of the blobs, false if
+// the filesystem doesn't report it.
+func (f *Manager) freeSpace() (int64, bool) {
+	var stat syscall.Statfs_t
+	if err := f.statfs(f.blobPath, &stat); err != nil || stat.Blocks == 0 {
+		return 0, false
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), true
+}
+
+// Opens the blob, looking it up in each of the directories it may be
+// stored in, in any form. Returns the form it is stored in.
+func (f *Manager) openBlob(id string, checksum string) (file *os.File, form blobForm, err error) {
+	for _, dir := range f.getBlobDirs(id) {
+		for _, form = range blobForms {
+			if file, err = os.Open(path.Join(dir, f.getBlobName(id, checksum)+form.suffix())); !os.IsNotExist(err) {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Returns true if the blob of id with the checksum is stored, in any
+// form, or if a dirty blob of id is, see WriteAt.
+func (f *Manager) Exists(id string, checksum string) bool {
+	if f.IsPassThrough() {
+		return false
+	}
+	if e, ok := f.index.get(id); ok && e.IsDirty() {
+		checksum = dirtyChecksum
+	}
+	return f.isStored(id, checksum)
+}
+
+// Returns true if the blob of id with the checksum is stored, in any
+// form.
+func (f *Manager) isStored(id string, checksum string) bool {
+	for _, dir := range f.getBlobDirs(id) {
+		for _, form := range blobForms {
+			if _, err := os.Stat(path.Join(dir, f.getBlobName(id, checksum)+form.suffix())); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the size of the content of the blob of id with the checksum,
+// or of the dirty blob of id, rather than its size on disk if it is
+// compressed or encrypted. Fails like os.Open if it is not stored.
+func (f *Manager) Size(id string, checksum string) (int64, error) {
+	if f.IsPassThrough() {
+		return 0, ErrCacheMiss
+	}
+	if e, ok := f.index.get(id); ok && e.IsDirty() {
+		checksum = dirtyChecksum
+	}
+	file, form, err := f.openBlob(id, checksum)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	_, size, err := f.contentAt(file, form)
+	return size, err
+}
+
+// Returns a reader of the blob in file stored in form, decrypting it if
+// encrypted, and its size. The content is compressed if the form is.
+func (f *Manager) storedContent(file *os.File, form blobForm) (io.ReaderAt, int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	if !form.encrypted {
+		return file, info.Size(), nil
+	}
+	d, err := newDecrypter(file, info.Size(), f.opts.Key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return d, d.size, nil
+}
+
+// Reads len(p) bytes of the content of the blob in file stored in
+// form, starting at off, like io.ReaderAt.
+func (f *Manager) readContent(file *os.File, form blobForm, p []byte, off int64) (int, error) {
+	r, size, err := f.storedContent(file, form)
+	if err != nil {
+		return 0, err
+	}
+	if form.compressed {
+		return readCompressed(r, size, p, off)
+	}
+	return r.ReadAt(p, off)
+}
+
+// Opens the content of the blob of the entry for reading, whichever
+// form it is stored in.
+func (f *Manager) OpenEntry(e Entry) (io.ReadCloser, error) {
+	file, err := os.Open(e.Path)
+	if err != nil {
+		return nil, err
+	}
+	content, err := f.openContent(file, e.form())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &blobReader{Reader: content, file: file}, nil
+}
+
+// Returns a reader of the content of the blob in file stored in form,
+// from its start.
+func (f *Manager) openContent(file *os.File, form blobForm) (io.Reader, error) {
+	r, size, err := f.storedContent(file, form)
+	if err != nil {
+		return nil, err
+	}
+	if form.compressed {
+		return openCompressed(r, size)
+	}
+	return io.NewSectionReader(r, 0, size), nil
+}
+
+// blobReader reads the content of a blob, closing its file once done.
+type blobReader struct {
+	io.Reader
+	file *os.File
+}
+
+func (r *blobReader) Close() error {
+	return r.file.Close()
+}
+
+func (f *Manager) cleanup(id string, checksum string) (err error) {
+	f.muRetained.Lock()
+	retained, isRetained := f.retained[id]
+	f.muRetained.Unlock()
+	for _, dir := range f.getBlobDirs(id) {
+		var blobs []os.FileInfo
+		if blobs, err = f.readDir(dir); os.IsNotExist(err) {
+			// nothing is stored there yet, e.g. for a new id
+			continue
+		} else if err != nil {
+			f.log.V("error listing the blobs of", id, err)
+			continue
+		}
+		for _, file := range blobs {
+			// the blob directory is shared by many ids, match the whole id
+			name, _ := trimSparseSuffix(file.Name())
+			name, _ = trimFormSuffix(strings.TrimSuffix(name, partialSuffix))
+			if isRetained && name == f.getBlobName(id, retained) {
+				// still read, see Retain
+				continue
+			}
+			if name != f.getBlobName(id, checksum) && strings.HasPrefix(file.Name(), f.getBlobName(id, "")) {
+				f.log.V("Deleting blob", file.Name())
+				// errors are not show stoppers here, they will cost additional disk space
+				// we can get rid of on the next removal try.
+				if rmErr := os.Remove(path.Join(dir, file.Name())); rmErr != nil {
+					f.log.V(rmErr)
+					continue
+				}
+				f.index.remove(id, path.Join(dir, file.Name()))
 			}
 		}
 	}
 	return nil
 }
 
-func (f *Manager) getBlobDir(id string) string {
-	l := len(id)
-	return path.Join(f.blobPath, id[l-2:l])
+// Returns the directories the blobs of id may be stored in, the shard
+// directory first.
+func (f *Manager) getBlobDirs(id string) []string {
+	if dir := f.getBlobDir(id); dir != f.blobPath {
+		return []string{dir, f.blobPath}
+	}
+	return []string{f.blobPath}
 }
 
+// Returns the file name of the blob, the escaped id and the checksum
+// separated by "==". The separator can't appear in an escaped id.
 func (f *Manager) getBlobName(id string, checksum string) string {
-	return id + "==" + checksum
+	return escapeId(id) + blobNameSeparator + checksum
 }
 
 func (f *Manager) getBlobPath(id string, checksum string) string {
@@ -0,0 +1,1500 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Contains tests for blob package.
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	T "github.com/rakyll/drivefuse/third_party/launchpad.net/gocheck"
+)
+
+type BlobSuite struct {
+	blobPath string
+}
+
+var _ = T.Suite(&BlobSuite{})
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	T.TestingT(t)
+}
+
+func (s *BlobSuite) SetUpTest(c *T.C) {
+	s.blobPath = c.MkDir()
+}
+
+func (s *BlobSuite) TestPassThroughDeleteDropsWindow(c *T.C) {
+	content := "old content"
+	fetcher := func(id string, offset int64, length int) ([]byte, error) {
+		return []byte(content), nil
+	}
+	m := New(s.blobPath, &Options{PassThrough: fetcher, PassThroughBufferSize: 1024})
+	data, _, err := m.Read("fileid", "checksum", 0, 3)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data), T.Equals, "old")
+
+	// deleted and restored with new content
+	c.Assert(m.Delete("fileid"), T.IsNil)
+	content = "new content"
+	data, _, err = m.Read("fileid", "checksum", 0, 3)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data), T.Equals, "new")
+}
+
+func (s *BlobSuite) TestPassThroughWindowFollowsChecksum(c *T.C) {
+	content := "old content"
+	fetcher := func(id string, offset int64, length int) ([]byte, error) {
+		return []byte(content), nil
+	}
+	m := New(s.blobPath, &Options{PassThrough: fetcher, PassThroughBufferSize: 1024})
+	data, _, err := m.Read("fileid", "old-checksum", 0, 3)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data), T.Equals, "old")
+
+	// edited remotely, the synced metadata has a new checksum
+	content = "new content"
+	data, _, err = m.Read("fileid", "new-checksum", 0, 3)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data), T.Equals, "new")
+}
+
+func (s *BlobSuite) TestPassThroughRead(c *T.C) {
+	content := []byte("0123456789abcdefghij")
+	fetches := 0
+	fetcher := func(id string, offset int64, length int) ([]byte, error) {
+		fetches++
+		c.Assert(id, T.Equals, "fileid")
+		end := offset + int64(length)
+		if end > int64(len(content)) {
+			end = int64(len(content))
+		}
+		return content[offset:end], nil
+	}
+	m := New(s.blobPath, &Options{PassThrough: fetcher, PassThroughBufferSize: 10})
+
+	err := m.Save("fileid", "checksum", ioutil.NopCloser(bytes.NewReader(content)))
+	c.Assert(err, T.IsNil)
+
+	data, size, err := m.Read("fileid", "checksum", 2, 4)
+	c.Assert(err, T.IsNil)
+	c.Assert(size, T.Equals, int64(4))
+	c.Assert(string(data), T.Equals, "2345")
+
+	// served from the in-memory window
+	data, _, err = m.Read("fileid", "checksum", 6, 4)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data), T.Equals, "6789")
+	c.Assert(fetches, T.Equals, 1)
+
+	data, _, err = m.Read("fileid", "checksum", 15, 10)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data), T.Equals, "fghij")
+	c.Assert(fetches, T.Equals, 2)
+
+	entries, err := ioutil.ReadDir(s.blobPath)
+	c.Assert(err, T.IsNil)
+	c.Assert(entries, T.HasLen, 0)
+}
+
+func (s *BlobSuite) TestSaveOutOfInodes(c *T.C) {
+	m := New(s.blobPath, nil)
+	m.statfs = func(path string, stat *syscall.Statfs_t) error {
+		stat.Files = 1000
+		stat.Ffree = minFreeInodes
+		return nil
+	}
+	err := m.Save("fileid", "checksum", ioutil.NopCloser(bytes.NewReader([]byte("content"))))
+	c.Assert(err, T.Equals, ErrNoInodes)
+	_, err = os.Stat(m.getBlobDir("fileid"))
+	c.Assert(os.IsNotExist(err), T.Equals, true)
+}
+
+func (s *BlobSuite) TestSaveReusesBlobDirWhenLowOnInodes(c *T.C) {
+	m := New(s.blobPath, nil)
+	c.Assert(m.Save("existing", "checksum", ioutil.NopCloser(bytes.NewReader([]byte("existing")))), T.IsNil)
+	m.statfs = func(path string, stat *syscall.Statfs_t) error {
+		stat.Files = 1000
+		// enough for a blob, but not for a new shard directory
+		stat.Ffree = minFreeInodes + 1
+		return nil
+	}
+	c.Assert(m.Save("fileid", "checksum", ioutil.NopCloser(bytes.NewReader([]byte("content")))), T.IsNil)
+	_, err := os.Stat(m.getBlobDir("fileid"))
+	c.Assert(os.IsNotExist(err), T.Equals, true)
+	data, size, err := m.Read("fileid", "checksum", 0, 7)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, "content")
+
+	// existing shard directories are still used
+	c.Assert(m.Save("existing", "other", ioutil.NopCloser(bytes.NewReader([]byte("updated")))), T.IsNil)
+	_, err = os.Stat(filepath.Join(m.getBlobDir("existing"), m.getBlobName("existing", "other")))
+	c.Assert(err, T.IsNil)
+
+	c.Assert(m.Delete("fileid"), T.IsNil)
+	_, _, err = m.Read("fileid", "checksum", 0, 7)
+	c.Assert(os.IsNotExist(err), T.Equals, true)
+}
+
+func (s *BlobSuite) TestShortIds(c *T.C) {
+	m := New(s.blobPath, nil)
+	// both are stored in the blob directory, next to each other
+	for _, id := range []string{"a", ""} {
+		c.Assert(m.Save(id, "checksum", ioutil.NopCloser(bytes.NewReader([]byte("content of "+id)))), T.IsNil)
+	}
+	for _, id := range []string{"", "a"} {
+		data, size, err := m.Read(id, "checksum", 0, 64)
+		c.Assert(err, T.IsNil)
+		c.Assert(string(data[:size]), T.Equals, "content of "+id)
+	}
+	c.Assert(m.Delete("a"), T.IsNil)
+	_, _, err := m.Read("a", "checksum", 0, 64)
+	c.Assert(os.IsNotExist(err), T.Equals, true)
+}
+
+func (s *BlobSuite) TestSaveRenamesWithinBlobDir(c *T.C) {
+	m := New(s.blobPath, nil)
+	target := m.getBlobPath("fileid", "checksum")
+	// the blob directory may be on another device than the data
+	// directory, only renames within it are atomic
+	m.rename = func(oldpath string, newpath string) error {
+		c.Assert(filepath.Dir(oldpath), T.Equals, filepath.Dir(newpath))
+		c.Assert(newpath, T.Equals, target)
+		// not visible until renamed
+		_, err := os.Stat(target)
+		c.Assert(os.IsNotExist(err), T.Equals, true)
+		return os.Rename(oldpath, newpath)
+	}
+	err := m.Save("fileid", "checksum", ioutil.NopCloser(bytes.NewReader([]byte("content"))))
+	c.Assert(err, T.IsNil)
+	data, err := ioutil.ReadFile(target)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data), T.Equals, "content")
+
+	// a failed rename leaves neither a partial blob nor a temp file
+	m.rename = func(oldpath string, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	err = m.Save("fileid", "other", ioutil.NopCloser(bytes.NewReader([]byte("content"))))
+	c.Assert(err, T.NotNil)
+	entries, err := ioutil.ReadDir(filepath.Dir(target))
+	c.Assert(err, T.IsNil)
+	c.Assert(entries, T.HasLen, 0)
+}
+
+func (s *BlobSuite) TestRetainedBlobsOutliveSaves(c *T.C) {
+	m := New(s.blobPath, nil)
+	c.Assert(m.Save("fileid", "old", ioutil.NopCloser(strings.NewReader("old content"))), T.IsNil)
+	m.Retain("fileid", "old")
+	c.Assert(m.Save("fileid", "new", ioutil.NopCloser(strings.NewReader("new content"))), T.IsNil)
+	for checksum, content := range map[string]string{"old": "old content", "new": "new content"} {
+		data, size, err := m.Read("fileid", checksum, 0, 64)
+		c.Assert(err, T.IsNil)
+		c.Assert(string(data[:size]), T.Equals, content)
+	}
+
+	c.Assert(m.Release("fileid", "new"), T.IsNil)
+	_, _, err := m.Read("fileid", "old", 0, 64)
+	c.Assert(os.IsNotExist(err), T.Equals, true)
+	data, size, err := m.Read("fileid", "new", 0, 64)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, "new content")
+
+	// not retained anymore
+	c.Assert(m.Save("fileid", "newer", ioutil.NopCloser(strings.NewReader("newer content"))), T.IsNil)
+	c.Assert(m.Exists("fileid", "new"), T.Equals, false)
+}
+
+func (s *BlobSuite) TestSavingTheSameBlobAgainSkipsTheCleanup(c *T.C) {
+	m := New(s.blobPath, nil)
+	listed := 0
+	m.readDir = func(dirname string) ([]os.FileInfo, error) {
+		listed++
+		return ioutil.ReadDir(dirname)
+	}
+	// the shard directory of a new id doesn't exist yet
+	c.Assert(m.Save("fileid", "checksum", ioutil.NopCloser(strings.NewReader("content"))), T.IsNil)
+	c.Assert(listed > 0, T.Equals, true)
+
+	listed = 0
+	c.Assert(m.Save("fileid", "checksum", ioutil.NopCloser(strings.NewReader("content"))), T.IsNil)
+	c.Assert(listed, T.Equals, 0)
+	data, size, err := m.Read("fileid", "checksum", 0, 64)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, "content")
+
+	// the blob of another checksum replaces it
+	c.Assert(m.Save("fileid", "other", ioutil.NopCloser(strings.NewReader("other content"))), T.IsNil)
+	c.Assert(listed > 0, T.Equals, true)
+	c.Assert(m.Exists("fileid", "checksum"), T.Equals, false)
+}
+
+func (s *BlobSuite) TestSavesAreStaged(c *T.C) {
+	staging := filepath.Join(c.MkDir(), "staging")
+	m := New(s.blobPath, &Options{StagingPath: staging})
+	c.Assert(m.LoadIndex(), T.IsNil)
+	target := m.getBlobPath("fileid", "checksum")
+	renamed := 0
+	m.rename = func(oldpath string, newpath string) error {
+		if filepath.Dir(oldpath) == staging {
+			renamed++
+		}
+		return os.Rename(oldpath, newpath)
+	}
+	c.Assert(m.Save("fileid", "checksum", ioutil.NopCloser(strings.NewReader("content"))), T.IsNil)
+	c.Assert(renamed, T.Equals, 1)
+	data, err := ioutil.ReadFile(target)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data), T.Equals, "content")
+
+	// staged on another device, the blob is copied into place
+	m.rename = func(oldpath string, newpath string) error {
+		if filepath.Dir(oldpath) == staging {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+		}
+		return os.Rename(oldpath, newpath)
+	}
+	c.Assert(m.Save("fileid", "other", ioutil.NopCloser(strings.NewReader("other content"))), T.IsNil)
+	data, size, err := m.Read("fileid", "other", 0, 64)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, "other content")
+	for _, dir := range []string{staging, filepath.Dir(target)} {
+		entries, err := ioutil.ReadDir(dir)
+		c.Assert(err, T.IsNil)
+		for _, entry := range entries {
+			c.Assert(strings.Contains(entry.Name(), ".tmp"), T.Equals, false, T.Commentf("%s", entry.Name()))
+		}
+	}
+}
+
+func (s *BlobSuite) TestSaveThenRead(c *T.C) {
+	// larger than the write buffer, with a partial last chunk
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	for _, policy := range []SyncPolicy{SyncNone, SyncOnClose, SyncAlways} {
+		m := New(s.blobPath, &Options{Sync: policy})
+		c.Assert(m.Save("fileid", "sum", ioutil.NopCloser(bytes.NewReader([]byte("hello world")))), T.IsNil)
+		data, size, err := m.Read("fileid", "sum", 0, 64)
+		c.Assert(err, T.IsNil)
+		c.Assert(string(data[:size]), T.Equals, "hello world")
+
+		c.Assert(m.Save("fileid", "large", ioutil.NopCloser(bytes.NewReader(content))), T.IsNil)
+		data, size, err = m.Read("fileid", "large", 0, len(content))
+		c.Assert(err, T.IsNil)
+		c.Assert(data[:size], T.DeepEquals, content)
+	}
+}
+
+func (s *BlobSuite) TestExistsAndSize(c *T.C) {
+	key, err := DeriveKey(s.blobPath, "passphrase")
+	c.Assert(err, T.IsNil)
+	for _, opts := range []*Options{{}, {Compress: true}, {Key: key}} {
+		m := New(c.MkDir(), opts)
+		content := strings.Repeat("0123456789", 1000)
+		c.Assert(m.Save("fileid", "checksum", ioutil.NopCloser(strings.NewReader(content))), T.IsNil)
+		c.Assert(m.Exists("fileid", "checksum"), T.Equals, true)
+		size, err := m.Size("fileid", "checksum")
+		c.Assert(err, T.IsNil)
+		c.Assert(size, T.Equals, int64(len(content)))
+
+		c.Assert(m.Exists("fileid", "other"), T.Equals, false)
+		_, err = m.Size("fileid", "other")
+		c.Assert(os.IsNotExist(err), T.Equals, true)
+
+		// written locally, whatever the checksum
+		c.Assert(m.WriteAt("fileid", "checksum", int64(len(content)), []byte("xy")), T.IsNil)
+		c.Assert(m.Exists("fileid", "other"), T.Equals, true)
+		size, err = m.Size("fileid", "other")
+		c.Assert(err, T.IsNil)
+		c.Assert(size, T.Equals, int64(len(content)+2))
+	}
+}
+
+func (s *BlobSuite) TestOpenBlobs(c *T.C) {
+	key, err := DeriveKey(s.blobPath, "passphrase")
+	c.Assert(err, T.IsNil)
+	for _, opts := range []*Options{{}, {Compress: true}, {Key: key}} {
+		m := New(c.MkDir(), opts)
+		content := strings.Repeat("0123456789", 10000)
+		c.Assert(m.Save("fileid", "checksum", ioutil.NopCloser(strings.NewReader(content))), T.IsNil)
+		_, err := m.Open("fileid", "other")
+		c.Assert(os.IsNotExist(err), T.Equals, true)
+
+		h, err := m.Open("fileid", "checksum")
+		c.Assert(err, T.IsNil)
+		p := make([]byte, 6)
+		n, err := h.(io.ReaderAt).ReadAt(p, 70003)
+		c.Assert(err, T.IsNil)
+		c.Assert(string(p[:n]), T.Equals, "345678")
+		end, err := h.Seek(-4, io.SeekEnd)
+		c.Assert(err, T.IsNil)
+		c.Assert(end, T.Equals, int64(len(content)-4))
+		rest, err := ioutil.ReadAll(h)
+		c.Assert(err, T.IsNil)
+		c.Assert(string(rest), T.Equals, "6789")
+		c.Assert(h.Close(), T.IsNil)
+	}
+}
+
+func (s *BlobSuite) TestWriteIntoBlobs(c *T.C) {
+	key, err := DeriveKey(s.blobPath, "passphrase")
+	c.Assert(err, T.IsNil)
+	for _, opts := range []*Options{{}, {Compress: true}, {Key: key}} {
+		m := New(c.MkDir(), opts)
+		content := strings.Repeat("0123456789", 1000)
+		sum := fmt.Sprintf("%x", md5.Sum([]byte(content)))
+		c.Assert(m.Save("fileid", sum, ioutil.NopCloser(strings.NewReader(content))), T.IsNil)
+
+		// into the middle, then past the end
+		c.Assert(m.WriteAt("fileid", sum, 3, []byte("abc")), T.IsNil)
+		c.Assert(m.WriteAt("fileid", sum, int64(len(content))+2, []byte("xy")), T.IsNil)
+		entry, ok := m.Stat("fileid")
+		c.Assert(ok, T.Equals, true)
+		c.Assert(entry.IsDirty(), T.Equals, true)
+		c.Assert(entry.Compressed, T.Equals, false)
+		c.Assert(entry.Encrypted, T.Equals, opts.Key != nil)
+		want := "012abc" + content[6:] + "\x00\x00xy"
+		// whatever the checksum, the remote content is stale
+		data, size, err := m.Read("fileid", sum, 0, len(want)+1)
+		c.Assert(err, T.IsNil)
+		c.Assert(string(data[:size]), T.Equals, want)
+		rc, err := m.OpenEntry(entry)
+		c.Assert(err, T.IsNil)
+		all, err := ioutil.ReadAll(rc)
+		rc.Close()
+		c.Assert(err, T.IsNil)
+		c.Assert(string(all), T.Equals, want)
+
+		// saved again once pushed, under the checksum of the new content
+		newSum := fmt.Sprintf("%x", md5.Sum([]byte(want)))
+		c.Assert(m.Save("fileid", newSum, ioutil.NopCloser(bytes.NewReader(all))), T.IsNil)
+		entry, _ = m.Stat("fileid")
+		c.Assert(entry.IsDirty(), T.Equals, false)
+		c.Assert(entry.Compressed, T.Equals, opts.Compress)
+		data, size, err = m.Read("fileid", newSum, 3, 3)
+		c.Assert(err, T.IsNil)
+		c.Assert(string(data[:size]), T.Equals, "abc")
+	}
+
+	m := New(s.blobPath, nil)
+	c.Assert(m.WriteAt("missing", "sum", 0, []byte("x")), T.Equals, ErrCacheMiss)
+	// new local files have no checksum yet
+	c.Assert(m.WriteAt("local", "", 2, []byte("x")), T.IsNil)
+	data, size, err := m.Read("local", "", 0, 8)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, "\x00\x00x")
+}
+
+func (s *BlobSuite) TestReadFillsTheRange(c *T.C) {
+	m := New(s.blobPath, nil)
+	content := make([]byte, 3*4096+100)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	c.Assert(m.Save("fileid", "sum", ioutil.NopCloser(bytes.NewReader(content))), T.IsNil)
+	// ranges straddling the buffer boundaries, and running past the end
+	for _, r := range [][2]int{{0, len(content)}, {4095, 2}, {4000, 8192}, {8191, 4097}, {12000, 1000}, {len(content), 10}} {
+		offset, l := r[0], r[1]
+		data, size, err := m.Read("fileid", "sum", int64(offset), l)
+		c.Assert(err, T.IsNil)
+		c.Assert(len(data), T.Equals, l)
+		end := offset + l
+		if end > len(content) {
+			end = len(content)
+		}
+		c.Assert(size, T.Equals, int64(end-offset))
+		c.Assert(data[:size], T.DeepEquals, content[offset:end])
+	}
+}
+
+func (s *BlobSuite) TestSyncPolicies(c *T.C) {
+	content := bytes.Repeat([]byte("x"), 3*4096)
+	syncs := map[SyncPolicy]int{}
+	for _, policy := range []SyncPolicy{SyncNone, SyncOnClose, SyncAlways} {
+		m := New(s.blobPath, &Options{Sync: policy})
+		m.fsync = func(file *os.File) error {
+			syncs[policy]++
+			return nil
+		}
+		err := m.Save("fileid", "checksum", ioutil.NopCloser(bytes.NewReader(content)))
+		c.Assert(err, T.IsNil)
+	}
+	c.Assert(syncs[SyncNone], T.Equals, 0)
+	c.Assert(syncs[SyncOnClose], T.Equals, 1)
+	// each write, the blob and then its directory
+	c.Assert(syncs[SyncAlways], T.Equals, 3+1+1)
+}
+
+func (s *BlobSuite) TestSyncFailureFailsSave(c *T.C) {
+	m := New(s.blobPath, nil)
+	m.fsync = func(file *os.File) error {
+		return syscall.EIO
+	}
+	err := m.Save("fileid", "checksum", ioutil.NopCloser(bytes.NewReader([]byte("content"))))
+	c.Assert(err, T.Equals, syscall.EIO)
+	entries, err := ioutil.ReadDir(m.getBlobDir("fileid"))
+	c.Assert(err, T.IsNil)
+	c.Assert(entries, T.HasLen, 0)
+}
+
+func (s *BlobSuite) TestTruncatedDownloadFailsSave(c *T.C) {
+	m := New(s.blobPath, nil)
+	// the connection is reset after a few chunks
+	body := io.MultiReader(bytes.NewReader(bytes.Repeat([]byte("x"), 9000)), iotest.ErrReader(syscall.ECONNRESET))
+	err := m.Save("fileid", "checksum", ioutil.NopCloser(body))
+	c.Assert(err, T.Equals, syscall.ECONNRESET)
+	entries, err := ioutil.ReadDir(m.getBlobDir("fileid"))
+	c.Assert(err, T.IsNil)
+	c.Assert(entries, T.HasLen, 0)
+	_, ok := m.Stat("fileid")
+	c.Assert(ok, T.Equals, false)
+}
+
+// cancelingReader cancels its context once it is read.
+type cancelingReader struct {
+	io.Reader
+	cancel context.CancelFunc
+}
+
+func (r cancelingReader) Read(p []byte) (int, error) {
+	r.cancel()
+	return r.Reader.Read(p)
+}
+
+func (s *BlobSuite) TestCanceledSaveAndRead(c *T.C) {
+	m := New(s.blobPath, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	body := cancelingReader{bytes.NewReader(bytes.Repeat([]byte("x"), 9000)), cancel}
+	c.Assert(m.SaveContext(ctx, "fileid", "checksum", ioutil.NopCloser(body)), T.Equals, context.Canceled)
+	_, ok := m.Stat("fileid")
+	c.Assert(ok, T.Equals, false)
+	entries, err := ioutil.ReadDir(m.getBlobDir("fileid"))
+	c.Assert(err, T.IsNil)
+	c.Assert(entries, T.HasLen, 0)
+
+	c.Assert(m.Save("fileid", "checksum", ioutil.NopCloser(strings.NewReader("content"))), T.IsNil)
+	_, _, err = m.ReadContext(ctx, "fileid", "checksum", 0, 7)
+	c.Assert(err, T.Equals, context.Canceled)
+	data, size, err := m.ReadContext(context.WithoutCancel(ctx), "fileid", "checksum", 0, 7)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, "content")
+
+	// a remote read is given up once interrupted
+	release := make(chan struct{})
+	defer close(release)
+	remote := New(s.blobPath, &Options{PassThrough: func(id string, offset int64, length int) ([]byte, error) {
+		<-release
+		return nil, io.EOF
+	}})
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err = remote.ReadContext(ctx, "fileid", "checksum", 0, 7)
+	c.Assert(err, T.Equals, context.DeadlineExceeded)
+}
+
+func (s *BlobSuite) TestCollect(c *T.C) {
+	m := New(s.blobPath, nil)
+	old := time.Now().Add(-time.Hour)
+	for _, id := range []string{"live", "orphan", "young", "reading"} {
+		c.Assert(m.Save(id, "checksum", ioutil.NopCloser(strings.NewReader(id))), T.IsNil)
+		if id != "young" {
+			c.Assert(os.Chtimes(m.getBlobPath(id, "checksum"), old, old), T.IsNil)
+		}
+	}
+	m.index.startRead("reading")
+	reclaimed, err := m.Collect(time.Now().Add(-time.Minute), func(e *Entry) bool {
+		return e.Id == "live"
+	})
+	c.Assert(err, T.IsNil)
+	c.Assert(reclaimed, T.Equals, int64(len("orphan")))
+	for id, kept := range map[string]bool{"live": true, "orphan": false, "young": true, "reading": true} {
+		_, ok := m.Stat(id)
+		c.Assert(ok, T.Equals, kept)
+		c.Assert(m.Exists(id, "checksum"), T.Equals, kept)
+	}
+}
+
+func (s *BlobSuite) TestSaveVerifiesMd5(c *T.C) {
+	m := New(s.blobPath, nil)
+	content := []byte("content")
+	sum := fmt.Sprintf("%x", md5.Sum(content))
+	c.Assert(m.Save("fileid", sum, ioutil.NopCloser(bytes.NewReader(content))), T.IsNil)
+	c.Assert(m.Save("upper", strings.ToUpper(sum), ioutil.NopCloser(bytes.NewReader(content))), T.IsNil)
+
+	// a corrupted download is not cached
+	other := fmt.Sprintf("%x", md5.Sum([]byte("other")))
+	err := m.Save("corrupted", other, ioutil.NopCloser(bytes.NewReader(content)))
+	c.Assert(err, T.Equals, ErrChecksumMismatch)
+	entries, err := ioutil.ReadDir(m.getBlobDir("corrupted"))
+	if err == nil {
+		for _, entry := range entries {
+			c.Assert(strings.HasPrefix(entry.Name(), m.getBlobName("corrupted", "")), T.Equals, false)
+		}
+	}
+	_, ok := m.Stat("corrupted")
+	c.Assert(ok, T.Equals, false)
+
+	// checksums other than md5 digests can't be verified
+	c.Assert(m.Save("exported", "2013-09-19T14:29:12.570Z", ioutil.NopCloser(bytes.NewReader(content))), T.IsNil)
+}
+
+func (s *BlobSuite) TestReadErrorHeals(c *T.C) {
+	healed := []string{}
+	m := New(s.blobPath, &Options{Heal: func(id string) {
+		healed = append(healed, id)
+	}})
+	// reading a directory fails with an I/O error
+	c.Assert(os.MkdirAll(m.getBlobPath("fileid", "checksum"), 0750), T.IsNil)
+	// downloading the new content
+	temp := m.getBlobPath("fileid", "new-checksum") + ".tmp123"
+	c.Assert(ioutil.WriteFile(temp, []byte("partial"), 0640), T.IsNil)
+
+	_, _, err := m.Read("fileid", "checksum", 0, 10)
+	c.Assert(err, T.Equals, ErrCacheMiss)
+	c.Assert(healed, T.DeepEquals, []string{"fileid"})
+	_, err = os.Stat(m.getBlobPath("fileid", "checksum"))
+	c.Assert(os.IsNotExist(err), T.Equals, true)
+	_, err = os.Stat(temp)
+	c.Assert(err, T.IsNil)
+
+	// a missing blob is a plain miss, not healed
+	_, _, err = m.Read("fileid", "checksum", 0, 10)
+	c.Assert(os.IsNotExist(err), T.Equals, true)
+	c.Assert(healed, T.HasLen, 1)
+}
+
+func (s *BlobSuite) TestReadErrorPropagates(c *T.C) {
+	m := New(s.blobPath, nil)
+	c.Assert(os.MkdirAll(m.getBlobPath("fileid", "checksum"), 0750), T.IsNil)
+	_, _, err := m.Read("fileid", "checksum", 0, 10)
+	c.Assert(err, T.NotNil)
+	c.Assert(err, T.Not(T.Equals), ErrCacheMiss)
+}
+
+func (s *BlobSuite) TestIndexIsRebuiltOnRestart(c *T.C) {
+	m := New(s.blobPath, nil)
+	c.Assert(m.Save("fileid", "checksum", ioutil.NopCloser(bytes.NewReader([]byte("content")))), T.IsNil)
+	c.Assert(m.Save("copyid", "checksum", ioutil.NopCloser(bytes.NewReader([]byte("content")))), T.IsNil)
+	c.Assert(m.Save("a", "other", ioutil.NopCloser(bytes.NewReader([]byte("unsharded")))), T.IsNil)
+	c.Assert(m.Save("fileid", "updated", ioutil.NopCloser(bytes.NewReader([]byte("updated content")))), T.IsNil)
+	// a save in progress
+	temp := m.getBlobPath("partid", "checksum") + ".tmp123"
+	c.Assert(os.MkdirAll(filepath.Dir(temp), 0750), T.IsNil)
+	c.Assert(ioutil.WriteFile(temp, []byte("partial"), 0640), T.IsNil)
+	size := int64(len("content") + len("unsharded") + len("updated content"))
+	c.Assert(m.CacheSize(), T.Equals, size)
+
+	restarted := New(s.blobPath, nil)
+	c.Assert(restarted.CacheSize(), T.Equals, int64(0))
+	c.Assert(restarted.LoadIndex(), T.IsNil)
+	c.Assert(restarted.CacheSize(), T.Equals, size)
+	entry, ok := restarted.Stat("fileid")
+	c.Assert(ok, T.Equals, true)
+	c.Assert(entry.Checksum, T.Equals, "updated")
+	c.Assert(entry.Size, T.Equals, int64(len("updated content")))
+	c.Assert(entry.Path, T.Equals, m.getBlobPath("fileid", "updated"))
+	_, ok = restarted.Stat("partid")
+	c.Assert(ok, T.Equals, false)
+	p, ok := restarted.LookupChecksum("checksum")
+	c.Assert(ok, T.Equals, true)
+	c.Assert(p, T.Equals, m.getBlobPath("copyid", "checksum"))
+	_, ok = restarted.LookupChecksum("missing")
+	c.Assert(ok, T.Equals, false)
+
+	// reads count as accesses
+	_, _, err := restarted.Read("a", "other", 0, 1)
+	c.Assert(err, T.IsNil)
+	read, _ := restarted.Stat("a")
+	c.Assert(read.LastAccess.After(entry.LastAccess), T.Equals, true)
+
+	c.Assert(restarted.Delete("copyid"), T.IsNil)
+	_, ok = restarted.LookupChecksum("checksum")
+	c.Assert(ok, T.Equals, false)
+	c.Assert(restarted.CacheSize(), T.Equals, size-int64(len("content")))
+}
+
+func (s *BlobSuite) TestForEachStopsAtError(c *T.C) {
+	m := New(s.blobPath, nil)
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("file%02d", i)
+		c.Assert(m.Save(id, "checksum", ioutil.NopCloser(bytes.NewReader([]byte(id)))), T.IsNil)
+	}
+	errStop := errors.New("stop")
+	var mu sync.Mutex
+	seen := 0
+	err := m.ForEach(func(e *Entry) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen++
+		return errStop
+	})
+	c.Assert(err, T.Equals, errStop)
+	c.Assert(seen < 20, T.Equals, true)
+}
+
+func (s *BlobSuite) TestWatermarksFireOnce(c *T.C) {
+	type event struct {
+		size int64
+		high bool
+	}
+	var events []event
+	m := New(s.blobPath, &Options{
+		HighWatermark: 30,
+		LowWatermark:  10,
+		OnWatermark: func(size int64, high bool) {
+			events = append(events, event{size, high})
+		},
+	})
+	save := func(id string) {
+		c.Assert(m.Save(id, "sum", ioutil.NopCloser(bytes.NewReader([]byte("0123456789")))), T.IsNil)
+	}
+	save("a")
+	save("b")
+	c.Assert(events, T.HasLen, 0)
+	save("c")
+	save("d")
+	// hovering around the high watermark
+	c.Assert(m.Delete("d"), T.IsNil)
+	save("d")
+	c.Assert(events, T.DeepEquals, []event{{30, true}})
+
+	c.Assert(m.Delete("d"), T.IsNil)
+	c.Assert(m.Delete("c"), T.IsNil)
+	c.Assert(events, T.HasLen, 1)
+	c.Assert(m.Delete("b"), T.IsNil)
+	c.Assert(events, T.DeepEquals, []event{{30, true}, {10, false}})
+}
+
+func (s *BlobSuite) TestSequentialReadsAreReadAhead(c *T.C) {
+	content := bytes.Repeat([]byte("x"), 8*minSequentialRead)
+	m := New(s.blobPath, &Options{ReadAhead: true})
+	var advised []int64
+	m.advise = func(file *os.File, offset int64, length int64) error {
+		advised = append(advised, offset, length)
+		// the real hint has to work on the blobs too
+		return adviseWillNeed(file, offset, length)
+	}
+	c.Assert(m.Save("fileid", "sum", ioutil.NopCloser(bytes.NewReader(content))), T.IsNil)
+	read := func(offset int64, l int) {
+		_, _, err := m.Read("fileid", "sum", offset, l)
+		c.Assert(err, T.IsNil)
+	}
+	read(0, minSequentialRead)
+	read(4*minSequentialRead, minSequentialRead)
+	// small sequential reads
+	read(5*minSequentialRead, 10)
+	c.Assert(advised, T.HasLen, 0)
+
+	read(5*minSequentialRead+10, minSequentialRead)
+	c.Assert(advised, T.DeepEquals, []int64{6*minSequentialRead + 10, readAheadFactor * minSequentialRead})
+}
+
+func (s *BlobSuite) TestSequentialReadsAreServedFromMemory(c *T.C) {
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	m := New(s.blobPath, &Options{ReadAheadBuffer: 16})
+	c.Assert(m.Save("fileid", "sum", ioutil.NopCloser(bytes.NewReader(content))), T.IsNil)
+	read := func(offset int64, l int) (string, error) {
+		data, size, err := m.Read("fileid", "sum", offset, l)
+		return string(data[:size]), err
+	}
+	assertRead := func(offset int64, l int, want string) {
+		got, err := read(offset, l)
+		c.Assert(err, T.IsNil)
+		c.Assert(got, T.Equals, want)
+	}
+	assertRead(0, 4, "0123")
+	// continues the previous read, reads ahead up to "jklmnopqrs"
+	assertRead(4, 4, "4567")
+
+	// with the blob gone from the disk, only the buffer serves reads
+	entry, ok := m.Stat("fileid")
+	c.Assert(ok, T.Equals, true)
+	c.Assert(os.Rename(entry.Path, entry.Path+".moved"), T.IsNil)
+	assertRead(8, 4, "89ab")
+	assertRead(12, 8, "cdefghij")
+	// past the buffer, read from the disk again
+	_, err := read(20, 4)
+	c.Assert(err, T.NotNil)
+
+	c.Assert(os.Rename(entry.Path+".moved", entry.Path), T.IsNil)
+	assertRead(20, 4, "klmn")
+	assertRead(24, 4, "opqr")
+	// a seek drops the buffer
+	assertRead(0, 4, "0123")
+	c.Assert(os.Rename(entry.Path, entry.Path+".moved"), T.IsNil)
+	_, err = read(28, 4)
+	c.Assert(err, T.NotNil)
+	c.Assert(os.Rename(entry.Path+".moved", entry.Path), T.IsNil)
+
+	// the end of the blob is read from the buffer as well
+	assertRead(4, 20, "456789abcdefghijklmn")
+	assertRead(24, 4, "opqr")
+	c.Assert(os.Rename(entry.Path, entry.Path+".moved"), T.IsNil)
+	assertRead(28, 16, "stuvwxyz")
+	c.Assert(os.Rename(entry.Path+".moved", entry.Path), T.IsNil)
+
+	// replaced blobs are not served from the buffer
+	assertRead(0, 4, "0123")
+	assertRead(4, 4, "4567")
+	c.Assert(m.Save("fileid", "sum", ioutil.NopCloser(bytes.NewReader(bytes.ToUpper(content)))), T.IsNil)
+	assertRead(8, 4, "89AB")
+}
+
+func (s *BlobSuite) TestCompressedBlobsAreReadAtAnyOffset(c *T.C) {
+	var b bytes.Buffer
+	for i := 0; b.Len() < 3*compressedChunkSize+100; i++ {
+		fmt.Fprintf(&b, "line %d\n", i)
+	}
+	content := b.Bytes()
+	m := New(s.blobPath, &Options{Compress: true})
+	c.Assert(m.Save("fileid", "sum", ioutil.NopCloser(bytes.NewReader(content))), T.IsNil)
+	entry, ok := m.Stat("fileid")
+	c.Assert(ok, T.Equals, true)
+	c.Assert(entry.Compressed, T.Equals, true)
+	c.Assert(strings.HasSuffix(entry.Path, compressedSuffix), T.Equals, true)
+	c.Assert(entry.Size < int64(len(content))/2, T.Equals, true)
+
+	for _, r := range []struct {
+		offset int64
+		l      int
+	}{
+		{0, 10},
+		{compressedChunkSize - 5, 10}, // across members
+		{compressedChunkSize + 7, 2 * compressedChunkSize}, // over a whole member
+		{int64(len(content)) - 3, 10},                      // past the end
+		{int64(len(content)) + 10, 10},
+	} {
+		data, size, err := m.Read("fileid", "sum", r.offset, r.l)
+		c.Assert(err, T.IsNil)
+		want := []byte{}
+		if r.offset < int64(len(content)) {
+			want = content[r.offset:min(r.offset+int64(r.l), int64(len(content)))]
+		}
+		c.Assert(data[:size], T.DeepEquals, want)
+	}
+
+	rc, err := m.OpenEntry(entry)
+	c.Assert(err, T.IsNil)
+	defer rc.Close()
+	all, err := ioutil.ReadAll(rc)
+	c.Assert(err, T.IsNil)
+	c.Assert(all, T.DeepEquals, content)
+
+	// survives restarts
+	restarted := New(s.blobPath, &Options{Compress: true})
+	c.Assert(restarted.LoadIndex(), T.IsNil)
+	entry, ok = restarted.Stat("fileid")
+	c.Assert(ok, T.Equals, true)
+	c.Assert(entry.Checksum, T.Equals, "sum")
+	c.Assert(entry.Compressed, T.Equals, true)
+	data, size, err := restarted.Read("fileid", "sum", 2*compressedChunkSize, 5)
+	c.Assert(err, T.IsNil)
+	c.Assert(data[:size], T.DeepEquals, content[2*compressedChunkSize:2*compressedChunkSize+5])
+}
+
+func (s *BlobSuite) TestEncryptedBlobsAreReadAtAnyOffset(c *T.C) {
+	content := bytes.Repeat([]byte("secret content "), encryptedChunkSize/5)
+	key, err := DeriveKey(s.blobPath, "passphrase")
+	c.Assert(err, T.IsNil)
+	m := New(s.blobPath, &Options{Key: key})
+	// verified against the plaintext
+	sum := fmt.Sprintf("%x", md5.Sum(content))
+	c.Assert(m.Save("fileid", sum, ioutil.NopCloser(bytes.NewReader(content))), T.IsNil)
+	entry, ok := m.Stat("fileid")
+	c.Assert(ok, T.Equals, true)
+	c.Assert(entry.Encrypted, T.Equals, true)
+	c.Assert(strings.HasSuffix(entry.Path, encryptedSuffix), T.Equals, true)
+	stored, err := ioutil.ReadFile(entry.Path)
+	c.Assert(err, T.IsNil)
+	c.Assert(bytes.Contains(stored, []byte("secret")), T.Equals, false)
+
+	for _, offset := range []int64{0, encryptedChunkSize - 3, 2*encryptedChunkSize + 1, int64(len(content)) - 2} {
+		data, size, err := m.Read("fileid", sum, offset, 6)
+		c.Assert(err, T.IsNil)
+		c.Assert(data[:size], T.DeepEquals, content[offset:min(offset+6, int64(len(content)))])
+	}
+	rc, err := m.OpenEntry(entry)
+	c.Assert(err, T.IsNil)
+	all, err := ioutil.ReadAll(rc)
+	rc.Close()
+	c.Assert(err, T.IsNil)
+	c.Assert(all, T.DeepEquals, content)
+
+	// the same passphrase derives the same key on the next runs
+	again, err := DeriveKey(s.blobPath, "passphrase")
+	c.Assert(err, T.IsNil)
+	c.Assert(again, T.DeepEquals, key)
+	other, err := DeriveKey(s.blobPath, "other")
+	c.Assert(err, T.IsNil)
+	_, _, err = New(s.blobPath, &Options{Key: other}).Read("fileid", sum, 0, 6)
+	c.Assert(err, T.Equals, ErrDecrypt)
+	_, _, err = New(s.blobPath, nil).Read("fileid", sum, 0, 6)
+	c.Assert(err, T.Equals, ErrNoKey)
+
+	// a truncated blob doesn't decrypt
+	c.Assert(os.Truncate(entry.Path, int64(encryptedHeaderSize+encryptedChunkSize+16)), T.IsNil)
+	_, _, err = m.Read("fileid", sum, 0, 6)
+	c.Assert(err, T.Equals, ErrDecrypt)
+}
+
+func (s *BlobSuite) TestBlobsAreCompressedThenEncrypted(c *T.C) {
+	content := bytes.Repeat([]byte("0123456789"), 2*compressedChunkSize/10)
+	m := New(s.blobPath, &Options{Compress: true, Key: bytes.Repeat([]byte{7}, 32)})
+	c.Assert(m.Save("fileid", "sum", ioutil.NopCloser(bytes.NewReader(content))), T.IsNil)
+	entry, _ := m.Stat("fileid")
+	c.Assert(entry.Compressed, T.Equals, true)
+	c.Assert(entry.Encrypted, T.Equals, true)
+	c.Assert(strings.HasSuffix(entry.Path, compressedSuffix+encryptedSuffix), T.Equals, true)
+	c.Assert(entry.Size < int64(len(content))/10, T.Equals, true)
+	data, size, err := m.Read("fileid", "sum", compressedChunkSize-2, 4)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, "4567")
+
+	restarted := New(s.blobPath, &Options{Key: bytes.Repeat([]byte{7}, 32)})
+	c.Assert(restarted.LoadIndex(), T.IsNil)
+	entry, _ = restarted.Stat("fileid")
+	c.Assert(entry.Compressed && entry.Encrypted, T.Equals, true)
+	rc, err := restarted.OpenEntry(entry)
+	c.Assert(err, T.IsNil)
+	all, err := ioutil.ReadAll(rc)
+	rc.Close()
+	c.Assert(err, T.IsNil)
+	c.Assert(all, T.DeepEquals, content)
+}
+
+func (s *BlobSuite) TestIncompressibleBlobsAreStoredAsTheyAre(c *T.C) {
+	content := make([]byte, compressedChunkSize+100)
+	rand.New(rand.NewSource(1)).Read(content)
+	m := New(s.blobPath, &Options{Compress: true})
+	c.Assert(m.Save("fileid", "sum", ioutil.NopCloser(bytes.NewReader(content))), T.IsNil)
+	entry, ok := m.Stat("fileid")
+	c.Assert(ok, T.Equals, true)
+	c.Assert(entry.Compressed, T.Equals, false)
+	c.Assert(entry.Size, T.Equals, int64(len(content)))
+	data, size, err := m.Read("fileid", "sum", compressedChunkSize, 10)
+	c.Assert(err, T.IsNil)
+	c.Assert(data[:size], T.DeepEquals, content[compressedChunkSize:compressedChunkSize+10])
+
+	// compressible content of the same file replaces the blob
+	text := bytes.Repeat([]byte("text"), compressedChunkSize)
+	c.Assert(m.Save("fileid", "sum", ioutil.NopCloser(bytes.NewReader(text))), T.IsNil)
+	entry, _ = m.Stat("fileid")
+	c.Assert(entry.Compressed, T.Equals, true)
+	_, err = os.Stat(strings.TrimSuffix(entry.Path, compressedSuffix))
+	c.Assert(os.IsNotExist(err), T.Equals, true)
+	data, size, err = m.Read("fileid", "sum", 2, 4)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, "xtte")
+}
+
+func (s *BlobSuite) TestIdsWithTheSeparator(c *T.C) {
+	m := New(s.blobPath, nil)
+	for _, id := range []string{"a", "a==b", "a==b==c", "x/y", "100%"} {
+		c.Assert(m.Save(id, "sum", ioutil.NopCloser(bytes.NewReader([]byte(id)))), T.IsNil)
+	}
+	// cleaning up the blobs of a doesn't touch the others
+	c.Assert(m.Delete("a"), T.IsNil)
+	c.Assert(m.Save("a==b", "new", ioutil.NopCloser(bytes.NewReader([]byte("new")))), T.IsNil)
+	_, _, err := m.Read("a", "sum", 0, 16)
+	c.Assert(os.IsNotExist(err), T.Equals, true)
+	for id, content := range map[string]string{"a==b": "new", "a==b==c": "a==b==c", "x/y": "x/y", "100%": "100%"} {
+		data, size, err := m.Read(id, map[bool]string{true: "new", false: "sum"}[id == "a==b"], 0, 16)
+		c.Assert(err, T.IsNil)
+		c.Assert(string(data[:size]), T.Equals, content)
+	}
+
+	// the index parses the names back
+	restarted := New(s.blobPath, nil)
+	c.Assert(restarted.LoadIndex(), T.IsNil)
+	entry, ok := restarted.Stat("a==b==c")
+	c.Assert(ok, T.Equals, true)
+	c.Assert(entry.Checksum, T.Equals, "sum")
+	_, ok = restarted.Stat("a")
+	c.Assert(ok, T.Equals, false)
+}
+
+func (s *BlobSuite) TestOldBlobNamesAreMigrated(c *T.C) {
+	// as named by older versions, sharded by the last two characters
+	// of the id as it is
+	old := filepath.Join(s.blobPath, "=b", "a==b==sum")
+	c.Assert(os.MkdirAll(filepath.Dir(old), 0750), T.IsNil)
+	c.Assert(ioutil.WriteFile(old, []byte("old"), 0640), T.IsNil)
+	plain := filepath.Join(s.blobPath, "id", "plainid==sum")
+	c.Assert(os.MkdirAll(filepath.Dir(plain), 0750), T.IsNil)
+	c.Assert(ioutil.WriteFile(plain, []byte("plain"), 0640), T.IsNil)
+
+	m := New(s.blobPath, nil)
+	c.Assert(m.LoadIndex(), T.IsNil)
+	data, size, err := m.Read("a==b", "sum", 0, 16)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, "old")
+	data, size, err = m.Read("plainid", "sum", 0, 16)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, "plain")
+
+	// migrated once, the new names are not escaped again
+	c.Assert(New(s.blobPath, nil).LoadIndex(), T.IsNil)
+	_, _, err = m.Read("a==b", "sum", 0, 16)
+	c.Assert(err, T.IsNil)
+}
+
+func (s *BlobSuite) TestEvictsLeastRecentlyUsed(c *T.C) {
+	m := New(s.blobPath, &Options{MaxSize: 25})
+	save := func(id string) {
+		c.Assert(m.Save(id, "sum", ioutil.NopCloser(bytes.NewReader(bytes.Repeat([]byte(id), 10)))), T.IsNil)
+	}
+	cached := func(id string) bool {
+		_, ok := m.Stat(id)
+		return ok
+	}
+	save("a")
+	save("b")
+	_, _, err := m.Read("a", "sum", 0, 1)
+	c.Assert(err, T.IsNil)
+	save("c")
+	c.Assert(cached("a"), T.Equals, true)
+	c.Assert(cached("b"), T.Equals, false)
+	c.Assert(cached("c"), T.Equals, true)
+	c.Assert(m.CacheSize(), T.Equals, int64(20))
+	_, _, err = m.Read("b", "sum", 0, 1)
+	c.Assert(os.IsNotExist(err), T.Equals, true)
+
+	// a blob being read is kept, even if it's the least recently used
+	m.index.startRead("a")
+	save("d")
+	m.index.endRead("a")
+	c.Assert(cached("a"), T.Equals, true)
+	c.Assert(cached("c"), T.Equals, false)
+	c.Assert(cached("d"), T.Equals, true)
+
+	// a lower cap applies once the index is loaded
+	restarted := New(s.blobPath, &Options{MaxSize: 10})
+	c.Assert(restarted.LoadIndex(), T.IsNil)
+	c.Assert(restarted.CacheSize(), T.Equals, int64(10))
+}
+
+func (s *BlobSuite) TestIdenticalContentsAreStoredOnce(c *T.C) {
+	content := strings.Repeat("copied content ", 100)
+	sum := fmt.Sprintf("%x", md5.Sum([]byte(content)))
+	m := New(s.blobPath, &Options{Dedup: true})
+	c.Assert(m.Save("original", sum, ioutil.NopCloser(strings.NewReader(content))), T.IsNil)
+	// linked, the content is not read again
+	c.Assert(m.Save("copy", sum, ioutil.NopCloser(iotest.ErrReader(errors.New("not read")))), T.IsNil)
+	linked, err := m.Link("other", sum)
+	c.Assert(err, T.IsNil)
+	c.Assert(linked, T.Equals, true)
+	linked, err = m.Link("missing", "0123456789abcdef0123456789abcdef")
+	c.Assert(err, T.IsNil)
+	c.Assert(linked, T.Equals, false)
+
+	original, _ := m.Stat("original")
+	copied, ok := m.Stat("copy")
+	c.Assert(ok, T.Equals, true)
+	info, err := os.Stat(original.Path)
+	c.Assert(err, T.IsNil)
+	copyInfo, err := os.Stat(copied.Path)
+	c.Assert(err, T.IsNil)
+	c.Assert(os.SameFile(info, copyInfo), T.Equals, true)
+	c.Assert(m.CacheSize(), T.Equals, int64(len(content)))
+	// counted once on restarts too
+	restarted := New(s.blobPath, &Options{Dedup: true})
+	c.Assert(restarted.LoadIndex(), T.IsNil)
+	c.Assert(restarted.CacheSize(), T.Equals, int64(len(content)))
+
+	// the content stays until its last blob is deleted
+	c.Assert(m.Delete("original"), T.IsNil)
+	c.Assert(m.Delete("other"), T.IsNil)
+	c.Assert(m.CacheSize(), T.Equals, int64(len(content)))
+	data, size, err := m.Read("copy", sum, 0, len(content))
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, content)
+	c.Assert(m.Delete("copy"), T.IsNil)
+	c.Assert(m.CacheSize(), T.Equals, int64(0))
+
+	// checksums other than md5 can't tell the contents apart
+	c.Assert(m.Save("doc", "v1", ioutil.NopCloser(strings.NewReader("doc"))), T.IsNil)
+	linked, err = m.Link("other doc", "v1")
+	c.Assert(err, T.IsNil)
+	c.Assert(linked, T.Equals, false)
+}
+
+func (s *BlobSuite) TestCopy(c *T.C) {
+	content := strings.Repeat("copied content ", 100)
+	key, err := DeriveKey(s.blobPath, "passphrase")
+	c.Assert(err, T.IsNil)
+	for _, linkErr := range []error{nil, errors.New("links unsupported")} {
+		for _, opts := range []*Options{{}, {Compress: true}, {Key: key}} {
+			m := New(c.MkDir(), opts)
+			if linkErr != nil {
+				m.hardLink = func(string, string) error { return linkErr }
+			}
+			c.Assert(m.Save("original", "sum", ioutil.NopCloser(strings.NewReader(content))), T.IsNil)
+			c.Assert(m.Save("copy", "old", ioutil.NopCloser(strings.NewReader("old"))), T.IsNil)
+			c.Assert(m.Copy("original", "copy", "sum"), T.IsNil)
+			c.Assert(m.Exists("copy", "old"), T.Equals, false)
+			// already stored
+			c.Assert(m.Copy("original", "copy", "sum"), T.IsNil)
+			c.Assert(m.Copy("missing", "other", "sum"), T.Equals, ErrCacheMiss)
+			c.Assert(m.Copy("original", "other", "other sum"), T.Equals, ErrCacheMiss)
+
+			original, _ := m.Stat("original")
+			copied, ok := m.Stat("copy")
+			c.Assert(ok, T.Equals, true)
+			c.Assert(copied.Checksum, T.Equals, "sum")
+			info, err := os.Stat(original.Path)
+			c.Assert(err, T.IsNil)
+			copyInfo, err := os.Stat(copied.Path)
+			c.Assert(err, T.IsNil)
+			c.Assert(os.SameFile(info, copyInfo), T.Equals, linkErr == nil)
+
+			// the copy outlives the original
+			c.Assert(m.Delete("original"), T.IsNil)
+			data, size, err := m.Read("copy", "sum", 0, len(content))
+			c.Assert(err, T.IsNil)
+			c.Assert(string(data[:size]), T.Equals, content)
+			id, ok := m.LookupChecksumId("sum")
+			c.Assert(ok, T.Equals, true)
+			c.Assert(id, T.Equals, "copy")
+		}
+	}
+}
+
+func (s *BlobSuite) TestShardLayoutsAreMigrated(c *T.C) {
+	m := New(s.blobPath, nil)
+	c.Assert(m.Save("abcdef", "sum", ioutil.NopCloser(strings.NewReader("content"))), T.IsNil)
+	c.Assert(m.SaveFrom("partial", "sum", 0, ioutil.NopCloser(iotest.TimeoutReader(strings.NewReader("partial content")))), T.NotNil)
+	c.Assert(m.getBlobDir("abcdef"), T.Equals, filepath.Join(s.blobPath, "ef"))
+
+	for _, layout := range []struct {
+		levels, chars int
+		dir           string
+	}{
+		{2, 2, "ef/cd"},
+		{1, 3, "def"},
+		{NoSharding, 0, ""},
+		{0, 0, "ef"},
+	} {
+		m = New(s.blobPath, &Options{ShardLevels: layout.levels, ShardChars: layout.chars})
+		c.Assert(m.LoadIndex(), T.IsNil)
+		dir := filepath.Join(s.blobPath, layout.dir)
+		c.Assert(m.getBlobDir("abcdef"), T.Equals, dir)
+		_, err := os.Stat(filepath.Join(dir, m.getBlobName("abcdef", "sum")))
+		c.Assert(err, T.IsNil)
+		data, size, err := m.Read("abcdef", "sum", 0, 16)
+		c.Assert(err, T.IsNil)
+		c.Assert(string(data[:size]), T.Equals, "content")
+		c.Assert(m.Partial("partial", "sum"), T.Equals, int64(len("partial content")))
+
+		// only the shards of the layout are left
+		dirs, err := m.blobDirs()
+		c.Assert(err, T.IsNil)
+		shards := map[string]bool{}
+		for _, d := range dirs {
+			shards[d] = true
+		}
+		for d := dir; d != s.blobPath; d = filepath.Dir(d) {
+			c.Assert(shards[d], T.Equals, true)
+		}
+		c.Assert(shards[filepath.Join(s.blobPath, "ef", "cd")], T.Equals, layout.dir == "ef/cd")
+	}
+
+	m = New(s.blobPath, &Options{ShardLevels: 2, ShardChars: 2})
+	c.Assert(m.LoadIndex(), T.IsNil)
+	c.Assert(m.Delete("abcdef"), T.IsNil)
+	_, err := os.Stat(filepath.Join(s.blobPath, "ef"))
+	c.Assert(os.IsNotExist(err), T.Equals, true)
+}
+
+func (s *BlobSuite) TestDeleteRemovesEmptyShards(c *T.C) {
+	m := New(s.blobPath, nil)
+	// both are in the "ab" shard
+	for _, id := range []string{"1ab", "2ab"} {
+		c.Assert(m.Save(id, "sum", ioutil.NopCloser(bytes.NewReader([]byte(id)))), T.IsNil)
+	}
+	shard := m.getBlobDir("1ab")
+	c.Assert(m.getBlobDir("2ab"), T.Equals, shard)
+
+	c.Assert(m.Delete("1ab"), T.IsNil)
+	_, err := os.Stat(shard)
+	c.Assert(err, T.IsNil)
+	c.Assert(m.Delete("2ab"), T.IsNil)
+	_, err = os.Stat(shard)
+	c.Assert(os.IsNotExist(err), T.Equals, true)
+
+	// saving is not affected by the removed shard
+	c.Assert(m.Save("1ab", "sum", ioutil.NopCloser(bytes.NewReader([]byte("again")))), T.IsNil)
+	data, size, err := m.Read("1ab", "sum", 0, 16)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, "again")
+}
+
+func (s *BlobSuite) TestInterruptedSavesAreResumed(c *T.C) {
+	content := bytes.Repeat([]byte("0123456789"), encryptedChunkSize/4)
+	sum := fmt.Sprintf("%x", md5.Sum(content))
+	for _, opts := range []*Options{{}, {Key: bytes.Repeat([]byte{7}, 32)}, {Key: bytes.Repeat([]byte{7}, 32), Compress: true}} {
+		m := New(c.MkDir(), opts)
+		cut := 2*encryptedChunkSize + 100
+		interrupted := io.MultiReader(bytes.NewReader(content[:cut]), iotest.ErrReader(io.ErrUnexpectedEOF))
+		c.Assert(m.SaveFrom("fileid", sum, 0, ioutil.NopCloser(interrupted)), T.Equals, io.ErrUnexpectedEOF)
+		_, ok := m.Stat("fileid")
+		c.Assert(ok, T.Equals, false)
+
+		offset := m.Partial("fileid", sum)
+		if opts.Key != nil {
+			// resumed after the last whole chunk
+			c.Assert(offset, T.Equals, int64(2*encryptedChunkSize))
+		} else {
+			c.Assert(offset, T.Equals, int64(cut))
+		}
+		c.Assert(m.SaveFrom("fileid", sum, offset+1, ioutil.NopCloser(bytes.NewReader(content[offset+1:]))), T.Equals, errPartialOffset)
+		c.Assert(m.SaveFrom("fileid", sum, offset, ioutil.NopCloser(bytes.NewReader(content[offset:]))), T.IsNil)
+		c.Assert(m.Partial("fileid", sum), T.Equals, int64(0))
+		data, size, err := m.Read("fileid", sum, 0, len(content))
+		c.Assert(err, T.IsNil)
+		c.Assert(data[:size], T.DeepEquals, content)
+
+		// the resumed content is verified as a whole
+		interrupted = io.MultiReader(bytes.NewReader(content[:cut]), iotest.ErrReader(io.ErrUnexpectedEOF))
+		c.Assert(m.SaveFrom("other", sum, 0, ioutil.NopCloser(interrupted)), T.Equals, io.ErrUnexpectedEOF)
+		offset = m.Partial("other", sum)
+		corrupted := bytes.Repeat([]byte("x"), len(content)-int(offset))
+		c.Assert(m.SaveFrom("other", sum, offset, ioutil.NopCloser(bytes.NewReader(corrupted))), T.Equals, ErrChecksumMismatch)
+		c.Assert(m.Partial("other", sum), T.Equals, int64(0))
+	}
+}
+
+func (s *BlobSuite) TestNamespaces(c *T.C) {
+	namespaces := []string{"", "alice@example.com", "bob/work"}
+	for _, ns := range namespaces {
+		m := New(s.blobPath, &Options{Namespace: ns})
+		c.Assert(m.Save("fileid", "sum", ioutil.NopCloser(strings.NewReader("content of "+ns))), T.IsNil)
+		c.Assert(m.Save("only"+ns, "sum", ioutil.NopCloser(strings.NewReader(ns))), T.IsNil)
+	}
+	for _, ns := range namespaces {
+		// as after a restart, from the blobs on disk
+		m := New(s.blobPath, &Options{Namespace: ns})
+		c.Assert(m.LoadIndex(), T.IsNil)
+		data, size, err := m.Read("fileid", "sum", 0, 64)
+		c.Assert(err, T.IsNil)
+		c.Assert(string(data[:size]), T.Equals, "content of "+ns)
+		ids := []string{}
+		c.Assert(m.ForEach(func(e *Entry) error {
+			ids = append(ids, e.Id)
+			return nil
+		}), T.IsNil)
+		sort.Strings(ids)
+		c.Assert(ids, T.DeepEquals, []string{"fileid", "only" + ns})
+		for _, other := range namespaces {
+			if other != ns {
+				c.Assert(m.Exists("only"+other, "sum"), T.Equals, false)
+				_, ok := m.Stat("only" + other)
+				c.Assert(ok, T.Equals, false)
+			}
+		}
+	}
+	// clearing the blobs without a namespace keeps the others
+	c.Assert(New(s.blobPath, nil).Clear(), T.IsNil)
+	m := New(s.blobPath, &Options{Namespace: "alice@example.com"})
+	c.Assert(m.Exists("fileid", "sum"), T.Equals, true)
+}
+
+func (s *BlobSuite) TestLazyReads(c *T.C) {
+	content := "0123456789"
+	sum := fmt.Sprintf("%x", md5.Sum([]byte(content)))
+	fetched := []int64{}
+	fetcher := func(id string, offset int64, length int) ([]byte, error) {
+		fetched = append(fetched, offset)
+		if id == "corrupted" {
+			return bytes.Repeat([]byte("x"), length), nil
+		}
+		return []byte(content[offset : offset+int64(length)]), nil
+	}
+	c.Assert(New(s.blobPath, nil).SaveLazy("fileid", sum, 10), T.Equals, errNotLazy)
+	opts := &Options{Lazy: fetcher, LazyChunkSize: 4}
+	m := New(s.blobPath, opts)
+	c.Assert(m.SaveLazy("fileid", sum, 10), T.IsNil)
+	c.Assert(m.Exists("fileid", sum), T.Equals, false)
+	c.Assert(m.CacheSize(), T.Equals, int64(0))
+
+	data, size, err := m.Read("fileid", sum, 5, 2)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, "56")
+	c.Assert(fetched, T.DeepEquals, []int64{4})
+	// the fetched ranges are read from disk, also after a restart
+	m = New(s.blobPath, opts)
+	c.Assert(m.LoadIndex(), T.IsNil)
+	c.Assert(m.CacheSize(), T.Equals, int64(0))
+	c.Assert(m.SaveLazy("fileid", sum, 10), T.IsNil)
+	data, size, err = m.Read("fileid", sum, 4, 4)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, "4567")
+	c.Assert(fetched, T.DeepEquals, []int64{4})
+
+	// the blob is stored whole once all of its chunks are fetched
+	data, size, err = m.Read("fileid", sum, 0, 20)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, content)
+	c.Assert(fetched, T.DeepEquals, []int64{4, 0, 8})
+	c.Assert(m.Exists("fileid", sum), T.Equals, true)
+	c.Assert(m.CacheSize(), T.Equals, int64(10))
+	matches, _ := filepath.Glob(filepath.Join(s.blobPath, "*", "*"+sparseSuffix+"*"))
+	c.Assert(matches, T.HasLen, 0)
+
+	// writes fetch the whole blob first
+	c.Assert(m.SaveLazy("otherid", sum, 10), T.IsNil)
+	c.Assert(m.WriteAt("otherid", sum, 0, []byte("ab")), T.IsNil)
+	data, size, err = m.Read("otherid", sum, 0, 20)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, "ab23456789")
+
+	c.Assert(m.SaveLazy("corrupted", sum, 10), T.IsNil)
+	_, _, err = m.Read("corrupted", sum, 0, 10)
+	c.Assert(err, T.Equals, ErrChecksumMismatch)
+	c.Assert(m.Exists("corrupted", sum), T.Equals, false)
+}
+
+func (s *BlobSuite) TestTrash(c *T.C) {
+	m := New(s.blobPath, nil)
+	c.Assert(m.Save("fileid", "sum", ioutil.NopCloser(strings.NewReader("content"))), T.IsNil)
+	c.Assert(m.Save("other", "sum", ioutil.NopCloser(strings.NewReader("other"))), T.IsNil)
+	c.Assert(m.Trash("fileid"), T.IsNil)
+	c.Assert(m.Trash("other"), T.IsNil)
+	c.Assert(m.Exists("fileid", "sum"), T.Equals, false)
+	c.Assert(m.CacheSize(), T.Equals, int64(0))
+
+	// kept in the trash across restarts and clears
+	m = New(s.blobPath, nil)
+	c.Assert(m.LoadIndex(), T.IsNil)
+	c.Assert(m.CacheSize(), T.Equals, int64(0))
+	c.Assert(m.Clear(), T.IsNil)
+	restored, err := m.Untrash("fileid", "fileid", "other sum")
+	c.Assert(err, T.IsNil)
+	c.Assert(restored, T.Equals, false)
+	restored, err = m.Untrash("fileid", "copy", "sum")
+	c.Assert(err, T.IsNil)
+	c.Assert(restored, T.Equals, true)
+	data, size, err := m.Read("copy", "sum", 0, 10)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, "content")
+	c.Assert(m.CacheSize(), T.Equals, int64(len("content")))
+	restored, err = m.Untrash("fileid", "fileid", "sum")
+	c.Assert(err, T.IsNil)
+	c.Assert(restored, T.Equals, false)
+
+	c.Assert(m.DeleteTrashed("other"), T.IsNil)
+	restored, err = m.Untrash("other", "other", "sum")
+	c.Assert(err, T.IsNil)
+	c.Assert(restored, T.Equals, false)
+}
+
+func (s *BlobSuite) TestVerify(c *T.C) {
+	m := New(s.blobPath, &Options{Compress: true})
+	sum := fmt.Sprintf("%x", md5.Sum([]byte(strings.Repeat("content", 100))))
+	c.Assert(m.Save("fileid", sum, ioutil.NopCloser(strings.NewReader(strings.Repeat("content", 100)))), T.IsNil)
+	c.Assert(m.Save("other", "not md5", ioutil.NopCloser(strings.NewReader("other"))), T.IsNil)
+	e, ok := m.Stat("fileid")
+	c.Assert(ok, T.Equals, true)
+	c.Assert(e.Compressed, T.Equals, true)
+	// the decompressed content is verified
+	c.Assert(m.Verify(&e), T.IsNil)
+	other, _ := m.Stat("other")
+	c.Assert(m.Verify(&other), T.IsNil)
+
+	c.Assert(ioutil.WriteFile(e.Path, []byte("tampered"), 0640), T.IsNil)
+	c.Assert(m.Verify(&e), T.NotNil)
+
+	// replaced since it was listed, kept
+	c.Assert(m.Save("fileid", sum, ioutil.NopCloser(strings.NewReader(strings.Repeat("content", 100)))), T.IsNil)
+	c.Assert(m.Remove(&e), T.IsNil)
+	c.Assert(m.Exists("fileid", sum), T.Equals, true)
+	e, _ = m.Stat("fileid")
+	c.Assert(m.Remove(&e), T.IsNil)
+	c.Assert(m.Exists("fileid", sum), T.Equals, false)
+	c.Assert(m.CacheSize(), T.Equals, other.Size)
+}
+
+// sizedReader is a content of a known length, see Sized.
+type sizedReader struct {
+	io.Reader
+	size int64
+}
+
+func (r *sizedReader) Remaining() int64 {
+	return r.size
+}
+
+func (r *sizedReader) Close() error {
+	return nil
+}
+
+func (s *BlobSuite) TestSaveChecksFreeSpace(c *T.C) {
+	m := New(s.blobPath, nil)
+	c.Assert(m.Save("old", "sum", ioutil.NopCloser(strings.NewReader("old content"))), T.IsNil)
+	c.Assert(m.Save("recent", "sum", ioutil.NopCloser(strings.NewReader("recent content"))), T.IsNil)
+	_, _, err := m.Read("recent", "sum", 0, 1)
+	c.Assert(err, T.IsNil)
+	// the disk holds the blobs and room for 10 more bytes
+	capacity := int64(minFreeSpace + 10 + len("old content") + len("recent content"))
+	m.statfs = func(path string, stat *syscall.Statfs_t) error {
+		stat.Blocks, stat.Bsize = uint64(capacity), 1
+		stat.Bavail = uint64(capacity - m.CacheSize())
+		return nil
+	}
+	content := "new content"
+	err = m.Save("new", "sum", &sizedReader{strings.NewReader(content), int64(len(content))})
+	c.Assert(err, T.IsNil)
+	// the least recently used blob made room for it
+	c.Assert(m.Exists("old", "sum"), T.Equals, false)
+	c.Assert(m.Exists("recent", "sum"), T.Equals, true)
+
+	// nothing is read if there is no room even after evicting
+	r := &sizedReader{strings.NewReader("large"), capacity}
+	err = m.SaveFrom("large", "sum", 0, r)
+	c.Assert(err, T.Equals, ErrInsufficientSpace)
+	c.Assert(r.Reader.(*strings.Reader).Len(), T.Equals, len("large"))
+	c.Assert(m.Partial("large", "sum"), T.Equals, int64(0))
+	// contents of unknown size are written until the disk is full
+	c.Assert(m.Save("unknown", "sum", ioutil.NopCloser(strings.NewReader("unknown"))), T.IsNil)
+}
+
+func (s *BlobSuite) TestFullDisksFailSaves(c *T.C) {
+	m := New(s.blobPath, &Options{Sync: SyncAlways})
+	m.fsync = func(file *os.File) error {
+		return &os.PathError{Op: "sync", Path: file.Name(), Err: syscall.ENOSPC}
+	}
+	content := func() io.ReadCloser {
+		return ioutil.NopCloser(strings.NewReader("content"))
+	}
+	c.Assert(m.SaveFrom("fileid", "sum", 0, content()), T.Equals, ErrInsufficientSpace)
+	c.Assert(m.Partial("fileid", "sum"), T.Equals, int64(0))
+	c.Assert(m.Save("fileid", "sum", content()), T.Equals, ErrInsufficientSpace)
+	entries, err := ioutil.ReadDir(m.getBlobDir("fileid"))
+	c.Assert(err, T.IsNil)
+	c.Assert(entries, T.HasLen, 0)
+}
+
+// countingReader counts the bytes read of a content.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *countingReader) Close() error {
+	return nil
+}
+
+func (s *BlobSuite) TestSavesReturnTheMd5OfTheContent(c *T.C) {
+	content := bytes.Repeat([]byte("0123456789"), encryptedChunkSize/4)
+	sum := fmt.Sprintf("%x", md5.Sum(content))
+	for _, opts := range []*Options{{}, {Key: bytes.Repeat([]byte{7}, 32)}} {
+		m := New(c.MkDir(), opts)
+		r := &countingReader{Reader: bytes.NewReader(content)}
+		digest, err := m.SaveContextMd5(context.Background(), "fileid", "version", r)
+		c.Assert(err, T.IsNil)
+		c.Assert(digest, T.Equals, sum)
+		// hashed while it was written
+		c.Assert(r.n, T.Equals, int64(len(content)))
+
+		// the resumed content is hashed as a whole
+		cut := 2*encryptedChunkSize + 100
+		interrupted := io.MultiReader(bytes.NewReader(content[:cut]), iotest.ErrReader(io.ErrUnexpectedEOF))
+		_, err = m.SaveFromMd5("other", "version", 0, ioutil.NopCloser(interrupted))
+		c.Assert(err, T.Equals, io.ErrUnexpectedEOF)
+		offset := m.Partial("other", "version")
+		digest, err = m.SaveFromMd5("other", "version", offset, ioutil.NopCloser(bytes.NewReader(content[offset:])))
+		c.Assert(err, T.IsNil)
+		c.Assert(digest, T.Equals, sum)
+
+		_, err = m.SaveContextMd5(context.Background(), "fileid", sum, ioutil.NopCloser(strings.NewReader("corrupted")))
+		c.Assert(err, T.Equals, ErrChecksumMismatch)
+	}
+}
+
+func (s *BlobSuite) BenchmarkSaveMd5(c *T.C) {
+	content := bytes.Repeat([]byte("0123456789"), 1<<20/10)
+	sum := fmt.Sprintf("%x", md5.Sum(content))
+	m := New(s.blobPath, nil)
+	c.SetBytes(int64(len(content)))
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		r := &countingReader{Reader: bytes.NewReader(content)}
+		digest, err := m.SaveFromMd5("fileid", fmt.Sprint("version", i), 0, r)
+		c.Assert(err, T.IsNil)
+		c.Assert(digest, T.Equals, sum)
+		// the content is read once, into both the hash and the blob
+		c.Assert(r.n, T.Equals, int64(len(content)))
+	}
+}
+
+func (s *BlobSuite) TestBlobsHaveTheConfiguredModes(c *T.C) {
+	for _, opts := range []*Options{nil, {FileMode: 0664, DirMode: 0775}, {FileMode: 0604, Compress: true, StagingPath: filepath.Join(c.MkDir(), "staging")}} {
+		m := New(c.MkDir(), opts)
+		fileMode, dirMode := DefaultFileMode, DefaultDirMode
+		if opts != nil && opts.FileMode != 0 {
+			fileMode = opts.FileMode
+		}
+		if opts != nil && opts.DirMode != 0 {
+			dirMode = opts.DirMode
+		}
+		c.Assert(m.Save("saved", "sum", ioutil.NopCloser(strings.NewReader(strings.Repeat("content", 100)))), T.IsNil)
+		c.Assert(m.SaveFrom("resumed", "sum", 0, ioutil.NopCloser(strings.NewReader("content"))), T.IsNil)
+		for _, id := range []string{"saved", "resumed"} {
+			e, ok := m.Stat(id)
+			c.Assert(ok, T.Equals, true)
+			info, err := os.Stat(e.Path)
+			c.Assert(err, T.IsNil)
+			c.Assert(info.Mode(), T.Equals, fileMode&^processUmask())
+			c.Assert(info.Mode()&0111, T.Equals, os.FileMode(0))
+			info, err = os.Stat(filepath.Dir(e.Path))
+			c.Assert(err, T.IsNil)
+			c.Assert(info.Mode().Perm(), T.Equals, dirMode&^processUmask())
+		}
+	}
+
+	mask := syscall.Umask(0)
+	syscall.Umask(mask)
+	c.Assert(processUmask(), T.Equals, os.FileMode(mask))
+
+	mode, err := ParseMode("0644")
+	c.Assert(err, T.IsNil)
+	c.Assert(mode, T.Equals, os.FileMode(0644))
+	_, err = ParseMode("rw-r--r--")
+	c.Assert(err, T.NotNil)
+	_, err = ParseMode("17777")
+	c.Assert(err, T.NotNil)
+	_, err = ParseMode("0000")
+	c.Assert(err, T.NotNil)
+}
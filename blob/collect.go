@@ -0,0 +1,67 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// Removes the stored blobs live doesn't report as the content of their
+// file, e.g. the blobs of the files deleted without deleting their
+// blobs, or left by a crash. Only the blobs last modified before cutoff
+// are removed, the younger ones may be of files that are not recorded
+// yet. The blobs being read are kept. live may be called from multiple
+// goroutines. Returns the number of bytes reclaimed.
+func (f *Manager) Collect(cutoff time.Time, live func(e *Entry) bool) (int64, error) {
+	if f.IsPassThrough() {
+		return 0, nil
+	}
+	var mu sync.Mutex
+	var reclaimed int64
+	err := f.ForEach(func(e *Entry) error {
+		if !e.LastAccess.Before(cutoff) || live(e) || !f.removeStale(e, cutoff) {
+			return nil
+		}
+		mu.Lock()
+		reclaimed += e.Size
+		mu.Unlock()
+		return nil
+	})
+	f.checkWatermarks()
+	return reclaimed, err
+}
+
+// Removes the blob of the entry unless it is being read, or it was
+// rewritten since it was listed. Returns true if it is removed.
+func (f *Manager) removeStale(e *Entry, cutoff time.Time) bool {
+	if f.index.reading(e.Id) {
+		return false
+	}
+	info, err := os.Stat(e.Path)
+	if err != nil || fileKeyOf(info) != e.file || !info.ModTime().Before(cutoff) {
+		return false
+	}
+	f.log.V("Collecting blob", e.Id, e.Checksum, e.Size, "bytes")
+	if err = os.Remove(e.Path); err != nil {
+		f.log.V(err)
+		return false
+	}
+	f.index.remove(e.Id, e.Path)
+	f.dropAhead(e.Id)
+	f.removeShard(e.Id)
+	return true
+}
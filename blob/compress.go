@@ -0,0 +1,252 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// A compressed blob is a sequence of gzip members, each of
+// compressedChunkSize bytes of content but the last one, followed by a
+// footer: the offsets of the members and of the end of the last one,
+// the size of the content, the number of members and compressedMagic.
+// A read only decompresses the members of its range.
+const (
+	// Appended to the names of the compressed blobs.
+	compressedSuffix = ".gz"
+
+	// Bytes of content compressed into each gzip member.
+	compressedChunkSize = 64 << 10
+
+	// Blobs compressed to more than this share of their size are
+	// stored uncompressed, e.g. media that is compressed already.
+	maxCompressedRatio = 0.9
+
+	compressedMagic = "dfz1"
+
+	// Size of the fixed part of the footer, after the offsets.
+	compressedTrailerSize = 8 + 4 + len(compressedMagic)
+)
+
+var (
+	errCorruptedBlob = errors.New("blob: corrupted compressed blob")
+)
+
+// compressedIndex is the footer of a compressed blob.
+type compressedIndex struct {
+	size    int64   // of the content
+	offsets []int64 // of the members, and of the end of the last one
+}
+
+// Compresses the content of the blob in file, stored in its
+// uncompressed form, into a temporary file in dir named after name.
+// Returns nil if compressing doesn't pay off.
+func (f *Manager) compressBlob(dir string, name string, file *os.File) (*os.File, error) {
+	content, size, err := f.storedContent(file, blobForm{encrypted: f.opts.Key != nil})
+	if err != nil {
+		return nil, err
+	}
+	gz, err := ioutil.TempFile(dir, name+compressedSuffix+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	var w io.WriteCloser = nopWriteCloser{gz}
+	if f.opts.Key != nil {
+		if w, err = newEncrypter(gz, f.opts.Key); err != nil {
+			gz.Close()
+			os.Remove(gz.Name())
+			return nil, err
+		}
+	}
+	if err = writeCompressed(w, io.NewSectionReader(content, 0, size), size); err == nil {
+		err = w.Close()
+	}
+	if err == nil && compressionPays(file, gz) {
+		return gz, nil
+	}
+	gz.Close()
+	os.Remove(gz.Name())
+	return nil, err
+}
+
+// Returns true if the compressed blob is small enough to be stored
+// instead of the uncompressed one.
+func compressionPays(plain *os.File, compressed *os.File) bool {
+	plainInfo, err := plain.Stat()
+	if err != nil {
+		return false
+	}
+	info, err := compressed.Stat()
+	return err == nil && float64(info.Size()) < maxCompressedRatio*float64(plainInfo.Size())
+}
+
+// Writes size bytes of content read from r to w in the compressed
+// format.
+func writeCompressed(w io.Writer, r io.Reader, size int64) error {
+	buf := bufio.NewWriter(w)
+	out := &countingWriter{w: buf}
+	gz := gzip.NewWriter(out)
+	offsets := []int64{}
+	for read := int64(0); read < size; read += compressedChunkSize {
+		offsets = append(offsets, out.n)
+		gz.Reset(out)
+		if _, err := io.CopyN(gz, r, min(compressedChunkSize, size-read)); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+	offsets = append(offsets, out.n)
+	footer := make([]byte, 0, 8*len(offsets)+compressedTrailerSize)
+	for _, offset := range offsets {
+		footer = binary.BigEndian.AppendUint64(footer, uint64(offset))
+	}
+	footer = binary.BigEndian.AppendUint64(footer, uint64(size))
+	footer = binary.BigEndian.AppendUint32(footer, uint32(len(offsets)-1))
+	footer = append(footer, compressedMagic...)
+	if _, err := out.Write(footer); err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+// Reads the footer of the compressed blob of size bytes read from r.
+func readCompressedIndex(r io.ReaderAt, size int64) (*compressedIndex, error) {
+	trailer := make([]byte, compressedTrailerSize)
+	if size < int64(len(trailer)) {
+		return nil, errCorruptedBlob
+	}
+	if _, err := r.ReadAt(trailer, size-int64(len(trailer))); err != nil {
+		return nil, err
+	}
+	if string(trailer[12:]) != compressedMagic {
+		return nil, errCorruptedBlob
+	}
+	x := &compressedIndex{size: int64(binary.BigEndian.Uint64(trailer))}
+	members := int64(binary.BigEndian.Uint32(trailer[8:]))
+	footerSize := 8*(members+1) + int64(len(trailer))
+	if x.size < 0 || members != (x.size+compressedChunkSize-1)/compressedChunkSize || footerSize > size {
+		return nil, errCorruptedBlob
+	}
+	footer := make([]byte, 8*(members+1))
+	if _, err := r.ReadAt(footer, size-footerSize); err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(footer); i += 8 {
+		offset := int64(binary.BigEndian.Uint64(footer[i:]))
+		if offset < 0 || (len(x.offsets) > 0 && offset < x.offsets[len(x.offsets)-1]) {
+			return nil, errCorruptedBlob
+		}
+		x.offsets = append(x.offsets, offset)
+	}
+	if x.offsets[members] != size-footerSize {
+		return nil, errCorruptedBlob
+	}
+	return x, nil
+}
+
+// Reads len(p) bytes of the content of the compressed blob of size
+// bytes read from r, starting at off, like io.ReaderAt: fewer only at
+// the end of the content, with io.EOF.
+func readCompressed(r io.ReaderAt, size int64, p []byte, off int64) (n int, err error) {
+	x, err := readCompressedIndex(r, size)
+	if err != nil {
+		return 0, err
+	}
+	return x.readAt(r, p, off)
+}
+
+// Reads the content like readCompressed, with the footer read already.
+func (x *compressedIndex) readAt(r io.ReaderAt, p []byte, off int64) (n int, err error) {
+	for i := off / compressedChunkSize; n < len(p) && i < int64(len(x.offsets)-1); i++ {
+		var chunk []byte
+		if chunk, err = x.member(r, i); err != nil {
+			return n, err
+		}
+		start := off + int64(n) - i*compressedChunkSize
+		if start >= int64(len(chunk)) {
+			// past the end of the last member
+			break
+		}
+		n += copy(p[n:], chunk[start:])
+	}
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+// Decompresses the i-th member of the compressed blob read from r.
+func (x *compressedIndex) member(r io.ReaderAt, i int64) ([]byte, error) {
+	// read at once, r may be decrypting
+	data := make([]byte, x.offsets[i+1]-x.offsets[i])
+	if _, err := r.ReadAt(data, x.offsets[i]); err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	gz.Multistream(false)
+	chunk, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(chunk)) != min(compressedChunkSize, x.size-i*compressedChunkSize) {
+		return nil, errCorruptedBlob
+	}
+	return chunk, nil
+}
+
+// Returns a reader of the content of the compressed blob of size bytes
+// read from r, from its start.
+func openCompressed(r io.ReaderAt, size int64) (io.Reader, error) {
+	x, err := readCompressedIndex(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if x.size == 0 {
+		return bytes.NewReader(nil), nil
+	}
+	// the members one after another
+	return gzip.NewReader(io.NewSectionReader(r, 0, x.offsets[len(x.offsets)-1]))
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
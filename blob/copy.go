@@ -0,0 +1,86 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"io"
+	"os"
+	"path"
+)
+
+// Stores the blob of srcId with the checksum as the blob of dstId too,
+// e.g. of a copy of the file of srcId, without fetching its content
+// again: the blob is hard linked, or copied as it is stored if it
+// can't be linked. A blob of dstId with the checksum already stored is
+// kept, the other blobs of dstId are replaced as by Save. Returns
+// ErrCacheMiss if the blob of srcId with the checksum is not stored.
+func (f *Manager) Copy(srcId string, dstId string, checksum string) error {
+	if f.IsPassThrough() {
+		return ErrCacheMiss
+	}
+	src, form, err := f.openBlob(srcId, checksum)
+	if os.IsNotExist(err) {
+		return ErrCacheMiss
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if dst, _, err := f.openBlob(dstId, checksum); err == nil {
+		dst.Close()
+		return nil
+	}
+	f.dropAhead(dstId)
+	f.cleanup(dstId, checksum)
+	dir, err := f.checkInodes(dstId)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, f.dirMode); err != nil {
+		return err
+	}
+	// linked or copied next to the blob, then renamed into place
+	p := path.Join(dir, f.getBlobName(dstId, checksum)+form.suffix())
+	tmp := p + ".tmp-link"
+	os.Remove(tmp)
+	if err = f.hardLink(src.Name(), tmp); err != nil {
+		f.log.V("can't link blob", dstId, "to", src.Name(), err)
+		err = f.copyStored(src, tmp)
+	}
+	if err == nil {
+		err = f.rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	f.log.V("Copied blob", srcId, "to", dstId)
+	return f.stored(dstId, checksum, dir, form)
+}
+
+// Copies the blob in src, as it is stored, to a new file at p.
+func (f *Manager) copyStored(src *os.File, p string) error {
+	file, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, f.fileMode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(file, src); err == nil && f.opts.Sync != SyncNone {
+		err = f.fsync(file)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
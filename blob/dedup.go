@@ -0,0 +1,74 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"os"
+	"path"
+)
+
+// Stores the blob of id with the checksum as a hard link to the stored
+// blob of another id with the same content, see Options.Dedup. Returns
+// false if Options.Dedup is unset, there is no such blob or it can't
+// be linked; the content is to be saved then.
+func (f *Manager) Link(id string, checksum string) (bool, error) {
+	if f.IsPassThrough() {
+		return false, nil
+	}
+	linked, err := f.link(id, checksum)
+	if linked {
+		f.dropAhead(id)
+		f.cleanup(id, checksum)
+	}
+	return linked, err
+}
+
+func (f *Manager) link(id string, checksum string) (bool, error) {
+	// only md5 checksums are verified, the others may be shared by
+	// different contents
+	if !f.opts.Dedup || !isMd5(checksum) {
+		return false, nil
+	}
+	src, ok := f.index.lookupOther(checksum, id)
+	if !ok {
+		return false, nil
+	}
+	_, _, form, ok := parseBlobName(path.Base(src))
+	if !ok {
+		return false, nil
+	}
+	dir, err := f.checkInodes(id)
+	if err != nil {
+		return false, err
+	}
+	if err = os.MkdirAll(dir, f.dirMode); err != nil {
+		return false, err
+	}
+	// linked next to the blob, then renamed into place over the blob
+	// if there is one
+	p := path.Join(dir, f.getBlobName(id, checksum)+form.suffix())
+	tmp := p + ".tmp-link"
+	os.Remove(tmp)
+	if err = f.hardLink(src, tmp); err != nil {
+		f.log.V("can't link blob", id, "to", src, err)
+		return false, nil
+	}
+	if err = f.rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	f.log.V("Linked blob", id, "to", src)
+	return true, f.stored(id, checksum, dir, form)
+}
@@ -0,0 +1,300 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// An encrypted blob starts with a header of encryptedMagic and a random
+// nonce prefix, followed by the content sealed with AES-GCM in chunks
+// of encryptedChunkSize bytes but the last one. The nonce of a chunk is
+// the prefix and the index of the chunk, the last chunk is marked in
+// its additional data so that a truncated blob doesn't decrypt. A read
+// only decrypts the chunks of its range.
+const (
+	// Appended to the names of the encrypted blobs, after the suffix
+	// of the compressed ones.
+	encryptedSuffix = ".enc"
+
+	// Bytes of content sealed into each chunk.
+	encryptedChunkSize = 64 << 10
+
+	encryptedMagic = "dfe1"
+
+	// Bytes of the nonce prefix, the rest of the nonce is the index of
+	// the chunk.
+	noncePrefixSize = 8
+
+	encryptedHeaderSize = len(encryptedMagic) + noncePrefixSize
+
+	// Bytes of the tag GCM appends to each chunk.
+	overheadGCM = 16
+
+	// Created in the blob directory, holds the salt of DeriveKey.
+	keySaltFile = ".key-salt"
+
+	keySaltSize = 16
+
+	// PBKDF2 iterations of DeriveKey.
+	keyIterations = 600000
+)
+
+var (
+	// The blob is encrypted but no key is set.
+	ErrNoKey = errors.New("blob: encrypted blob without a key")
+
+	// The blob doesn't decrypt with the key, e.g. the key is wrong or
+	// the blob is corrupted.
+	ErrDecrypt = errors.New("blob: can't decrypt blob")
+)
+
+// Derives an AES-256 key from passphrase for the blobs stored under
+// blobPath. The salt is generated once and stored next to the blobs,
+// the same passphrase derives the same key on the next runs.
+func DeriveKey(blobPath string, passphrase string) ([]byte, error) {
+	saltPath := path.Join(blobPath, keySaltFile)
+	salt, err := ioutil.ReadFile(saltPath)
+	if os.IsNotExist(err) {
+		salt = make([]byte, keySaltSize)
+		if _, err = rand.Read(salt); err != nil {
+			return nil, err
+		}
+		if err = os.MkdirAll(blobPath, DefaultDirMode); err == nil {
+			err = ioutil.WriteFile(saltPath, salt, DefaultFileMode)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pbkdf2.Key(sha256.New, passphrase, salt, keyIterations, 32)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Returns the nonce of the i-th chunk.
+func chunkNonce(prefix []byte, i int64) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte(nil), prefix...), uint32(i))
+}
+
+// Returns the additional data of a chunk.
+func chunkData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encrypter encrypts the content written to it into the encrypted
+// format. The last chunk is written on Close.
+type encrypter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	chunks int64  // sealed so far
+	buf    []byte // content of the next chunk
+}
+
+// Creates a new encrypter writing to w, writes the header.
+func newEncrypter(w io.Writer, key []byte) (*encrypter, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, noncePrefixSize)
+	if _, err = rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(append([]byte(encryptedMagic), prefix...)); err != nil {
+		return nil, err
+	}
+	return &encrypter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, encryptedChunkSize)}, nil
+}
+
+// Creates an encrypter appending to the content of file, written by
+// an encrypter that was not closed, following its first chunks chunks.
+// The content of these chunks is written to w, the rest is truncated.
+func resumeEncrypter(file *os.File, chunks int64, key []byte, w io.Writer) (*encrypter, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encryptedHeaderSize)
+	if _, err = file.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if string(header[:len(encryptedMagic)]) != encryptedMagic {
+		return nil, ErrDecrypt
+	}
+	e := &encrypter{w: file, aead: aead, prefix: header[len(encryptedMagic):], chunks: chunks, buf: make([]byte, 0, encryptedChunkSize)}
+	sealedSize := int64(encryptedChunkSize + aead.Overhead())
+	sealed := make([]byte, sealedSize)
+	for i := int64(0); i < chunks; i++ {
+		if _, err = file.ReadAt(sealed, int64(len(header))+i*sealedSize); err != nil {
+			return nil, err
+		}
+		chunk, err := aead.Open(sealed[:0], chunkNonce(e.prefix, i), sealed, chunkData(false))
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+		w.Write(chunk)
+	}
+	end := int64(len(header)) + chunks*sealedSize
+	if err = file.Truncate(end); err != nil {
+		return nil, err
+	}
+	if _, err = file.Seek(end, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *encrypter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		// a full chunk is sealed once more content follows, the last
+		// one is sealed differently
+		if len(e.buf) == cap(e.buf) {
+			if err = e.seal(false); err != nil {
+				return
+			}
+		}
+		k := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+k]
+		p = p[k:]
+		n += k
+	}
+	return
+}
+
+// Seals the last chunk, doesn't close the underlying writer.
+func (e *encrypter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encrypter) seal(last bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.prefix, e.chunks), e.buf, chunkData(last))
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+	e.chunks++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// decrypter reads the content of an encrypted blob. The last chunk
+// read is kept to serve the following small reads.
+type decrypter struct {
+	r      io.ReaderAt
+	aead   cipher.AEAD
+	prefix []byte
+	size   int64 // of the content
+	chunks int64
+
+	cached int64 // index of the chunk in cache, -1 if none
+	cache  []byte
+}
+
+// Creates a new decrypter of the encrypted blob of size bytes read
+// from r.
+func newDecrypter(r io.ReaderAt, size int64, key []byte) (*decrypter, error) {
+	if key == nil {
+		return nil, ErrNoKey
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encryptedHeaderSize)
+	if size < int64(len(header)) {
+		return nil, ErrDecrypt
+	}
+	if _, err = r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if string(header[:len(encryptedMagic)]) != encryptedMagic {
+		return nil, ErrDecrypt
+	}
+	sealedSize := int64(encryptedChunkSize + aead.Overhead())
+	body := size - int64(len(header))
+	// there is always a last chunk, possibly empty
+	chunks := max(1, (body+sealedSize-1)/sealedSize)
+	if body < chunks*int64(aead.Overhead()) {
+		return nil, ErrDecrypt
+	}
+	return &decrypter{
+		r:      r,
+		aead:   aead,
+		prefix: header[len(encryptedMagic):],
+		size:   body - chunks*int64(aead.Overhead()),
+		chunks: chunks,
+		cached: -1,
+	}, nil
+}
+
+// Reads len(p) bytes of the content starting at off, like
+// io.ReaderAt: fewer only at the end of the content, with io.EOF.
+func (d *decrypter) ReadAt(p []byte, off int64) (n int, err error) {
+	for i := off / encryptedChunkSize; n < len(p) && i < d.chunks; i++ {
+		var chunk []byte
+		if chunk, err = d.chunk(i); err != nil {
+			return n, err
+		}
+		start := off + int64(n) - i*encryptedChunkSize
+		if start >= int64(len(chunk)) {
+			// past the end of the last chunk
+			break
+		}
+		n += copy(p[n:], chunk[start:])
+	}
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+// Decrypts the i-th chunk.
+func (d *decrypter) chunk(i int64) ([]byte, error) {
+	if i == d.cached {
+		return d.cache, nil
+	}
+	overhead := int64(d.aead.Overhead())
+	plainSize := min(encryptedChunkSize, d.size-i*encryptedChunkSize)
+	sealed := make([]byte, plainSize+overhead)
+	if _, err := d.r.ReadAt(sealed, int64(encryptedHeaderSize)+i*(encryptedChunkSize+overhead)); err != nil {
+		return nil, err
+	}
+	chunk, err := d.aead.Open(sealed[:0], chunkNonce(d.prefix, i), sealed, chunkData(i == d.chunks-1))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	d.cached, d.cache = i, chunk
+	return chunk, nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// Opens the content of the blob of id with the checksum, or of the
+// dirty blob of id, see WriteAt. The handle also implements io.ReaderAt
+// and keeps the blob open until it is closed, the blob is not evicted
+// in the meantime. Content written after it is opened may not be seen.
+// Fails like os.Open if the blob is not stored, with ErrCacheMiss in
+// pass-through mode, its content is read with Read instead.
+func (f *Manager) Open(id string, checksum string) (io.ReadSeekCloser, error) {
+	if f.IsPassThrough() {
+		return nil, ErrCacheMiss
+	}
+	if e, ok := f.index.get(id); ok && e.IsDirty() {
+		checksum = dirtyChecksum
+	}
+	file, form, err := f.openBlob(id, checksum)
+	if err != nil {
+		return nil, err
+	}
+	r, size, err := f.contentAt(file, form)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f.index.startRead(id)
+	f.touch(id)
+	return &blobHandle{SectionReader: io.NewSectionReader(r, 0, size), file: file, done: func() {
+		f.index.endRead(id)
+	}}, nil
+}
+
+// Returns a reader of the content of the blob in file stored in form,
+// decrypted and decompressed if need be, and its size.
+func (f *Manager) contentAt(file *os.File, form blobForm) (io.ReaderAt, int64, error) {
+	r, size, err := f.storedContent(file, form)
+	if err != nil || !form.compressed {
+		return r, size, err
+	}
+	x, err := readCompressedIndex(r, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &compressedReader{r: r, x: x}, x.size, nil
+}
+
+// compressedReader reads the content of a compressed blob at any
+// offset, see writeCompressed.
+type compressedReader struct {
+	r io.ReaderAt
+	x *compressedIndex
+}
+
+func (c *compressedReader) ReadAt(p []byte, off int64) (int, error) {
+	return c.x.readAt(c.r, p, off)
+}
+
+// blobHandle reads the content of an open blob, see Manager.Open.
+type blobHandle struct {
+	*io.SectionReader
+	file *os.File
+	once sync.Once
+	done func()
+}
+
+func (h *blobHandle) Close() error {
+	h.once.Do(h.done)
+	return h.file.Close()
+}
@@ -0,0 +1,452 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// Number of shard directories scanned at the same time while
+	// loading the index.
+	numIndexWorkers = 4
+
+	// Number of blobs between the progress logs while loading the
+	// index.
+	indexProgressInterval = 10000
+
+	// Minimum time between the updates of the access time of a blob
+	// on disk.
+	accessPersistInterval = time.Minute
+)
+
+// Entry describes a blob stored on disk.
+type Entry struct {
+	Id       string
+	Checksum string
+	Path     string
+
+	// Size on disk, of the compressed or encrypted content if so.
+	Size       int64
+	Compressed bool
+	Encrypted  bool
+
+	// Last time the blob was saved or read.
+	LastAccess time.Time
+
+	file fileKey
+}
+
+// fileKey identifies a file on disk, the hard links of a file share it.
+type fileKey struct {
+	dev uint64
+	ino uint64
+}
+
+// Returns the key of the file described by info, zero if the system
+// doesn't report it.
+func fileKeyOf(info os.FileInfo) fileKey {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return fileKey{dev: uint64(st.Dev), ino: st.Ino}
+	}
+	return fileKey{}
+}
+
+// Returns true if the blob is written locally, see Manager.WriteAt.
+func (e *Entry) IsDirty() bool {
+	return e.Checksum == dirtyChecksum
+}
+
+// Returns true if the content of the blob can be verified against the
+// checksum it is named after, see Manager.Verify.
+func (e *Entry) IsVerifiable() bool {
+	return isMd5(e.Checksum)
+}
+
+func (e *Entry) form() blobForm {
+	return blobForm{compressed: e.Compressed, encrypted: e.Encrypted}
+}
+
+// index keeps the sizes and access times of the stored blobs, and the
+// paths of the blobs by checksum, in memory.
+type index struct {
+	mu         sync.Mutex
+	entries    map[string]*Entry          // keyed by id
+	byChecksum map[string]map[string]bool // paths keyed by checksum
+	readers    map[string]int             // number of reads in progress, keyed by id
+	files      map[fileKey]int            // number of entries of each file on disk
+	size       int64                      // of the files on disk, once each
+}
+
+func newIndex() *index {
+	return &index{entries: make(map[string]*Entry), byChecksum: make(map[string]map[string]bool), readers: make(map[string]int), files: make(map[fileKey]int)}
+}
+
+// Adds the entry, replacing the entry of the same id if any.
+func (x *index) add(e *Entry) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.addLocked(e)
+}
+
+// Adds the entry unless there is an entry of the same id.
+func (x *index) addIfAbsent(e *Entry) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.entries[e.Id]; !ok {
+		x.addLocked(e)
+	}
+}
+
+func (x *index) addLocked(e *Entry) {
+	x.removeLocked(e.Id)
+	x.entries[e.Id] = e
+	if x.byChecksum[e.Checksum] == nil {
+		x.byChecksum[e.Checksum] = make(map[string]bool)
+	}
+	x.byChecksum[e.Checksum][e.Path] = true
+	if e.file == (fileKey{}) {
+		x.size += e.Size
+		return
+	}
+	// hard links of a stored file take no space
+	if x.files[e.file]++; x.files[e.file] == 1 {
+		x.size += e.Size
+	}
+}
+
+// Removes the entry of id if it is of the blob at p.
+func (x *index) remove(id string, p string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if e, ok := x.entries[id]; ok && e.Path == p {
+		x.removeLocked(id)
+	}
+}
+
+func (x *index) removeLocked(id string) {
+	e, ok := x.entries[id]
+	if !ok {
+		return
+	}
+	delete(x.entries, id)
+	delete(x.byChecksum[e.Checksum], e.Path)
+	if len(x.byChecksum[e.Checksum]) == 0 {
+		delete(x.byChecksum, e.Checksum)
+	}
+	if e.file == (fileKey{}) {
+		x.size -= e.Size
+		return
+	}
+	if x.files[e.file]--; x.files[e.file] == 0 {
+		delete(x.files, e.file)
+		x.size -= e.Size
+	}
+}
+
+// Removes all of the entries.
+func (x *index) clear() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.entries = make(map[string]*Entry)
+	x.byChecksum = make(map[string]map[string]bool)
+	x.files = make(map[fileKey]int)
+	x.size = 0
+}
+
+// Marks the blob of id as accessed now. Returns the path of the blob
+// if its access time on disk is stale, so that the recency survives
+// restarts without writing to the disk on each read.
+func (x *index) touch(id string) (p string, stale bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	e, ok := x.entries[id]
+	if !ok {
+		return "", false
+	}
+	now := time.Now()
+	stale = now.Sub(e.LastAccess) >= accessPersistInterval
+	e.LastAccess = now
+	return e.Path, stale
+}
+
+// Marks the blob of id as being read, it is not evicted until the
+// read is done.
+func (x *index) startRead(id string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.readers[id]++
+}
+
+func (x *index) endRead(id string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.readers[id]--; x.readers[id] <= 0 {
+		delete(x.readers, id)
+	}
+}
+
+// Returns true if the blob of id is being read.
+func (x *index) reading(id string) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.readers[id] > 0
+}
+
+// Removes the least recently used entries, other than the entry of
+// keep, the ones being read and the dirty ones, until the total size
+// is at most max. Returns the removed entries.
+func (x *index) evict(max int64, keep string) []*Entry {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.size <= max {
+		return nil
+	}
+	lru := make([]*Entry, 0, len(x.entries))
+	for _, e := range x.entries {
+		lru = append(lru, e)
+	}
+	sort.Slice(lru, func(i, j int) bool {
+		return lru[i].LastAccess.Before(lru[j].LastAccess)
+	})
+	evicted := []*Entry{}
+	for _, e := range lru {
+		if x.size <= max {
+			break
+		}
+		if e.Id == keep || x.readers[e.Id] > 0 || e.IsDirty() {
+			continue
+		}
+		x.removeLocked(e.Id)
+		evicted = append(evicted, e)
+	}
+	return evicted
+}
+
+// Returns a copy of the entry of id.
+func (x *index) get(id string) (Entry, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	e, ok := x.entries[id]
+	if !ok {
+		return Entry{}, false
+	}
+	return *e, true
+}
+
+// Returns the path of a blob with the checksum of another id than id.
+func (x *index) lookupOther(checksum string, id string) (string, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for p := range x.byChecksum[checksum] {
+		if e, ok := x.entries[id]; !ok || e.Path != p {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// Returns a path of a blob with the checksum.
+func (x *index) lookup(checksum string) (string, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for p := range x.byChecksum[checksum] {
+		return p, true
+	}
+	return "", false
+}
+
+// Calls fn for each of the blobs stored on disk. Temporary files of
+// the saves in progress are skipped. Shard directories are scanned
+// concurrently, fn may be called from multiple goroutines. Stops at
+// the first error returned by fn and returns it.
+func (f *Manager) ForEach(fn func(e *Entry) error) error {
+	// the blob directory itself holds the blobs that couldn't be sharded
+	dirs, err := f.blobDirs()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	work := make(chan string)
+	done := make(chan struct{})
+	var once sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+	for i := 0; i < numIndexWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dir := range work {
+				if err := f.forEachIn(dir, fn, done); err != nil {
+					// stop the other workers
+					once.Do(func() {
+						firstErr = err
+						close(done)
+					})
+				}
+			}
+		}()
+	}
+dispatch:
+	for _, dir := range dirs {
+		select {
+		case work <- dir:
+		case <-done:
+			break dispatch
+		}
+	}
+	close(work)
+	wg.Wait()
+	return firstErr
+}
+
+// Calls fn for each of the blobs in dir, until done is closed.
+func (f *Manager) forEachIn(dir string, fn func(e *Entry) error, done <-chan struct{}) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		id, checksum, form, ok := parseBlobName(file.Name())
+		if !ok || file.IsDir() {
+			continue
+		}
+		e := &Entry{
+			Id:         id,
+			Checksum:   checksum,
+			Path:       path.Join(dir, file.Name()),
+			Size:       file.Size(),
+			Compressed: form.compressed,
+			Encrypted:  form.encrypted,
+			LastAccess: file.ModTime(),
+			file:       fileKeyOf(file),
+		}
+		if err = fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rebuilds the in-memory index of the blobs from the blobs on disk,
+// so that it survives restarts. Blobs saved while the index is being
+// loaded are kept. Logs the progress on large caches. Blobs named by
+// older versions or stored in another layout of the shard directories
+// are moved first, see migrateNames and migrateShards.
+func (f *Manager) LoadIndex() error {
+	if f.IsPassThrough() {
+		return nil
+	}
+	if err := f.migrateNames(); err != nil {
+		return err
+	}
+	if err := f.migrateShards(); err != nil {
+		return err
+	}
+	if err := f.checkStaging(); err != nil {
+		return err
+	}
+	var mu sync.Mutex
+	count := 0
+	err := f.ForEach(func(e *Entry) error {
+		f.index.addIfAbsent(e)
+		mu.Lock()
+		count++
+		if count%indexProgressInterval == 0 {
+			f.log.V("Indexed", count, "blobs")
+		}
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	f.log.V("Indexed", count, "blobs,", f.CacheSize(), "bytes")
+	// the cap may have been lowered since the last run
+	f.evict("")
+	f.checkWatermarks()
+	return nil
+}
+
+// Returns the total size of the stored blobs in bytes.
+func (f *Manager) CacheSize() int64 {
+	f.index.mu.Lock()
+	defer f.index.mu.Unlock()
+	return f.index.size
+}
+
+// Returns the cap of the total size of the stored blobs in bytes, zero
+// if it is not capped, see Options.MaxSize.
+func (f *Manager) MaxSize() int64 {
+	return f.opts.MaxSize
+}
+
+// Returns the entry of the stored blob of id.
+func (f *Manager) Stat(id string) (Entry, bool) {
+	return f.index.get(id)
+}
+
+// Returns the path of a stored blob with the given checksum, whichever
+// file it belongs to.
+func (f *Manager) LookupChecksum(checksum string) (string, bool) {
+	return f.index.lookup(checksum)
+}
+
+// Returns the id of a stored blob with the given checksum, e.g. of the
+// file another file is a copy of, see Copy.
+func (f *Manager) LookupChecksumId(checksum string) (string, bool) {
+	p, ok := f.index.lookup(checksum)
+	if !ok {
+		return "", false
+	}
+	id, _, _, ok := parseBlobName(path.Base(p))
+	return id, ok
+}
+
+// Removes the least recently used blobs, other than the blob of keep,
+// the blobs being read and the dirty ones, until the blobs fit into
+// MaxSize. Reads of the evicted blobs miss the cache, see Options.Heal.
+func (f *Manager) evict(keep string) {
+	if f.opts.MaxSize > 0 {
+		f.evictTo(f.opts.MaxSize, keep)
+	}
+}
+
+// Removes the least recently used blobs like evict, until the blobs fit
+// into max bytes.
+func (f *Manager) evictTo(max int64, keep string) {
+	for _, e := range f.index.evict(max, keep) {
+		f.log.V("Evicting blob", e.Id, e.Size, "bytes")
+		f.dropAhead(e.Id)
+		if err := os.Remove(e.Path); err != nil && !os.IsNotExist(err) {
+			f.log.V(err)
+		}
+		f.removeShard(e.Id)
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// Size of the ranges fetched by the lazy reads, see
+	// Options.LazyChunkSize.
+	DefaultLazyChunkSize = 1 << 20
+
+	// Appended to the names of the sparse blobs, the content of which
+	// is fetched on demand, and to the names of the files holding the
+	// ranges fetched, after the suffix of the sparse blobs.
+	sparseSuffix = ".sparse"
+	rangesSuffix = ".ranges"
+)
+
+var (
+	errNotLazy = errors.New("blob: contents are not fetched lazily")
+)
+
+// sparseBlob records the chunks of the content of a sparse blob that
+// are fetched, in a bitmap.
+type sparseBlob struct {
+	size   int64
+	chunks []byte
+}
+
+func newSparseBlob(size int64, chunkSize int64) *sparseBlob {
+	n := (size + chunkSize - 1) / chunkSize
+	return &sparseBlob{size: size, chunks: make([]byte, (n+7)/8)}
+}
+
+func (s *sparseBlob) has(chunk int64) bool {
+	return s.chunks[chunk/8]&(1<<(chunk%8)) != 0
+}
+
+func (s *sparseBlob) set(chunk int64) {
+	s.chunks[chunk/8] |= 1 << (chunk % 8)
+}
+
+// Returns true if all of the chunks are fetched.
+func (s *sparseBlob) complete(chunkSize int64) bool {
+	for c := int64(0); c*chunkSize < s.size; c++ {
+		if !s.has(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if the contents are fetched on demand, see Options.Lazy.
+// Blobs are always fetched whole if they are encrypted, their chunks
+// can't be written in place.
+func (f *Manager) IsLazy() bool {
+	return f.opts.Lazy != nil && f.opts.Key == nil && !f.IsPassThrough()
+}
+
+// Strips the suffixes of the sparse blobs and of their ranges from
+// name. Returns false if name is neither.
+func trimSparseSuffix(name string) (string, bool) {
+	name = strings.TrimSuffix(name, rangesSuffix)
+	return strings.CutSuffix(name, sparseSuffix)
+}
+
+// Stores the blob of id with the checksum as a sparse blob of size
+// bytes, the content of which is fetched by the reads, range by range,
+// see Options.Lazy. The blob is kept if it is already stored, whole or
+// sparse; the blobs of other checksums are removed. Sparse blobs don't
+// count into the size of the cache until they are fetched whole.
+func (f *Manager) SaveLazy(id string, checksum string, size int64) error {
+	if !f.IsLazy() {
+		return errNotLazy
+	}
+	f.dropAhead(id)
+	f.cleanup(id, checksum)
+	if file, _, err := f.openBlob(id, checksum); err == nil {
+		file.Close()
+		return nil
+	}
+	f.muLazy.Lock()
+	defer f.muLazy.Unlock()
+	if _, ok := f.findSparse(id, checksum); ok {
+		return nil
+	}
+	dir, err := f.checkInodes(id)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, f.dirMode); err != nil {
+		return err
+	}
+	p := path.Join(dir, f.getBlobName(id, checksum)+sparseSuffix)
+	file, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_TRUNC, f.fileMode)
+	if err != nil {
+		return err
+	}
+	err = file.Truncate(size)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	s := newSparseBlob(size, f.lazyChunkSize())
+	if err == nil {
+		err = f.saveRanges(p, s)
+	}
+	if err == nil && size == 0 {
+		// there is nothing to fetch
+		err = f.completeSparse(id, checksum, p)
+	}
+	if err != nil {
+		os.Remove(p)
+		os.Remove(p + rangesSuffix)
+	}
+	return err
+}
+
+func (f *Manager) lazyChunkSize() int64 {
+	if f.opts.LazyChunkSize > 0 {
+		return int64(f.opts.LazyChunkSize)
+	}
+	return DefaultLazyChunkSize
+}
+
+// Returns true if the blob of id with the checksum is stored as a
+// sparse blob, see SaveLazy.
+func (f *Manager) IsSparse(id string, checksum string) bool {
+	if !f.IsLazy() {
+		return false
+	}
+	_, ok := f.findSparse(id, checksum)
+	return ok
+}
+
+// Returns the path of the sparse blob of id with the checksum if there
+// is one.
+func (f *Manager) findSparse(id string, checksum string) (string, bool) {
+	for _, dir := range f.getBlobDirs(id) {
+		p := path.Join(dir, f.getBlobName(id, checksum)+sparseSuffix)
+		if _, err := os.Stat(p); err == nil {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// Reads up to l bytes of the sparse blob of id with the checksum like
+// read, fetching the chunks of the range that are not fetched yet.
+// Returns false if there is no such sparse blob. The lazy reads are
+// serialized. Once all of the chunks are fetched, the blob is stored
+// whole, if its md5 checksum matches.
+func (f *Manager) readLazy(id string, checksum string, seek int64, l int) (blob []byte, size int64, ok bool, err error) {
+	f.muLazy.Lock()
+	defer f.muLazy.Unlock()
+	p, ok := f.findSparse(id, checksum)
+	if !ok {
+		return nil, 0, false, nil
+	}
+	s, err := loadRanges(p)
+	if err != nil {
+		return nil, 0, true, err
+	}
+	file, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		return nil, 0, true, err
+	}
+	defer file.Close()
+	end := min(seek+int64(l), s.size)
+	fetched, err := f.fetchChunks(id, p, file, s, seek, end)
+	if err != nil {
+		return nil, 0, true, err
+	}
+	blob = make([]byte, l)
+	var n int
+	if seek < end {
+		if n, err = file.ReadAt(blob[:end-seek], seek); err != nil {
+			return nil, 0, true, err
+		}
+	}
+	if fetched && s.complete(f.lazyChunkSize()) {
+		err = f.completeSparse(id, checksum, p)
+	}
+	return blob, int64(n), true, err
+}
+
+// Fetches the chunks of the sparse blob of id with the checksum that
+// are not fetched yet and stores the blob whole, e.g. before it is
+// written, see WriteAt. Returns false if there is no such sparse blob.
+func (f *Manager) fetchSparse(id string, checksum string) (bool, error) {
+	f.muLazy.Lock()
+	defer f.muLazy.Unlock()
+	p, ok := f.findSparse(id, checksum)
+	if !ok {
+		return false, nil
+	}
+	s, err := loadRanges(p)
+	if err != nil {
+		return true, err
+	}
+	file, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		return true, err
+	}
+	_, err = f.fetchChunks(id, p, file, s, 0, s.size)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return true, err
+	}
+	return true, f.completeSparse(id, checksum, p)
+}
+
+// Fetches the chunks of the sparse blob s of id, at p and open as file,
+// overlapping the range from seek to end that are not fetched yet, and
+// records them. Returns true if any chunk is fetched.
+func (f *Manager) fetchChunks(id string, p string, file *os.File, s *sparseBlob, seek int64, end int64) (fetched bool, err error) {
+	chunkSize := f.lazyChunkSize()
+	for c := max(seek, 0) / chunkSize; c*chunkSize < end; c++ {
+		if s.has(c) {
+			continue
+		}
+		off := c * chunkSize
+		n := min(chunkSize, s.size-off)
+		var data []byte
+		if data, err = f.opts.Lazy(id, off, int(n)); err != nil {
+			break
+		}
+		if int64(len(data)) != n {
+			// the content doesn't have the size of the file
+			err = io.ErrUnexpectedEOF
+			break
+		}
+		if _, err = file.WriteAt(data, off); err != nil {
+			break
+		}
+		s.set(c)
+		fetched = true
+	}
+	if !fetched {
+		return false, err
+	}
+	// the chunks reach the disk before they are recorded
+	var saveErr error
+	if f.opts.Sync != SyncNone {
+		saveErr = f.fsync(file)
+	}
+	if saveErr == nil {
+		saveErr = f.saveRanges(p, s)
+	}
+	if err == nil {
+		err = saveErr
+	}
+	return true, err
+}
+
+// Stores the sparse blob at p, fetched whole, as the blob of id with
+// the checksum.
+func (f *Manager) completeSparse(id string, checksum string, p string) error {
+	if isMd5(checksum) {
+		file, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		hash := md5.New()
+		_, err = io.Copy(hash, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(hex.EncodeToString(hash.Sum(nil)), checksum) {
+			f.log.V("checksum mismatch of blob", id, checksum)
+			os.Remove(p)
+			os.Remove(p + rangesSuffix)
+			return ErrChecksumMismatch
+		}
+	}
+	dir := path.Dir(p)
+	if err := f.rename(p, path.Join(dir, f.getBlobName(id, checksum))); err != nil {
+		return err
+	}
+	return f.stored(id, checksum, dir, blobForm{})
+}
+
+// Reads the ranges of the sparse blob at p: its size, then the bitmap
+// of its chunks.
+func loadRanges(p string) (*sparseBlob, error) {
+	data, err := ioutil.ReadFile(p + rangesSuffix)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8 {
+		return nil, errors.New("blob: corrupted ranges of " + path.Base(p))
+	}
+	return &sparseBlob{size: int64(binary.BigEndian.Uint64(data)), chunks: data[8:]}, nil
+}
+
+func (f *Manager) saveRanges(p string, s *sparseBlob) error {
+	data := make([]byte, 8, 8+len(s.chunks))
+	binary.BigEndian.PutUint64(data, uint64(s.size))
+	return ioutil.WriteFile(p+rangesSuffix, append(data, s.chunks...), f.fileMode)
+}
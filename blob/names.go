@@ -0,0 +1,183 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	blobNameSeparator = "=="
+
+	// Created in the blob directory once the blobs are named with
+	// escaped ids.
+	namesVersionFile = ".names-v2"
+)
+
+// Escapes the characters of id that can't appear in a blob name: the
+// "=" of the separator, the path separator and the escape character
+// itself. Drive ids have none of them, they are kept as they are.
+func escapeId(id string) string {
+	if !strings.ContainsAny(id, "%=/") {
+		return id
+	}
+	var b strings.Builder
+	for i := 0; i < len(id); i++ {
+		switch ch := id[i]; ch {
+		case '%', '=', '/':
+			fmt.Fprintf(&b, "%%%02X", ch)
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
+
+// The reverse of escapeId.
+func unescapeId(escaped string) (string, bool) {
+	if !strings.Contains(escaped, "%") {
+		return escaped, true
+	}
+	var b strings.Builder
+	for i := 0; i < len(escaped); i++ {
+		if escaped[i] != '%' {
+			b.WriteByte(escaped[i])
+			continue
+		}
+		if i+2 >= len(escaped) {
+			return "", false
+		}
+		ch, err := strconv.ParseUint(escaped[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", false
+		}
+		b.WriteByte(byte(ch))
+		i += 2
+	}
+	return b.String(), true
+}
+
+// blobForm is how the content of a blob is stored, marked by the
+// suffixes of its name.
+type blobForm struct {
+	compressed bool
+	encrypted  bool
+}
+
+// All the forms, the ones blobs are looked up in.
+var blobForms = []blobForm{{}, {compressed: true}, {encrypted: true}, {compressed: true, encrypted: true}}
+
+func (b blobForm) suffix() string {
+	s := ""
+	if b.compressed {
+		s += compressedSuffix
+	}
+	if b.encrypted {
+		s += encryptedSuffix
+	}
+	return s
+}
+
+// Removes the suffixes of the form from a blob name.
+func trimFormSuffix(name string) (string, blobForm) {
+	var form blobForm
+	name, form.encrypted = strings.CutSuffix(name, encryptedSuffix)
+	name, form.compressed = strings.CutSuffix(name, compressedSuffix)
+	return name, form
+}
+
+// Splits a blob name into the id and the checksum of the blob, and the
+// form it is stored in. Returns false for the names that are not
+// blobs, e.g. temporary files, or are not named by getBlobName.
+func parseBlobName(name string) (id string, checksum string, form blobForm, ok bool) {
+	i := strings.Index(name, blobNameSeparator)
+	if i < 0 {
+		return "", "", form, false
+	}
+	checksum = name[i+len(blobNameSeparator):]
+	if strings.Contains(checksum, "=") || strings.Contains(checksum, ".tmp") || strings.Contains(checksum, sparseSuffix) || strings.HasSuffix(checksum, partialSuffix) {
+		return "", "", form, false
+	}
+	if id, ok = unescapeId(name[:i]); !ok || escapeId(id) != name[:i] {
+		return "", "", form, false
+	}
+	checksum, form = trimFormSuffix(checksum)
+	return id, checksum, form, true
+}
+
+// Renames the blobs named by older versions, with ids that were not
+// escaped, once. Such names are ambiguous if the id contains the
+// separator; the checksums never do, the last separator is taken.
+// Blobs named by getBlobName, e.g. saved since the start, are kept.
+func (f *Manager) migrateNames() error {
+	marker := path.Join(f.blobPath, namesVersionFile)
+	if _, err := os.Stat(marker); err == nil {
+		return nil
+	}
+	dirs, err := f.blobDirs()
+	if os.IsNotExist(err) {
+		// nothing stored yet
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err = f.migrateNamesIn(dir); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(marker, nil, f.fileMode)
+}
+
+func (f *Manager) migrateNamesIn(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if _, _, _, ok := parseBlobName(file.Name()); ok {
+			continue
+		}
+		i := strings.LastIndex(file.Name(), blobNameSeparator)
+		if file.IsDir() || i < 0 || strings.Contains(file.Name()[i:], ".tmp") || strings.Contains(file.Name()[i:], sparseSuffix) {
+			continue
+		}
+		id, checksum := file.Name()[:i], file.Name()[i+len(blobNameSeparator):]
+		to := dir
+		if dir != f.blobPath {
+			// the shard directory depends on the escaped id
+			to = f.getBlobDir(id)
+		}
+		oldPath := path.Join(dir, file.Name())
+		newPath := path.Join(to, f.getBlobName(id, checksum))
+		if newPath == oldPath {
+			continue
+		}
+		f.log.V("Renaming blob", oldPath, "to", newPath)
+		if err = os.MkdirAll(to, f.dirMode); err != nil {
+			return err
+		}
+		if err = f.rename(oldPath, newPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
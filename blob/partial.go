@@ -0,0 +1,179 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// Appended to the names of the blobs being saved by SaveFrom, after
+	// the suffix of the encrypted ones.
+	partialSuffix = ".partial"
+)
+
+var (
+	errPartialOffset = errors.New("blob: offset doesn't match the partially saved content")
+)
+
+// Returns the path of the partial blob of id with the checksum and its
+// size if there is one.
+func (f *Manager) findPartial(id string, checksum string) (string, int64, bool) {
+	for _, dir := range f.getBlobDirs(id) {
+		p := path.Join(dir, f.partialName(id, checksum))
+		if info, err := os.Stat(p); err == nil {
+			return p, info.Size(), true
+		}
+	}
+	return "", 0, false
+}
+
+// Returns the name of the partial blob, marked as encrypted if blobs
+// are encrypted. Partial blobs are never compressed.
+func (f *Manager) partialName(id string, checksum string) string {
+	form := blobForm{encrypted: f.opts.Key != nil}
+	return f.getBlobName(id, checksum) + form.suffix() + partialSuffix
+}
+
+// Returns the number of bytes of the content of the blob of id with
+// the checksum saved by an interrupted SaveFrom, which SaveFrom can
+// resume from. Zero if there are none.
+func (f *Manager) Partial(id string, checksum string) int64 {
+	if f.IsPassThrough() {
+		return 0
+	}
+	_, size, ok := f.findPartial(id, checksum)
+	if !ok || f.opts.Key == nil {
+		return size
+	}
+	// only the sealed chunks are kept, see resumeEncrypter
+	if size < int64(encryptedHeaderSize) {
+		return 0
+	}
+	return (size - int64(encryptedHeaderSize)) / (encryptedChunkSize + overheadGCM) * encryptedChunkSize
+}
+
+// Saves the blob like Save, the content read from rc following the
+// first offset bytes of it saved by an interrupted call. The offset is
+// either Partial(id, checksum) or zero to start over. If reading rc
+// fails, the content read so far is kept for the next call to resume
+// from. Partial blobs don't count into the size of the cache, they are
+// removed once the blob is saved or deleted, or saved with another
+// checksum.
+func (f *Manager) SaveFrom(id string, checksum string, offset int64, rc io.ReadCloser) error {
+	_, err := f.SaveFromMd5(id, checksum, offset, rc)
+	return err
+}
+
+// SaveFromMd5 is like SaveFrom, but also returns the md5 checksum of
+// the whole content saved, like SaveContextMd5. The content read from
+// rc is hashed while it is written; only the resumed partial content
+// is read back from the disk.
+func (f *Manager) SaveFromMd5(id string, checksum string, offset int64, rc io.ReadCloser) (string, error) {
+	if f.IsPassThrough() {
+		return "", nil
+	}
+	if offset != 0 && offset != f.Partial(id, checksum) {
+		return "", errPartialOffset
+	}
+	f.dropAhead(id)
+	f.cleanup(id, checksum)
+	if err := f.checkSpace(id, remaining(rc)); err != nil {
+		return "", err
+	}
+	p, _, ok := f.findPartial(id, checksum)
+	dir := path.Dir(p)
+	if !ok {
+		var err error
+		if dir, err = f.checkInodes(id); err != nil {
+			return "", err
+		}
+		if err = os.MkdirAll(dir, f.dirMode); err != nil {
+			return "", err
+		}
+		p = path.Join(dir, f.partialName(id, checksum))
+	}
+	// the partial blob of the other form, if the key was set or unset
+	// since, can't be resumed
+	os.Remove(path.Join(dir, f.getBlobName(id, checksum)+blobForm{encrypted: f.opts.Key == nil}.suffix()+partialSuffix))
+
+	file, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, f.fileMode)
+	if err != nil {
+		return "", err
+	}
+	hash := md5.New()
+	w, err := f.resumePartial(file, offset, hash)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	if err = f.copyBlob(file, w, io.TeeReader(rc, hash)); err == nil {
+		err = w.Close()
+	}
+	if err = spaceErr(err); err == ErrInsufficientSpace {
+		// the disk is full, nothing to resume
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	if err != nil {
+		f.log.V("saving blob", id, "interrupted, keeping the partial content")
+		file.Close()
+		return "", err
+	}
+	digest := hex.EncodeToString(hash.Sum(nil))
+	if isMd5(checksum) && !strings.EqualFold(digest, checksum) {
+		f.log.V("checksum mismatch of blob", id, checksum)
+		file.Close()
+		os.Remove(file.Name())
+		return "", ErrChecksumMismatch
+	}
+	if err = f.store(id, checksum, dir, file, blobForm{encrypted: f.opts.Key != nil}); err != nil {
+		return "", spaceErr(err)
+	}
+	return digest, nil
+}
+
+// Keeps the first offset bytes of the content of the partial blob in
+// file, written to hash, and returns a writer appending to them.
+func (f *Manager) resumePartial(file *os.File, offset int64, hash hash.Hash) (io.WriteCloser, error) {
+	if f.opts.Key != nil {
+		if offset == 0 {
+			if err := file.Truncate(0); err != nil {
+				return nil, err
+			}
+			return newEncrypter(file, f.opts.Key)
+		}
+		return resumeEncrypter(file, offset/encryptedChunkSize, f.opts.Key, hash)
+	}
+	if err := file.Truncate(offset); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(hash, io.NewSectionReader(file, 0, offset)); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return nopWriteCloser{file}, nil
+}
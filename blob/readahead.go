@@ -0,0 +1,112 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"time"
+)
+
+const (
+	// Reads at least this large that start where the previous read of
+	// the blob ended are taken as a sequential scan.
+	minSequentialRead = 64 << 10
+
+	// Number of read sizes past a sequential read the OS is advised
+	// to read ahead.
+	readAheadFactor = 8
+
+	// Number of blobs whose last reads are tracked.
+	maxTrackedReads = 1024
+
+	// Number of blobs read ahead into memory at the same time, see
+	// Options.ReadAheadBuffer.
+	maxAheadBuffers = 16
+
+	// Buffers read ahead are dropped once they are not read for this
+	// long.
+	aheadIdleTimeout = 10 * time.Second
+)
+
+// The content of a blob read ahead into memory.
+type aheadBuffer struct {
+	window
+	eof      bool // the window reaches the end of the blob
+	lastRead time.Time
+}
+
+// Records a read of l bytes of the blob of id at offset, returns true
+// if it starts where the previous read of the blob ended.
+func (f *Manager) recordRead(id string, offset int64, l int) bool {
+	f.muReads.Lock()
+	defer f.muReads.Unlock()
+	end, ok := f.readEnds[id]
+	if !ok && len(f.readEnds) >= maxTrackedReads {
+		// forget the reads of the files that are not read anymore
+		f.readEnds = make(map[string]int64)
+	}
+	f.readEnds[id] = offset + int64(l)
+	return ok && end == offset
+}
+
+// Serves the sequential read of l bytes of the blob of id at offset
+// from the buffer read ahead, if it holds the range. Reads that don't
+// continue the previous one drop the buffer.
+func (f *Manager) readBuffered(id string, checksum string, offset int64, l int, sequential bool) (blob []byte, size int64, ok bool) {
+	f.muReads.Lock()
+	defer f.muReads.Unlock()
+	now := time.Now()
+	for key, b := range f.ahead {
+		if now.Sub(b.lastRead) >= aheadIdleTimeout {
+			delete(f.ahead, key)
+		}
+	}
+	b, ok := f.ahead[id]
+	if !ok {
+		return nil, 0, false
+	}
+	end := b.offset + int64(len(b.data))
+	if !sequential || b.checksum != checksum || offset < b.offset || offset > end || (offset+int64(l) > end && !b.eof) {
+		delete(f.ahead, id)
+		return nil, 0, false
+	}
+	b.lastRead = now
+	blob = make([]byte, l)
+	return blob, int64(copy(blob, b.data[offset-b.offset:])), true
+}
+
+// Keeps data, read ahead from offset of the blob of id, in memory.
+func (f *Manager) keepAhead(id string, checksum string, offset int64, data []byte, eof bool) {
+	f.muReads.Lock()
+	defer f.muReads.Unlock()
+	if _, ok := f.ahead[id]; !ok && len(f.ahead) >= maxAheadBuffers {
+		// make room, dropping the least recently read buffer
+		var lru string
+		for key, b := range f.ahead {
+			if lru == "" || b.lastRead.Before(f.ahead[lru].lastRead) {
+				lru = key
+			}
+		}
+		delete(f.ahead, lru)
+	}
+	f.ahead[id] = &aheadBuffer{window: window{id: id, checksum: checksum, offset: offset, data: data}, eof: eof, lastRead: time.Now()}
+}
+
+// Drops the buffer read ahead of the blob of id, e.g. once the blob
+// is replaced or removed.
+func (f *Manager) dropAhead(id string) {
+	f.muReads.Lock()
+	defer f.muReads.Unlock()
+	delete(f.ahead, id)
+}
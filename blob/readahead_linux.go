@@ -0,0 +1,36 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build amd64 || arm64
+// +build amd64 arm64
+
+package blob
+
+import (
+	"os"
+	"syscall"
+)
+
+// POSIX_FADV_WILLNEED, see posix_fadvise(2).
+const fadvWillNeed = 3
+
+// Advises the OS to read the given range of the file into the page
+// cache in the background.
+func adviseWillNeed(file *os.File, offset int64, length int64) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, file.Fd(), uintptr(offset), uintptr(length), fadvWillNeed, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	DefaultShardLevels = 1
+	DefaultShardChars  = 2
+
+	// ShardLevels of the blobs stored without shard directories.
+	NoSharding = -1
+
+	// Created in the blob directory, holds the layout of the shard
+	// directories the blobs are stored in. Blob directories without it
+	// are in the default layout, the only one of older versions.
+	shardsFile = ".shards"
+
+	// Created in the blob directory, holds the directories of the blobs
+	// of the namespaces, see Options.Namespace. Named apart from the
+	// shard directories: escaped ids never hold "=", and the shards of
+	// the ids named by older versions are two characters long.
+	namespacesDir = "=namespaces"
+)
+
+// Returns the directory of the blobs of the namespace under the blob
+// directory.
+func namespaceDir(namespace string) string {
+	return path.Join(namespacesDir, escapeId(namespace))
+}
+
+// Returns the shard directory of the blobs of id. Ids too short to be
+// sharded are stored in the blob directory itself.
+func (f *Manager) getBlobDir(id string) string {
+	escaped := escapeId(id)
+	if f.shardLevels <= 0 || len(escaped) < f.shardLevels*f.shardChars {
+		return f.blobPath
+	}
+	dir := f.blobPath
+	for end := len(escaped); end > len(escaped)-f.shardLevels*f.shardChars; end -= f.shardChars {
+		shard := escaped[end-f.shardChars : end]
+		if strings.Trim(shard, ".") == "" {
+			// would name the shard or its parent
+			return f.blobPath
+		}
+		dir = path.Join(dir, shard)
+	}
+	return dir
+}
+
+// Removes the shard directories of id that are left without blobs.
+// Shards are shared by many ids, one still holding blobs is kept.
+func (f *Manager) removeShard(id string) {
+	for dir := f.getBlobDir(id); strings.HasPrefix(dir, f.blobPath+"/"); dir = path.Dir(dir) {
+		// fails unless the directory is empty
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// Returns the number of the shard directories of dir, one of the shard
+// directories or the blob directory, that don't exist yet.
+func (f *Manager) missingShards(dir string) int {
+	missing := 0
+	for ; strings.HasPrefix(dir, f.blobPath+"/"); dir = path.Dir(dir) {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			break
+		}
+		missing++
+	}
+	return missing
+}
+
+// Returns the blob directory and the shard directories under it, at
+// any depth, the parents first. The directories of the namespaces are
+// not, they hold the blobs of other managers, nor is the trash.
+func (f *Manager) blobDirs() ([]string, error) {
+	dirs := []string{f.blobPath}
+	for i := 0; i < len(dirs); i++ {
+		entries, err := ioutil.ReadDir(dirs[i])
+		if i > 0 && os.IsNotExist(err) {
+			// emptied and removed by a concurrent delete
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && !(i == 0 && (entry.Name() == namespacesDir || entry.Name() == trashDir)) {
+				dirs = append(dirs, path.Join(dirs[i], entry.Name()))
+			}
+		}
+	}
+	return dirs, nil
+}
+
+// Moves the blobs, the partial and the sparse blobs, into the shard directories
+// of the configured layout if they were stored in another one, e.g.
+// before the sharding options changed. The shard directories left
+// empty are removed. The layout is recorded in the blob directory.
+func (f *Manager) migrateShards() error {
+	layout := fmt.Sprintf("%dx%d", f.shardLevels, f.shardChars)
+	if f.shardLevels <= 0 {
+		layout = "none"
+	}
+	marker := path.Join(f.blobPath, shardsFile)
+	prev, err := ioutil.ReadFile(marker)
+	if os.IsNotExist(err) {
+		prev, err = []byte(fmt.Sprintf("%dx%d", DefaultShardLevels, DefaultShardChars)), nil
+	}
+	if err != nil {
+		return err
+	}
+	if string(prev) != layout {
+		f.log.V("Moving blobs from the shard layout", string(prev), "to", layout)
+		if err = f.moveShards(); err != nil {
+			return err
+		}
+	}
+	if err = os.MkdirAll(f.blobPath, f.dirMode); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(marker, []byte(layout), f.fileMode)
+}
+
+func (f *Manager) moveShards() error {
+	dirs, err := f.blobDirs()
+	if os.IsNotExist(err) {
+		// nothing stored yet
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			name, _ := trimSparseSuffix(file.Name())
+			id, _, _, ok := parseBlobName(strings.TrimSuffix(name, partialSuffix))
+			if file.IsDir() || !ok {
+				continue
+			}
+			to := f.getBlobDir(id)
+			if to == dir {
+				continue
+			}
+			if err = os.MkdirAll(to, f.dirMode); err != nil {
+				return err
+			}
+			if err = f.rename(path.Join(dir, file.Name()), path.Join(to, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	// the deepest shards first, so that their parents are emptied
+	for i := len(dirs) - 1; i > 0; i-- {
+		os.Remove(dirs[i])
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+// Creates the staging directory and the blob directory if they don't
+// exist yet, and checks whether they are on the same device, see
+// Options.StagingPath. The blobs staged on another device are copied
+// into place instead of renamed.
+func (f *Manager) checkStaging() error {
+	if f.opts.StagingPath == "" {
+		return nil
+	}
+	for _, dir := range []string{f.opts.StagingPath, f.blobPath} {
+		if err := os.MkdirAll(dir, f.dirMode); err != nil {
+			return err
+		}
+	}
+	staging, err := os.Stat(f.opts.StagingPath)
+	if err != nil {
+		return err
+	}
+	blobs, err := os.Stat(f.blobPath)
+	if err != nil {
+		return err
+	}
+	if fileKeyOf(staging).dev != fileKeyOf(blobs).dev {
+		f.log.V("warning: the staging directory", f.opts.StagingPath, "is not on the device of the blobs, they are copied into place, not renamed")
+		f.crossDevice = true
+	}
+	return nil
+}
+
+// Creates a temporary file in the staging directory, named after
+// pattern like ioutil.TempFile.
+func (f *Manager) stagingFile(pattern string) (*os.File, error) {
+	file, err := ioutil.TempFile(f.opts.StagingPath, pattern)
+	if os.IsNotExist(err) {
+		if err = os.MkdirAll(f.opts.StagingPath, f.dirMode); err == nil {
+			file, err = ioutil.TempFile(f.opts.StagingPath, pattern)
+		}
+	}
+	return file, err
+}
+
+// Moves the temporary file at from into place at to. A file staged on
+// another device than the blobs can't be renamed there: it is copied
+// next to the blob first, synced as Options.Sync tells, then renamed
+// over the blob. The temporary file is removed.
+func (f *Manager) moveStaged(from string, to string) error {
+	if !f.crossDevice {
+		err := f.rename(from, to)
+		if f.opts.StagingPath == "" || !errors.Is(err, syscall.EXDEV) {
+			return err
+		}
+		f.log.V("can't rename the staged blob", from, err)
+	}
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	tmp := to + ".tmp-staged"
+	os.Remove(tmp)
+	err = f.copyStored(src, tmp)
+	src.Close()
+	if err == nil {
+		err = f.rename(tmp, to)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	os.Remove(from)
+	return nil
+}
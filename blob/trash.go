@@ -0,0 +1,133 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+const (
+	// Created in the blob directory, holds the trashed blobs, see
+	// Trash. Named apart from the shard directories like namespacesDir.
+	trashDir = "=trash"
+)
+
+// Moves the blobs of id into the trash, e.g. of a file deleted on
+// Drive that may be restored, see Untrash. Trashed blobs are not read,
+// nor indexed, evicted or cleared, and don't count into the size of the
+// cache; they are kept until DeleteTrashed. The partial and sparse
+// blobs of id are deleted.
+func (f *Manager) Trash(id string) error {
+	if f.IsPassThrough() {
+		return f.Delete(id)
+	}
+	f.dropAhead(id)
+	dir := path.Join(f.blobPath, trashDir)
+	for _, p := range f.storedBlobs(id) {
+		if err := os.MkdirAll(dir, f.dirMode); err != nil {
+			return err
+		}
+		if err := f.rename(p, path.Join(dir, path.Base(p))); err != nil {
+			return err
+		}
+		f.log.V("Trashed blob", path.Base(p))
+		f.index.remove(id, p)
+	}
+	return f.Delete(id)
+}
+
+// Returns the paths of the blobs of id stored on disk, of any checksum.
+func (f *Manager) storedBlobs(id string) []string {
+	paths := []string{}
+	for _, dir := range f.getBlobDirs(id) {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if blobId, _, _, ok := parseBlobName(file.Name()); ok && blobId == id && !file.IsDir() {
+				paths = append(paths, path.Join(dir, file.Name()))
+			}
+		}
+	}
+	return paths
+}
+
+// Restores the trashed blob of id with the checksum as the blob of
+// toId, e.g. id itself once the file is restored on Drive, replacing
+// the other blobs of toId as Save does. The other trashed blobs of id
+// are deleted. Returns false if there is no such trashed blob.
+func (f *Manager) Untrash(id string, toId string, checksum string) (bool, error) {
+	if f.IsPassThrough() {
+		return false, nil
+	}
+	files, err := ioutil.ReadDir(path.Join(f.blobPath, trashDir))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, file := range files {
+		blobId, blobChecksum, form, ok := parseBlobName(file.Name())
+		if !ok || blobId != id || blobChecksum != checksum {
+			continue
+		}
+		f.dropAhead(toId)
+		f.cleanup(toId, checksum)
+		dir, err := f.checkInodes(toId)
+		if err != nil {
+			return false, err
+		}
+		if err = os.MkdirAll(dir, f.dirMode); err != nil {
+			return false, err
+		}
+		from := path.Join(f.blobPath, trashDir, file.Name())
+		if err = f.rename(from, path.Join(dir, f.getBlobName(toId, checksum)+form.suffix())); err != nil {
+			return false, err
+		}
+		f.log.V("Restored blob", file.Name(), "as", toId)
+		if err = f.stored(toId, checksum, dir, form); err != nil {
+			return true, err
+		}
+		return true, f.DeleteTrashed(id)
+	}
+	return false, nil
+}
+
+// Deletes the trashed blobs of id, see Trash.
+func (f *Manager) DeleteTrashed(id string) error {
+	if f.IsPassThrough() {
+		return nil
+	}
+	dir := path.Join(f.blobPath, trashDir)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if blobId, _, _, ok := parseBlobName(file.Name()); ok && blobId == id {
+			if err = os.Remove(path.Join(dir, file.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
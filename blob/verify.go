@@ -0,0 +1,66 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+)
+
+// Computes the md5 checksum of the content of the blob of the entry,
+// decompressed and decrypted if so, and compares it to the checksum the
+// blob is named after. Returns ErrChecksumMismatch if they differ, and
+// the error of the read if the content can't be read, e.g. it is
+// truncated. Blobs of other checksums than md5 ones, such as the dirty
+// blobs and the ones of the native docs, can't be verified.
+func (f *Manager) Verify(e *Entry) error {
+	if !isMd5(e.Checksum) {
+		return nil
+	}
+	content, err := f.OpenEntry(*e)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	hash := md5.New()
+	if _, err = io.Copy(hash, content); err != nil {
+		return err
+	}
+	if !strings.EqualFold(hex.EncodeToString(hash.Sum(nil)), e.Checksum) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// Removes the blob of the entry, e.g. one that failed to verify, unless
+// the blob of id was replaced since the entry was listed.
+func (f *Manager) Remove(e *Entry) error {
+	info, err := os.Stat(e.Path)
+	if err != nil || fileKeyOf(info) != e.file {
+		return err
+	}
+	f.log.V("Removing blob", e.Id, e.Checksum, e.Size, "bytes")
+	if err = os.Remove(e.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f.index.remove(e.Id, e.Path)
+	f.dropAhead(e.Id)
+	f.removeShard(e.Id)
+	f.checkWatermarks()
+	return nil
+}
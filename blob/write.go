@@ -0,0 +1,175 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	// Checksum of the blobs written locally, their content doesn't
+	// match the checksum of the file on Drive anymore.
+	dirtyChecksum = "dirty"
+)
+
+var (
+	ErrReadOnly = errors.New("blob: blobs can't be written in pass-through mode")
+
+	errNegativeOffset = errors.New("blob: negative offset")
+)
+
+// Writes p into the content of the blob of id with the checksum at off,
+// extending the content if off is past its end; the gap reads as
+// zeros. The first write copies the content into a dirty blob of id,
+// which the following writes and the reads of id use instead, whatever
+// their checksum, until the next Save of id replaces it, e.g. once the
+// file is pushed with the checksum Drive computes for its content.
+// Dirty blobs are never compressed nor evicted. Unencrypted dirty blobs
+// are written in place, encrypted ones are encrypted again on each
+// write. A blob that is not stored is empty if the checksum is empty,
+// as the one of a new local file, a cache miss otherwise.
+func (f *Manager) WriteAt(id string, checksum string, off int64, p []byte) error {
+	if f.IsPassThrough() {
+		return ErrReadOnly
+	}
+	if off < 0 {
+		return errNegativeOffset
+	}
+	f.muWrites.Lock()
+	defer f.muWrites.Unlock()
+	f.dropAhead(id)
+	e, ok := f.index.get(id)
+	if ok && e.IsDirty() && !e.Encrypted && f.opts.Key == nil {
+		return f.writeInPlace(e, off, p)
+	}
+	if ok && e.IsDirty() {
+		checksum = dirtyChecksum
+	}
+	return f.rewrite(id, checksum, off, p)
+}
+
+// Writes p into the unencrypted dirty blob of the entry at off.
+func (f *Manager) writeInPlace(e Entry, off int64, p []byte) error {
+	file, err := os.OpenFile(e.Path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err = file.WriteAt(p, off); err == nil && f.opts.Sync != SyncNone {
+		err = f.fsync(file)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if info, statErr := os.Stat(e.Path); statErr == nil {
+		e.Size, e.LastAccess = info.Size(), time.Now()
+		f.index.add(&e)
+		f.evict(e.Id)
+		f.checkWatermarks()
+	}
+	return nil
+}
+
+// Stores the content of the blob of id with the checksum, with p
+// written at off, as the dirty blob of id.
+func (f *Manager) rewrite(id string, checksum string, off int64, p []byte) error {
+	var content io.Reader = bytes.NewReader(nil)
+	file, form, err := f.openBlob(id, checksum)
+	if os.IsNotExist(err) && checksum != "" && f.IsLazy() {
+		// a sparse blob is fetched whole first, see SaveLazy
+		if ok, fetchErr := f.fetchSparse(id, checksum); ok && fetchErr != nil {
+			return fetchErr
+		} else if ok {
+			file, form, err = f.openBlob(id, checksum)
+		}
+	}
+	switch {
+	case err == nil:
+		defer file.Close()
+		if content, err = f.openContent(file, form); err != nil {
+			return err
+		}
+	case os.IsNotExist(err) && checksum == "":
+		// nothing is written yet
+	case os.IsNotExist(err):
+		return ErrCacheMiss
+	default:
+		return err
+	}
+	// the blob of the checksum is not the content of id anymore, it is
+	// read from the open file
+	f.cleanup(id, dirtyChecksum)
+
+	dir, tmp, err := f.tempBlob(id, dirtyChecksum)
+	if err != nil {
+		return err
+	}
+	form = blobForm{encrypted: f.opts.Key != nil}
+	var w io.WriteCloser = nopWriteCloser{tmp}
+	if form.encrypted {
+		w, err = newEncrypter(tmp, f.opts.Key)
+	}
+	if err == nil {
+		err = splice(w, content, off, p)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	return f.store(id, dirtyChecksum, dir, tmp, form)
+}
+
+// Writes the content read from r to w, with p written at off over it.
+// The content is padded with zeros up to off if it ends before.
+func splice(w io.Writer, r io.Reader, off int64, p []byte) error {
+	n, err := io.CopyN(w, r, off)
+	if err == io.EOF {
+		err = writeZeros(w, off-n)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(p); err != nil {
+		return err
+	}
+	// the rest of the content, after the written range
+	if _, err = io.CopyN(io.Discard, r, int64(len(p))); err != nil && err != io.EOF {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func writeZeros(w io.Writer, n int64) error {
+	zeros := make([]byte, min(n, 32<<10))
+	for n > 0 {
+		k := min(n, int64(len(zeros)))
+		if _, err := w.Write(zeros[:k]); err != nil {
+			return err
+		}
+		n -= k
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cachefs
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// Tar streams the named file or folder, and everything under it, as a
+// tar archive. Entries are named relative to the folder containing the
+// named file, so archiving "docs" yields "docs/", "docs/notes.txt" and
+// so on. Contents that are not cached yet are fetched as they are
+// archived, one file at a time. Closing the reader stops the archival.
+func (f *FS) Tar(name string) io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(f.WriteTar(w, name))
+	}()
+	return r
+}
+
+// WriteTar writes the tar archive of the named file or folder to w,
+// see Tar.
+func (f *FS) WriteTar(w io.Writer, name string) error {
+	tw := tar.NewWriter(w)
+	prefix := ""
+	if dir := path.Dir(name); dir != "." {
+		prefix = dir + "/"
+	}
+	err := fs.WalkDir(f, name, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == "." {
+			// the root folder itself has no entry
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = strings.TrimPrefix(p, prefix)
+		if entry.IsDir() {
+			hdr.Name += "/"
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		return f.copyTo(tw, p)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Copies the contents of the named file to w, without holding all of
+// it in memory.
+func (f *FS) copyTo(w io.Writer, name string) error {
+	file, err := f.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
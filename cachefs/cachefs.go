@@ -0,0 +1,279 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cachefs exposes the cached Drive tree as an io/fs file
+// system, so that it can be used without mounting it.
+package cachefs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/rakyll/drivefuse/blob"
+	"github.com/rakyll/drivefuse/metadata"
+)
+
+// Fetcher downloads the contents of the file at the given slash
+// separated path, relative to the root folder. Implemented by
+// fileio.Downloader.
+type Fetcher interface {
+	Prefetch(p string) error
+}
+
+// FS is a read-only fs.FS backed by the cached metadata and blobs.
+// Contents that are not cached yet are fetched when the file is
+// opened.
+type FS struct {
+	metaService *metadata.MetaService
+	blobManager *blob.Manager
+	fetcher     Fetcher
+}
+
+// Creates a new FS. If fetcher is nil, only the cached contents can
+// be read.
+func New(metaService *metadata.MetaService, blobManager *blob.Manager, fetcher Fetcher) *FS {
+	return &FS{metaService: metaService, blobManager: blobManager, fetcher: fetcher}
+}
+
+// Opens the named file or folder.
+func (f *FS) Open(name string) (fs.File, error) {
+	file, err := f.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if file.IsFolder() {
+		return &folder{fsys: f, info: newFileInfo(name, file)}, nil
+	}
+	if !f.isCached(file) && f.fetcher != nil {
+		if err = f.fetcher.Prefetch(name); err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+	return &blobFile{fsys: f, info: newFileInfo(name, file)}, nil
+}
+
+// Returns the file info of the named file or folder.
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	file, err := f.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return newFileInfo(name, file), nil
+}
+
+// Lists the named folder, sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	file, err := f.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !file.IsFolder() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return f.readDir(name, file.Id)
+}
+
+func (f *FS) readDir(name string, id string) ([]fs.DirEntry, error) {
+	children, err := f.metaService.GetAllChildren(id)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, child := range children {
+		entries = append(entries, fs.FileInfoToDirEntry(newFileInfo(child.Name, child)))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+// Resolves the named file, returns a *fs.PathError for op if it
+// is invalid or doesn't exist.
+func (f *FS) resolve(op string, name string) (*metadata.CachedDriveFile, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	p := name
+	if p == "." {
+		p = ""
+	}
+	file, err := f.metaService.Resolve(p)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return file, nil
+}
+
+// Returns true if the contents of the file are cached.
+func (f *FS) isCached(file *metadata.CachedDriveFile) bool {
+	if f.blobManager.IsPassThrough() {
+		// read from Drive on demand
+		return true
+	}
+	_, _, err := f.blobManager.Read(file.Id, file.ActiveChecksum(), 0, 0)
+	return err == nil
+}
+
+// fileInfo describes a cached file or folder.
+type fileInfo struct {
+	name string
+	file *metadata.CachedDriveFile
+}
+
+func newFileInfo(name string, file *metadata.CachedDriveFile) *fileInfo {
+	return &fileInfo{name: path.Base(name), file: file}
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.file.FileSize }
+func (i *fileInfo) ModTime() time.Time { return i.file.LastMod }
+func (i *fileInfo) IsDir() bool        { return i.file.IsFolder() }
+func (i *fileInfo) Sys() interface{}   { return i.file }
+
+func (i *fileInfo) Mode() fs.FileMode {
+	if i.IsDir() {
+		return fs.ModeDir | 0500
+	}
+	return 0400
+}
+
+// blobFile is an opened file, reading from its blob.
+type blobFile struct {
+	fsys   *FS
+	info   *fileInfo
+	offset int64
+	closed bool
+}
+
+func (b *blobFile) Stat() (fs.FileInfo, error) {
+	return b.info, nil
+}
+
+func (b *blobFile) Read(p []byte) (n int, err error) {
+	n, err = b.ReadAt(p, b.offset)
+	b.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return
+}
+
+func (b *blobFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if b.closed {
+		return 0, &fs.PathError{Op: "read", Path: b.info.name, Err: fs.ErrClosed}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: b.info.name, Err: fs.ErrInvalid}
+	}
+	for n < len(p) && off+int64(n) < b.info.Size() {
+		want := len(p) - n
+		if rest := b.info.Size() - off - int64(n); rest < int64(want) {
+			want = int(rest)
+		}
+		data, size, readErr := b.fsys.blobManager.Read(b.info.file.Id, b.info.file.ActiveChecksum(), off+int64(n), want)
+		n += copy(p[n:], data[:size])
+		if readErr == io.EOF || size == 0 {
+			break
+		}
+		if readErr != nil {
+			return n, &fs.PathError{Op: "read", Path: b.info.name, Err: readErr}
+		}
+	}
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+func (b *blobFile) Seek(offset int64, whence int) (int64, error) {
+	if b.closed {
+		return 0, &fs.PathError{Op: "seek", Path: b.info.name, Err: fs.ErrClosed}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.info.Size()
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: b.info.name, Err: fs.ErrInvalid}
+	}
+	b.offset = offset
+	return offset, nil
+}
+
+func (b *blobFile) Close() error {
+	if b.closed {
+		return &fs.PathError{Op: "close", Path: b.info.name, Err: fs.ErrClosed}
+	}
+	b.closed = true
+	return nil
+}
+
+// folder is an opened folder. Its entries are listed on the first
+// ReadDir call.
+type folder struct {
+	fsys    *FS
+	info    *fileInfo
+	entries []fs.DirEntry
+	offset  int
+	listed  bool
+}
+
+func (d *folder) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *folder) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+func (d *folder) ReadDir(count int) ([]fs.DirEntry, error) {
+	if !d.listed {
+		entries, err := d.fsys.readDir(d.info.name, d.info.file.Id)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.listed = entries, true
+	}
+	rest := d.entries[d.offset:]
+	if count <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(rest) {
+		count = len(rest)
+	}
+	d.offset += count
+	return rest[:count], nil
+}
+
+func (d *folder) Close() error {
+	return nil
+}
+
+var (
+	_ fs.ReadDirFS = (*FS)(nil)
+	_ fs.StatFS    = (*FS)(nil)
+	_ io.Seeker    = (*blobFile)(nil)
+	_ io.ReaderAt  = (*blobFile)(nil)
+)
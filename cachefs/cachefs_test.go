@@ -0,0 +1,216 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Contains tests for cachefs package.
+package cachefs
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/rakyll/drivefuse/blob"
+	"github.com/rakyll/drivefuse/metadata"
+	T "github.com/rakyll/drivefuse/third_party/launchpad.net/gocheck"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	T.TestingT(t)
+}
+
+// fakeFetcher records the files it is asked to fetch.
+type fakeFetcher struct {
+	fetched []string
+}
+
+func (f *fakeFetcher) Prefetch(p string) error {
+	f.fetched = append(f.fetched, p)
+	return nil
+}
+
+type CachefsSuite struct {
+	dir         string
+	metaService *metadata.MetaService
+	contents    map[string]string
+}
+
+var _ = T.Suite(&CachefsSuite{})
+
+func (s *CachefsSuite) SetUpTest(c *T.C) {
+	s.dir = c.MkDir()
+	var err error
+	s.metaService, err = metadata.New(filepath.Join(s.dir, "meta.sql"), nil)
+	c.Assert(err, T.IsNil)
+	s.contents = make(map[string]string)
+
+	s.save(c, metadata.IdRootFolder, "", "", "")
+	s.save(c, "docs-folder", metadata.IdRootFolder, "docs", "")
+	s.save(c, "notes-file", "docs-folder", "notes.txt", "some notes")
+	s.save(c, "empty-folder", "docs-folder", "empty", "")
+	s.save(c, "readme-file", metadata.IdRootFolder, "README", strings.Repeat("readme ", 1000))
+}
+
+func (s *CachefsSuite) TearDownTest(c *T.C) {
+	s.metaService.Close()
+}
+
+// Saves a folder, or a file with the given content if it isn't empty.
+func (s *CachefsSuite) save(c *T.C, id string, parentId string, name string, content string) {
+	file := &metadata.CachedDriveFile{Id: id, ParentId: parentId, Name: name, Md5Checksum: "md5" + id}
+	if content == "" {
+		file.MimeType = metadata.MimeTypeFolder
+	} else {
+		file.MimeType = "text/plain"
+		file.FileSize = int64(len(content))
+		s.contents[id] = content
+	}
+	c.Assert(s.metaService.Save(parentId, id, file, false, false), T.IsNil)
+}
+
+// Returns a blob manager serving the seeded contents.
+func (s *CachefsSuite) passThrough() *blob.Manager {
+	fetch := func(id string, offset int64, length int) ([]byte, error) {
+		content := s.contents[id]
+		if offset >= int64(len(content)) {
+			return []byte{}, nil
+		}
+		end := offset + int64(length)
+		if end > int64(len(content)) {
+			end = int64(len(content))
+		}
+		return []byte(content[offset:end]), nil
+	}
+	return blob.New(filepath.Join(s.dir, "blob"), &blob.Options{PassThrough: fetch, PassThroughBufferSize: 512})
+}
+
+func (s *CachefsSuite) TestFS(c *T.C) {
+	fsys := New(s.metaService, s.passThrough(), nil)
+	if err := fstest.TestFS(fsys, "docs", "docs/notes.txt", "docs/empty", "README"); err != nil {
+		c.Fatal(err)
+	}
+	data, err := fs.ReadFile(fsys, "README")
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data), T.Equals, s.contents["readme-file"])
+}
+
+func (s *CachefsSuite) TestFSWithStoredBlobs(c *T.C) {
+	blobMngr := blob.New(filepath.Join(s.dir, "blob"), nil)
+	for id, content := range s.contents {
+		c.Assert(blobMngr.Save(id, "md5"+id, ioutil.NopCloser(strings.NewReader(content))), T.IsNil)
+	}
+	fsys := New(s.metaService, blobMngr, nil)
+	if err := fstest.TestFS(fsys, "docs", "docs/notes.txt", "docs/empty", "README"); err != nil {
+		c.Fatal(err)
+	}
+	data, err := fs.ReadFile(fsys, "README")
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data), T.Equals, s.contents["readme-file"])
+}
+
+func (s *CachefsSuite) TestOpenFetchesUncached(c *T.C) {
+	fetcher := &fakeFetcher{}
+	fsys := New(s.metaService, blob.New(filepath.Join(s.dir, "blob"), nil), fetcher)
+	_, err := fs.Stat(fsys, "docs/notes.txt")
+	c.Assert(err, T.IsNil)
+	_, err = fs.ReadDir(fsys, "docs")
+	c.Assert(err, T.IsNil)
+	c.Assert(fetcher.fetched, T.HasLen, 0)
+
+	f, err := fsys.Open("docs/notes.txt")
+	c.Assert(err, T.IsNil)
+	c.Assert(f.Close(), T.IsNil)
+	c.Assert(fetcher.fetched, T.DeepEquals, []string{"docs/notes.txt"})
+}
+
+func (s *CachefsSuite) TestOpenMissing(c *T.C) {
+	fsys := New(s.metaService, s.passThrough(), nil)
+	_, err := fsys.Open("docs/missing")
+	c.Assert(err, T.FitsTypeOf, &fs.PathError{})
+	c.Assert(err.(*fs.PathError).Err, T.Equals, fs.ErrNotExist)
+
+	_, err = fsys.Open("/README")
+	c.Assert(err.(*fs.PathError).Err, T.Equals, fs.ErrInvalid)
+}
+
+// storingFetcher caches the contents of the files it is asked to fetch.
+type storingFetcher struct {
+	s        *CachefsSuite
+	blobMngr *blob.Manager
+	fetched  []string
+}
+
+func (f *storingFetcher) Prefetch(p string) error {
+	f.fetched = append(f.fetched, p)
+	file, err := f.s.metaService.Resolve(p)
+	if err != nil {
+		return err
+	}
+	return f.blobMngr.Save(file.Id, file.Md5Checksum, ioutil.NopCloser(strings.NewReader(f.s.contents[file.Id])))
+}
+
+// Returns the names and contents of the entries of a tar archive.
+func readTar(c *T.C, r io.Reader) (names []string, contents map[string]string) {
+	contents = make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return
+		}
+		c.Assert(err, T.IsNil)
+		data, err := ioutil.ReadAll(tr)
+		c.Assert(err, T.IsNil)
+		c.Assert(int64(len(data)), T.Equals, hdr.Size)
+		names = append(names, hdr.Name)
+		contents[hdr.Name] = string(data)
+	}
+}
+
+func (s *CachefsSuite) TestTar(c *T.C) {
+	fsys := New(s.metaService, s.passThrough(), nil)
+	archive := fsys.Tar(".")
+	defer archive.Close()
+	names, contents := readTar(c, archive)
+	c.Assert(names, T.DeepEquals, []string{"README", "docs/", "docs/empty/", "docs/notes.txt"})
+	c.Assert(contents["README"], T.Equals, s.contents["readme-file"])
+	c.Assert(contents["docs/notes.txt"], T.Equals, "some notes")
+}
+
+func (s *CachefsSuite) TestTarOfSubtreeFetchesUncached(c *T.C) {
+	s.save(c, "drafts-folder", "docs-folder", "drafts", "")
+	s.save(c, "draft-file", "drafts-folder", "draft.txt", "a draft")
+	blobMngr := blob.New(filepath.Join(s.dir, "blob"), nil)
+	c.Assert(blobMngr.Save("notes-file", "md5notes-file", ioutil.NopCloser(strings.NewReader("some notes"))), T.IsNil)
+	fetcher := &storingFetcher{s: s, blobMngr: blobMngr}
+	fsys := New(s.metaService, blobMngr, fetcher)
+
+	archive := fsys.Tar("docs/drafts")
+	defer archive.Close()
+	names, contents := readTar(c, archive)
+	c.Assert(names, T.DeepEquals, []string{"drafts/", "drafts/draft.txt"})
+	c.Assert(contents["drafts/draft.txt"], T.Equals, "a draft")
+	c.Assert(fetcher.fetched, T.DeepEquals, []string{"docs/drafts/draft.txt"})
+
+	// errors end the archive
+	archive = fsys.Tar("docs/missing")
+	defer archive.Close()
+	_, err := ioutil.ReadAll(archive)
+	c.Assert(err, T.FitsTypeOf, &fs.PathError{})
+}
@@ -22,7 +22,6 @@ import (
 	"github.com/rakyll/drivefuse/auth"
 	"github.com/rakyll/drivefuse/config"
 	"github.com/rakyll/drivefuse/logger"
-	"github.com/rakyll/drivefuse/third_party/code.google.com/p/goauth2/oauth"
 	"github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
 )
 
@@ -88,7 +87,7 @@ func readQuestion(opt *question) string {
 	return s
 }
 
-func listFolders(tr *oauth.Transport) {
+func listFolders(tr *auth.Transport) {
 	svc, err := drive.New(tr.Client())
 	if err != nil {
 		logger.F(err)
@@ -0,0 +1,65 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/rakyll/drivefuse/logger"
+	"github.com/rakyll/drivefuse/syncer"
+)
+
+// Runs a sync of s, which is set up for dry runs, and prints what it
+// would change, see syncer.SyncOptions.DryRun. Returns false if the
+// sync fails.
+func RunDryRun(s *syncer.CachedSyncer) bool {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range s.Events() {
+			switch e.Kind {
+			case syncer.FileSynced:
+				fmt.Println("sync", e.Id, e.Name, e.Bytes)
+			case syncer.FileDeleted:
+				fmt.Println("delete", e.Id, e.Name)
+			case syncer.QuotaWarning:
+				fmt.Printf("Drive holds %d bytes, more than the cache cap of %d bytes\n", e.Bytes, e.Total)
+			case syncer.SyncFinished:
+				return
+			}
+		}
+	}()
+	result, err := s.Sync(false)
+	if err != syncer.ErrOffline && err != syncer.ErrSyncInProgress {
+		// the sync ran, the events are printed up to its end
+		<-done
+	}
+	for _, err := range result.Errors {
+		fmt.Println("error", err)
+	}
+	if err != nil {
+		logger.V("error during dry run", err)
+		return false
+	}
+	fmt.Println(Bold(fmt.Sprintf("%d files would be added, %d updated and %d deleted, %d bytes downloaded",
+		result.FilesAdded, result.FilesUpdated, result.FilesDeleted, result.BytesQueued)))
+	if result.FilesSkipped > 0 {
+		fmt.Printf("%d files of %d bytes would not be cached, they are too large\n", result.FilesSkipped, result.BytesSkipped)
+	}
+	if len(result.Conflicts) > 0 {
+		fmt.Printf("%d files are edited both locally and on Drive\n", len(result.Conflicts))
+	}
+	return true
+}
@@ -0,0 +1,44 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/rakyll/drivefuse/logger"
+	"github.com/rakyll/drivefuse/syncer"
+)
+
+// Writes the manifest of the cached tree to the file at p, or to the
+// standard output if p is "-", see syncer.CachedSyncer.ExportManifest.
+func RunManifest(s *syncer.CachedSyncer, p string) {
+	if p == "-" {
+		if err := s.ExportManifest(os.Stdout); err != nil {
+			logger.F("Error writing the manifest.", err)
+		}
+		return
+	}
+	file, err := os.Create(p)
+	if err != nil {
+		logger.F("Error creating the manifest.", err)
+	}
+	err = s.ExportManifest(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		logger.F("Error writing the manifest.", err)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/rakyll/drivefuse/blob"
+	"github.com/rakyll/drivefuse/logger"
+	"github.com/rakyll/drivefuse/syncer"
+)
+
+// Verifies the cache and prints what is wrong with it, repairing it if
+// repair is set, see syncer.CachedSyncer.Verify. Returns true if nothing
+// is wrong.
+func RunVerify(s *syncer.CachedSyncer, repair bool) bool {
+	report, err := s.Verify(repair)
+	if err != nil {
+		logger.F(err)
+	}
+	printEntries := func(title string, entries []blob.Entry) {
+		for _, e := range entries {
+			fmt.Println(title, e.Id, e.Path)
+		}
+	}
+	printEntries("corrupt", report.Corrupt)
+	printEntries("orphan", report.Orphans)
+	printEntries("stale", report.Stale)
+	for _, id := range report.Missing {
+		fmt.Println("missing", id)
+	}
+	fmt.Println(Bold(fmt.Sprintf("%d blobs verified: %d corrupt, %d orphans, %d stale, %d missing, %d skipped as verified recently",
+		report.Blobs, len(report.Corrupt), len(report.Orphans), len(report.Stale), len(report.Missing), report.Skipped)))
+	if repair && !report.OK() {
+		fmt.Println("Removed the bad blobs, the files are downloaded again on the next mount.")
+	}
+	return report.OK()
+}
@@ -75,6 +75,10 @@ type Account struct {
 
 	// OAuth 2.0 refresh token.
 	RefreshToken string `json:"refresh_token"`
+
+	// Paths relative to LocalPath, whose contents are downloaded in
+	// the background on startup.
+	WarmPaths []string `json:"warm_paths,omitempty"`
 }
 
 // Validate tests whether all required fields are present.
@@ -92,6 +96,10 @@ type Config struct {
 	// Base data directory
 	DataDir string `json:"-"` // Omits from json marshal/unmarshal.
 
+	// Blob directory, e.g. on a faster or larger disk. Defaults to
+	// a directory in the data directory.
+	BlobDir string `json:"blob_dir,omitempty"`
+
 	// Accounts are the configured accounts.
 	Accounts []*Account `json:"accounts"`
 }
@@ -190,8 +198,12 @@ func (c *Config) ConfigPath() string {
 	return c.DataPath(configName)
 }
 
-// BlobPath is the path to the blob directory in the data directory.
+// BlobPath is the path to the blob directory, in the data directory
+// unless BlobDir is set.
 func (c *Config) BlobPath() string {
+	if c.BlobDir != "" {
+		return c.BlobDir
+	}
 	return c.DataPath(blobName)
 }
 
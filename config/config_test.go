@@ -102,6 +102,14 @@ func (s *ConfigSuite) TestConfigSetup(c *T.C) {
 	c.Assert(filepath.Join(s.dataDir, blobName), fileExists)
 }
 
+func (s *ConfigSuite) TestConfigSetupBlobDir(c *T.C) {
+	cfg := NewConfig(s.dataDir)
+	cfg.BlobDir = filepath.Join(c.MkDir(), "blobs")
+	cfg.Setup()
+	c.Assert(cfg.BlobPath(), T.Equals, cfg.BlobDir)
+	c.Assert(cfg.BlobDir, fileExists)
+}
+
 func (s *ConfigSuite) TestConfigPath(c *T.C) {
 	cfg := NewConfig(s.dataDir)
 	c.Assert(filepath.Join(s.dataDir, configName), T.Equals, cfg.ConfigPath())
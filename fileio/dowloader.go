@@ -15,8 +15,16 @@
 package fileio
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -26,11 +34,15 @@ import (
 )
 
 const (
-	intervalTick                           = 5 * time.Second // TODO(burcud): need to be adaptive
-	maxNumberOfConcurrentDownloadsPerQueue = 5
-	maxSizeQueueTreshold                   = 1 << 20 // TODO(burcud): need to be adaptive
+	intervalTick         = 5 * time.Second // TODO(burcud): need to be adaptive
+	maxSizeQueueTreshold = 1 << 20         // TODO(burcud): need to be adaptive
 
-	baseUrlDownloadHost = "https://googledrive.com/host"
+	// Number of files of each download queue downloaded at the same
+	// time.
+	DefaultWorkers = 4
+
+	baseUrlFiles  = "https://www.googleapis.com/drive/v2/files"
+	baseUrlExport = "https://www.googleapis.com/drive/v3/files"
 )
 
 type Downloader struct {
@@ -40,99 +52,726 @@ type Downloader struct {
 
 	muSmall sync.Mutex
 	muLarge sync.Mutex
+
+	muInFlight sync.Mutex
+	inFlight   map[string]bool // ids of the files being downloaded
+	transfers  map[string]*transfer
+
+	muWaiters sync.Mutex
+	waiters   map[string][]chan struct{} // closed once the file is downloaded, keyed by id
+
+	muFetches sync.Mutex
+	fetches   map[string]*fetch // keyed by id, see EnsureBlob
+
+	muHooks    sync.Mutex
+	hooks      []DownloadHook
+	hookErrors []error
+	hookQueue  chan hookRun
+	hooksOnce  sync.Once
+
+	limiter *rateLimiter // of the aggregate rate of the downloads
+
+	opts *Options
+
+	ctx  context.Context // parent of the download contexts
+	stop context.CancelFunc
+}
+
+// RetryPolicy controls how failed downloads are retried.
+type RetryPolicy struct {
+	// Maximum number of attempts, including the first one.
+	Attempts int
+
+	// Delay before the first retry, doubled after each retry.
+	Delay time.Duration
+
+	// Time limit of the whole download, including the retries and
+	// reading the content. Zero means no limit.
+	Timeout time.Duration
 }
 
-func NewDownloader(client *http.Client, m *metadata.MetaService, blobMngr *blob.Manager) *Downloader {
+// QuarantinePolicy controls when the downloads of a file that keep
+// failing are stopped for a while.
+type QuarantinePolicy struct {
+	// Number of failed downloads in a row, each with its retries,
+	// after which the file is quarantined.
+	Failures int
+
+	// Time until the download is attempted again.
+	Cooldown time.Duration
+}
+
+var (
+	// Returned by download if the file is already being downloaded.
+	errInFlight = errors.New("fileio: download in progress")
+
+	// Returned by download for the links to native docs, their content
+	// is stored by the syncer and there is nothing to download.
+	errLink = errors.New("fileio: links to docs are not downloaded")
+)
+
+var (
+	DefaultBinaryRetry = RetryPolicy{Attempts: 3, Delay: time.Second, Timeout: time.Hour}
+	DefaultExportRetry = RetryPolicy{Attempts: 5, Delay: 5 * time.Second, Timeout: 5 * time.Minute}
+	DefaultQuarantine  = QuarantinePolicy{Failures: 5, Cooldown: time.Hour}
+)
+
+// Options configures a Downloader. A nil Options uses the defaults.
+type Options struct {
+	// Retry policy of binary file downloads.
+	BinaryRetry *RetryPolicy
+
+	// Retry policy of exports of native Google docs, which are
+	// rendered on demand and may need longer waits.
+	ExportRetry *RetryPolicy
+
+	// Quarantine policy of the binary files whose downloads keep
+	// failing.
+	Quarantine *QuarantinePolicy
+
+	// Number of files downloaded at the same time by each of the
+	// queues, the one of the small files and the one of the large
+	// files. Defaults to DefaultWorkers.
+	Workers int
+
+	// If set, the binary files of LazyMinSize bytes or more are not
+	// downloaded if the blob manager fetches the contents lazily, see
+	// blob.Options.Lazy: their blobs are sparse, the ranges read are
+	// fetched on demand, e.g. of large videos which are only partly
+	// watched. Zero downloads all of the files.
+	LazyMinSize int64
+
+	// Limit of the aggregate rate of the downloads in bytes per second,
+	// e.g. so that the first sync doesn't saturate a shared link. Zero
+	// means unlimited. It can be changed later, see SetRateLimit.
+	RateLimit int64
+}
+
+// Returns a copy of the options with the unset fields defaulted.
+func (o *Options) withDefaults() *Options {
+	opts := &Options{}
+	if o != nil {
+		*opts = *o
+	}
+	if opts.BinaryRetry == nil {
+		opts.BinaryRetry = &DefaultBinaryRetry
+	}
+	if opts.ExportRetry == nil {
+		opts.ExportRetry = &DefaultExportRetry
+	}
+	if opts.Quarantine == nil {
+		opts.Quarantine = &DefaultQuarantine
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+	return opts
+}
+
+// SyncWaiter is implemented by syncers to signal sync completion.
+type SyncWaiter interface {
+	// Blocks until the first sync has completed successfully.
+	WaitReady()
+
+	// Returns a channel closed after the next successful sync.
+	NextSync() <-chan struct{}
+}
+
+func NewDownloader(client *http.Client, m *metadata.MetaService, blobMngr *blob.Manager, opts *Options) *Downloader {
+	ctx, stop := context.WithCancel(context.Background())
 	downloader := &Downloader{
+		ctx:         ctx,
+		stop:        stop,
 		client:      client,
 		metaService: m,
 		blobMngr:    blobMngr,
+		inFlight:    make(map[string]bool),
+		transfers:   make(map[string]*transfer),
+		waiters:     make(map[string][]chan struct{}),
+		fetches:     make(map[string]*fetch),
+		hookQueue:   make(chan hookRun, hookQueueSize),
+		opts:        opts.withDefaults(),
 	}
+	downloader.limiter = newRateLimiter(downloader.opts.RateLimit)
 	downloader.Start()
 	return downloader
 }
 
 func (d *Downloader) Start() {
 	go func() {
-		for {
-			d.tickForSmall()
-			<-time.After(intervalTick)
+		// the previous run may have ended before all of the blobs
+		// were persisted
+		if err := d.Reconcile(); err != nil {
+			logger.V("error reconciling blobs", err)
 		}
+		d.runQueue("small", d.tickForSmall)
 	}()
-	go func() {
-		for {
-			d.tickForLarge()
-			<-time.After(intervalTick)
+	go d.runQueue("large", d.tickForLarge)
+}
+
+// Runs the downloads of a queue until the downloader is stopped. The
+// queue is drained without pausing while the downloads progress, and
+// polled every intervalTick otherwise.
+func (d *Downloader) runQueue(name string, tick func() (int, []error)) {
+	for {
+		downloaded, errs := tick()
+		if len(errs) > 0 {
+			logger.V(len(errs), "downloads of the", name, "files failed:", errors.Join(errs...))
 		}
-	}()
+		if d.ctx.Err() != nil {
+			return
+		}
+		if downloaded > 0 {
+			continue
+		}
+		if !d.sleep(intervalTick) {
+			return
+		}
+	}
 }
 
-func (d *Downloader) tickForSmall() {
+// Stop cancels the in-flight downloads and stops the download queues.
+func (d *Downloader) Stop() {
+	d.stop()
+}
+
+// Waits for the given duration, returns false if the downloader is
+// stopped in the meantime.
+func (d *Downloader) sleep(duration time.Duration) bool {
+	select {
+	case <-time.After(duration):
+		return true
+	case <-d.ctx.Done():
+		return false
+	}
+}
+
+// Reconcile queues the downloaded files whose blobs are missing for
+// download again. In pass-through mode nothing is cached, so there is
+// nothing to reconcile.
+func (d *Downloader) Reconcile() error {
+	if d.blobMngr.IsPassThrough() {
+		return nil
+	}
+	missing := []string{}
+	err := d.metaService.EachCached(func(file *metadata.CachedDriveFile) error {
+		if !d.hasBlob(file) {
+			missing = append(missing, file.Id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range missing {
+		logger.V("Backfilling", id)
+		if err = d.metaService.EnqueueForIO("download", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Downloader) tickForSmall() (int, []error) {
 	d.muSmall.Lock()
 	defer d.muSmall.Unlock()
-	d.tick(0, maxSizeQueueTreshold)
+	return d.tick(0, maxSizeQueueTreshold)
 }
 
-func (d *Downloader) tickForLarge() {
+func (d *Downloader) tickForLarge() (int, []error) {
 	d.muLarge.Lock()
 	defer d.muLarge.Unlock()
-	d.tick(maxSizeQueueTreshold+1, math.MaxInt64)
+	return d.tick(maxSizeQueueTreshold+1, math.MaxInt64)
 }
 
-func (d *Downloader) tick(minSize int64, maxSize int64) {
-	// TODO: add an additional queue for small sized files
-	// so that, large files dont block the download queue.
-	// retrieve at least MaxNumberOfConcurrentDownloads files to download
-	downloads, _ := d.metaService.ListDownloads(maxNumberOfConcurrentDownloadsPerQueue, minSize, maxSize)
-	if len(downloads) == 0 {
-		return
+// Downloads the next queued files of the size range, up to the
+// configured number of workers at the same time, and waits for them.
+// Returns the number of files downloaded and the errors of the ones
+// that failed. Files that are already being downloaded are neither.
+func (d *Downloader) tick(minSize int64, maxSize int64) (downloaded int, errs []error) {
+	downloads, err := d.metaService.ListDownloads(int64(d.opts.Workers), minSize, maxSize)
+	if err != nil {
+		return 0, []error{err}
 	}
-	completed := make(chan bool, len(downloads))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
 	for _, item := range downloads {
-		go func(id string, checksum string, ch chan bool) {
-			d.download(id, checksum)
-			ch <- true
-		}(item.Id, item.Md5Checksum, completed)
+		wg.Add(1)
+		go func(file *metadata.CachedDriveFile) {
+			defer wg.Done()
+			err := d.download(file)
+			mu.Lock()
+			defer mu.Unlock()
+			switch err {
+			case nil:
+				downloaded++
+			case errInFlight:
+			default:
+				errs = append(errs, err)
+			}
+		}(item)
+	}
+	wg.Wait()
+	return
+}
+
+// Warm downloads the contents of the given paths once the initial sync
+// is completed. Paths that are not synced yet are retried after each
+// subsequent sync.
+func (d *Downloader) Warm(paths []string, s SyncWaiter) {
+	if len(paths) == 0 {
+		return
+	}
+	s.WaitReady()
+	for {
+		pending := []string{}
+		for _, p := range paths {
+			logger.V("Warming", p)
+			if err := d.Prefetch(p); err != nil {
+				logger.V("error warming", p, err)
+				pending = append(pending, p)
+			}
+		}
+		if len(pending) == 0 {
+			logger.V("Done warming")
+			return
+		}
+		paths = pending
+		<-s.NextSync()
+	}
+}
+
+// Prefetch downloads the contents of the file at the given path,
+// relative to the root folder. Folders are prefetched recursively.
+func (d *Downloader) Prefetch(p string) error {
+	file, err := d.metaService.Resolve(p)
+	if err != nil {
+		return err
+	}
+	return d.prefetchFile(file)
+}
+
+func (d *Downloader) prefetchFile(file *metadata.CachedDriveFile) error {
+	if !file.IsFolder() {
+		if !d.isFresh(file) {
+			d.download(file)
+		}
+		return nil
+	}
+	children, err := d.metaService.GetAllChildren(file.Id)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err = d.prefetchFile(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns true if the content of the file is cached and up to date.
+func (d *Downloader) isFresh(file *metadata.CachedDriveFile) bool {
+	if queued, err := d.metaService.IsQueuedForIO("download", file.Id); err != nil || queued {
+		return false
+	}
+	return d.hasBlob(file)
+}
+
+// Returns true if the blob of the file is stored, whole or sparse.
+// Unlike a read, it doesn't count as an access of the blob, which would
+// change the order of the evictions.
+func (d *Downloader) hasBlob(file *metadata.CachedDriveFile) bool {
+	return d.blobMngr.Exists(file.Id, file.Md5Checksum) || d.blobMngr.IsSparse(file.Id, file.Md5Checksum)
+}
+
+// Marks the file as being downloaded, returns false if it already is.
+func (d *Downloader) acquire(id string) bool {
+	d.muInFlight.Lock()
+	defer d.muInFlight.Unlock()
+	if d.inFlight[id] {
+		return false
+	}
+	d.inFlight[id] = true
+	return true
+}
+
+func (d *Downloader) release(id string) {
+	d.muInFlight.Lock()
+	defer d.muInFlight.Unlock()
+	delete(d.inFlight, id)
+	delete(d.transfers, id)
+}
+
+// InFlight returns the progress of the downloads in progress.
+func (d *Downloader) InFlight() []Progress {
+	d.muInFlight.Lock()
+	defer d.muInFlight.Unlock()
+	progress := make([]Progress, 0, len(d.transfers))
+	for _, t := range d.transfers {
+		progress = append(progress, t.progress())
 	}
-	<-completed
+	return progress
 }
 
-func (d *Downloader) download(id string, checksum string) {
+// Downloads the contents of the file into its blob, unless it is
+// already being downloaded. Returns the error of the download, if it
+// failed; it is also recorded on the file.
+func (d *Downloader) download(file *metadata.CachedDriveFile) error {
+	id, checksum := file.Id, file.Md5Checksum
+	if !d.acquire(id) {
+		return errInFlight
+	}
+	defer d.release(id)
+	if file.IsLink() {
+		// stored again once the doc changes
+		d.metaService.SetDownloadError(id, errLink.Error())
+		d.metaService.DequeueFromIO("download", id)
+		return errLink
+	}
+	if d.blobMngr.IsPassThrough() {
+		// content is fetched on read, only make the file visible
+		if err := d.metaService.InitFile(id); err != nil {
+			logger.V(err)
+			return err
+		}
+		d.metaService.DequeueFromIO("download", id)
+		d.notifyDownloaded(id)
+		return nil
+	}
+	if file.StaleChecksum != "" {
+		// read until the content is downloaded, see downloaded
+		d.blobMngr.Retain(id, file.StaleChecksum)
+	}
+	if linked, err := d.blobMngr.Link(id, checksum); err != nil {
+		logger.V(err)
+	} else if linked {
+		// the same content is stored for another file
+		return d.downloaded(file)
+	}
+	if d.lazy(file) {
+		if err := d.blobMngr.SaveLazy(id, checksum, file.FileSize); err != nil {
+			logger.V(err)
+			d.fail(id, err)
+			return err
+		}
+		return d.downloaded(file)
+	}
 	// TODO: handle all error cases, make sure queue is not blocked
 	// with erroneous files
 	logger.V("Downloading", id, checksum)
-	var (
-		resp *http.Response
-		err  error
-	)
-	if resp, err = d.client.Get(baseUrlDownloadHost + "/" + id); err != nil {
+	policy := d.opts.BinaryRetry
+	if file.IsNativeDoc() {
+		policy = d.opts.ExportRetry
+	}
+	ctx := d.ctx
+	if policy.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.Timeout)
+		defer cancel()
+	}
+	// an interrupted download is resumed, exports are generated anew
+	var offset int64
+	if !file.IsNativeDoc() {
+		offset = d.blobMngr.Partial(id, checksum)
+	}
+	link := downloadUrl(file)
+	resp, err := d.get(ctx, id, link, offset, *policy)
+	if err == nil && file.DownloadUrl != "" && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		// the download url expired, fetch it through the API instead
+		resp.Body.Close()
+		logger.V("download url of", id, "is rejected, downloading", id, "through the API")
+		link = mediaUrl(id)
+		resp, err = d.get(ctx, id, link, offset, *policy)
+	}
+	if err == nil && offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// the partial content doesn't fit the file, start over
+		resp.Body.Close()
+		offset = 0
+		resp, err = d.get(ctx, id, link, offset, *policy)
+	}
+	if err == nil && offset > 0 && resp.StatusCode == http.StatusOK {
+		// the range is ignored, the whole content follows
+		offset = 0
+	}
+	if err == nil && resp.StatusCode == http.StatusPartialContent && !rangeStartsAt(resp, offset) {
+		resp.Body.Close()
+		err = fmt.Errorf("error downloading %v: unexpected range %v", id, resp.Header.Get("Content-Range"))
+	}
+	if err != nil {
 		logger.V("error downloading", id, err)
-		return
+		if file.IsNativeDoc() {
+			// give up, until the document changes
+			d.metaService.SetDownloadError(id, err.Error())
+			d.metaService.DequeueFromIO("download", id)
+			return err
+		}
+		d.fail(id, err)
+		return err
 	}
 
 	if resp.StatusCode == 404 {
+		resp.Body.Close()
 		d.metaService.DequeueFromIO("download", id)
 		logger.V("error downloading [not found]", id)
-		return
+		return nil
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
 		logger.V("error downloading [not ok]", id, resp.StatusCode)
-		return
+		err = fmt.Errorf("error downloading %v: %v", id, resp.Status)
+		d.fail(id, err)
+		return err
 	}
 
 	defer resp.Body.Close()
-	err = d.blobMngr.Save(id, checksum, resp.Body)
+	t := newTransfer(id, offset, resp.ContentLength, d.throttle(ctx, resp.Body))
+	d.muInFlight.Lock()
+	d.transfers[id] = t
+	d.muInFlight.Unlock()
+	if offset > 0 {
+		logger.V("Resuming download of", id, "at", offset)
+	}
+	digest, err := d.blobMngr.SaveFromMd5(id, checksum, offset, t)
 	if err != nil {
 		logger.V(err)
-		return
+		d.fail(id, err)
+		return err
+	}
+	if checksum == "" && digest != "" {
+		// Drive gave no checksum, the one of the content is recorded
+		if err := d.metaService.SetContentMd5(file, digest); err != nil {
+			logger.V(err)
+		}
+	}
+	return d.downloaded(file)
+}
+
+// Returns true if the content of the file is fetched on demand rather
+// than downloaded, see Options.LazyMinSize.
+func (d *Downloader) lazy(file *metadata.CachedDriveFile) bool {
+	return d.opts.LazyMinSize > 0 && file.FileSize >= d.opts.LazyMinSize && !file.IsNativeDoc() && d.blobMngr.IsLazy()
+}
+
+// Makes the downloaded file visible and dequeues it, then queues its
+// hooks, see AddHook. The stale content of the file, if any, is removed
+// once the reads are switched to the downloaded one.
+func (d *Downloader) downloaded(file *metadata.CachedDriveFile) error {
+	id := file.Id
+	if err := d.metaService.InitFile(id); err != nil {
+		logger.V(err)
+		return err
+	}
+	if file.StaleChecksum != "" {
+		if err := d.blobMngr.Release(id, file.Md5Checksum); err != nil {
+			logger.V(err)
+		}
 	}
+	if file.DownloadFailures > 0 {
+		d.metaService.Unquarantine(id)
+	}
+	d.metaService.DequeueFromIO("download", id)
+	d.notifyDownloaded(id)
+	d.queueHooks(file)
+	return nil
+}
 
-	err = d.metaService.InitFile(id)
+// Records a failed download of the file identified by id, quarantines
+// the file once its downloads failed often enough in a row. Failures
+// of stopped downloads don't count, nor do the ones of a full disk,
+// the file is retried once there is room.
+func (d *Downloader) fail(id string, cause error) {
+	if d.ctx.Err() != nil || cause == blob.ErrInsufficientSpace {
+		return
+	}
+	failures, err := d.metaService.AddDownloadFailure(id, cause.Error())
 	if err != nil {
 		logger.V(err)
 		return
 	}
+	policy := d.opts.Quarantine
+	if policy.Failures <= 0 || failures < policy.Failures {
+		return
+	}
+	logger.V("quarantining", id, "after", failures, "failed downloads for", policy.Cooldown)
+	if err = d.metaService.Quarantine(id, time.Now().Add(policy.Cooldown)); err != nil {
+		logger.V(err)
+	}
+}
 
-	d.metaService.DequeueFromIO("download", id)
+// WaitFile blocks until the content of the file identified by id is
+// cached and up to date, returns immediately if it already is. Doesn't
+// start a download, see Prefetch. Returns the error of ctx if it is
+// done first.
+func (d *Downloader) WaitFile(ctx context.Context, id string) error {
+	ch := make(chan struct{})
+	// registered before checking, not to miss a download completing
+	// in between
+	d.muWaiters.Lock()
+	d.waiters[id] = append(d.waiters[id], ch)
+	d.muWaiters.Unlock()
+	defer d.removeWaiter(id, ch)
+
+	file, err := d.metaService.Get(id)
+	if err != nil {
+		return err
+	}
+	if d.isFresh(file) {
+		return nil
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.ctx.Done():
+		return d.ctx.Err()
+	}
+}
+
+func (d *Downloader) removeWaiter(id string, ch chan struct{}) {
+	d.muWaiters.Lock()
+	defer d.muWaiters.Unlock()
+	waiters := d.waiters[id]
+	for i, waiter := range waiters {
+		if waiter == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(d.waiters, id)
+	} else {
+		d.waiters[id] = waiters
+	}
+}
+
+// Wakes up the goroutines waiting for the file identified by id.
+func (d *Downloader) notifyDownloaded(id string) {
+	d.muWaiters.Lock()
+	defer d.muWaiters.Unlock()
+	for _, ch := range d.waiters[id] {
+		close(ch)
+	}
+	delete(d.waiters, id)
+}
+
+// Returns the url the contents of the file are downloaded from. Native
+// docs are exported. The download url Drive provided is preferred for
+// the other files, the API is used if there is none, as newer versions
+// of the API don't provide it anymore.
+func downloadUrl(file *metadata.CachedDriveFile) string {
+	if file.IsNativeDoc() {
+		return baseUrlExport + "/" + url.PathEscape(file.Id) + "/export?mimeType=" + url.QueryEscape(file.ExportMimeType())
+	}
+	if file.DownloadUrl != "" {
+		return file.DownloadUrl
+	}
+	return mediaUrl(file.Id)
+}
+
+// Returns the url of the contents of the file identified by id in the
+// Drive API, as Files.Get with alt=media.
+func mediaUrl(id string) string {
+	// files of shared drives are only served if they are supported
+	return baseUrlFiles + "/" + url.PathEscape(id) + "?alt=media&supportsAllDrives=true"
+}
+
+// Returns true if the partial content of the response starts at
+// offset.
+func rangeStartsAt(resp *http.Response, offset int64) bool {
+	// e.g. "bytes 100-999/1000"
+	start, _, ok := strings.Cut(strings.TrimPrefix(resp.Header.Get("Content-Range"), "bytes "), "-")
+	return ok && start == strconv.FormatInt(offset, 10)
+}
+
+// Requests the contents of the file identified by id from link, from
+// offset on if it is not zero, retrying on network errors and server
+// side failures as the policy allows.
+func (d *Downloader) get(ctx context.Context, id string, link string, offset int64, policy RetryPolicy) (resp *http.Response, err error) {
+	delay := policy.Delay
+	for attempt := 1; ; attempt++ {
+		var req *http.Request
+		if req, err = http.NewRequestWithContext(ctx, "GET", link, nil); err != nil {
+			return
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		resp, err = d.client.Do(req)
+		if err == nil && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("error downloading %v: %v", id, resp.Status)
+		}
+		if attempt >= policy.Attempts {
+			return nil, err
+		}
+		logger.V("retrying download of", id, "in", delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// NewRangeFetcher returns a blob.RangeFetcher that downloads ranges of
+// the file contents with the given client, from the url the contents
+// of the file are downloaded from, see downloadUrl. Files without
+// metadata are fetched through the API.
+func NewRangeFetcher(client *http.Client, metaService *metadata.MetaService) blob.RangeFetcher {
+	return func(id string, offset int64, length int) ([]byte, error) {
+		link := mediaUrl(id)
+		file, err := metaService.Get(id)
+		if err == nil {
+			link = downloadUrl(file)
+		}
+		resp, err := getRange(client, link, offset, length)
+		if err == nil && file != nil && link == file.DownloadUrl && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			// the download url expired, fetch the range through the API
+			// instead
+			resp.Body.Close()
+			resp, err = getRange(client, mediaUrl(id), offset, length)
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+			// reading past the end of the file
+			return []byte{}, nil
+		case resp.StatusCode == http.StatusOK:
+			// the server ignored the range, skip to the offset
+			if _, err = io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+				if err == io.EOF {
+					return []byte{}, nil
+				}
+				return nil, err
+			}
+		case resp.StatusCode != http.StatusPartialContent:
+			return nil, fmt.Errorf("error fetching range of %v: %v", id, resp.Status)
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(length)))
+		if err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+}
+
+// Requests length bytes of the contents at link from offset on.
+// Exports ignore the range, their whole content follows.
+func getRange(client *http.Client, link string, offset int64, length int) (*http.Response, error) {
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(length)-1))
+	return client.Do(req)
 }
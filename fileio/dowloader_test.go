@@ -0,0 +1,927 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Contains tests for fileio package.
+package fileio
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/rakyll/drivefuse/blob"
+	"github.com/rakyll/drivefuse/metadata"
+	T "github.com/rakyll/drivefuse/third_party/launchpad.net/gocheck"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	T.TestingT(t)
+}
+
+// fakeHost serves file contents keyed by file id.
+type fakeHost struct {
+	mu       sync.Mutex
+	contents map[string]string
+
+	// Number of requests to fail with 503, keyed by file id.
+	failures map[string]int
+
+	// Delay between the chunks of a response body.
+	chunkDelay time.Duration
+
+	// Number of requests served, keyed by file id.
+	requests map[string]int
+
+	// Paths of the requests, in the order they were served.
+	paths []string
+
+	// Number of bytes after which the next response body fails, keyed
+	// by file id.
+	cuts map[string]int
+
+	// Range headers of the requests, in the order they were served.
+	ranges []string
+}
+
+func (h *fakeHost) RoundTrip(req *http.Request) (*http.Response, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.paths = append(h.paths, req.URL.Path)
+	failed := func(code int) (*http.Response, error) {
+		return &http.Response{StatusCode: code, Request: req, Body: ioutil.NopCloser(&bytes.Buffer{})}, nil
+	}
+	var id string
+	switch p := req.URL.Path; {
+	case strings.HasPrefix(p, "/drive/v3/files/") && strings.HasSuffix(p, "/export"):
+		// native docs are exported to a format of their mime type
+		id = strings.TrimSuffix(strings.TrimPrefix(p, "/drive/v3/files/"), "/export")
+		if req.URL.Query().Get("mimeType") == "" {
+			return failed(http.StatusBadRequest)
+		}
+	case strings.HasPrefix(p, "/drive/v2/files/"):
+		id = strings.TrimPrefix(p, "/drive/v2/files/")
+		if req.URL.Query().Get("alt") != "media" {
+			return failed(http.StatusBadRequest)
+		}
+	case req.URL.Host == "googledrive.com":
+		// only hosts public files
+		return failed(http.StatusNotFound)
+	case strings.HasPrefix(p, "/expired/"):
+		// a download url that is not valid anymore
+		return failed(http.StatusForbidden)
+	default:
+		// the host and download urls
+		id = path.Base(p)
+	}
+	content, ok := h.contents[id]
+	if h.requests != nil {
+		h.requests[id]++
+	}
+	resp := &http.Response{StatusCode: http.StatusOK, Request: req, Header: make(http.Header)}
+	if h.failures[id] > 0 {
+		h.failures[id]--
+		resp.StatusCode = http.StatusServiceUnavailable
+		content = ""
+	} else if !ok {
+		resp.StatusCode = http.StatusNotFound
+	}
+	if r := req.Header.Get("Range"); r != "" && resp.StatusCode == http.StatusOK {
+		h.ranges = append(h.ranges, r)
+		var start int
+		fmt.Sscanf(r, "bytes=%d-", &start)
+		if start >= len(content) {
+			return failed(http.StatusRequestedRangeNotSatisfiable)
+		}
+		resp.StatusCode = http.StatusPartialContent
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(content)-1, len(content)))
+		content = content[start:]
+	}
+	resp.ContentLength = int64(len(content))
+	var body io.Reader = &slowReader{req.Context(), bytes.NewBufferString(content), h.chunkDelay}
+	if cut, ok := h.cuts[id]; ok {
+		delete(h.cuts, id)
+		body = io.MultiReader(io.LimitReader(body, int64(cut)), iotest.ErrReader(io.ErrUnexpectedEOF))
+	}
+	resp.Body = ioutil.NopCloser(body)
+	return resp, nil
+}
+
+// slowReader returns at most 64 bytes per read, after a delay. Fails
+// once the request is cancelled.
+type slowReader struct {
+	ctx   context.Context
+	r     io.Reader
+	delay time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	select {
+	case <-time.After(r.delay):
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	}
+	if len(p) > 64 {
+		p = p[:64]
+	}
+	return r.r.Read(p)
+}
+
+// fakeSyncer lets the test decide when syncs complete.
+type fakeSyncer struct {
+	ready    chan struct{}
+	nextSync chan struct{}
+}
+
+func (s *fakeSyncer) WaitReady()                { <-s.ready }
+func (s *fakeSyncer) NextSync() <-chan struct{} { return s.nextSync }
+
+type DownloaderSuite struct {
+	host        *fakeHost
+	metaService *metadata.MetaService
+	blobMngr    *blob.Manager
+	downloader  *Downloader
+}
+
+var _ = T.Suite(&DownloaderSuite{})
+
+func (s *DownloaderSuite) SetUpTest(c *T.C) {
+	dir := c.MkDir()
+	var err error
+	s.metaService, err = metadata.New(filepath.Join(dir, "meta.sql"), nil)
+	c.Assert(err, T.IsNil)
+	s.blobMngr = blob.New(filepath.Join(dir, "blob"), nil)
+	s.host = &fakeHost{contents: make(map[string]string), failures: make(map[string]int)}
+	// not started, downloads only happen when requested
+	ctx, stop := context.WithCancel(context.Background())
+	s.downloader = &Downloader{
+		ctx:         ctx,
+		stop:        stop,
+		client:      &http.Client{Transport: s.host},
+		metaService: s.metaService,
+		blobMngr:    s.blobMngr,
+		inFlight:    make(map[string]bool),
+		transfers:   make(map[string]*transfer),
+		waiters:     make(map[string][]chan struct{}),
+		fetches:     make(map[string]*fetch),
+		hookQueue:   make(chan hookRun, hookQueueSize),
+		limiter:     newRateLimiter(0),
+		opts:        (*Options)(nil).withDefaults(),
+	}
+	s.save(c, metadata.IdRootFolder, "", "", true)
+}
+
+func (s *DownloaderSuite) TearDownTest(c *T.C) {
+	s.downloader.Stop()
+	s.metaService.Close()
+}
+
+// Saves metadata for a folder or a file with the given content.
+func (s *DownloaderSuite) save(c *T.C, id string, parentId string, content string, isFolder bool) {
+	file := &metadata.CachedDriveFile{Id: id, ParentId: parentId, Name: id, Md5Checksum: "md5" + id}
+	if isFolder {
+		file.MimeType = metadata.MimeTypeFolder
+	} else {
+		s.host.mu.Lock()
+		s.host.contents[id] = content
+		s.host.mu.Unlock()
+		file.FileSize = int64(len(content))
+	}
+	c.Assert(s.metaService.Save(parentId, id, file, !isFolder, false), T.IsNil)
+}
+
+// Returns true if the whole content of the file is cached.
+func (s *DownloaderSuite) cached(id string) bool {
+	s.host.mu.Lock()
+	content := s.host.contents[id]
+	s.host.mu.Unlock()
+	data, size, err := s.blobMngr.Read(id, "md5"+id, 0, len(content)+1)
+	if err != nil && err != io.EOF {
+		return false
+	}
+	return string(data[:size]) == content
+}
+
+func (s *DownloaderSuite) TestWarm(c *T.C) {
+	s.save(c, "docs", metadata.IdRootFolder, "", true)
+	s.save(c, "file-a", "docs", "content of a", false)
+	s.save(c, "file-b", metadata.IdRootFolder, "content of b", false)
+
+	syncer := &fakeSyncer{ready: make(chan struct{}), nextSync: make(chan struct{})}
+	done := make(chan bool)
+	go func() {
+		s.downloader.Warm([]string{"/docs", "later"}, syncer)
+		done <- true
+	}()
+	close(syncer.ready)
+
+	// "later" doesn't exist yet, becomes available with the next sync
+	s.save(c, "later", metadata.IdRootFolder, "content of later", false)
+	close(syncer.nextSync)
+	<-done
+
+	c.Assert(s.cached("file-a"), T.Equals, true)
+	c.Assert(s.cached("later"), T.Equals, true)
+	c.Assert(s.cached("file-b"), T.Equals, false)
+}
+
+func (s *DownloaderSuite) TestPrefetchSkipsCachedFiles(c *T.C) {
+	s.host.requests = make(map[string]int)
+	s.save(c, "docs", metadata.IdRootFolder, "", true)
+	s.save(c, "file-a", "docs", "content of a", false)
+	c.Assert(s.downloader.Prefetch("/docs"), T.IsNil)
+	c.Assert(s.cached("file-a"), T.Equals, true)
+
+	// warming the same paths again, e.g. after a restart
+	c.Assert(s.downloader.Prefetch("/docs"), T.IsNil)
+	c.Assert(s.host.requests["file-a"], T.Equals, 1)
+
+	// queued again, e.g. a native doc that was edited
+	s.host.contents["file-a"] = "new content of a"
+	c.Assert(s.metaService.EnqueueForIO("download", "file-a"), T.IsNil)
+	c.Assert(s.downloader.Prefetch("/docs"), T.IsNil)
+	c.Assert(s.host.requests["file-a"], T.Equals, 2)
+	c.Assert(s.cached("file-a"), T.Equals, true)
+}
+
+func (s *DownloaderSuite) TestInFlightProgress(c *T.C) {
+	s.host.chunkDelay = 10 * time.Millisecond
+	s.save(c, "slowfile", metadata.IdRootFolder, strings.Repeat("x", 64*20), false)
+
+	done := make(chan bool)
+	go func() {
+		file, _ := s.metaService.Get("slowfile")
+		s.downloader.download(file)
+		close(done)
+	}()
+
+	var last Progress
+	samples := 0
+	for samples < 2 {
+		select {
+		case <-done:
+			c.Fatalf("download completed after %d samples", samples)
+		case <-time.After(30 * time.Millisecond):
+		}
+		inFlight := s.downloader.InFlight()
+		if len(inFlight) == 0 {
+			continue
+		}
+		p := inFlight[0]
+		c.Assert(p.Id, T.Equals, "slowfile")
+		c.Assert(p.BytesTotal, T.Equals, int64(64*20))
+		if p.BytesDone == 0 {
+			continue
+		}
+		c.Assert(p.BytesDone > last.BytesDone, T.Equals, true)
+		c.Assert(p.AverageSpeed > 0, T.Equals, true)
+		c.Assert(p.ETA > 0 && p.ETA < time.Minute, T.Equals, true)
+		last = p
+		samples++
+	}
+	<-done
+	c.Assert(s.downloader.InFlight(), T.HasLen, 0)
+}
+
+// Saves a native doc whose export fails the given number of times.
+func (s *DownloaderSuite) saveDoc(c *T.C, id string, failures int) *metadata.CachedDriveFile {
+	s.save(c, id, metadata.IdRootFolder, "exported "+id, false)
+	file, err := s.metaService.Get(id)
+	c.Assert(err, T.IsNil)
+	file.MimeType = "application/vnd.google-apps.document"
+	c.Assert(s.metaService.Save(metadata.IdRootFolder, id, file, true, false), T.IsNil)
+	s.host.failures[id] = failures
+	return file
+}
+
+// Returns true if the file is waiting to be downloaded.
+func (s *DownloaderSuite) queued(c *T.C, id string) bool {
+	queue, err := s.metaService.ListDownloads(100, 0, 1<<20)
+	c.Assert(err, T.IsNil)
+	for _, file := range queue {
+		if file.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *DownloaderSuite) TestExportRetriedWithExportPolicy(c *T.C) {
+	s.downloader.opts = (&Options{
+		BinaryRetry: &RetryPolicy{Attempts: 1, Delay: time.Millisecond},
+		ExportRetry: &RetryPolicy{Attempts: 3, Delay: time.Millisecond},
+	}).withDefaults()
+	doc := s.saveDoc(c, "doc", 2)
+	s.downloader.download(doc)
+	c.Assert(s.cached("doc"), T.Equals, true)
+	c.Assert(s.queued(c, "doc"), T.Equals, false)
+
+	// binary downloads give up after a single attempt and stay queued
+	s.save(c, "binary", metadata.IdRootFolder, "content", false)
+	s.host.failures["binary"] = 1
+	file, _ := s.metaService.Get("binary")
+	s.downloader.download(file)
+	c.Assert(s.cached("binary"), T.Equals, false)
+	c.Assert(s.queued(c, "binary"), T.Equals, true)
+}
+
+func (s *DownloaderSuite) TestExhaustedExportIsDequeued(c *T.C) {
+	s.downloader.opts = (&Options{
+		BinaryRetry: &RetryPolicy{Attempts: 5, Delay: time.Millisecond},
+		ExportRetry: &RetryPolicy{Attempts: 2, Delay: time.Millisecond},
+	}).withDefaults()
+	doc := s.saveDoc(c, "doc", 2)
+	s.downloader.download(doc)
+	c.Assert(s.cached("doc"), T.Equals, false)
+	c.Assert(s.queued(c, "doc"), T.Equals, false)
+	file, err := s.metaService.Get("doc")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.DownloadError, T.Not(T.Equals), "")
+}
+
+func (s *DownloaderSuite) TestStartBackfillsMissingBlobs(c *T.C) {
+	s.save(c, "cached-file", metadata.IdRootFolder, "cached", false)
+	s.save(c, "lost-file", metadata.IdRootFolder, "lost", false)
+	for _, id := range []string{"cached-file", "lost-file"} {
+		file, _ := s.metaService.Get(id)
+		s.downloader.download(file)
+	}
+	c.Assert(s.queued(c, "lost-file"), T.Equals, false)
+
+	// the blob didn't survive the restart
+	c.Assert(s.blobMngr.Delete("lost-file"), T.IsNil)
+	c.Assert(s.downloader.Reconcile(), T.IsNil)
+	c.Assert(s.queued(c, "lost-file"), T.Equals, true)
+	c.Assert(s.queued(c, "cached-file"), T.Equals, false)
+
+	s.downloader.Start()
+	for i := 0; i < 500 && !s.cached("lost-file"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(s.cached("lost-file"), T.Equals, true)
+}
+
+func (s *DownloaderSuite) TestReconcileKeepsTheEvictionOrder(c *T.C) {
+	dir := c.MkDir()
+	s.blobMngr = blob.New(dir, nil)
+	s.downloader.blobMngr = s.blobMngr
+	s.save(c, "older", metadata.IdRootFolder, "older", false)
+	s.save(c, "newer", metadata.IdRootFolder, "newer", false)
+	for _, id := range []string{"older", "newer"} {
+		file, _ := s.metaService.Get(id)
+		s.downloader.download(file)
+	}
+	// the blobs were last read before the restart
+	accesses := map[string]time.Time{
+		"older": time.Now().Add(-2 * time.Hour).Truncate(time.Second),
+		"newer": time.Now().Add(-time.Hour).Truncate(time.Second),
+	}
+	for id, at := range accesses {
+		e, ok := s.blobMngr.Stat(id)
+		c.Assert(ok, T.Equals, true)
+		c.Assert(os.Chtimes(e.Path, at, at), T.IsNil)
+	}
+	// restarted
+	s.blobMngr = blob.New(dir, nil)
+	s.downloader.blobMngr = s.blobMngr
+	c.Assert(s.blobMngr.LoadIndex(), T.IsNil)
+
+	c.Assert(s.downloader.Reconcile(), T.IsNil)
+	c.Assert(s.downloader.Prefetch("/"), T.IsNil)
+	for id, at := range accesses {
+		e, ok := s.blobMngr.Stat(id)
+		c.Assert(ok, T.Equals, true)
+		c.Assert(e.LastAccess.Equal(at), T.Equals, true, T.Commentf("%s accessed at %v", id, e.LastAccess))
+		info, err := os.Stat(e.Path)
+		c.Assert(err, T.IsNil)
+		c.Assert(info.ModTime().Equal(at), T.Equals, true)
+	}
+	c.Assert(s.queued(c, "older"), T.Equals, false)
+	c.Assert(s.queued(c, "newer"), T.Equals, false)
+}
+
+func (s *DownloaderSuite) TestDownloadsHonorTheirTimeouts(c *T.C) {
+	s.host.chunkDelay = 5 * time.Millisecond
+	// 20 chunks take about 100ms
+	content := strings.Repeat("x", 64*20)
+	s.save(c, "binary", metadata.IdRootFolder, content, false)
+	doc := s.saveDoc(c, "doc", 0)
+	s.host.contents["doc"] = content
+	binary, _ := s.metaService.Get("binary")
+
+	// each kind of download has its own limit
+	s.downloader.opts = (&Options{
+		BinaryRetry: &RetryPolicy{Attempts: 1, Timeout: time.Second},
+		ExportRetry: &RetryPolicy{Attempts: 1, Timeout: 20 * time.Millisecond},
+	}).withDefaults()
+	start := time.Now()
+	s.downloader.download(doc)
+	c.Assert(time.Since(start) < 80*time.Millisecond, T.Equals, true)
+	c.Assert(s.cached("doc"), T.Equals, false)
+	s.downloader.download(binary)
+	c.Assert(s.cached("binary"), T.Equals, true)
+
+	s.host.contents["binary"] = content + "changed"
+	c.Assert(s.blobMngr.Delete("binary"), T.IsNil)
+	s.downloader.opts = (&Options{
+		BinaryRetry: &RetryPolicy{Attempts: 1, Timeout: 20 * time.Millisecond},
+		ExportRetry: &RetryPolicy{Attempts: 1, Timeout: time.Second},
+	}).withDefaults()
+	start = time.Now()
+	s.downloader.download(binary)
+	c.Assert(time.Since(start) < 80*time.Millisecond, T.Equals, true)
+	c.Assert(s.cached("binary"), T.Equals, false)
+	s.downloader.download(doc)
+	c.Assert(s.cached("doc"), T.Equals, true)
+}
+
+func (s *DownloaderSuite) TestStopCancelsDownloads(c *T.C) {
+	s.host.chunkDelay = 5 * time.Millisecond
+	s.save(c, "binary", metadata.IdRootFolder, strings.Repeat("x", 64*20), false)
+	binary, _ := s.metaService.Get("binary")
+	time.AfterFunc(20*time.Millisecond, s.downloader.Stop)
+	start := time.Now()
+	s.downloader.download(binary)
+	c.Assert(time.Since(start) < 80*time.Millisecond, T.Equals, true)
+	c.Assert(s.cached("binary"), T.Equals, false)
+}
+
+func (s *DownloaderSuite) TestWaitFile(c *T.C) {
+	s.save(c, "file-a", metadata.IdRootFolder, "content of a", false)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.downloader.WaitFile(context.Background(), "file-a")
+	}()
+	select {
+	case err := <-done:
+		c.Fatalf("resolved before the download: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.Assert(s.downloader.Prefetch("file-a"), T.IsNil)
+	select {
+	case err := <-done:
+		c.Assert(err, T.IsNil)
+	case <-time.After(time.Second):
+		c.Fatal("not resolved once the file is downloaded")
+	}
+	c.Assert(s.cached("file-a"), T.Equals, true)
+
+	// already cached
+	c.Assert(s.downloader.WaitFile(context.Background(), "file-a"), T.IsNil)
+
+	// cancelled before the file is downloaded
+	s.save(c, "file-b", metadata.IdRootFolder, "content of b", false)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	c.Assert(s.downloader.WaitFile(ctx, "file-b"), T.Equals, context.DeadlineExceeded)
+	s.downloader.muWaiters.Lock()
+	c.Assert(s.downloader.waiters, T.HasLen, 0)
+	s.downloader.muWaiters.Unlock()
+}
+
+func (s *DownloaderSuite) TestDownloadUrls(c *T.C) {
+	urls := map[string]string{
+		"api":     "",
+		"fast":    "https://example.com/download/fast",
+		"expired": "https://example.com/expired/expired",
+	}
+	for id, link := range urls {
+		file := &metadata.CachedDriveFile{Id: id, ParentId: metadata.IdRootFolder, Name: id, Md5Checksum: "md5" + id, DownloadUrl: link}
+		s.host.contents[id] = "content of " + id
+		s.downloader.download(file)
+		c.Assert(s.cached(id), T.Equals, true)
+	}
+	sort.Strings(s.host.paths)
+	c.Assert(s.host.paths, T.DeepEquals, []string{
+		// without a download url, fetched through the API
+		"/download/fast",
+		"/drive/v2/files/api",
+		// the expired url is tried first
+		"/drive/v2/files/expired",
+		"/expired/expired",
+	})
+}
+
+func (s *DownloaderSuite) TestFailingDownloadsAreQuarantined(c *T.C) {
+	s.downloader.opts = (&Options{
+		BinaryRetry: &RetryPolicy{Attempts: 1},
+		Quarantine:  &QuarantinePolicy{Failures: 3, Cooldown: time.Hour},
+	}).withDefaults()
+	s.save(c, "flaky", metadata.IdRootFolder, "content", false)
+	s.host.failures["flaky"] = 3
+	for i := 0; i < 3; i++ {
+		c.Assert(s.queued(c, "flaky"), T.Equals, true)
+		file, err := s.metaService.Get("flaky")
+		c.Assert(err, T.IsNil)
+		s.downloader.download(file)
+	}
+	c.Assert(s.queued(c, "flaky"), T.Equals, false)
+	file, err := s.metaService.Get("flaky")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.DownloadFailures, T.Equals, 3)
+	c.Assert(file.DownloadError, T.Not(T.Equals), "")
+	c.Assert(file.IsQuarantined(time.Now()), T.Equals, true)
+	c.Assert(file.QuarantinedAt.IsZero(), T.Equals, false)
+
+	// once the cooldown is over, it is retried and the failures cleared
+	c.Assert(s.metaService.Quarantine("flaky", time.Now().Add(-time.Second)), T.IsNil)
+	c.Assert(s.queued(c, "flaky"), T.Equals, true)
+	file, err = s.metaService.Get("flaky")
+	c.Assert(err, T.IsNil)
+	s.downloader.download(file)
+	c.Assert(s.cached("flaky"), T.Equals, true)
+	file, err = s.metaService.Get("flaky")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.DownloadFailures, T.Equals, 0)
+	c.Assert(file.DownloadError, T.Equals, "")
+	c.Assert(file.QuarantinedUntil.IsZero(), T.Equals, true)
+}
+
+func (s *DownloaderSuite) TestUnquarantine(c *T.C) {
+	s.save(c, "flaky", metadata.IdRootFolder, "content", false)
+	_, err := s.metaService.AddDownloadFailure("flaky", "unavailable")
+	c.Assert(err, T.IsNil)
+	c.Assert(s.metaService.Quarantine("flaky", time.Now().Add(time.Hour)), T.IsNil)
+	c.Assert(s.queued(c, "flaky"), T.Equals, false)
+
+	c.Assert(s.metaService.Unquarantine("flaky"), T.IsNil)
+	c.Assert(s.queued(c, "flaky"), T.Equals, true)
+	file, err := s.metaService.Get("flaky")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.DownloadFailures, T.Equals, 0)
+	c.Assert(file.DownloadError, T.Equals, "")
+}
+
+func (s *DownloaderSuite) TestQueuedFilesAreDownloadedInParallel(c *T.C) {
+	s.downloader.opts = (&Options{BinaryRetry: &RetryPolicy{Attempts: 1}, Workers: 3}).withDefaults()
+	// each download takes two chunks, about 100ms
+	s.host.chunkDelay = 50 * time.Millisecond
+	for i := 0; i < 6; i++ {
+		s.save(c, fmt.Sprintf("file-%d", i), metadata.IdRootFolder, "content", false)
+	}
+	s.host.failures["file-0"] = 1
+
+	start := time.Now()
+	downloaded, errs := s.downloader.tickForSmall()
+	c.Assert(time.Since(start) < 250*time.Millisecond, T.Equals, true)
+	c.Assert(downloaded, T.Equals, 2)
+	c.Assert(errs, T.HasLen, 1)
+
+	// the queue is drained without waiting for the next tick
+	s.downloader.Start()
+	for i := 0; i < 300 && s.queued(c, "file-5"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 6; i++ {
+		c.Assert(s.cached(fmt.Sprintf("file-%d", i)), T.Equals, true)
+	}
+}
+
+func (s *DownloaderSuite) TestInterruptedDownloadsAreResumed(c *T.C) {
+	content := strings.Repeat("0123456789", 100)
+	s.save(c, "large", metadata.IdRootFolder, content, false)
+	// verified once the content is complete
+	c.Assert(s.metaService.Save(metadata.IdRootFolder, "large", &metadata.CachedDriveFile{
+		Id: "large", ParentId: metadata.IdRootFolder, Name: "large", FileSize: int64(len(content)),
+		Md5Checksum: fmt.Sprintf("%x", md5.Sum([]byte(content))),
+	}, true, false), T.IsNil)
+	file, err := s.metaService.Get("large")
+	c.Assert(err, T.IsNil)
+
+	s.host.cuts = map[string]int{"large": 640}
+	c.Assert(s.downloader.download(file), T.NotNil)
+	c.Assert(s.blobMngr.Partial("large", file.Md5Checksum), T.Equals, int64(640))
+	c.Assert(s.host.ranges, T.HasLen, 0)
+
+	c.Assert(s.downloader.download(file), T.IsNil)
+	c.Assert(s.host.ranges, T.DeepEquals, []string{"bytes=640-"})
+	c.Assert(s.blobMngr.Partial("large", file.Md5Checksum), T.Equals, int64(0))
+	data, size, err := s.blobMngr.Read("large", file.Md5Checksum, 0, len(content))
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, content)
+}
+
+func (s *DownloaderSuite) TestChecksumsOfDownloadsAreRecorded(c *T.C) {
+	content := "content without a checksum"
+	s.host.contents["binary"] = content
+	file := &metadata.CachedDriveFile{Id: "binary", ParentId: metadata.IdRootFolder, Name: "binary", FileSize: int64(len(content)), Version: "rev1"}
+	c.Assert(s.metaService.Save(metadata.IdRootFolder, "binary", file, true, false), T.IsNil)
+	c.Assert(s.downloader.download(file), T.IsNil)
+	saved, err := s.metaService.Get("binary")
+	c.Assert(err, T.IsNil)
+	c.Assert(saved.ContentMd5, T.Equals, fmt.Sprintf("%x", md5.Sum([]byte(content))))
+
+	// kept while the content is unchanged, e.g. once renamed
+	renamed := *file
+	renamed.Name = "renamed"
+	c.Assert(s.metaService.Save(metadata.IdRootFolder, "binary", &renamed, true, false), T.IsNil)
+	saved, err = s.metaService.Get("binary")
+	c.Assert(err, T.IsNil)
+	c.Assert(saved.ContentMd5, T.Equals, fmt.Sprintf("%x", md5.Sum([]byte(content))))
+
+	// dropped once it changes
+	changed := renamed
+	changed.Version = "rev2"
+	c.Assert(s.metaService.Save(metadata.IdRootFolder, "binary", &changed, true, false), T.IsNil)
+	saved, err = s.metaService.Get("binary")
+	c.Assert(err, T.IsNil)
+	c.Assert(saved.ContentMd5, T.Equals, "")
+
+	// nor recorded for a content that changed while it was downloaded
+	c.Assert(s.downloader.download(file), T.IsNil)
+	saved, err = s.metaService.Get("binary")
+	c.Assert(err, T.IsNil)
+	c.Assert(saved.ContentMd5, T.Equals, "")
+}
+
+func (s *DownloaderSuite) TestReadsEnsureTheirBlobs(c *T.C) {
+	s.host.requests = make(map[string]int)
+	s.host.chunkDelay = time.Millisecond
+	s.save(c, "evicted", metadata.IdRootFolder, strings.Repeat("x", 64*10), false)
+
+	// the concurrent reads share a single download
+	errs := make(chan error)
+	for i := 0; i < 5; i++ {
+		go func() {
+			errs <- s.downloader.EnsureBlob(context.Background(), "evicted")
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		c.Assert(<-errs, T.IsNil)
+	}
+	c.Assert(s.cached("evicted"), T.Equals, true)
+	c.Assert(s.downloader.EnsureBlob(context.Background(), "evicted"), T.IsNil)
+	c.Assert(s.host.requests["evicted"], T.Equals, 1)
+
+	// or the one of the queues
+	s.save(c, "queued", metadata.IdRootFolder, strings.Repeat("y", 64*10), false)
+	file, err := s.metaService.Get("queued")
+	c.Assert(err, T.IsNil)
+	go s.downloader.download(file)
+	c.Assert(s.downloader.EnsureBlob(context.Background(), "queued"), T.IsNil)
+	c.Assert(s.cached("queued"), T.Equals, true)
+	c.Assert(s.host.requests["queued"], T.Equals, 1)
+
+	// the failures of the download are returned
+	s.downloader.opts.BinaryRetry = &RetryPolicy{Attempts: 1}
+	s.save(c, "failing", metadata.IdRootFolder, "content", false)
+	s.host.failures["failing"] = 1
+	c.Assert(s.downloader.EnsureBlob(context.Background(), "failing"), T.ErrorMatches, "error downloading failing.*")
+
+	uncached := &metadata.CachedDriveFile{Id: "large", ParentId: metadata.IdRootFolder, Name: "large", Uncached: true}
+	c.Assert(s.metaService.Save(metadata.IdRootFolder, "large", uncached, false, false), T.IsNil)
+	c.Assert(s.downloader.EnsureBlob(context.Background(), "large"), T.Equals, ErrUncached)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Assert(s.downloader.EnsureBlob(ctx, "evicted"), T.Equals, context.Canceled)
+}
+
+func (s *DownloaderSuite) TestStaleContentIsReadDuringRefresh(c *T.C) {
+	content := strings.Repeat("0123456789", 64)
+	s.save(c, "file", metadata.IdRootFolder, content, false)
+	c.Assert(s.blobMngr.Save("file", "old", ioutil.NopCloser(strings.NewReader("old content"))), T.IsNil)
+	c.Assert(s.metaService.Save(metadata.IdRootFolder, "file", &metadata.CachedDriveFile{
+		Id: "file", ParentId: metadata.IdRootFolder, Name: "file", FileSize: int64(len(content)),
+		Md5Checksum: fmt.Sprintf("%x", md5.Sum([]byte(content))), StaleChecksum: "old",
+	}, true, false), T.IsNil)
+	file, err := s.metaService.Get("file")
+	c.Assert(err, T.IsNil)
+	// listed while its content is downloaded
+	_, err = s.metaService.LookUp(metadata.IdRootFolder, "file")
+	c.Assert(err, T.IsNil)
+
+	s.host.chunkDelay = 10 * time.Millisecond
+	done := make(chan error, 1)
+	go func() {
+		done <- s.downloader.download(file)
+	}()
+	for inFlight := s.downloader.InFlight(); len(inFlight) == 0 || inFlight[0].BytesDone == 0; inFlight = s.downloader.InFlight() {
+		select {
+		case err := <-done:
+			c.Fatalf("download completed before it was read: %v", err)
+		case <-time.After(time.Millisecond):
+		}
+	}
+	// the content is being saved, the stale one is still read
+	file, err = s.metaService.Get("file")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.ActiveChecksum(), T.Equals, "old")
+	data, size, err := s.blobMngr.Read("file", file.ActiveChecksum(), 0, 64)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, "old content")
+
+	c.Assert(<-done, T.IsNil)
+	file, err = s.metaService.Get("file")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.StaleChecksum, T.Equals, "")
+	data, size, err = s.blobMngr.Read("file", file.ActiveChecksum(), 0, len(content))
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, content)
+	c.Assert(s.blobMngr.Exists("file", "old"), T.Equals, false)
+}
+
+func (s *DownloaderSuite) TestCopiesAreLinkedInsteadOfDownloaded(c *T.C) {
+	s.blobMngr = blob.New(c.MkDir(), &blob.Options{Dedup: true})
+	s.downloader.blobMngr = s.blobMngr
+	s.host.requests = make(map[string]int)
+	content := "shared content"
+	sum := fmt.Sprintf("%x", md5.Sum([]byte(content)))
+	for _, id := range []string{"original", "copy"} {
+		s.save(c, id, metadata.IdRootFolder, content, false)
+		c.Assert(s.metaService.Save(metadata.IdRootFolder, id, &metadata.CachedDriveFile{
+			Id: id, ParentId: metadata.IdRootFolder, Name: id, FileSize: int64(len(content)), Md5Checksum: sum,
+		}, true, false), T.IsNil)
+		file, err := s.metaService.Get(id)
+		c.Assert(err, T.IsNil)
+		c.Assert(s.downloader.download(file), T.IsNil)
+	}
+	c.Assert(s.host.requests, T.DeepEquals, map[string]int{"original": 1})
+	data, size, err := s.blobMngr.Read("copy", sum, 0, len(content))
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, content)
+	queued, err := s.metaService.IsQueuedForIO("download", "copy")
+	c.Assert(err, T.IsNil)
+	c.Assert(queued, T.Equals, false)
+}
+
+func (s *DownloaderSuite) TestLargeFilesAreFetchedLazily(c *T.C) {
+	client := &http.Client{Transport: s.host}
+	s.blobMngr = blob.New(c.MkDir(), &blob.Options{Lazy: NewRangeFetcher(client, s.metaService), LazyChunkSize: 4})
+	s.downloader.blobMngr = s.blobMngr
+	s.downloader.opts.LazyMinSize = 10
+	s.host.requests = make(map[string]int)
+	s.save(c, "small", metadata.IdRootFolder, "tiny", false)
+	s.save(c, "large", metadata.IdRootFolder, "the content of a large video", false)
+	for _, id := range []string{"small", "large"} {
+		file, err := s.metaService.Get(id)
+		c.Assert(err, T.IsNil)
+		c.Assert(s.downloader.download(file), T.IsNil)
+		queued, err := s.metaService.IsQueuedForIO("download", id)
+		c.Assert(err, T.IsNil)
+		c.Assert(queued, T.Equals, false)
+	}
+	c.Assert(s.host.requests, T.DeepEquals, map[string]int{"small": 1})
+
+	// only the chunks of the range read are fetched
+	data, size, err := s.blobMngr.Read("large", "md5large", 6, 6)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, "ntent ")
+	c.Assert(s.host.requests["large"], T.Equals, 2)
+	c.Assert(s.host.ranges, T.DeepEquals, []string{"bytes=4-7", "bytes=8-11"})
+	c.Assert(s.cached("large"), T.Equals, true)
+}
+
+func (s *DownloaderSuite) TestRangesAreFetchedFromTheDownloadUrls(c *T.C) {
+	fetch := NewRangeFetcher(&http.Client{Transport: s.host}, s.metaService)
+	urls := map[string]string{
+		"api":     "",
+		"fast":    "https://example.com/download/fast",
+		"expired": "https://example.com/expired/expired",
+	}
+	for id, link := range urls {
+		file := &metadata.CachedDriveFile{Id: id, ParentId: metadata.IdRootFolder, Name: id, Md5Checksum: "md5" + id, DownloadUrl: link}
+		c.Assert(s.metaService.Save(metadata.IdRootFolder, id, file, false, false), T.IsNil)
+		s.host.contents[id] = "content of " + id
+	}
+	doc := &metadata.CachedDriveFile{Id: "doc", ParentId: metadata.IdRootFolder, Name: "doc", MimeType: "application/vnd.google-apps.document"}
+	c.Assert(s.metaService.Save(metadata.IdRootFolder, "doc", doc, false, false), T.IsNil)
+	s.host.contents["doc"] = "content of doc"
+	// without metadata, e.g. not synced yet
+	s.host.contents["unknown"] = "content of unknown"
+
+	for _, id := range []string{"api", "fast", "expired", "doc", "unknown"} {
+		data, err := fetch(id, 3, 5)
+		c.Assert(err, T.IsNil, T.Commentf(id))
+		c.Assert(string(data), T.Equals, "tent ", T.Commentf(id))
+	}
+	sort.Strings(s.host.paths)
+	c.Assert(s.host.paths, T.DeepEquals, []string{
+		"/download/fast",
+		"/drive/v2/files/api",
+		"/drive/v2/files/expired",
+		"/drive/v2/files/unknown",
+		"/drive/v3/files/doc/export",
+		"/expired/expired",
+	})
+}
+
+func (s *DownloaderSuite) TestStalePartialDownloadsStartOver(c *T.C) {
+	s.save(c, "shrunk", metadata.IdRootFolder, strings.Repeat("x", 1000), false)
+	file, err := s.metaService.Get("shrunk")
+	c.Assert(err, T.IsNil)
+	s.host.cuts = map[string]int{"shrunk": 900}
+	c.Assert(s.downloader.download(file), T.NotNil)
+
+	// the range can't be served, downloaded from the start again
+	s.host.contents["shrunk"] = "short content"
+	c.Assert(s.downloader.download(file), T.IsNil)
+	c.Assert(s.host.ranges, T.DeepEquals, []string{"bytes=900-"})
+	data, size, err := s.blobMngr.Read("shrunk", file.Md5Checksum, 0, 100)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, "short content")
+}
+
+func (s *DownloaderSuite) TestHooksRunAfterDownloads(c *T.C) {
+	type call struct{ hook, id, name, path string }
+	calls := make(chan call, 4)
+	hook := func(name string, err error) DownloadHook {
+		return func(fileId string, fileName string, path string, file *metadata.CachedDriveFile) error {
+			c.Check(file.Id, T.Equals, fileId)
+			calls <- call{name, fileId, fileName, path}
+			return err
+		}
+	}
+	s.downloader.AddHook(hook("first", nil))
+	s.downloader.AddHook(hook("second", errors.New("scan failed")))
+
+	s.save(c, "file-a", metadata.IdRootFolder, "content of a", false)
+	file, err := s.metaService.Get("file-a")
+	c.Assert(err, T.IsNil)
+	c.Assert(s.downloader.download(file), T.IsNil)
+	entry, ok := s.blobMngr.Stat("file-a")
+	c.Assert(ok, T.Equals, true)
+	for _, name := range []string{"first", "second"} {
+		select {
+		case got := <-calls:
+			c.Assert(got, T.Equals, call{name, "file-a", "file-a", entry.Path})
+		case <-time.After(5 * time.Second):
+			c.Fatal("hook ", name, " didn't run")
+		}
+	}
+
+	// the failing hook didn't fail the download, its error is collected once
+	c.Assert(s.cached("file-a"), T.Equals, true)
+	var errs []error
+	for i := 0; i < 100 && len(errs) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		errs = s.downloader.HookErrors()
+	}
+	c.Assert(errs, T.HasLen, 1)
+	c.Assert(errs[0], T.ErrorMatches, ".*file-a.*scan failed")
+	c.Assert(s.downloader.HookErrors(), T.HasLen, 0)
+}
+
+func (s *DownloaderSuite) TestDownloadsAreThrottled(c *T.C) {
+	const size, rate = 3000, 10000
+	s.downloader.SetRateLimit(rate)
+	ids := []string{"file-a", "file-b"}
+	for _, id := range ids {
+		s.save(c, id, metadata.IdRootFolder, strings.Repeat("x", size), false)
+	}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		file, err := s.metaService.Get(id)
+		c.Assert(err, T.IsNil)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Check(s.downloader.download(file), T.IsNil)
+		}()
+	}
+	wg.Wait()
+	// the rate limit is shared by the downloads
+	elapsed := time.Since(start)
+	expected := time.Duration(len(ids)) * size * time.Second / rate
+	c.Assert(elapsed > expected*3/4, T.Equals, true, T.Commentf("took %v", elapsed))
+	c.Assert(elapsed < expected*2, T.Equals, true, T.Commentf("took %v", elapsed))
+	for _, id := range ids {
+		c.Assert(s.cached(id), T.Equals, true)
+	}
+
+	// unlimited
+	s.downloader.SetRateLimit(0)
+	s.save(c, "file-c", metadata.IdRootFolder, strings.Repeat("x", 10*size), false)
+	file, err := s.metaService.Get("file-c")
+	c.Assert(err, T.IsNil)
+	start = time.Now()
+	c.Assert(s.downloader.download(file), T.IsNil)
+	c.Assert(time.Since(start) < expected/2, T.Equals, true)
+	c.Assert(s.cached("file-c"), T.Equals, true)
+}
@@ -0,0 +1,96 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileio
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// Returned by EnsureBlob for the files whose content is never
+	// cached, see metadata.CachedDriveFile.Uncached.
+	ErrUncached = errors.New("fileio: the content of the file is not cached")
+
+	// Interval at which a fetch waiting for a download of the queues
+	// checks whether it failed, to download the file itself.
+	fetchPollInterval = time.Second
+)
+
+// fetch is a download requested by the reads of a file, shared by the
+// concurrent ones, see EnsureBlob.
+type fetch struct {
+	done chan struct{} // closed once the download is done
+	err  error
+}
+
+// EnsureBlob downloads the content of the file identified by id if it
+// is not cached, e.g. its blob was evicted or it was not downloaded
+// yet, and blocks until it is cached or the download fails. It lets the
+// reads missing the cache fetch the content they need. Concurrent calls
+// for the same file share a single download. Returns the error of ctx
+// if it is done first, the download goes on for the other calls.
+func (d *Downloader) EnsureBlob(ctx context.Context, id string) error {
+	d.muFetches.Lock()
+	f, ok := d.fetches[id]
+	if !ok {
+		f = &fetch{done: make(chan struct{})}
+		d.fetches[id] = f
+		go d.runFetch(id, f)
+	}
+	d.muFetches.Unlock()
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *Downloader) runFetch(id string, f *fetch) {
+	f.err = d.fetchFile(id)
+	d.muFetches.Lock()
+	delete(d.fetches, id)
+	d.muFetches.Unlock()
+	close(f.done)
+}
+
+// Downloads the content of the file identified by id unless it is
+// fresh. If the queues are downloading it, waits for their download,
+// and takes over if it fails.
+func (d *Downloader) fetchFile(id string) error {
+	for {
+		file, err := d.metaService.Get(id)
+		if err != nil {
+			return err
+		}
+		if file.Uncached {
+			return ErrUncached
+		}
+		if d.isFresh(file) {
+			return nil
+		}
+		if err = d.download(file); err != errInFlight {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(d.ctx, fetchPollInterval)
+		err = d.WaitFile(ctx, id)
+		cancel()
+		if err != context.DeadlineExceeded {
+			return err
+		}
+	}
+}
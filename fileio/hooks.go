@@ -0,0 +1,118 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileio
+
+import (
+	"fmt"
+
+	"github.com/rakyll/drivefuse/logger"
+	"github.com/rakyll/drivefuse/metadata"
+)
+
+const (
+	// Number of the downloaded files waiting for their hooks to run,
+	// the hooks of the files downloaded while it is full are skipped.
+	hookQueueSize = 256
+
+	// Number of the errors of the hooks kept until they are collected,
+	// see HookErrors.
+	maxHookErrors = 100
+)
+
+// DownloadHook is called once the content of a file is downloaded,
+// with the id and the local name of the file, the path of its blob and
+// its metadata, e.g. to scan or index the content. The blob must not
+// be modified nor removed.
+type DownloadHook func(fileId string, name string, path string, file *metadata.CachedDriveFile) error
+
+// hookRun is a downloaded file waiting for the hooks to run.
+type hookRun struct {
+	file *metadata.CachedDriveFile
+	path string
+}
+
+// AddHook registers a hook called after each download, once the blob is
+// saved and the file is marked as downloaded. Hooks run in the order
+// they are registered, one file at a time, apart from the downloads.
+// Their errors don't fail the downloads, they are collected by
+// HookErrors. Files whose contents are not stored whole, e.g. in
+// pass-through mode or as sparse blobs, are not hooked.
+func (d *Downloader) AddHook(hook DownloadHook) {
+	d.muHooks.Lock()
+	defer d.muHooks.Unlock()
+	d.hooks = append(d.hooks, hook)
+	d.hooksOnce.Do(func() { go d.runHooks() })
+}
+
+// HookErrors returns the errors of the hooks since the last call, up to
+// the last maxHookErrors of them, e.g. to be reported with the results
+// of the syncs, see syncer.SyncOptions.Errors.
+func (d *Downloader) HookErrors() []error {
+	d.muHooks.Lock()
+	defer d.muHooks.Unlock()
+	errs := d.hookErrors
+	d.hookErrors = nil
+	return errs
+}
+
+func (d *Downloader) hookError(err error) {
+	logger.V(err)
+	d.muHooks.Lock()
+	defer d.muHooks.Unlock()
+	if len(d.hookErrors) == maxHookErrors {
+		d.hookErrors = d.hookErrors[1:]
+	}
+	d.hookErrors = append(d.hookErrors, err)
+}
+
+// Queues the hooks of the downloaded file, if any are registered and
+// its blob is stored whole.
+func (d *Downloader) queueHooks(file *metadata.CachedDriveFile) {
+	d.muHooks.Lock()
+	hooked := len(d.hooks) > 0
+	d.muHooks.Unlock()
+	if !hooked {
+		return
+	}
+	entry, ok := d.blobMngr.Stat(file.Id)
+	if !ok {
+		return
+	}
+	select {
+	case d.hookQueue <- hookRun{file: file, path: entry.Path}:
+	default:
+		d.hookError(fmt.Errorf("skipping the hooks of %v, too many downloads are waiting for them", file.Id))
+	}
+}
+
+// Runs the hooks of the downloaded files until the downloader is
+// stopped.
+func (d *Downloader) runHooks() {
+	for {
+		select {
+		case run := <-d.hookQueue:
+			d.muHooks.Lock()
+			hooks := d.hooks
+			d.muHooks.Unlock()
+			for _, hook := range hooks {
+				if err := hook(run.file.Id, run.file.Name, run.path, run.file); err != nil {
+					d.hookError(fmt.Errorf("error in the hook of %v: %w", run.file.Id, err))
+				}
+			}
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
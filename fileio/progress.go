@@ -0,0 +1,126 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileio
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// Period over which the instantaneous download speed is measured.
+	intervalSpeedSample = time.Second
+)
+
+// Progress is a snapshot of an in-flight download.
+type Progress struct {
+	Id string
+
+	// Number of bytes downloaded so far.
+	BytesDone int64
+
+	// Size of the file, zero if unknown.
+	BytesTotal int64
+
+	// Speed in bytes per second over the last sampling period and
+	// since the download started.
+	Speed        float64
+	AverageSpeed float64
+
+	// Estimated time remaining, zero if it can't be estimated.
+	ETA time.Duration
+}
+
+// transfer wraps the body of a download and tracks its progress.
+type transfer struct {
+	io.ReadCloser
+
+	mu          sync.Mutex
+	id          string
+	resumed     int64 // bytes done before the transfer started
+	done        int64
+	total       int64
+	started     time.Time
+	sampleStart time.Time
+	sampleBytes int64
+	speed       float64
+}
+
+// Creates a new transfer of the body of a download resumed at offset,
+// of length bytes if it is known.
+func newTransfer(id string, offset int64, length int64, body io.ReadCloser) *transfer {
+	now := time.Now()
+	total := length
+	if length > 0 {
+		total += offset
+	}
+	return &transfer{
+		ReadCloser:  body,
+		id:          id,
+		resumed:     offset,
+		done:        offset,
+		total:       total,
+		started:     now,
+		sampleStart: now,
+	}
+}
+
+func (t *transfer) Read(p []byte) (n int, err error) {
+	n, err = t.ReadCloser.Read(p)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done += int64(n)
+	t.sampleBytes += int64(n)
+	now := time.Now()
+	if elapsed := now.Sub(t.sampleStart); elapsed >= intervalSpeedSample {
+		t.speed = float64(t.sampleBytes) / elapsed.Seconds()
+		t.sampleStart = now
+		t.sampleBytes = 0
+	}
+	return
+}
+
+// Returns the number of bytes left to download, negative if the length
+// of the body is unknown, so that the blob manager checks that there
+// is room for them, see blob.Sized.
+func (t *transfer) Remaining() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.total <= 0 {
+		return -1
+	}
+	return t.total - t.done
+}
+
+func (t *transfer) progress() Progress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := Progress{Id: t.id, BytesDone: t.done, BytesTotal: t.total, Speed: t.speed}
+	if elapsed := time.Since(t.started).Seconds(); elapsed > 0 {
+		p.AverageSpeed = float64(t.done-t.resumed) / elapsed
+	}
+	if p.Speed == 0 {
+		// no full sample yet
+		p.Speed = p.AverageSpeed
+	}
+	if p.BytesTotal > 0 && p.Speed > 0 {
+		remaining := float64(p.BytesTotal - p.BytesDone)
+		p.ETA = time.Duration(remaining / p.Speed * float64(time.Second))
+	}
+	return p
+}
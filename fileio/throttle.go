@@ -0,0 +1,136 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileio
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// Time of downloading at the rate limit the bucket of the limiter
+	// holds, the bursts after idle periods are at most this long.
+	rateBurst = 100 * time.Millisecond
+)
+
+// rateLimiter is a token bucket shared by the downloads, so that their
+// aggregate rate stays under a number of bytes per second. Tokens are
+// reserved as the bytes are read, a read that overdraws the bucket
+// waits until the bucket is refilled.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    int64 // bytes per second, zero if unlimited
+	tokens  float64
+	last    time.Time     // of the last refill
+	changed chan struct{} // closed once the rate changes
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	l := &rateLimiter{changed: make(chan struct{})}
+	l.setRate(rate)
+	return l
+}
+
+// Changes the rate, zero or less for unlimited. The bucket starts over
+// empty, the reads waiting for the previous rate are released.
+func (l *rateLimiter) setRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = max(rate, 0)
+	l.tokens, l.last = 0, time.Now()
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Returns the capacity of the bucket in bytes, at least one byte.
+func (l *rateLimiter) burst() int {
+	return max(int(l.rate*int64(rateBurst)/int64(time.Second)), 1)
+}
+
+// Returns the number of bytes a read takes at most, so that the rate
+// stays smooth, zero if the rate is unlimited.
+func (l *rateLimiter) maxRead() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return 0
+	}
+	return l.burst()
+}
+
+// Reserves n bytes and waits until the bucket holds them, or ctx is
+// done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(l.rate), float64(l.burst()))
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	changed := l.changed
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-changed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// throttledReader reads the body of a download under the rate limit.
+type throttledReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *rateLimiter
+}
+
+func (r *throttledReader) Read(p []byte) (n int, err error) {
+	if limit := r.limiter.maxRead(); limit > 0 && len(p) > limit {
+		p = p[:limit]
+	}
+	n, err = r.ReadCloser.Read(p)
+	if n == 0 {
+		return
+	}
+	if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return
+}
+
+// Returns the body read under the rate limit of the downloads, see
+// Options.RateLimit.
+func (d *Downloader) throttle(ctx context.Context, body io.ReadCloser) io.ReadCloser {
+	return &throttledReader{ReadCloser: body, ctx: ctx, limiter: d.limiter}
+}
+
+// SetRateLimit changes the limit of the aggregate rate of the downloads
+// in bytes per second, zero for unlimited, see Options.RateLimit. The
+// downloads in progress are throttled at the new rate.
+func (d *Downloader) SetRateLimit(rate int64) {
+	d.limiter.setRate(rate)
+}
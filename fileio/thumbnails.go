@@ -0,0 +1,153 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileio
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rakyll/drivefuse/logger"
+)
+
+const (
+	// Thumbnails are a few KBs each, a small cache holds thousands.
+	DefaultMaxThumbnailBytes = 32 << 20
+
+	// Time limit of fetching a thumbnail.
+	thumbnailTimeout = 30 * time.Second
+)
+
+// Thumbnails fetches and caches the thumbnails of Drive files, apart
+// from their contents. Once the cache grows over its size cap, the
+// least recently used thumbnails are evicted.
+type Thumbnails struct {
+	client   *http.Client
+	dir      string
+	maxBytes int64
+	timeout  time.Duration
+
+	mu sync.Mutex
+}
+
+// Creates a new thumbnail cache in dir, holding at most maxBytes of
+// thumbnails. A maxBytes of zero uses DefaultMaxThumbnailBytes.
+func NewThumbnails(client *http.Client, dir string, maxBytes int64) (*Thumbnails, error) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxThumbnailBytes
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &Thumbnails{client: client, dir: dir, maxBytes: maxBytes, timeout: thumbnailTimeout}, nil
+}
+
+// Fetches the thumbnail of the file identified by id from link and
+// caches it, replacing the previous one.
+func (t *Thumbnails) Fetch(id string, link string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", link, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("error fetching thumbnail of %v: %v", id, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, t.maxBytes+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > t.maxBytes {
+		return fmt.Errorf("thumbnail of %v is larger than the cache", id)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err = ioutil.WriteFile(t.path(id), data, 0640); err != nil {
+		return err
+	}
+	return t.evict(id)
+}
+
+// Returns the cached thumbnail of the file identified by id.
+func (t *Thumbnails) Thumbnail(id string) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	data, err := ioutil.ReadFile(t.path(id))
+	if err != nil {
+		return nil, err
+	}
+	// mark as recently used
+	now := time.Now()
+	os.Chtimes(t.path(id), now, now)
+	return data, nil
+}
+
+// Removes the cached thumbnail of the file identified by id.
+func (t *Thumbnails) Delete(id string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := os.Remove(t.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Removes the least recently used thumbnails, other than keep, until
+// the cache fits into its size cap.
+func (t *Thumbnails) evict(keep string) error {
+	files, err := ioutil.ReadDir(t.dir)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, file := range files {
+		total += file.Size()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, file := range files {
+		if total <= t.maxBytes {
+			break
+		}
+		if file.Name() == keep {
+			continue
+		}
+		logger.V("Evicting thumbnail", file.Name())
+		if err = os.Remove(filepath.Join(t.dir, file.Name())); err != nil {
+			return err
+		}
+		total -= file.Size()
+	}
+	return nil
+}
+
+func (t *Thumbnails) path(id string) string {
+	return filepath.Join(t.dir, id)
+}
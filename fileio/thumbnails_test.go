@@ -0,0 +1,108 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileio
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rakyll/drivefuse/metadata"
+	T "github.com/rakyll/drivefuse/third_party/launchpad.net/gocheck"
+)
+
+type ThumbnailsSuite struct {
+	host       *fakeHost
+	thumbnails *Thumbnails
+}
+
+var _ = T.Suite(&ThumbnailsSuite{})
+
+func (s *ThumbnailsSuite) SetUpTest(c *T.C) {
+	s.host = &fakeHost{contents: make(map[string]string), failures: make(map[string]int)}
+	var err error
+	s.thumbnails, err = NewThumbnails(&http.Client{Transport: s.host}, filepath.Join(c.MkDir(), "thumbnails"), 10)
+	c.Assert(err, T.IsNil)
+}
+
+// Returns a thumbnail link served by the fake host.
+func (s *ThumbnailsSuite) link(id string, content string) string {
+	s.host.contents["thumb-"+id] = content
+	return "https://example.com/host/thumb-" + id
+}
+
+// Makes the cached thumbnail look used at the given time.
+func (s *ThumbnailsSuite) touch(c *T.C, id string, at time.Time) {
+	c.Assert(os.Chtimes(s.thumbnails.path(id), at, at), T.IsNil)
+}
+
+func (s *ThumbnailsSuite) TestFetchAndServe(c *T.C) {
+	c.Assert(s.thumbnails.Fetch("photo", s.link("photo", "png")), T.IsNil)
+	data, err := s.thumbnails.Thumbnail("photo")
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data), T.Equals, "png")
+
+	_, err = s.thumbnails.Thumbnail("other")
+	c.Assert(err, T.NotNil)
+	c.Assert(s.thumbnails.Delete("photo"), T.IsNil)
+	_, err = s.thumbnails.Thumbnail("photo")
+	c.Assert(err, T.NotNil)
+}
+
+func (s *ThumbnailsSuite) TestEvictsLeastRecentlyUsed(c *T.C) {
+	now := time.Now()
+	c.Assert(s.thumbnails.Fetch("old", s.link("old", "1234")), T.IsNil)
+	s.touch(c, "old", now.Add(-2*time.Hour))
+	c.Assert(s.thumbnails.Fetch("used", s.link("used", "1234")), T.IsNil)
+	s.touch(c, "used", now.Add(-3*time.Hour))
+	_, err := s.thumbnails.Thumbnail("used")
+	c.Assert(err, T.IsNil)
+
+	// over the cap of 10 bytes, the least recently used goes
+	c.Assert(s.thumbnails.Fetch("new", s.link("new", "1234")), T.IsNil)
+	_, err = s.thumbnails.Thumbnail("old")
+	c.Assert(err, T.NotNil)
+	for _, id := range []string{"used", "new"} {
+		_, err = s.thumbnails.Thumbnail(id)
+		c.Assert(err, T.IsNil)
+	}
+
+	c.Assert(s.thumbnails.Fetch("huge", s.link("huge", strings.Repeat("x", 11))), T.NotNil)
+}
+
+func (s *ThumbnailsSuite) TestFetchTimesOut(c *T.C) {
+	s.host.chunkDelay = 200 * time.Millisecond
+	s.thumbnails.timeout = 20 * time.Millisecond
+	start := time.Now()
+	c.Assert(s.thumbnails.Fetch("photo", s.link("photo", "png")), T.NotNil)
+	c.Assert(time.Since(start) < 150*time.Millisecond, T.Equals, true)
+	_, err := s.thumbnails.Thumbnail("photo")
+	c.Assert(err, T.NotNil)
+}
+
+func (s *DownloaderSuite) TestThumbnailIsIndependentOfBlob(c *T.C) {
+	thumbnails, err := NewThumbnails(&http.Client{Transport: s.host}, filepath.Join(c.MkDir(), "thumbnails"), 0)
+	c.Assert(err, T.IsNil)
+	s.save(c, "photo", metadata.IdRootFolder, "full size photo", false)
+	s.host.contents["thumb-photo"] = "small photo"
+	c.Assert(thumbnails.Fetch("photo", "https://example.com/host/thumb-photo"), T.IsNil)
+
+	data, err := thumbnails.Thumbnail("photo")
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data), T.Equals, "small photo")
+	c.Assert(s.cached("photo"), T.Equals, false)
+}
@@ -59,3 +59,34 @@ func V(args ...interface{}) {
 		log.Println(args...)
 	}
 }
+
+// Logger receives the logs of a component, e.g. to route them into the
+// logging of an application embedding it. It is called from multiple
+// goroutines.
+type Logger interface {
+	// Logs the errors and the notable events, like V.
+	V(args ...interface{})
+
+	// Logs the details of the work, e.g. of each page of changes, like
+	// D.
+	D(args ...interface{})
+}
+
+var (
+	// Logs to the standard logger at the level of DRIVEFUSE_LOGLEVEL,
+	// like the functions of the package.
+	Default Logger = std{}
+
+	// Drops the logs.
+	Discard Logger = discard{}
+)
+
+type std struct{}
+
+func (std) V(args ...interface{}) { V(args...) }
+func (std) D(args ...interface{}) { D(args...) }
+
+type discard struct{}
+
+func (discard) V(args ...interface{}) {}
+func (discard) D(args ...interface{}) {}
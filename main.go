@@ -15,10 +15,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"io"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -31,20 +34,94 @@ import (
 	"github.com/rakyll/drivefuse/metadata"
 	"github.com/rakyll/drivefuse/mount"
 	"github.com/rakyll/drivefuse/syncer"
+)
 
-	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
+const (
+	// Size of the in-memory read window in pass-through mode.
+	passThroughBufferSize = 1 << 20
 )
 
 var (
-	flagDataDir    = flag.String("datadir", config.DefaultDataDir(), "path of the data directory")
-	flagMountPoint = flag.String("mountpoint", config.DefaultMountpoint(), "mount point")
-	flagBlockSync  = flag.Bool("blocksync", false, "set true to force blocking sync on startup")
+	flagDataDir     = flag.String("datadir", config.DefaultDataDir(), "path of the data directory")
+	flagMountPoint  = flag.String("mountpoint", config.DefaultMountpoint(), "mount point")
+	flagBlockSync   = flag.Bool("blocksync", false, "set true to force blocking sync on startup")
+	flagPassThrough = flag.Bool("passthrough", false, "set true to stream reads from Drive without caching blobs locally")
+	flagLazyMinSize = flag.Int64("lazy_min_size", 0, "size in bytes from which files are not downloaded, the ranges read are fetched on demand, 0 to download all files")
+	flagMaxBlobSize = flag.Int64("max_blob_size", 0, "size in bytes from which the contents of files are not cached, the files are listed but can't be read, 0 to cache all files")
+	flagNamespace   = flag.String("namespace", "", "name of the account to keep the blobs and the change ids of apart, to sync several accounts into one data directory")
+	flagStagingDir  = flag.String("staging_dir", "", "directory to write the blobs being saved to before they are moved into the data directory, e.g. on a faster disk")
+
+	flagFsync      = flag.String("fsync", "onclose", "when blob writes are synced to disk: none, onclose or always")
+	flagHeal       = flag.Bool("heal", false, "set true to download blobs again if reading them fails, instead of returning an error")
+	flagReadAhead  = flag.Bool("readahead", false, "set true to advise the OS to read ahead the blobs read sequentially, Linux only")
+	flagAheadBuf   = flag.Int("readahead_buffer", 0, "bytes to read ahead into memory on sequential reads of a blob, 0 to disable")
+	flagCompress   = flag.Bool("compress_blobs", false, "set true to store the blobs gzip-compressed on disk, unless they don't compress well")
+	flagShardLvls  = flag.Int("blob_shard_levels", blob.DefaultShardLevels, "levels of the directories the blobs are sharded into, -1 for none")
+	flagShardChars = flag.Int("blob_shard_chars", blob.DefaultShardChars, "characters of the ids naming each level of the blob shard directories")
+	flagDedup      = flag.Bool("dedup_blobs", false, "set true to store the identical contents of different files once on disk, as hard links")
+	flagFileMode   = flag.String("blob_file_mode", "0640", "octal permission bits of the blobs, less the umask")
+	flagDirMode    = flag.String("blob_dir_mode", "0750", "octal permission bits of the directories of the blobs, less the umask")
+	flagPassphrase = flag.String("passphrase_file", "", "file holding a passphrase to encrypt the blobs on disk with, costs CPU time on reads and saves")
+	flagThumbnails = flag.Bool("thumbnails", false, "set true to cache the thumbnails of the synced files")
+	flagFileIds    = flag.String("file_ids", "", "comma separated ids of the only files to sync, into the root folder")
+	flagFolderIds  = flag.String("folder_ids", "", "comma separated ids of the only folders of My Drive to sync, into the root folder")
+	flagMimeTypes  = flag.String("mime_types", "", "comma separated mime types of the only files to sync, or patterns of them, e.g. image/*,application/pdf")
+	flagExcluded   = flag.String("exclude_mime_types", "", "comma separated mime types of the files not to sync, or patterns of them, e.g. video/*")
+	flagPruneEmpty = flag.Bool("prune_empty_folders", false, "set true to remove the folders left without any synced file, e.g. by -mime_types")
+	flagSubscribed = flag.Bool("include_subscribed", false, "set true to also sync the files outside of My Drive, such as the ones shared with the user")
+	flagDrives     = flag.String("shared_drives", "", "comma separated ids of the shared drives to sync besides My Drive, into the root folder")
+	flagSymlinks   = flag.Bool("shortcut_symlinks", false, "set true to show Drive shortcuts as symlinks instead of as their targets")
+	flagOffline    = flag.Bool("offline", false, "set true to serve the cached files without syncing")
+	flagExports    = flag.String("export_formats", "", "comma separated formats to export Google docs to by kind, or link to store links opening them online, e.g. document=pdf,form=link")
+	flagExtensions = flag.String("extensions", "", "comma separated extensions to append to the names of the files by mime type unless they end with one, default for the usual ones, e.g. default,image/heic=heic")
+	flagConflicts  = flag.String("conflicts", "keep_both", "how files edited both locally and on Drive are merged: keep_both, prefer_local or prefer_remote")
+	flagNames      = flag.String("name_policy", "posix", "characters and names the local file names can't hold: posix, or windows for the ones Windows reserves too")
+
+	flagCacheMax  = flag.Int64("cache_max_size", 0, "cache size in bytes to evict the least recently used blobs at, 0 for no limit")
+	flagCacheHigh = flag.Int64("cache_high_watermark", 0, "cache size in bytes to warn at, 0 to never warn")
+	flagCacheLow  = flag.Int64("cache_low_watermark", 0, "cache size in bytes to clear the warning at, below the high watermark")
+
+	flagSyncInterval    = flag.Duration("sync_interval", syncer.DefaultSyncInterval, "interval between the syncs while there are changes")
+	flagMaxSyncInterval = flag.Duration("max_sync_interval", syncer.DefaultMaxSyncInterval, "interval between the syncs the interval grows to while there are no changes")
+	flagStartJitter     = flag.Duration("start_jitter", syncer.DefaultStartJitter, "maximum random delay of the first sync, so that many mounts started at once don't call Drive together, 0 for none")
+	flagSyncJitter      = flag.Float64("sync_jitter", syncer.DefaultIntervalJitter, "fraction of the interval between the syncs by which each one is randomly shifted, 0 for none")
+
+	flagMetadataConcurrency = flag.Int("metadata_concurrency", 0, "maximum number of concurrent metadata database calls, 0 for no limit")
+
+	flagDownloadTimeout = flag.Duration("download_timeout", fileio.DefaultBinaryRetry.Timeout, "time limit of downloading a file, including the retries")
+
+	flagExportAttempts = flag.Int("export_attempts", fileio.DefaultExportRetry.Attempts, "number of attempts to export a Google doc before giving up")
+	flagExportDelay    = flag.Duration("export_delay", fileio.DefaultExportRetry.Delay, "delay before retrying a failed export, doubled after each retry")
+	flagExportTimeout  = flag.Duration("export_timeout", fileio.DefaultExportRetry.Timeout, "time limit of exporting a Google doc, including the retries")
+
+	flagQuarantineFailures = flag.Int("quarantine_failures", fileio.DefaultQuarantine.Failures, "number of failed downloads in a row after which a file is quarantined, 0 to never quarantine")
+	flagQuarantineCooldown = flag.Duration("quarantine_cooldown", fileio.DefaultQuarantine.Cooldown, "time until the download of a quarantined file is attempted again")
+
+	flagDownloadWorkers = flag.Int("download_workers", fileio.DefaultWorkers, "number of small and of large files downloaded at the same time")
+	flagDownloadRate    = flag.Int64("download_rate", 0, "limit of the aggregate rate of the downloads in bytes per second, 0 for unlimited")
+
+	flagResumableThreshold = flag.Int64("resumable_upload_threshold", syncer.DefaultResumableThreshold, "size in bytes from which contents are uploaded in chunks that survive interruptions")
+	flagUploadChunkSize    = flag.Int64("upload_chunk_size", syncer.DefaultUploadChunkSize, "size in bytes of the chunks of the resumable uploads, a multiple of 256 KiB")
+
+	flagCollectInterval = flag.Duration("blob_gc_interval", 24*time.Hour, "interval between the removals of the cached blobs left without a file, 0 to never remove them")
+	flagCollectGrace    = flag.Duration("blob_gc_grace", syncer.DefaultCollectGrace, "blobs modified within this time before the last sync are never removed as left without a file")
+	flagTrashRetention  = flag.Duration("trash_retention", 0, "time the files deleted on Drive are kept in a local trash to restore them from, 0 to delete them right away")
+
+	flagWebhookAddress = flag.String("webhook_address", "", "https url Drive notifies of the changes, routed to -webhook_listen; empty to only poll the changes")
+	flagWebhookListen  = flag.String("webhook_listen", "", "address to receive the notifications of the changes at, e.g. :8080")
+
+	flagMaxRequests = flag.Int("max_concurrent_requests", syncer.DefaultMaxConcurrentRequests, "maximum number of requests to Drive in flight at the same time, shared by the syncs and the downloads")
+	flagPageSize    = flag.Int64("changes_page_size", syncer.DefaultMaxResults, "maximum number of changes listed by each request of the change feed, at most 1000")
+	flagBatchSize   = flag.Int("batch_size", syncer.DefaultBatchSize, "maximum number of files fetched by each batch request to Drive, at most 100")
 
 	flagRunAuthWizard = flag.Bool("wizard", false, "Run the startup wizard.")
+	flagVerify        = flag.String("verify", "", "set report to verify the cached blobs against their checksums and metadata and exit, or repair to also remove the bad ones and download them again")
+	flagReverify      = flag.Duration("reverify_after", 0, "time after which the blobs found sound by -verify are read again, 0 to read all of them every time")
+	flagManifest      = flag.String("manifest", "", "file to write a JSON manifest of the cached files to and exit, - for the standard output")
+	flagDryRun        = flag.Bool("dry_run", false, "sync once without downloading, pushing or writing anything, print what would change and exit")
 
-	metaService  *metadata.MetaService
-	driveService *client.Service
-	blobManager  *blob.Manager
+	metaService *metadata.MetaService
+	blobManager *blob.Manager
 )
 
 func main() {
@@ -69,24 +146,171 @@ func main() {
 
 	transport := auth.NewTransport(cfg.FirstAccount())
 
-	metaService, _ = metadata.New(cfg.MetadataPath())
-	driveService, _ = client.New(transport.Client())
-	blobManager = blob.New(cfg.BlobPath())
+	metaService, _ = metadata.New(cfg.MetadataPath(), &metadata.Options{MaxConcurrency: *flagMetadataConcurrency, Namespace: *flagNamespace})
+	blobOpts := &blob.Options{ReadAhead: *flagReadAhead, ReadAheadBuffer: *flagAheadBuf, Compress: *flagCompress, Dedup: *flagDedup, ShardLevels: *flagShardLvls, ShardChars: *flagShardChars, MaxSize: *flagCacheMax, Namespace: *flagNamespace, StagingPath: *flagStagingDir}
+	if blobOpts.Sync, err = blob.ParseSyncPolicy(*flagFsync); err != nil {
+		logger.F(err)
+	}
+	if blobOpts.FileMode, err = blob.ParseMode(*flagFileMode); err != nil {
+		logger.F(err)
+	}
+	if blobOpts.DirMode, err = blob.ParseMode(*flagDirMode); err != nil {
+		logger.F(err)
+	}
+	if *flagPassphrase != "" {
+		passphrase, err := os.ReadFile(*flagPassphrase)
+		if err != nil {
+			logger.F("Error reading the passphrase file.", err)
+		}
+		if blobOpts.Key, err = blob.DeriveKey(cfg.BlobPath(), strings.TrimSpace(string(passphrase))); err != nil {
+			logger.F(err)
+		}
+	}
+	if *flagHeal {
+		blobOpts.Heal = func(id string) {
+			metaService.EnqueueForIO("download", id)
+		}
+	}
+	if *flagCacheHigh > 0 {
+		blobOpts.HighWatermark = *flagCacheHigh
+		blobOpts.LowWatermark = *flagCacheLow
+		blobOpts.OnWatermark = func(size int64, high bool) {
+			if high {
+				logger.V("cache size", size, "is over the high watermark")
+			} else {
+				logger.V("cache size", size, "is back under the low watermark")
+			}
+		}
+	}
+	if *flagPassThrough {
+		blobOpts.PassThrough = fileio.NewRangeFetcher(transport.Client(), metaService)
+		blobOpts.PassThroughBufferSize = passThroughBufferSize
+	}
+	if *flagLazyMinSize > 0 {
+		blobOpts.Lazy = fileio.NewRangeFetcher(transport.Client(), metaService)
+	}
+	blobManager = blob.New(cfg.BlobPath(), blobOpts)
+	loadIndex := func() {
+		if err := blobManager.LoadIndex(); err != nil {
+			logger.V("error indexing blobs", err)
+		}
+	}
+	if *flagVerify != "" || *flagManifest != "" {
+		// the blobs are moved into place before they are verified or
+		// listed
+		loadIndex()
+	} else {
+		go loadIndex()
+	}
 
-	downloader := fileio.NewDownloader(
+	syncOpts := &syncer.SyncOptions{Interval: *flagSyncInterval, MaxInterval: *flagMaxSyncInterval, Offline: *flagOffline, IncludeSubscribed: *flagSubscribed}
+	syncOpts.StartJitter, syncOpts.IntervalJitter = *flagStartJitter, *flagSyncJitter
+	syncOpts.ResumableThreshold, syncOpts.UploadChunkSize = *flagResumableThreshold, *flagUploadChunkSize
+	syncOpts.CollectInterval, syncOpts.CollectGrace = *flagCollectInterval, *flagCollectGrace
+	syncOpts.TrashRetention, syncOpts.MaxBlobSize = *flagTrashRetention, *flagMaxBlobSize
+	syncOpts.WebhookAddress = *flagWebhookAddress
+	syncOpts.VerifyInterval = *flagReverify
+	syncOpts.MaxConcurrentRequests, syncOpts.MaxResults = *flagMaxRequests, *flagPageSize
+	syncOpts.BatchSize = *flagBatchSize
+	syncOpts.DryRun = *flagDryRun
+	syncOpts.RefreshToken = transport.Reauthorize
+	if *flagFileIds != "" {
+		syncOpts.FileIds = strings.Split(*flagFileIds, ",")
+	}
+	if *flagFolderIds != "" {
+		syncOpts.FolderIds = strings.Split(*flagFolderIds, ",")
+	}
+	if syncOpts.MimeTypes, err = syncer.ParseMimeTypes(*flagMimeTypes); err != nil {
+		logger.F(err)
+	}
+	if syncOpts.ExcludeMimeTypes, err = syncer.ParseMimeTypes(*flagExcluded); err != nil {
+		logger.F(err)
+	}
+	syncOpts.PruneEmptyFolders = *flagPruneEmpty
+	if *flagDrives != "" {
+		syncOpts.SharedDrives = strings.Split(*flagDrives, ",")
+	}
+	if syncOpts.ExportFormats, err = syncer.ParseExportFormats(*flagExports); err != nil {
+		logger.F(err)
+	}
+	if syncOpts.Extensions, err = syncer.ParseExtensions(*flagExtensions); err != nil {
+		logger.F(err)
+	}
+	if syncOpts.Conflicts, err = syncer.ParseConflictPolicy(*flagConflicts); err != nil {
+		logger.F(err)
+	}
+	if syncOpts.Names, err = syncer.ParseNamePolicy(*flagNames); err != nil {
+		logger.F(err)
+	}
+	if *flagThumbnails {
+		if syncOpts.Thumbnails, err = fileio.NewThumbnails(transport.Client(), cfg.DataPath("thumbnails"), 0); err != nil {
+			logger.F(err)
+		}
+	}
+	syncManager, err := syncer.NewCachedSyncerWithClient(
 		transport.Client(),
 		metaService,
-		blobManager)
+		blobManager,
+		syncOpts)
+	if err != nil {
+		logger.F(err)
+	}
+	switch *flagVerify {
+	case "":
+	case "report", "repair":
+		if !cmd.RunVerify(syncManager, *flagVerify == "repair") {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	default:
+		logger.F("unknown -verify mode", *flagVerify)
+	}
+	if *flagManifest != "" {
+		cmd.RunManifest(syncManager, *flagManifest)
+		os.Exit(0)
+	}
+	if *flagDryRun {
+		if !cmd.RunDryRun(syncManager) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
-	syncManager := syncer.NewCachedSyncer(
-		driveService,
+	downloader := fileio.NewDownloader(
+		syncManager.LimitClient(transport.Client()),
 		metaService,
-		blobManager)
+		blobManager,
+		&fileio.Options{
+			BinaryRetry: &fileio.RetryPolicy{
+				Attempts: fileio.DefaultBinaryRetry.Attempts,
+				Delay:    fileio.DefaultBinaryRetry.Delay,
+				Timeout:  *flagDownloadTimeout,
+			},
+			ExportRetry: &fileio.RetryPolicy{
+				Attempts: *flagExportAttempts,
+				Delay:    *flagExportDelay,
+				Timeout:  *flagExportTimeout,
+			},
+			Quarantine: &fileio.QuarantinePolicy{
+				Failures: *flagQuarantineFailures,
+				Cooldown: *flagQuarantineCooldown,
+			},
+			Workers:     *flagDownloadWorkers,
+			LazyMinSize: *flagLazyMinSize,
+			RateLimit:   *flagDownloadRate,
+		})
 
 	if *flagBlockSync {
 		syncManager.Sync(true)
 	}
-	syncManager.Start()
+	if *flagWebhookListen != "" {
+		go func() {
+			logger.F(http.ListenAndServe(*flagWebhookListen, syncManager.NotificationHandler()))
+		}()
+	}
+	syncCtx, stopSync := context.WithCancel(context.Background())
+	syncManager.Start(syncCtx)
+	go downloader.Warm(cfg.FirstAccount().WarmPaths, syncManager)
 
 	logger.V("mounting...")
 	mountpoint := cfg.FirstAccount().LocalPath
@@ -97,13 +321,13 @@ func main() {
 		logger.F(err)
 	}
 	shutdownChan := make(chan io.Closer, 1)
-	go gracefulShutDown(shutdownChan, mountpoint)
-	if err = mount.MountAndServe(mountpoint, metaService, blobManager, downloader); err != nil {
+	go gracefulShutDown(shutdownChan, mountpoint, stopSync)
+	if err = mount.MountAndServe(mountpoint, metaService, blobManager, downloader, &mount.Options{ShortcutsAsSymlinks: *flagSymlinks}); err != nil {
 		logger.F(err)
 	}
 }
 
-func gracefulShutDown(shutdownc <-chan io.Closer, mountpoint string) {
+func gracefulShutDown(shutdownc <-chan io.Closer, mountpoint string, stopSync context.CancelFunc) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP)
 	signal.Notify(c, syscall.SIGINT)
@@ -117,6 +341,7 @@ func gracefulShutDown(shutdownc <-chan io.Closer, mountpoint string) {
 		switch sig {
 		case syscall.SIGINT:
 			logger.V("Gracefully shutting down...")
+			stopSync()
 			mount.Umount(mountpoint)
 			// TODO(burcud): Handle Umount errors
 			go func() {
@@ -0,0 +1,165 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	// Prefix of the keys of the consumer positions in the info table.
+	keyPrefixCursor = "cursor:"
+
+	sqlJournalAfter = "select changeId, remoteId, kind from journal where changeId > ? order by changeId, id limit ?"
+	sqlListCursors  = "select value from info where key like '" + keyPrefixCursor + "%'"
+)
+
+// Cursor is the position of a named consumer, such as a search indexer
+// or a backup tool, in the journal of the applied changes. Positions
+// are persisted, so that a restarted consumer resumes where it left
+// off. The journal is not pruned past the position of a consumer.
+type Cursor struct {
+	meta *MetaService
+	name string
+}
+
+// Returns the cursor of the consumer called name. Consumers registered
+// for the first time start at the current sync position, see
+// GetLargestChangeId.
+func (m *MetaService) Cursor(name string) (*Cursor, error) {
+	if name == "" {
+		return nil, errors.New("metadata: cursor name is empty")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := keyPrefixCursor + name
+	if val, err := m.getValue(key); err != nil || val != "" {
+		return &Cursor{meta: m, name: name}, err
+	}
+	val, err := m.getValue(m.changeIdKey(keyLargestChangeId))
+	if err != nil {
+		return nil, err
+	}
+	if val == "" {
+		val = "0"
+	}
+	if err = m.setValue(key, val); err != nil {
+		return nil, err
+	}
+	return &Cursor{meta: m, name: name}, nil
+}
+
+// Removes the cursor of the consumer called name, so that it doesn't
+// hold back the pruning of the journal anymore.
+func (m *MetaService) RemoveCursor(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.db.Exec(sqlDeleteValue, keyPrefixCursor+name)
+	return err
+}
+
+// Returns the id of the last change acknowledged by the consumer.
+func (c *Cursor) Position() (int64, error) {
+	c.meta.mu.RLock()
+	defer c.meta.mu.RUnlock()
+	return c.position()
+}
+
+func (c *Cursor) position() (int64, error) {
+	val, err := c.meta.getValue(keyPrefixCursor + c.name)
+	if err != nil {
+		return 0, err
+	}
+	if val == "" {
+		return 0, fmt.Errorf("metadata: cursor %v is removed", c.name)
+	}
+	return strconv.ParseInt(val, 0, 64)
+}
+
+// Returns up to limit of the changes applied after the position of the
+// consumer, in the order they were applied. Unlike Diff, the changes of
+// a file are not collapsed. Returns the same changes until they are
+// acknowledged. Returns ErrJournalPruned if the changes are not retained
+// anymore.
+func (c *Cursor) Next(limit int) (entries []*JournalEntry, err error) {
+	c.meta.mu.RLock()
+	defer c.meta.mu.RUnlock()
+
+	var pos int64
+	if pos, err = c.position(); err != nil {
+		return
+	}
+	if pos < c.meta.journalPruned() {
+		return nil, ErrJournalPruned
+	}
+	var rows *sql.Rows
+	if rows, err = c.meta.db.Query(sqlJournalAfter, pos, limit); err != nil {
+		return
+	}
+	defer rows.Close()
+	entries = []*JournalEntry{}
+	for rows.Next() {
+		entry := &JournalEntry{}
+		var kind int
+		if err = rows.Scan(&entry.ChangeId, &entry.Id, &kind); err != nil {
+			return
+		}
+		entry.Kind = ChangeKind(kind)
+		entries = append(entries, entry)
+	}
+	err = rows.Err()
+	return
+}
+
+// Acknowledges that the consumer has processed the changes up to and
+// including changeId. Positions only move forward, acknowledging an
+// earlier change is a no-op.
+func (c *Cursor) Ack(changeId int64) error {
+	c.meta.mu.Lock()
+	defer c.meta.mu.Unlock()
+	pos, err := c.position()
+	if err != nil || changeId <= pos {
+		return err
+	}
+	return c.meta.setValue(keyPrefixCursor+c.name, fmt.Sprintf("%d", changeId))
+}
+
+// Returns the smallest position of the consumers, false if there are
+// none.
+func (m *MetaService) minCursor() (min int64, ok bool, err error) {
+	var rows *sql.Rows
+	if rows, err = m.db.Query(sqlListCursors); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var val string
+		if err = rows.Scan(&val); err != nil {
+			return
+		}
+		pos, parseErr := strconv.ParseInt(val, 0, 64)
+		if parseErr != nil {
+			continue
+		}
+		if !ok || pos < min {
+			min, ok = pos, true
+		}
+	}
+	err = rows.Err()
+	return
+}
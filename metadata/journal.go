@@ -0,0 +1,188 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	// Number of the latest change ids whose journal entries are kept,
+	// the older entries are pruned as the sync position advances.
+	JournalRetention = 100000
+
+	sqlJournalAppend = "insert into journal (changeId, remoteId, kind) values(?, ?, ?)"
+	sqlJournalRange  = "select changeId, remoteId, kind from journal where changeId > ? and changeId <= ? order by changeId, id"
+	sqlJournalPrune  = "delete from journal where changeId <= ?"
+	sqlJournalClear  = "delete from journal"
+)
+
+var (
+	ErrJournalPruned = errors.New("metadata: journal is pruned past the checkpoint")
+)
+
+// ChangeKind is the type of a change applied to a file.
+type ChangeKind int
+
+const (
+	ChangeCreated ChangeKind = iota + 1
+	ChangeModified
+	ChangeDeleted
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeCreated:
+		return "created"
+	case ChangeModified:
+		return "modified"
+	case ChangeDeleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+// JournalEntry is a change applied to a file during a sync.
+type JournalEntry struct {
+	// Id of the remote change that was applied.
+	ChangeId int64
+	Id       string
+	Kind     ChangeKind
+}
+
+// Records that the change identified by changeId has been applied to
+// the file identified by id.
+func (m *MetaService) Journal(changeId int64, id string, kind ChangeKind) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return appendJournal(m.db, changeId, id, kind)
+}
+
+// Records a change as a part of the batch.
+func (b *Batch) Journal(changeId int64, id string, kind ChangeKind) error {
+	return appendJournal(b.tx, changeId, id, kind)
+}
+
+func appendJournal(conn dbConn, changeId int64, id string, kind ChangeKind) error {
+	_, err := conn.Exec(sqlJournalAppend, changeId, id, int(kind))
+	return err
+}
+
+// Lists the files created, modified or deleted after the checkpoint
+// from, up to and including the checkpoint to. Checkpoints are the
+// largest change ids of syncs, see GetLargestChangeId. Multiple changes
+// of a file are collapsed into one entry; files created and deleted in
+// between are left out. Returns ErrJournalPruned if the changes after
+// from are not retained anymore.
+func (m *MetaService) Diff(from int64, to int64) (entries []*JournalEntry, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if from < m.journalPruned() {
+		return nil, ErrJournalPruned
+	}
+	var rows *sql.Rows
+	if rows, err = m.db.Query(sqlJournalRange, from, to); err != nil {
+		return
+	}
+	defer rows.Close()
+
+	byId := make(map[string]*JournalEntry)
+	order := []string{}
+	for rows.Next() {
+		var changeId int64
+		var id string
+		var kind int
+		if err = rows.Scan(&changeId, &id, &kind); err != nil {
+			return
+		}
+		entry, ok := byId[id]
+		if !ok {
+			byId[id] = &JournalEntry{ChangeId: changeId, Id: id, Kind: ChangeKind(kind)}
+			order = append(order, id)
+			continue
+		}
+		entry.ChangeId = changeId
+		entry.Kind = collapse(entry.Kind, ChangeKind(kind))
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	entries = []*JournalEntry{}
+	for _, id := range order {
+		if entry := byId[id]; entry.Kind != 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return
+}
+
+// Removes the journal entries of the changes up to and including
+// changeId, keeping the ones not acknowledged by all consumers yet.
+func (m *MetaService) pruneJournal(changeId int64) error {
+	min, ok, err := m.minCursor()
+	if err != nil {
+		return err
+	}
+	if ok && min < changeId {
+		changeId = min
+	}
+	if changeId <= m.journalPruned() {
+		return nil
+	}
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(sqlJournalPrune, changeId); err == nil {
+		_, err = tx.Exec(sqlSetValue, keyJournalPruned, fmt.Sprintf("%d", changeId))
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Returns the largest change id whose journal entries are pruned.
+func (m *MetaService) journalPruned() int64 {
+	val, _ := m.getValue(keyJournalPruned)
+	pruned, _ := strconv.ParseInt(val, 0, 64)
+	return pruned
+}
+
+// Returns the net effect of a change of kind next following a change
+// of kind prev, zero if they cancel each other out.
+func collapse(prev ChangeKind, next ChangeKind) ChangeKind {
+	switch {
+	case prev == 0:
+		// deleted before, a create brings it back
+		if next == ChangeDeleted {
+			return 0
+		}
+		return ChangeCreated
+	case prev == ChangeCreated && next == ChangeDeleted:
+		return 0
+	case prev == ChangeCreated:
+		return ChangeCreated
+	case prev == ChangeDeleted && next != ChangeDeleted:
+		return ChangeModified
+	}
+	return next
+}
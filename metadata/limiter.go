@@ -0,0 +1,69 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"sync"
+)
+
+// limitedLock is a readers-writer lock that also caps the number of
+// goroutines accessing the database at the same time, readers and
+// writers alike, so that heavy reads don't thrash the writes of a
+// sync. A nil slots doesn't cap them.
+type limitedLock struct {
+	sync.RWMutex
+	slots chan struct{}
+}
+
+func newLimitedLock(max int) limitedLock {
+	if max <= 0 {
+		return limitedLock{}
+	}
+	return limitedLock{slots: make(chan struct{}, max)}
+}
+
+// Blocks until a slot is available, for the calls that access the
+// database without the lock.
+func (l *limitedLock) acquire() {
+	if l.slots != nil {
+		l.slots <- struct{}{}
+	}
+}
+
+func (l *limitedLock) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+func (l *limitedLock) Lock() {
+	l.acquire()
+	l.RWMutex.Lock()
+}
+
+func (l *limitedLock) Unlock() {
+	l.RWMutex.Unlock()
+	l.release()
+}
+
+func (l *limitedLock) RLock() {
+	l.acquire()
+	l.RWMutex.RLock()
+}
+
+func (l *limitedLock) RUnlock() {
+	l.RWMutex.RUnlock()
+	l.release()
+}
@@ -19,19 +19,49 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/rakyll/drivefuse/logger"
-	_ "github.com/rakyll/drivefuse/third_party/github.com/mattn/go-sqlite3"
+	"github.com/rakyll/drivefuse/third_party/github.com/mattn/go-sqlite3"
 )
 
 const (
 	MimeTypeFolder = "application/vnd.google-apps.folder"
-	IdRootFolder   = "root"
+	// Shortcuts point to another file or folder, they have no content.
+	MimeTypeShortcut = "application/vnd.google-apps.shortcut"
+	// Prefix of the mime types of native Google docs.
+	MimeTypePrefixGoogleApps = "application/vnd.google-apps."
+	// Export format of the native docs that are stored as links to
+	// open them online rather than exported, see IsLink.
+	MimeTypeLink = "application/x-drivefuse-link"
+	IdRootFolder = "root"
+	// Prefix of the ids of the files and folders created locally,
+	// which are not on Drive yet.
+	LocalIdPrefix = "local:"
+
+	// Folders nested deeper than this are taken as a cycle.
+	maxPathDepth = 1024
 
 	keyStarted         = "started-before"
 	keyLargestChangeId = "largest-change-id"
+	keyJournalPruned   = "journal-pruned-change-id"
+
+	// Id of the root folder of My Drive on Drive, an alias of
+	// IdRootFolder, see SaveRootId.
+	keyRootId = "root-id"
+
+	// Prefix of the keys of the largest change ids of shared drives.
+	keyPrefixDriveChangeId = "drive-change-id:"
+
+	// Prefix of the keys of the page tokens of the change feeds being
+	// walked, followed by the id of the shared drive, empty for My Drive.
+	keyPrefixPageToken = "page-token:"
+)
+
+var (
+	// Returned by Get and Resolve if there is no such file.
+	ErrNotFound = errors.New("file not found")
 )
 
 // CachedDriveFile represents metadata about a Drive file or folder.
@@ -44,6 +74,85 @@ type CachedDriveFile struct {
 	LastMod     time.Time
 	Md5Checksum string
 	FileSize    int64
+
+	// Time the file was created on Drive, its modification time if Drive
+	// doesn't record it.
+	Created time.Time
+
+	// Original title of the file on Drive. Name may differ from it
+	// if the title had to be shortened to be used as a local name.
+	Title string
+
+	// Version of the remote content. Used to detect content changes
+	// of files that have no checksum, such as native Google docs or
+	// binary files versioned by their head revision only.
+	Version string
+
+	// Error of the last failed download, if it was given up.
+	DownloadError string
+
+	// Id of the file or folder a shortcut points to.
+	TargetId string
+
+	// Link to download the content from, if Drive provided one. The
+	// content is fetched through the API otherwise.
+	DownloadUrl string
+
+	// Mime type a native doc is exported to, if one was chosen, see
+	// ExportMimeType.
+	ExportFormat string
+
+	// Number of failed downloads since the last successful one.
+	DownloadFailures int
+
+	// When the downloads of the file were stopped after failing
+	// repeatedly, and until when, zero if they are not. The reason is
+	// in DownloadError.
+	QuarantinedAt    time.Time
+	QuarantinedUntil time.Time
+
+	// Set if the file has no content that can be fetched, neither
+	// downloaded nor exported, such as the files of third-party apps.
+	// It is listed as an empty file.
+	Unsupported bool
+
+	// Set if the content of the file is not cached, neither downloaded
+	// nor served, e.g. it is too large. It is listed with its size.
+	Uncached bool
+
+	// Checksum of the previous content of the file, which is still
+	// cached and read while the content of Md5Checksum is downloaded,
+	// empty if there is none. Cleared once the download completes, see
+	// InitFile.
+	StaleChecksum string
+
+	// Md5 checksum of the cached content of a file Drive gives no
+	// Md5Checksum for, computed while it was downloaded, empty if it is
+	// not known. Kept while the content is unchanged, see SetContentMd5.
+	ContentMd5 string
+
+	// Id of the last change of Drive merged into the metadata of the
+	// file, kept by the saves without one, e.g. of the files pushed.
+	ChangeId int64
+
+	// When the cached content of the file was last verified against its
+	// checksum, zero if it never was. Kept while the content is
+	// unchanged, see SetVerified.
+	VerifiedAt time.Time
+}
+
+// Returns the checksum of the content the reads of the file are served,
+// the stale one while the new content is downloaded.
+func (file *CachedDriveFile) ActiveChecksum() string {
+	if file.StaleChecksum != "" {
+		return file.StaleChecksum
+	}
+	return file.Md5Checksum
+}
+
+// Returns true if the downloads of the file are stopped at the time.
+func (file *CachedDriveFile) IsQuarantined(now time.Time) bool {
+	return now.Before(file.QuarantinedUntil)
 }
 
 // Returns true if the object is a folder.
@@ -51,58 +160,305 @@ func (file *CachedDriveFile) IsFolder() bool {
 	return file.MimeType == MimeTypeFolder
 }
 
+// Returns true if the object is created locally and not uploaded yet.
+func (file *CachedDriveFile) IsLocal() bool {
+	return strings.HasPrefix(file.Id, LocalIdPrefix)
+}
+
+// Returns true if the object is a shortcut to another file or folder.
+func (file *CachedDriveFile) IsShortcut() bool {
+	return file.MimeType == MimeTypeShortcut
+}
+
+// Returns true if the object is a native Google doc, whose contents
+// can only be exported.
+func (file *CachedDriveFile) IsNativeDoc() bool {
+	return !file.IsFolder() && !file.IsShortcut() && strings.HasPrefix(file.MimeType, MimeTypePrefixGoogleApps)
+}
+
+// Formats native Google docs are exported to by default, keyed by
+// their mime type. Other native docs, such as forms, can't be
+// exported.
+var exportMimeTypes = map[string]string{
+	MimeTypePrefixGoogleApps + "document":     "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	MimeTypePrefixGoogleApps + "spreadsheet":  "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	MimeTypePrefixGoogleApps + "presentation": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	MimeTypePrefixGoogleApps + "drawing":      "image/png",
+}
+
+// Extensions of the local names of the exported docs, keyed by the
+// mime type of their format.
+var exportExtensions = map[string]string{
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   ".docx",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         ".xlsx",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": ".pptx",
+	"application/vnd.oasis.opendocument.text":                                   ".odt",
+	"application/vnd.oasis.opendocument.spreadsheet":                            ".ods",
+	"application/vnd.oasis.opendocument.presentation":                           ".odp",
+	"application/pdf":           ".pdf",
+	"application/rtf":           ".rtf",
+	"application/epub+zip":      ".epub",
+	"application/zip":           ".zip",
+	"text/plain":                ".txt",
+	"text/csv":                  ".csv",
+	"text/tab-separated-values": ".tsv",
+	"text/html":                 ".html",
+	"image/png":                 ".png",
+	"image/jpeg":                ".jpg",
+	"image/svg+xml":             ".svg",
+}
+
+// Returns the format native docs of the mime type are exported to by
+// default, empty if they can't be exported.
+func DefaultExportMimeType(mimeType string) string {
+	return exportMimeTypes[mimeType]
+}
+
+// Returns the extension of the local names of the docs exported to
+// the format of exportMimeType, empty if it is not known.
+func ExportExtension(exportMimeType string) string {
+	return exportExtensions[exportMimeType]
+}
+
+// Returns the mime type of the export format of the extension, empty
+// if it is not known.
+func ExportMimeTypeByExtension(ext string) string {
+	for mimeType, e := range exportExtensions {
+		if e == ext {
+			return mimeType
+		}
+	}
+	return ""
+}
+
+// Extensions of the local names of the links to native docs, keyed by
+// the mime type of the docs, as the ones of the Drive clients. Links to
+// other docs are named with linkExtension.
+var linkExtensions = map[string]string{
+	MimeTypePrefixGoogleApps + "document":     ".gdoc",
+	MimeTypePrefixGoogleApps + "spreadsheet":  ".gsheet",
+	MimeTypePrefixGoogleApps + "presentation": ".gslides",
+	MimeTypePrefixGoogleApps + "drawing":      ".gdraw",
+	MimeTypePrefixGoogleApps + "form":         ".gform",
+	MimeTypePrefixGoogleApps + "map":          ".gmap",
+	MimeTypePrefixGoogleApps + "site":         ".gsite",
+}
+
+const linkExtension = ".glink"
+
+// Returns the extension of the local names of the links to the native
+// docs of the mime type.
+func LinkExtension(mimeType string) string {
+	if ext, ok := linkExtensions[mimeType]; ok {
+		return ext
+	}
+	return linkExtension
+}
+
+// Extensions of the files of the mime types, keyed by mime type, the
+// one appended to the names without any of them first, see
+// DefaultFileExtensions.
+var fileExtensions = map[string][]string{
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   {".docx"},
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         {".xlsx"},
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": {".pptx"},
+	"application/vnd.oasis.opendocument.text":                                   {".odt"},
+	"application/vnd.oasis.opendocument.spreadsheet":                            {".ods"},
+	"application/vnd.oasis.opendocument.presentation":                           {".odp"},
+	"application/pdf":               {".pdf"},
+	"application/msword":            {".doc", ".dot"},
+	"application/vnd.ms-excel":      {".xls", ".xlt"},
+	"application/vnd.ms-powerpoint": {".ppt", ".pps", ".pot"},
+	"application/rtf":               {".rtf"},
+	"application/epub+zip":          {".epub"},
+	"application/zip":               {".zip"},
+	"application/x-gzip":            {".gz", ".tgz"},
+	"application/x-tar":             {".tar"},
+	"application/x-7z-compressed":   {".7z"},
+	"application/json":              {".json"},
+	"application/xml":               {".xml"},
+	"text/plain":                    {".txt", ".text", ".log"},
+	"text/csv":                      {".csv"},
+	"text/tab-separated-values":     {".tsv"},
+	"text/html":                     {".html", ".htm"},
+	"text/css":                      {".css"},
+	"text/markdown":                 {".md", ".markdown"},
+	"image/jpeg":                    {".jpg", ".jpeg", ".jpe"},
+	"image/png":                     {".png"},
+	"image/gif":                     {".gif"},
+	"image/bmp":                     {".bmp"},
+	"image/tiff":                    {".tif", ".tiff"},
+	"image/webp":                    {".webp"},
+	"image/heic":                    {".heic"},
+	"image/svg+xml":                 {".svg"},
+	"audio/mpeg":                    {".mp3"},
+	"audio/mp4":                     {".m4a"},
+	"audio/ogg":                     {".ogg", ".oga"},
+	"audio/wav":                     {".wav"},
+	"audio/flac":                    {".flac"},
+	"video/mp4":                     {".mp4", ".m4v"},
+	"video/quicktime":               {".mov", ".qt"},
+	"video/x-msvideo":               {".avi"},
+	"video/x-matroska":              {".mkv"},
+	"video/webm":                    {".webm"},
+	"video/mpeg":                    {".mpg", ".mpeg"},
+}
+
+// Returns the extensions of the files of the mime type, empty if they
+// are not known.
+func FileExtensions(mimeType string) []string {
+	return fileExtensions[mimeType]
+}
+
+// Returns the extensions appended to the names of the files of each
+// mime type by default, keyed by mime type.
+func DefaultFileExtensions() map[string]string {
+	exts := make(map[string]string, len(fileExtensions))
+	for mimeType, e := range fileExtensions {
+		exts[mimeType] = e[0]
+	}
+	return exts
+}
+
+// Returns true if the object is a native doc stored as a small file
+// linking to the doc online, rather than exported. The content of the
+// link is generated by the syncer, it is never downloaded.
+func (file *CachedDriveFile) IsLink() bool {
+	return file.IsNativeDoc() && file.ExportFormat == MimeTypeLink
+}
+
+// Returns the mime type the native doc is exported to, empty if it
+// is not a native doc, is a link or can't be exported.
+func (file *CachedDriveFile) ExportMimeType() string {
+	if !file.IsNativeDoc() || file.IsLink() {
+		return ""
+	}
+	if file.ExportFormat != "" {
+		return file.ExportFormat
+	}
+	return exportMimeTypes[file.MimeType]
+}
+
 // MetaService implements utility methods to retrieve, save, delete
 // metadata about Google Drive files/folders.
 type MetaService struct {
 	db *sql.DB
 
-	mu sync.RWMutex // TODO(burcud): Lock for each file ID indiviually
+	// Number of the latest change ids whose journal entries are kept.
+	journalRetention int64
+
+	// Prefixes the keys of the change ids, see Options.Namespace.
+	namespace string
+
+	mu limitedLock // TODO(burcud): Lock for each file ID indiviually
+}
+
+// Options configures a MetaService.
+type Options struct {
+	// Maximum number of calls accessing the database at the same time,
+	// shared by the syncer and the readers such as the mounted file
+	// system. Zero doesn't limit them.
+	MaxConcurrency int
+
+	// If set, the change ids synchronized are stored under keys of
+	// their own, e.g. of one of several Drive accounts whose syncers
+	// share the database, so that their change feeds don't collide.
+	Namespace string
 }
 
-// Initiates a new MetaService.
-func New(dbPath string) (metaservice *MetaService, err error) {
+// Initiates a new MetaService. A nil opts uses the default options.
+func New(dbPath string, opts *Options) (metaservice *MetaService, err error) {
+	if opts == nil {
+		opts = &Options{}
+	}
 	var dbase *sql.DB
 	if dbase, err = sql.Open("sqlite3", dbPath); err != nil {
 		return
 	}
-	metaservice = &MetaService{db: dbase}
+	metaservice = &MetaService{db: dbase, journalRetention: JournalRetention, namespace: opts.Namespace, mu: newLimitedLock(opts.MaxConcurrency)}
 	if err = metaservice.setup(); err != nil {
 		return
 	}
 	return metaservice, nil
 }
 
+// Returns true if err is caused by another connection holding a lock
+// on the database. Such errors are transient, the operation may be
+// retried.
+func IsBusy(err error) bool {
+	if err == sqlite3.ErrBusy || err == sqlite3.ErrLocked {
+		return true
+	}
+	// some errors are only reported with their messages
+	return err != nil && strings.Contains(err.Error(), "is locked")
+}
+
 // Cleans up and closes resources used by the meta service.
 func (m *MetaService) Close() error {
 	return m.db.Close()
 }
 
 func (m *MetaService) Get(id string) (*CachedDriveFile, error) {
-	files, err := m.listFiles(fmt.Sprintf(sqlGetByRemoteId, id))
+	m.mu.acquire()
+	defer m.mu.release()
+	return getFile(m.db, id)
+}
+
+func getFile(conn dbConn, id string) (*CachedDriveFile, error) {
+	files, err := listFiles(conn, fmt.Sprintf(sqlGetByRemoteId, id))
 	if err != nil {
 		return nil, err
 	}
 	if files == nil || len(files) == 0 {
-		return nil, errors.New("file not found")
+		// the root folder is cached under IdRootFolder, see SaveRootId
+		if rootId, _ := getValue(conn, keyRootId); id != IdRootFolder && id == rootId {
+			return getFile(conn, IdRootFolder)
+		}
+		return nil, ErrNotFound
 	}
 	return files[0], nil
 }
 
-// Permanently saves a file/folder's metadata.
+// Permanently saves a file/folder's metadata. A file saved with a
+// StaleChecksum stays visible while its new content is downloaded.
 func (m *MetaService) Save(parentId string, id string, data *CachedDriveFile, download bool, upload bool) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	return saveFile(m.db, id, data, download, upload)
+}
 
-	if download {
-		// check if the content is changed
-		if file, err := m.Get(id); err == nil {
-			// ignore error cases
-			download = data.Md5Checksum != file.Md5Checksum
+func saveFile(conn dbConn, id string, data *CachedDriveFile, download bool, upload bool) error {
+	// check if the content is changed
+	if file, err := getFile(conn, id); err == nil {
+		// ignore error cases
+		changed := data.Md5Checksum != file.Md5Checksum ||
+			(data.Md5Checksum == "" && data.Version != file.Version) ||
+			data.ExportFormat != file.ExportFormat
+		if download {
+			download = changed
 		}
+		data = keepState(file, data, changed)
 	}
 
 	logger.V("Caching metadata for", id)
-	return m.upsertFile(data, download, upload)
+	return upsertFile(conn, data, download, upload)
+}
+
+// Returns data with the state of the file kept from its previous
+// metadata prev: the change it was last synced by, unless data tells,
+// and the state of its content if it is unchanged.
+func keepState(prev *CachedDriveFile, data *CachedDriveFile, changed bool) *CachedDriveFile {
+	kept := *data
+	if kept.ChangeId == 0 {
+		kept.ChangeId = prev.ChangeId
+	}
+	if !changed && kept.ContentMd5 == "" {
+		kept.ContentMd5 = prev.ContentMd5
+	}
+	if !changed && kept.VerifiedAt.IsZero() {
+		kept.VerifiedAt = prev.VerifiedAt
+	}
+	return &kept
 }
 
 func (m *MetaService) Delete(id string) (err error) {
@@ -110,22 +466,208 @@ func (m *MetaService) Delete(id string) (err error) {
 	defer m.mu.Unlock()
 
 	logger.V("Deleting metadata for", id)
-	return m.deleteFile(id)
+	return deleteFile(m.db, id)
+}
+
+// Batch groups metadata writes so that readers observe either all or
+// none of them.
+type Batch struct {
+	tx   *sql.Tx
+	meta *MetaService
+
+	// set by SaveLargestChangeId, the journal is pruned up to pruneTo
+	// once the batch is committed
+	prune   bool
+	pruneTo int64
+}
+
+// Runs fn in a transaction, committing its writes if it returns nil
+// and rolling them back otherwise. Readers are blocked until the
+// transaction completes.
+func (m *MetaService) Batch(fn func(b *Batch) error) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var tx *sql.Tx
+	if tx, err = m.db.Begin(); err != nil {
+		return
+	}
+	b := &Batch{tx: tx, meta: m}
+	if err = fn(b); err != nil {
+		tx.Rollback()
+		return
+	}
+	if err = tx.Commit(); err != nil || !b.prune {
+		return
+	}
+	return m.pruneJournal(b.pruneTo)
+}
+
+// Runs fn as a part of the batch, rolling back the writes of fn alone
+// if it returns an error; the batch goes on with the writes before.
+func (b *Batch) Savepoint(fn func(b *Batch) error) error {
+	if _, err := b.tx.Exec("savepoint nested"); err != nil {
+		return err
+	}
+	if err := fn(b); err != nil {
+		b.tx.Exec("rollback to nested")
+		b.tx.Exec("release nested")
+		return err
+	}
+	_, err := b.tx.Exec("release nested")
+	return err
+}
+
+// Saves a file/folder's metadata as a part of the batch.
+func (b *Batch) Save(parentId string, id string, data *CachedDriveFile, download bool, upload bool) error {
+	return saveFile(b.tx, id, data, download, upload)
+}
+
+// Deletes a file/folder's metadata as a part of the batch.
+func (b *Batch) Delete(id string) error {
+	logger.V("Deleting metadata for", id)
+	return deleteFile(b.tx, id)
+}
+
+// Lists the children of the folder identified by parentId that are
+// named name, including the ones that are not downloaded yet.
+func (b *Batch) LookUpAll(parentId string, name string) ([]*CachedDriveFile, error) {
+	return listFiles(b.tx, sqlNamed, parentId, name)
+}
+
+// Changes the local name of a file/folder as a part of the batch.
+func (b *Batch) Rename(id string, name string) error {
+	_, err := b.tx.Exec(sqlRename, name, id)
+	return err
+}
+
+// Moves the children of the folder identified by fromId under the
+// folder identified by toId as a part of the batch.
+func (b *Batch) MoveChildren(fromId string, toId string) error {
+	if _, err := b.tx.Exec(sqlMoveChildren, toId, fromId); err != nil {
+		return err
+	}
+	_, err := b.tx.Exec(sqlMoveLinks, toId, fromId)
+	return err
+}
+
+// Records the parents of the file identified by id other than the
+// one it is saved under, replacing the ones recorded before, as a
+// part of the batch. The file is listed in each of them.
+func (b *Batch) SetOtherParents(id string, parentIds []string) error {
+	if _, err := b.tx.Exec(sqlUnlinkParents, id); err != nil {
+		return err
+	}
+	for _, parentId := range parentIds {
+		if _, err := b.tx.Exec(sqlLinkParent, id, parentId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Records the id of the root folder of My Drive on Drive as a part of
+// the batch, like MetaService.SaveRootId.
+func (b *Batch) SaveRootId(id string) error {
+	return setValue(b.tx, keyRootId, id)
+}
+
+// Gets a file/folder's metadata, including the writes of the batch.
+func (b *Batch) Get(id string) (*CachedDriveFile, error) {
+	return getFile(b.tx, id)
+}
+
+// Marks the file as downloaded or generated as a part of the batch,
+// see MetaService.InitFile.
+func (b *Batch) InitFile(id string) error {
+	_, err := b.tx.Exec(sqlSetInited, id)
+	return err
+}
+
+// Returns true if the file is in the upload or download queue,
+// including the writes of the batch.
+func (b *Batch) IsQueuedForIO(queueName string, id string) (bool, error) {
+	return isQueuedForIO(b.tx, queueName, id)
+}
+
+// Persists the largest change id synchronized as a part of the batch,
+// like MetaService.SaveLargestChangeId. The journal is pruned once the
+// batch is committed.
+func (b *Batch) SaveLargestChangeId(id int64) error {
+	saved, err := saveChangeId(b.tx, b.meta.changeIdKey(keyLargestChangeId), id)
+	if saved {
+		b.prune, b.pruneTo = true, id-b.meta.journalRetention
+	}
+	return err
+}
+
+// Persists the largest change id synchronized of the shared drive
+// identified by driveId as a part of the batch, like
+// MetaService.SaveDriveChangeId.
+func (b *Batch) SaveDriveChangeId(driveId string, id int64) error {
+	_, err := saveChangeId(b.tx, b.meta.changeIdKey(keyPrefixDriveChangeId+driveId), id)
+	return err
+}
+
+// Walks the folder tree from the root, calling fn for each file and
+// folder with its slash separated path. The walk observes a
+// consistent state of the tree, writes are blocked until it's done.
+// fn must not call back into the MetaService.
+func (m *MetaService) Walk(fn func(p string, file *CachedDriveFile) error) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	root, err := getFile(m.db, IdRootFolder)
+	if err != nil {
+		return err
+	}
+	return m.walk("", root, fn)
+}
+
+func (m *MetaService) walk(p string, folder *CachedDriveFile, fn func(p string, file *CachedDriveFile) error) error {
+	children, err := m.listFiles(fmt.Sprintf(sqlChildrenAll, folder.Id))
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		childPath := p + "/" + child.Name
+		if err = fn(childPath, child); err != nil {
+			return err
+		}
+		if child.IsFolder() {
+			if err = m.walk(childPath, child, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the files whose downloads are stopped at the time, after
+// failing repeatedly, see Quarantine.
+func (m *MetaService) ListQuarantined(now time.Time) ([]*CachedDriveFile, error) {
+	m.mu.acquire()
+	defer m.mu.release()
+	return m.listFiles(fmt.Sprintf(sqlListQuarantined, now.Unix()))
 }
 
 func (m *MetaService) ListDownloads(limit int64, min int64, max int64) ([]*CachedDriveFile, error) {
+	m.mu.acquire()
+	defer m.mu.release()
 	// TODO: order by lastMod
-	return m.listFiles(fmt.Sprintf(sqlListDownloads, min, max, limit))
+	return m.listFiles(fmt.Sprintf(sqlListDownloads, min, max, time.Now().Unix(), limit))
 }
 
-// Looks up for files under parentId, named with name.
+// Looks up for files under parentId, named with name, as GetChildren
+// would list them. The files linked under parentId, see
+// Batch.SetOtherParents, are looked up by the name they have under
+// their parent. Returns nil if there is none.
 func (m *MetaService) LookUp(parentId string, name string) (file *CachedDriveFile, err error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	query := fmt.Sprintf(sqlLookup, parentId, name)
 	var files []*CachedDriveFile
-	if files, err = m.listFiles(query); err != nil {
+	if files, err = listFiles(m.db, sqlLookup, parentId, name); err != nil {
 		return
 	}
 	if len(files) > 0 {
@@ -142,6 +684,141 @@ func (m *MetaService) GetChildren(parentId string) (output []*CachedDriveFile, e
 	return m.listFiles(query)
 }
 
+// Lists the children of the folder identified by parentId like
+// GetChildren, sorted by name, with the sizes and the modification
+// times they are served with, so that a folder is listed as is. The
+// files linked under the folder are listed too.
+func (m *MetaService) ListChildren(parentId string) ([]*CachedDriveFile, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return listFiles(m.db, fmt.Sprintf(sqlChildrenByName, parentId))
+}
+
+// Calls fn for each child of the folder identified by parentId, as
+// GetChildren would list them, without loading all of them into
+// memory. Preferable for very large folders. Stops at the first error
+// returned by fn and returns it. fn must not call back into the
+// MetaService.
+func (m *MetaService) EachChild(parentId string, fn func(file *CachedDriveFile) error) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return eachFile(m.db, fmt.Sprintf(sqlChildren, parentId), fn)
+}
+
+// Calls fn for each file whose content has been downloaded and isn't
+// queued for download again. Stops at the first error returned by fn
+// and returns it. fn must not call back into the MetaService.
+func (m *MetaService) EachCached(fn func(file *CachedDriveFile) error) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return eachFile(m.db, sqlCached, fn)
+}
+
+// Gets all children of the folder identified by parentId, including
+// the files whose contents are not downloaded yet.
+func (m *MetaService) GetAllChildren(parentId string) (output []*CachedDriveFile, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.listFiles(fmt.Sprintf(sqlChildrenAll, parentId))
+}
+
+// Returns the parents of the file identified by id other than the one
+// it is saved under, see Batch.SetOtherParents.
+func (m *MetaService) OtherParents(id string) (parentIds []string, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var rows *sql.Rows
+	if rows, err = m.db.Query(sqlLinkedParents, id); err != nil {
+		return
+	}
+	defer rows.Close()
+	parentIds = []string{}
+	for rows.Next() {
+		var parentId string
+		if err = rows.Scan(&parentId); err != nil {
+			return
+		}
+		parentIds = append(parentIds, parentId)
+	}
+	err = rows.Err()
+	return
+}
+
+// Returns the parents of all of the files other than the ones they are
+// saved under, keyed by file id, see OtherParents.
+func (m *MetaService) AllOtherParents() (parentIds map[string][]string, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var rows *sql.Rows
+	if rows, err = m.db.Query(sqlAllLinks); err != nil {
+		return
+	}
+	defer rows.Close()
+	parentIds = make(map[string][]string)
+	for rows.Next() {
+		var id, parentId string
+		if err = rows.Scan(&id, &parentId); err != nil {
+			return
+		}
+		parentIds[id] = append(parentIds[id], parentId)
+	}
+	err = rows.Err()
+	return
+}
+
+// Resolves a slash separated path relative to the root folder,
+// including the files whose contents are not downloaded yet.
+func (m *MetaService) Resolve(p string) (file *CachedDriveFile, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if file, err = getFile(m.db, IdRootFolder); err != nil {
+		return
+	}
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+		var files []*CachedDriveFile
+		if files, err = m.listFiles(fmt.Sprintf(sqlLookupAll, file.Id, name)); err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, ErrNotFound
+		}
+		file = files[0]
+	}
+	return
+}
+
+// Returns the slash separated path of the file or folder identified by
+// id, relative to the root folder. The reverse of Resolve. Fails if the
+// file or any of its ancestors is not cached.
+func (m *MetaService) PathOf(id string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	names := []string{}
+	for id != IdRootFolder {
+		file, err := getFile(m.db, id)
+		if err != nil {
+			return "", err
+		}
+		if len(names) > maxPathDepth {
+			return "", errors.New("metadata: path is too deep")
+		}
+		names = append(names, file.Name)
+		id = file.ParentId
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return strings.Join(names, "/"), nil
+}
+
+// Marks the file as downloaded or generated, makes it visible. The
+// content it was downloaded to replaces the stale one in a single
+// write, see CachedDriveFile.StaleChecksum.
 func (m *MetaService) InitFile(id string) (err error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -149,6 +826,65 @@ func (m *MetaService) InitFile(id string) (err error) {
 	return
 }
 
+// Records the md5 checksum of the content downloaded for the file, see
+// CachedDriveFile.ContentMd5. Nothing is recorded if the content of the
+// file changed meanwhile.
+func (m *MetaService) SetContentMd5(file *CachedDriveFile, checksum string) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err = m.db.Exec(sqlSetContentMd5, checksum, file.Id, file.Md5Checksum, file.Version, file.ExportFormat)
+	return
+}
+
+// Records that the cached content of the file was verified at the time,
+// see CachedDriveFile.VerifiedAt. Nothing is recorded if the checksum of
+// the file changed meanwhile.
+func (m *MetaService) SetVerified(file *CachedDriveFile, at time.Time) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err = m.db.Exec(sqlSetVerified, at, file.Id, file.Md5Checksum)
+	return
+}
+
+// Records the error of a download that was given up. The error is
+// cleared when the metadata of the file is saved again.
+func (m *MetaService) SetDownloadError(id string, message string) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err = m.db.Exec(sqlSetDownloadError, message, id)
+	return
+}
+
+// Records a failed download of the file with its error, returns the
+// number of failures since the last successful download. The failures
+// are cleared when the metadata of the file is saved again.
+func (m *MetaService) AddDownloadFailure(id string, message string) (failures int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err = m.db.Exec(sqlAddFailure, message, id); err != nil {
+		return
+	}
+	err = m.db.QueryRow(sqlGetFailures, id).Scan(&failures)
+	return
+}
+
+// Stops listing the file for download until the given time.
+func (m *MetaService) Quarantine(id string, until time.Time) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err = m.db.Exec(sqlQuarantine, time.Now().Unix(), until.Unix(), id)
+	return
+}
+
+// Clears the download failures and the error of the file, and lifts
+// its quarantine if any, so that it is downloaded right away.
+func (m *MetaService) Unquarantine(id string) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err = m.db.Exec(sqlUnquarantine, id)
+	return
+}
+
 // Enqueues a file into the upload or download queue.
 func (m *MetaService) EnqueueForIO(queueName string, id string) error {
 	m.mu.Lock()
@@ -156,6 +892,26 @@ func (m *MetaService) EnqueueForIO(queueName string, id string) error {
 	return m.updateIOQueue(queueName, id, 1)
 }
 
+// Returns true if the file is in the upload or download queue.
+func (m *MetaService) IsQueuedForIO(queueName string, id string) (queued bool, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return isQueuedForIO(m.db, queueName, id)
+}
+
+func isQueuedForIO(conn dbConn, queueName string, id string) (queued bool, err error) {
+	err = conn.QueryRow(fmt.Sprintf("select %s from files where remoteId = ?", queueName), id).Scan(&queued)
+	return
+}
+
+// Returns true if there is any file in the upload or download queue.
+func (m *MetaService) HasQueuedForIO(queueName string) (queued bool, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	err = m.db.QueryRow(fmt.Sprintf("select count(*) > 0 from files where %s = 1", queueName)).Scan(&queued)
+	return
+}
+
 // Removes the file from upload or download queue.
 func (m *MetaService) DequeueFromIO(queueName string, id string) error {
 	m.mu.Lock()
@@ -163,10 +919,33 @@ func (m *MetaService) DequeueFromIO(queueName string, id string) error {
 	return m.updateIOQueue(queueName, id, 0)
 }
 
+// Removes all cached metadata and the persisted sync position.
+func (m *MetaService) Clear() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	logger.V("Clearing metadata")
+	return m.clear()
+}
+
+// Records the id of the root folder of My Drive on Drive, so that the
+// root folder, cached under IdRootFolder, is found by either id.
+func (m *MetaService) SaveRootId(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.setValue(keyRootId, id)
+}
+
 // Gets the largest change id synchnonized.
 func (m *MetaService) GetLargestChangeId() (largestId int64, err error) {
+	m.mu.acquire()
+	defer m.mu.release()
+	return m.largestChangeId()
+}
+
+func (m *MetaService) largestChangeId() (largestId int64, err error) {
 	var val string
-	val, err = m.getValue(keyLargestChangeId)
+	val, err = m.getValue(m.changeIdKey(keyLargestChangeId))
 	if err != nil {
 		return
 	}
@@ -177,7 +956,81 @@ func (m *MetaService) GetLargestChangeId() (largestId int64, err error) {
 	return
 }
 
-// Persists the largest change id synchnonized.
+// Returns the key the change id of key is stored under, prefixed by
+// the namespace if set.
+func (m *MetaService) changeIdKey(key string) string {
+	if m.namespace == "" {
+		return key
+	}
+	return m.namespace + "/" + key
+}
+
+// Gets the largest change id synchronized of the shared drive
+// identified by driveId. Shared drives have change feeds of their own,
+// apart from the one of My Drive.
+func (m *MetaService) GetDriveChangeId(driveId string) (largestId int64, err error) {
+	m.mu.acquire()
+	defer m.mu.release()
+	var val string
+	if val, err = m.getValue(m.changeIdKey(keyPrefixDriveChangeId + driveId)); err != nil {
+		return
+	}
+	return strconv.ParseInt(val, 0, 64)
+}
+
+// Persists the largest change id synchronized of the shared drive
+// identified by driveId. Like the largest change id of My Drive, it
+// never decreases.
+func (m *MetaService) SaveDriveChangeId(driveId string, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := saveChangeId(m.db, m.changeIdKey(keyPrefixDriveChangeId+driveId), id)
+	return err
+}
+
+// Stores the change id under key, unless it is lower than the stored
+// one. Returns false if it is ignored.
+func saveChangeId(conn dbConn, key string, id int64) (bool, error) {
+	val, _ := getValue(conn, key)
+	if stored, err := strconv.ParseInt(val, 0, 64); err == nil && id < stored {
+		logger.V("ignoring change id", id, "of", key, "lower than the stored", stored)
+		return false, nil
+	}
+	return true, setValue(conn, key, fmt.Sprintf("%d", id))
+}
+
+// Gets the token of the next page of the change feed of the shared
+// drive identified by driveId, or of My Drive if it is empty, saved
+// while the feed was walked, e.g. by a sync interrupted by a restart.
+// Empty if the feed was walked to its end.
+func (m *MetaService) GetPageToken(driveId string) (string, error) {
+	m.mu.acquire()
+	defer m.mu.release()
+	return m.getValue(m.changeIdKey(keyPrefixPageToken + driveId))
+}
+
+// Persists the token of the next page of the change feed of the shared
+// drive identified by driveId, or of My Drive if it is empty. An empty
+// token, once the feed is walked to its end, deletes it.
+func (m *MetaService) SavePageToken(driveId string, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := m.changeIdKey(keyPrefixPageToken + driveId)
+	if token == "" {
+		_, err := m.db.Exec(sqlDeleteValue, key)
+		return err
+	}
+	return m.setValue(key, token)
+}
+
+// Persists the largest change id synchnonized. The stored id never
+// decreases; saving a lower id than the stored one is ignored, so that
+// the sync position can't regress. Clear resets it.
 func (m *MetaService) SaveLargestChangeId(id int64) error {
-	return m.setValue(keyLargestChangeId, fmt.Sprintf("%d", id))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if saved, err := saveChangeId(m.db, m.changeIdKey(keyLargestChangeId), id); err != nil || !saved {
+		return err
+	}
+	return m.pruneJournal(id - m.journalRetention)
 }
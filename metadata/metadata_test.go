@@ -0,0 +1,575 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Contains tests for metadata package.
+package metadata
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rakyll/drivefuse/third_party/github.com/mattn/go-sqlite3"
+	T "github.com/rakyll/drivefuse/third_party/launchpad.net/gocheck"
+)
+
+type MetadataSuite struct {
+	meta *MetaService
+	path string
+}
+
+var _ = T.Suite(&MetadataSuite{})
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	T.TestingT(t)
+}
+
+func (s *MetadataSuite) SetUpTest(c *T.C) {
+	var err error
+	s.path = filepath.Join(c.MkDir(), "meta.sql")
+	s.meta, err = New(s.path, nil)
+	c.Assert(err, T.IsNil)
+}
+
+func (s *MetadataSuite) TearDownTest(c *T.C) {
+	s.meta.Close()
+}
+
+// Returns the ids of the files queued for download.
+func (s *MetadataSuite) downloads(c *T.C) []string {
+	files, err := s.meta.ListDownloads(100, 0, math.MaxInt64)
+	c.Assert(err, T.IsNil)
+	ids := []string{}
+	for _, f := range files {
+		ids = append(ids, f.Id)
+	}
+	return ids
+}
+
+func (s *MetadataSuite) TestVersionBumpRequeuesDownload(c *T.C) {
+	doc := &CachedDriveFile{Id: "doc", ParentId: IdRootFolder, Name: "Doc", Version: "v1"}
+	c.Assert(s.meta.Save(IdRootFolder, "doc", doc, true, false), T.IsNil)
+	c.Assert(s.meta.DequeueFromIO("download", "doc"), T.IsNil)
+
+	// unchanged version, nothing to download
+	c.Assert(s.meta.Save(IdRootFolder, "doc", doc, true, false), T.IsNil)
+	c.Assert(s.downloads(c), T.HasLen, 0)
+
+	edited := *doc
+	edited.Version = "v2"
+	c.Assert(s.meta.Save(IdRootFolder, "doc", &edited, true, false), T.IsNil)
+	c.Assert(s.downloads(c), T.DeepEquals, []string{"doc"})
+
+	file, err := s.meta.Get("doc")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Version, T.Equals, "v2")
+}
+
+func (s *MetadataSuite) TestEachChildStreamsLargeFolder(c *T.C) {
+	const n = 20000
+	err := s.meta.Batch(func(b *Batch) error {
+		for i := 0; i < n; i++ {
+			id := fmt.Sprintf("file%05d", i)
+			file := &CachedDriveFile{Id: id, ParentId: "big", Name: id, MimeType: MimeTypeFolder}
+			if err := b.Save("big", id, file, false, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	c.Assert(err, T.IsNil)
+
+	seen := make(map[string]bool)
+	err = s.meta.EachChild("big", func(file *CachedDriveFile) error {
+		seen[file.Name] = true
+		return nil
+	})
+	c.Assert(err, T.IsNil)
+	c.Assert(seen, T.HasLen, n)
+
+	// rows are consumed as fn is called, stopping early leaves the
+	// rest unread
+	errStop := errors.New("stop")
+	count := 0
+	err = s.meta.EachChild("big", func(file *CachedDriveFile) error {
+		if count++; count == 10 {
+			return errStop
+		}
+		return nil
+	})
+	c.Assert(err, T.Equals, errStop)
+	c.Assert(count, T.Equals, 10)
+}
+
+func (s *MetadataSuite) TestChildrenAreListedByName(c *T.C) {
+	mod := time.Date(2013, 5, 1, 10, 0, 0, 0, time.UTC)
+	files := []*CachedDriveFile{
+		{Id: "b", ParentId: "dir", Name: "b.txt", FileSize: 2},
+		{Id: "a2", ParentId: "dir", Name: "a (1).txt", FileSize: 3},
+		{Id: "a1", ParentId: "dir", Name: "a.txt", FileSize: 1},
+		{Id: "quoted", ParentId: "dir", Name: "it's.txt"},
+		{Id: "sub", ParentId: "dir", Name: "sub", MimeType: MimeTypeFolder},
+		{Id: "linked", ParentId: "other", Name: "linked.txt", FileSize: 4},
+		{Id: "missing", ParentId: "dir", Name: "missing.txt"},
+	}
+	err := s.meta.Batch(func(b *Batch) error {
+		for _, file := range files {
+			file.LastMod = mod
+			if err := b.Save(file.ParentId, file.Id, file, false, false); err != nil {
+				return err
+			}
+			if file.Id != "missing" {
+				// the content of missing is not downloaded yet
+				if err := b.InitFile(file.Id); err != nil {
+					return err
+				}
+			}
+		}
+		return b.SetOtherParents("linked", []string{"dir"})
+	})
+	c.Assert(err, T.IsNil)
+
+	children, err := s.meta.ListChildren("dir")
+	c.Assert(err, T.IsNil)
+	names := []string{}
+	for _, child := range children {
+		names = append(names, child.Name)
+		c.Assert(child.LastMod.Equal(mod), T.Equals, true)
+	}
+	c.Assert(names, T.DeepEquals, []string{"a (1).txt", "a.txt", "b.txt", "it's.txt", "linked.txt", "sub"})
+	c.Assert(children[0].FileSize, T.Equals, int64(3))
+	c.Assert(children[4].ParentId, T.Equals, "other")
+
+	file, err := s.meta.LookUp("dir", "it's.txt")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Id, T.Equals, "quoted")
+	file, err = s.meta.LookUp("dir", "linked.txt")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Id, T.Equals, "linked")
+	file, err = s.meta.LookUp("dir", "missing.txt")
+	c.Assert(err, T.IsNil)
+	c.Assert(file, T.IsNil)
+}
+
+func (s *MetadataSuite) TestLargestChangeIdNeverDecreases(c *T.C) {
+	c.Assert(s.meta.SaveLargestChangeId(42), T.IsNil)
+	c.Assert(s.meta.SaveLargestChangeId(7), T.IsNil)
+	id, err := s.meta.GetLargestChangeId()
+	c.Assert(err, T.IsNil)
+	c.Assert(id, T.Equals, int64(42))
+
+	c.Assert(s.meta.SaveLargestChangeId(43), T.IsNil)
+	id, err = s.meta.GetLargestChangeId()
+	c.Assert(err, T.IsNil)
+	c.Assert(id, T.Equals, int64(43))
+
+	c.Assert(s.meta.Clear(), T.IsNil)
+	c.Assert(s.meta.SaveLargestChangeId(3), T.IsNil)
+	id, err = s.meta.GetLargestChangeId()
+	c.Assert(err, T.IsNil)
+	c.Assert(id, T.Equals, int64(3))
+}
+
+func (s *MetadataSuite) TestSavepointsRollBackAlone(c *T.C) {
+	failure := errors.New("failed")
+	err := s.meta.Batch(func(b *Batch) error {
+		c.Assert(b.Savepoint(func(b *Batch) error {
+			return b.Save("", "kept", &CachedDriveFile{Id: "kept", Name: "kept"}, false, false)
+		}), T.IsNil)
+		c.Assert(b.Savepoint(func(b *Batch) error {
+			if err := b.Save("", "dropped", &CachedDriveFile{Id: "dropped", Name: "dropped"}, false, false); err != nil {
+				return err
+			}
+			return failure
+		}), T.Equals, failure)
+		_, err := b.Get("dropped")
+		c.Assert(err, T.NotNil)
+		return b.SaveLargestChangeId(5)
+	})
+	c.Assert(err, T.IsNil)
+	_, err = s.meta.Get("kept")
+	c.Assert(err, T.IsNil)
+	_, err = s.meta.Get("dropped")
+	c.Assert(err, T.NotNil)
+	id, err := s.meta.GetLargestChangeId()
+	c.Assert(err, T.IsNil)
+	c.Assert(id, T.Equals, int64(5))
+
+	err = s.meta.Batch(func(b *Batch) error {
+		if err := b.SaveLargestChangeId(9); err != nil {
+			return err
+		}
+		return failure
+	})
+	c.Assert(err, T.Equals, failure)
+	id, err = s.meta.GetLargestChangeId()
+	c.Assert(err, T.IsNil)
+	c.Assert(id, T.Equals, int64(5))
+}
+
+func (s *MetadataSuite) TestNamespacedChangeIds(c *T.C) {
+	other, err := New(s.path, &Options{Namespace: "bob's account"})
+	c.Assert(err, T.IsNil)
+	defer other.Close()
+	c.Assert(s.meta.SaveLargestChangeId(42), T.IsNil)
+	c.Assert(s.meta.SaveDriveChangeId("drive", 5), T.IsNil)
+	c.Assert(other.SaveLargestChangeId(7), T.IsNil)
+
+	id, err := s.meta.GetLargestChangeId()
+	c.Assert(err, T.IsNil)
+	c.Assert(id, T.Equals, int64(42))
+	id, err = other.GetLargestChangeId()
+	c.Assert(err, T.IsNil)
+	c.Assert(id, T.Equals, int64(7))
+	_, err = other.GetDriveChangeId("drive")
+	c.Assert(err, T.NotNil)
+
+	// clearing one namespace keeps the change ids of the others
+	c.Assert(other.Clear(), T.IsNil)
+	id, err = s.meta.GetLargestChangeId()
+	c.Assert(err, T.IsNil)
+	c.Assert(id, T.Equals, int64(42))
+	id, err = s.meta.GetDriveChangeId("drive")
+	c.Assert(err, T.IsNil)
+	c.Assert(id, T.Equals, int64(5))
+}
+
+func (s *MetadataSuite) TestPageTokens(c *T.C) {
+	c.Assert(s.meta.SavePageToken("", "token"), T.IsNil)
+	c.Assert(s.meta.SavePageToken("drive", "drive token"), T.IsNil)
+	token, err := s.meta.GetPageToken("")
+	c.Assert(err, T.IsNil)
+	c.Assert(token, T.Equals, "token")
+
+	// walked to the end
+	c.Assert(s.meta.SavePageToken("", ""), T.IsNil)
+	token, err = s.meta.GetPageToken("")
+	c.Assert(err, T.IsNil)
+	c.Assert(token, T.Equals, "")
+	token, err = s.meta.GetPageToken("drive")
+	c.Assert(err, T.IsNil)
+	c.Assert(token, T.Equals, "drive token")
+
+	c.Assert(s.meta.Clear(), T.IsNil)
+	token, err = s.meta.GetPageToken("drive")
+	c.Assert(err, T.IsNil)
+	c.Assert(token, T.Equals, "")
+}
+
+func (s *MetadataSuite) TestJournalIsPruned(c *T.C) {
+	s.meta.journalRetention = 10
+	for id := int64(1); id <= 30; id++ {
+		c.Assert(s.meta.Journal(id, fmt.Sprintf("file-%d", id), ChangeCreated), T.IsNil)
+	}
+	c.Assert(s.meta.SaveLargestChangeId(30), T.IsNil)
+	diff, err := s.meta.Diff(20, 30)
+	c.Assert(err, T.IsNil)
+	c.Assert(diff, T.HasLen, 10)
+	_, err = s.meta.Diff(19, 30)
+	c.Assert(err, T.Equals, ErrJournalPruned)
+
+	var count int
+	c.Assert(s.meta.db.QueryRow("select count(*) from journal").Scan(&count), T.IsNil)
+	c.Assert(count, T.Equals, 10)
+
+	// clearing starts the journal over
+	c.Assert(s.meta.Clear(), T.IsNil)
+	diff, err = s.meta.Diff(0, 30)
+	c.Assert(err, T.IsNil)
+	c.Assert(diff, T.HasLen, 0)
+}
+
+func (s *MetadataSuite) TestReadersSeeBatchesAtomically(c *T.C) {
+	folder := func(id string, parentId string) *CachedDriveFile {
+		return &CachedDriveFile{Id: id, ParentId: parentId, Name: id, MimeType: MimeTypeFolder}
+	}
+	c.Assert(s.meta.Save("", IdRootFolder, folder(IdRootFolder, ""), false, false), T.IsNil)
+	c.Assert(s.meta.Save(IdRootFolder, "a", folder("a", IdRootFolder), false, false), T.IsNil)
+	c.Assert(s.meta.Save(IdRootFolder, "b", folder("b", IdRootFolder), false, false), T.IsNil)
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("child-%d", i)
+		c.Assert(s.meta.Save("a", id, folder(id, "a"), false, false), T.IsNil)
+	}
+
+	// moves the children one row at a time, back and forth
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 20; i++ {
+			parentId := []string{"b", "a"}[i%2]
+			err := s.meta.Batch(func(b *Batch) error {
+				for j := 0; j < 10; j++ {
+					id := fmt.Sprintf("child-%d", j)
+					if err := b.Save(parentId, id, folder(id, parentId), false, false); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			c.Check(err, T.IsNil)
+		}
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		parents := make(map[string]int)
+		err := s.meta.Walk(func(p string, file *CachedDriveFile) error {
+			if strings.HasPrefix(file.Id, "child-") {
+				parents[file.ParentId]++
+			}
+			return nil
+		})
+		c.Assert(err, T.IsNil)
+		// never split between the old and the new parent
+		c.Assert(parents, T.HasLen, 1)
+		for _, n := range parents {
+			c.Assert(n, T.Equals, 10)
+		}
+	}
+}
+
+func (s *MetadataSuite) TestIsBusy(c *T.C) {
+	c.Assert(IsBusy(sqlite3.ErrBusy), T.Equals, true)
+	c.Assert(IsBusy(sqlite3.ErrLocked), T.Equals, true)
+	c.Assert(IsBusy(errors.New("database is locked")), T.Equals, true)
+	c.Assert(IsBusy(sqlite3.ErrConstraint), T.Equals, false)
+	c.Assert(IsBusy(nil), T.Equals, false)
+}
+
+func (s *MetadataSuite) TestCursorResumesFromAck(c *T.C) {
+	for id := int64(1); id <= 3; id++ {
+		c.Assert(s.meta.Journal(id, fmt.Sprintf("file-%d", id), ChangeCreated), T.IsNil)
+	}
+	c.Assert(s.meta.SaveLargestChangeId(3), T.IsNil)
+	// registered after the first sync, starts at its position
+	cursor, err := s.meta.Cursor("indexer")
+	c.Assert(err, T.IsNil)
+	for id := int64(4); id <= 6; id++ {
+		c.Assert(s.meta.Journal(id, fmt.Sprintf("file-%d", id), ChangeModified), T.IsNil)
+	}
+	entries, err := cursor.Next(2)
+	c.Assert(err, T.IsNil)
+	c.Assert(entries, T.DeepEquals, []*JournalEntry{
+		{ChangeId: 4, Id: "file-4", Kind: ChangeModified},
+		{ChangeId: 5, Id: "file-5", Kind: ChangeModified},
+	})
+	c.Assert(cursor.Ack(4), T.IsNil)
+
+	// the consumer restarts along with the metadata
+	s.meta.Close()
+	s.meta, err = New(s.path, nil)
+	c.Assert(err, T.IsNil)
+	cursor, err = s.meta.Cursor("indexer")
+	c.Assert(err, T.IsNil)
+	pos, err := cursor.Position()
+	c.Assert(err, T.IsNil)
+	c.Assert(pos, T.Equals, int64(4))
+	entries, err = cursor.Next(10)
+	c.Assert(err, T.IsNil)
+	c.Assert(entries, T.HasLen, 2)
+	c.Assert(entries[0].ChangeId, T.Equals, int64(5))
+	c.Assert(entries[1].ChangeId, T.Equals, int64(6))
+
+	// the entries the consumer hasn't acknowledged are not pruned
+	s.meta.journalRetention = 0
+	c.Assert(s.meta.SaveLargestChangeId(6), T.IsNil)
+	entries, err = cursor.Next(10)
+	c.Assert(err, T.IsNil)
+	c.Assert(entries, T.HasLen, 2)
+	c.Assert(cursor.Ack(6), T.IsNil)
+	c.Assert(s.meta.SaveLargestChangeId(6), T.IsNil)
+	entries, err = cursor.Next(10)
+	c.Assert(err, T.IsNil)
+	c.Assert(entries, T.HasLen, 0)
+	_, err = s.meta.Diff(3, 6)
+	c.Assert(err, T.Equals, ErrJournalPruned)
+}
+
+func (s *MetadataSuite) TestConcurrencyIsLimited(c *T.C) {
+	s.meta.Close()
+	var err error
+	s.meta, err = New(s.path, &Options{MaxConcurrency: 2})
+	c.Assert(err, T.IsNil)
+	folder := &CachedDriveFile{Id: "folder", ParentId: IdRootFolder, Name: "folder", MimeType: MimeTypeFolder}
+	c.Assert(s.meta.Save(IdRootFolder, "folder", folder, false, false), T.IsNil)
+
+	var mu sync.Mutex
+	active, max := 0, 0
+	// counts the calls in progress while they hold the database
+	access := func() {
+		mu.Lock()
+		active++
+		if active > max {
+			max = active
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			c.Check(s.meta.EachChild(IdRootFolder, func(file *CachedDriveFile) error {
+				access()
+				return nil
+			}), T.IsNil)
+		}()
+		go func(i int) {
+			defer wg.Done()
+			c.Check(s.meta.Batch(func(b *Batch) error {
+				access()
+				id := fmt.Sprintf("file-%d", i)
+				return b.Save(IdRootFolder, id, &CachedDriveFile{Id: id, ParentId: IdRootFolder, Name: id}, false, false)
+			}), T.IsNil)
+		}(i)
+	}
+	wg.Wait()
+	c.Assert(max <= 2, T.Equals, true)
+	children, err := s.meta.GetAllChildren(IdRootFolder)
+	c.Assert(err, T.IsNil)
+	c.Assert(children, T.HasLen, 11)
+}
+
+func (s *MetadataSuite) TestUploadSessions(c *T.C) {
+	session, err := s.meta.GetUploadSession("file")
+	c.Assert(err, T.IsNil)
+	c.Assert(session, T.IsNil)
+	saved := &UploadSession{Uri: "https://example.com/upload?id=1 2", Md5: "md5"}
+	c.Assert(s.meta.SaveUploadSession("file", saved), T.IsNil)
+	c.Assert(s.meta.SaveUploadSession("other", saved), T.IsNil)
+	session, err = s.meta.GetUploadSession("file")
+	c.Assert(err, T.IsNil)
+	c.Assert(session, T.DeepEquals, saved)
+
+	c.Assert(s.meta.DeleteUploadSession("file"), T.IsNil)
+	session, err = s.meta.GetUploadSession("file")
+	c.Assert(err, T.IsNil)
+	c.Assert(session, T.IsNil)
+	c.Assert(s.meta.Clear(), T.IsNil)
+	session, err = s.meta.GetUploadSession("other")
+	c.Assert(err, T.IsNil)
+	c.Assert(session, T.IsNil)
+}
+
+func (s *MetadataSuite) TestLastSyncTime(c *T.C) {
+	last, err := s.meta.GetLastSyncTime()
+	c.Assert(err, T.IsNil)
+	c.Assert(last.IsZero(), T.Equals, true)
+
+	synced := time.Date(2013, 9, 19, 14, 29, 12, 0, time.UTC)
+	c.Assert(s.meta.SaveSyncAttempt(synced, nil), T.IsNil)
+	failed := synced.Add(time.Hour)
+	c.Assert(s.meta.SaveSyncAttempt(failed, errors.New("unreachable")), T.IsNil)
+	last, err = s.meta.GetLastSyncTime()
+	c.Assert(err, T.IsNil)
+	c.Assert(last.Equal(synced), T.Equals, true)
+	at, message, err := s.meta.GetLastSyncAttempt()
+	c.Assert(err, T.IsNil)
+	c.Assert(at.Equal(failed), T.Equals, true)
+	c.Assert(message, T.Equals, "unreachable")
+
+	c.Assert(s.meta.SaveSyncAttempt(failed.Add(time.Hour), nil), T.IsNil)
+	_, message, err = s.meta.GetLastSyncAttempt()
+	c.Assert(err, T.IsNil)
+	c.Assert(message, T.Equals, "")
+}
+
+func (s *MetadataSuite) TestTrash(c *T.C) {
+	trashedAt := time.Date(2013, 9, 19, 14, 29, 12, 0, time.UTC)
+	for _, id := range []string{"old", "new"} {
+		c.Assert(s.meta.Save("", id, &CachedDriveFile{Id: id, Name: id, Md5Checksum: "md5" + id, FileSize: 3}, false, false), T.IsNil)
+	}
+	err := s.meta.Batch(func(b *Batch) error {
+		if err := b.Trash("old", trashedAt); err != nil {
+			return err
+		}
+		return b.Trash("new", trashedAt.Add(time.Hour))
+	})
+	c.Assert(err, T.IsNil)
+	_, err = s.meta.Get("old")
+	c.Assert(err, T.Equals, ErrNotFound)
+	file, err := s.meta.GetTrashed("old")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Name, T.Equals, "old")
+	c.Assert(file.Md5Checksum, T.Equals, "md5old")
+	c.Assert(file.FileSize, T.Equals, int64(3))
+
+	files, err := s.meta.ListTrash(trashedAt.Add(time.Minute))
+	c.Assert(err, T.IsNil)
+	c.Assert(len(files), T.Equals, 1)
+	c.Assert(files[0].Id, T.Equals, "old")
+
+	// the trash outlives the resyncs
+	c.Assert(s.meta.Clear(), T.IsNil)
+	c.Assert(s.meta.DeleteTrashed("old"), T.IsNil)
+	_, err = s.meta.GetTrashed("old")
+	c.Assert(err, T.Equals, ErrNotFound)
+	files, err = s.meta.ListTrash(trashedAt.Add(2 * time.Hour))
+	c.Assert(err, T.IsNil)
+	c.Assert(len(files), T.Equals, 1)
+	c.Assert(files[0].Id, T.Equals, "new")
+}
+
+func (s *MetadataSuite) TestPendingOpsAreMerged(c *T.C) {
+	for _, id := range []string{"local:new", "edited", "gone"} {
+		c.Assert(s.meta.Save(IdRootFolder, id, &CachedDriveFile{Id: id, ParentId: IdRootFolder, Name: id}, false, false), T.IsNil)
+	}
+	c.Assert(s.meta.MarkPending("local:new", PendingCreate), T.IsNil)
+	c.Assert(s.meta.MarkPending("edited", PendingRename), T.IsNil)
+	c.Assert(s.meta.MarkPending("edited", PendingUpdate), T.IsNil)
+	c.Assert(s.meta.MarkPending("gone", PendingMove), T.IsNil)
+	c.Assert(s.meta.MarkPending("gone", PendingDelete), T.IsNil)
+	changes, err := s.meta.ListPending()
+	c.Assert(err, T.IsNil)
+	c.Assert(changes, T.DeepEquals, []*PendingChange{
+		{Id: "local:new", Ops: PendingCreate, Version: 1},
+		{Id: "edited", Ops: PendingRename | PendingUpdate, Version: 2},
+		{Id: "gone", Ops: PendingDelete, Version: 2},
+	})
+	for id, queued := range map[string]bool{"local:new": true, "edited": true, "gone": false} {
+		upload, err := s.meta.IsQueuedForIO("upload", id)
+		c.Assert(err, T.IsNil)
+		c.Assert(upload, T.Equals, queued)
+	}
+
+	// never pushed, there is nothing to delete on Drive
+	c.Assert(s.meta.MarkPending("local:new", PendingDelete), T.IsNil)
+	change, err := s.meta.GetPending("local:new")
+	c.Assert(err, T.IsNil)
+	c.Assert(change, T.IsNil)
+
+	// written again while it was pushed
+	c.Assert(s.meta.MarkPending("edited", PendingUpdate), T.IsNil)
+	c.Assert(s.meta.ClearPending("edited", 2), T.IsNil)
+	change, err = s.meta.GetPending("edited")
+	c.Assert(err, T.IsNil)
+	c.Assert(change.Version, T.Equals, int64(3))
+	c.Assert(s.meta.ClearPending("edited", 3), T.IsNil)
+	changes, err = s.meta.ListPending()
+	c.Assert(err, T.IsNil)
+	c.Assert(changes, T.DeepEquals, []*PendingChange{{Id: "gone", Ops: PendingDelete, Version: 2}})
+}
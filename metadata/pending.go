@@ -0,0 +1,160 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"database/sql"
+)
+
+const (
+	sqlGetPending    = "select remoteId, ops, version from pending where remoteId = ?"
+	sqlListPending   = "select remoteId, ops, version from pending order by rowid"
+	sqlSetPending    = "insert or replace into pending (remoteId, ops, version) values (?, ?, ?)"
+	sqlClearPending  = "delete from pending where remoteId = ? and version = ?"
+	sqlDeletePending = "delete from pending where remoteId = ?"
+	sqlRekeyPending  = "update pending set remoteId = ?, ops = ops & ~? where remoteId = ?"
+	sqlQueueUpload   = "update files set upload = 1 where remoteId = ?"
+	sqlPendingClear  = "delete from pending"
+)
+
+// PendingOp is a set of operations on a file made locally, which are
+// not pushed to Drive yet, see MarkPending.
+type PendingOp int
+
+const (
+	// The file was created locally, its id is a local one.
+	PendingCreate PendingOp = 1 << iota
+
+	// The content was written locally, the blob of the file is dirty,
+	// see blob.Manager.WriteAt.
+	PendingUpdate
+
+	// The file was renamed or moved to another folder locally.
+	PendingRename
+	PendingMove
+
+	// The file was deleted locally, its metadata is removed already.
+	PendingDelete
+)
+
+// PendingChange is a file with local operations that are not pushed to
+// Drive yet.
+type PendingChange struct {
+	Id  string
+	Ops PendingOp
+
+	// Local version of the file, incremented by each MarkPending, so
+	// that the operations recorded while the file is pushed are not
+	// cleared along with the pushed ones, see ClearPending.
+	Version int64
+}
+
+// Records the operations made locally on the file identified by id, so
+// that they are pushed to Drive by the next sync, along with the ones
+// recorded before. The file is queued for upload if it is created or
+// written. A delete supersedes the other operations, the delete of a
+// file created locally clears them instead: there is nothing on Drive
+// to delete.
+func (m *MetaService) MarkPending(id string, ops PendingOp) error {
+	return m.Batch(func(b *Batch) error {
+		return b.MarkPending(id, ops)
+	})
+}
+
+// Records the operations made locally on the file identified by id as
+// a part of the batch, like MetaService.MarkPending.
+func (b *Batch) MarkPending(id string, ops PendingOp) error {
+	prev, err := getPending(b.tx, id)
+	if err != nil {
+		return err
+	}
+	if prev == nil {
+		prev = &PendingChange{Id: id}
+	}
+	switch {
+	case ops&PendingDelete != 0 && prev.Ops&PendingCreate != 0:
+		_, err = b.tx.Exec(sqlDeletePending, id)
+		return err
+	case ops&PendingDelete != 0:
+		ops = PendingDelete
+	default:
+		ops |= prev.Ops
+	}
+	if ops&(PendingCreate|PendingUpdate) != 0 {
+		if _, err = b.tx.Exec(sqlQueueUpload, id); err != nil {
+			return err
+		}
+	}
+	_, err = b.tx.Exec(sqlSetPending, id, ops, prev.Version+1)
+	return err
+}
+
+// Moves the local operations of the local file identified by localId
+// to the id Drive assigned it once it is created, as a part of the
+// batch. The file is not pending creation anymore.
+func (b *Batch) RekeyPending(localId string, id string) error {
+	_, err := b.tx.Exec(sqlRekeyPending, id, PendingCreate, localId)
+	return err
+}
+
+// Gets the local operations on the file identified by id that are not
+// pushed yet, nil if there are none.
+func (m *MetaService) GetPending(id string) (*PendingChange, error) {
+	m.mu.acquire()
+	defer m.mu.release()
+	return getPending(m.db, id)
+}
+
+func getPending(conn dbConn, id string) (*PendingChange, error) {
+	change := &PendingChange{}
+	err := conn.QueryRow(sqlGetPending, id).Scan(&change.Id, &change.Ops, &change.Version)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// Lists the files with local operations that are not pushed yet, in
+// the order they were first recorded.
+func (m *MetaService) ListPending() ([]*PendingChange, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rows, err := m.db.Query(sqlListPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := []*PendingChange{}
+	for rows.Next() {
+		change := &PendingChange{}
+		if err = rows.Scan(&change.Id, &change.Ops, &change.Version); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+// Clears the local operations of the file identified by id once they
+// are pushed, unless more were recorded since version was listed.
+func (m *MetaService) ClearPending(id string, version int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.db.Exec(sqlClearPending, id, version)
+	return err
+}
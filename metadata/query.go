@@ -18,18 +18,48 @@ import (
 	"database/sql"
 	"fmt"
 	"time"
+
+	"github.com/rakyll/drivefuse/third_party/github.com/mattn/go-sqlite3"
 )
 
 const (
-	sqlGetByRemoteId = "select remoteId, parentId, name, mimetype, size, md5checksum, lastMod from files where remoteId = '%s'"
-	sqlLookup        = "select remoteId, parentId, name, mimetype, size, md5checksum, lastMod from files where parentId = '%s' and name = '%s' and (inited = 1 or mimetype = 'application/vnd.google-apps.folder')"
-	sqlChildren      = "select remoteId, parentId, name, mimetype, size, md5checksum, lastMod from files where parentId = '%s' and (inited = 1 or mimetype = 'application/vnd.google-apps.folder')"
-	sqlListDownloads = "select remoteId, parentId, name, mimetype, size, md5checksum, lastMod from files where download = 1 and size >= %d and size <= %d limit %d"
-	sqlUpsert        = "insert or replace into files (remoteId, parentId, name, mimetype, size, md5checksum, lastMod, download, upload) values(?, ?, ?, ?, ?, ?, ?, ?, ?)"
-	sqlDelete        = "delete from files where remoteId = '%s'"
-	sqlSetInited     = "update files set inited = 1 where remoteId = ?"
-	sqlGetValue      = "select value from info where key = '%s'"
-	sqlSetValue      = "insert or replace into info (key, value) values(?, ?)"
+	sqlFileColumns      = "remoteId, parentId, name, mimetype, size, md5checksum, title, version, targetId, downloadUrl, exportFormat, unsupported, uncached, lastMod, created"
+	sqlColumns          = "remoteId, parentId, name, mimetype, size, md5checksum, title, version, downloadError, targetId, downloadUrl, exportFormat, downloadFailures, quarantinedAt, quarantinedUntil, unsupported, uncached, lastMod, created, staleChecksum, contentMd5, changeId, verifiedAt"
+	sqlGetByRemoteId    = "select " + sqlColumns + " from files where remoteId = '%s'"
+	sqlInParent         = "(parentId = '%[1]s' or remoteId in (select remoteId from links where parentId = '%[1]s'))"
+	sqlLookup           = sqlNamed + " and (inited = 1 or mimetype in ('application/vnd.google-apps.folder', 'application/vnd.google-apps.shortcut'))"
+	sqlChildren         = "select " + sqlColumns + " from files where " + sqlInParent + " and (inited = 1 or mimetype in ('application/vnd.google-apps.folder', 'application/vnd.google-apps.shortcut'))"
+	sqlChildrenByName   = sqlChildren + " order by name, remoteId"
+	sqlLookupAll        = "select " + sqlColumns + " from files where " + sqlInParent + " and name = '%[2]s'"
+	sqlChildrenAll      = "select " + sqlColumns + " from files where " + sqlInParent
+	sqlNamed            = "select " + sqlColumns + " from files where (parentId = ?1 or remoteId in (select remoteId from links where parentId = ?1)) and name = ?2"
+	sqlRename           = "update files set name = ? where remoteId = ?"
+	sqlMoveChildren     = "update files set parentId = ? where parentId = ?"
+	sqlMoveLinks        = "update links set parentId = ? where parentId = ?"
+	sqlLinkParent       = "insert or replace into links (remoteId, parentId) values(?, ?)"
+	sqlUnlinkParents    = "delete from links where remoteId = ?"
+	sqlUnlinkChildren   = "delete from links where parentId = ?"
+	sqlLinkedParents    = "select parentId from links where remoteId = ? order by parentId"
+	sqlClearLinks       = "delete from links"
+	sqlAllLinks         = "select remoteId, parentId from links order by remoteId, parentId"
+	sqlCached           = "select " + sqlColumns + " from files where inited = 1 and download = 0 and not ifnull(uncached, 0) and mimetype != 'application/vnd.google-apps.folder'"
+	sqlListDownloads    = "select " + sqlColumns + " from files where download = 1 and size >= %d and size <= %d and (quarantinedUntil is null or quarantinedUntil <= %d) limit %d"
+	sqlListQuarantined  = "select " + sqlColumns + " from files where quarantinedUntil > %d order by remoteId"
+	sqlUpsert           = "insert or replace into files (" + sqlFileColumns + ", staleChecksum, contentMd5, changeId, verifiedAt, inited, download, upload) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	sqlDelete           = "delete from files where remoteId = '%s'"
+	sqlSetInited        = "update files set inited = 1, staleChecksum = null where remoteId = ?"
+	sqlSetDownloadError = "update files set downloadError = ? where remoteId = ?"
+	sqlSetContentMd5    = "update files set contentMd5 = ? where remoteId = ? and ifnull(md5checksum, '') = ? and ifnull(version, '') = ? and ifnull(exportFormat, '') = ?"
+	sqlSetVerified      = "update files set verifiedAt = ? where remoteId = ? and ifnull(md5checksum, '') = ?"
+	sqlAddFailure       = "update files set downloadError = ?, downloadFailures = ifnull(downloadFailures, 0) + 1 where remoteId = ?"
+	sqlGetFailures      = "select ifnull(downloadFailures, 0) from files where remoteId = ?"
+	sqlQuarantine       = "update files set quarantinedAt = ?, quarantinedUntil = ? where remoteId = ?"
+	sqlUnquarantine     = "update files set downloadError = null, downloadFailures = 0, quarantinedAt = null, quarantinedUntil = null where remoteId = ?"
+	sqlClearFiles       = "delete from files"
+	sqlDeleteValue      = "delete from info where key = ?"
+	sqlDeletePrefixed   = "delete from info where key like ? || '%'"
+	sqlGetValue         = "select value from info where key = ?"
+	sqlSetValue         = "insert or replace into info (key, value) values(?, ?)"
 )
 
 // Sets up the sqlite db, creates required tables and indexes.
@@ -44,12 +74,60 @@ func (m *MetaService) setup() error {
 			"   size int," +
 			"   md5checksum string," +
 			"   lastMod date," +
+			"   created date," +
+			"   title string," +
+			"   version string," +
+			"   downloadError string," +
+			"   targetId string," +
+			"   downloadUrl string," +
+			"   exportFormat string," +
+			"   downloadFailures int," +
+			"   quarantinedAt int," +
+			"   quarantinedUntil int," +
+			"   unsupported bool," +
+			"   uncached bool," +
+			"   staleChecksum string," +
+			"   contentMd5 string," +
+			"   changeId int," +
+			"   verifiedAt date," +
 			"   inited bool default 0," +
 			"   upload bool," +
 			"   download bool)",
 		"create table if not exists info (key string, value string)",
-		"create unique index idx_remote on files (remoteId)",
-		"create unique index idx_k on info (key)"}
+		// the parents of the files other than the one in files
+		"create table if not exists links (remoteId string, parentId string)",
+		"create unique index if not exists idx_links on links (remoteId, parentId)",
+		"create index if not exists idx_links_parent on links (parentId)",
+		"create table if not exists journal (" +
+			"   id integer not null primary key," +
+			"   changeId integer," +
+			"   remoteId string," +
+			"   kind int)",
+		"create index if not exists idx_journal on journal (changeId)",
+		// the files trashed locally, see Batch.Trash
+		"create table if not exists trash (" +
+			"   remoteId string," +
+			"   parentId string," +
+			"   name string," +
+			"   mimetype string," +
+			"   size int," +
+			"   md5checksum string," +
+			"   lastMod date," +
+			"   created date," +
+			"   title string," +
+			"   version string," +
+			"   targetId string," +
+			"   downloadUrl string," +
+			"   exportFormat string," +
+			"   unsupported bool," +
+			"   uncached bool," +
+			"   trashedAt int)",
+		"create unique index if not exists idx_trash on trash (remoteId)",
+		// the local operations not pushed yet, see MarkPending
+		"create table if not exists pending (remoteId string, ops int, version int)",
+		"create unique index if not exists idx_pending on pending (remoteId)",
+		"create unique index if not exists idx_remote on files (remoteId)",
+		"create unique index if not exists idx_k on info (key)"}
 	// don't remove the index, used by insert or replace into queries
 	for _, v := range queries {
 		_, err := m.db.Exec(v)
@@ -57,18 +135,109 @@ func (m *MetaService) setup() error {
 			return err
 		}
 	}
+	return m.migrate()
+}
+
+// Adds the columns introduced after the initial schema to databases
+// created by older versions.
+func (m *MetaService) migrate() error {
+	columns := [][]string{
+		{"title", "string"},
+		{"version", "string"},
+		{"downloadError", "string"},
+		{"targetId", "string"},
+		{"downloadUrl", "string"},
+		{"downloadFailures", "int"},
+		{"quarantinedAt", "int"},
+		{"quarantinedUntil", "int"},
+		{"exportFormat", "string"},
+		{"unsupported", "bool"},
+		{"uncached", "bool"},
+		{"created", "date"},
+		{"staleChecksum", "string"},
+		{"contentMd5", "string"},
+		{"changeId", "int"},
+		{"verifiedAt", "date"},
+	}
+	existing, err := m.listColumns("files")
+	if err != nil {
+		return err
+	}
+	for _, v := range columns {
+		if existing[v[0]] {
+			continue
+		}
+		if _, err = m.db.Exec("alter table files add column " + v[0] + " " + v[1]); err != nil {
+			return err
+		}
+	}
+	// the trash holds the columns of the files it keeps, see Batch.Trash
+	if existing, err = m.listColumns("trash"); err != nil {
+		return err
+	}
+	for _, v := range [][]string{{"uncached", "bool"}, {"created", "date"}} {
+		if existing[v[0]] {
+			continue
+		}
+		if _, err = m.db.Exec("alter table trash add column " + v[0] + " " + v[1]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// Returns the set of column names of the given table.
+func (m *MetaService) listColumns(table string) (columns map[string]bool, err error) {
+	var rows *sql.Rows
+	if rows, err = m.db.Query("pragma table_info(" + table + ")"); err != nil {
+		return
+	}
+	defer rows.Close()
+	columns = make(map[string]bool)
+	for rows.Next() {
+		var cid int
+		var name, ctype string
+		var notnull, pk int
+		var dflt sql.NullString
+		if err = rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			return
+		}
+		columns[name] = true
+	}
+	return
+}
+
+// dbConn is implemented by both *sql.DB and *sql.Tx, so that queries
+// can run either directly or as a part of a transaction.
+type dbConn interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 // For the given query, returns the matching files.
 func (m *MetaService) listFiles(query string) (files []*CachedDriveFile, err error) {
+	return listFiles(m.db, query)
+}
+
+func listFiles(conn dbConn, query string, args ...interface{}) (files []*CachedDriveFile, err error) {
+	files = []*CachedDriveFile{}
+	err = eachFile(conn, query, func(file *CachedDriveFile) error {
+		files = append(files, file)
+		return nil
+	}, args...)
+	return
+}
+
+// Calls fn for each of the files matching the query, as the rows are
+// read. Stops at the first error returned by fn and returns it.
+func eachFile(conn dbConn, query string, fn func(file *CachedDriveFile) error, args ...interface{}) (err error) {
 	var rows *sql.Rows
-	if rows, err = m.db.Query(query); err != nil {
+	if rows, err = conn.Query(query, args...); err != nil {
 		return
 	}
 	defer rows.Close()
 
-	files = []*CachedDriveFile{}
 	for rows.Next() {
 		var remoteId string
 		var parentId string
@@ -76,9 +245,25 @@ func (m *MetaService) listFiles(query string) (files []*CachedDriveFile, err err
 		var mimetype string
 		var size int64
 		var md5checksum string
-		var lastMod time.Time
+		var title sql.NullString
+		var version sql.NullString
+		var downloadError sql.NullString
+		var targetId sql.NullString
+		var downloadUrl sql.NullString
+		var exportFormat sql.NullString
+		var downloadFailures sql.NullInt64
+		var quarantinedAt sql.NullInt64
+		var quarantinedUntil sql.NullInt64
+		var unsupported sql.NullBool
+		var uncached sql.NullBool
+		var lastMod sql.NullString
+		var created sql.NullString
+		var staleChecksum sql.NullString
+		var contentMd5 sql.NullString
+		var changeId sql.NullInt64
+		var verifiedAt sql.NullString
 		// TODO(burcud): add all columns
-		rows.Scan(&remoteId, &parentId, &name, &mimetype, &size, &md5checksum, &lastMod)
+		rows.Scan(&remoteId, &parentId, &name, &mimetype, &size, &md5checksum, &title, &version, &downloadError, &targetId, &downloadUrl, &exportFormat, &downloadFailures, &quarantinedAt, &quarantinedUntil, &unsupported, &uncached, &lastMod, &created, &staleChecksum, &contentMd5, &changeId, &verifiedAt)
 		file := &CachedDriveFile{
 			Id:          remoteId,
 			ParentId:    parentId,
@@ -86,21 +271,67 @@ func (m *MetaService) listFiles(query string) (files []*CachedDriveFile, err err
 			MimeType:    mimetype,
 			FileSize:    size,
 			Md5Checksum: md5checksum,
-			LastMod:     lastMod,
+			LastMod:     parseTime(lastMod),
+			Created:     parseTime(created),
+			Title:       title.String,
+			Version:     version.String,
+
+			DownloadError: downloadError.String,
+			TargetId:      targetId.String,
+			DownloadUrl:   downloadUrl.String,
+			ExportFormat:  exportFormat.String,
+
+			DownloadFailures: int(downloadFailures.Int64),
+			QuarantinedAt:    unixTime(quarantinedAt),
+			QuarantinedUntil: unixTime(quarantinedUntil),
+
+			Unsupported: unsupported.Bool,
+			Uncached:    uncached.Bool,
+
+			StaleChecksum: staleChecksum.String,
+			ContentMd5:    contentMd5.String,
+
+			ChangeId:   changeId.Int64,
+			VerifiedAt: parseTime(verifiedAt),
+		}
+		if err = fn(file); err != nil {
+			return
 		}
-		files = append(files, file)
 	}
-	return
+	return rows.Err()
+}
+
+// Parses a time stored by the driver, the zero time if there is none.
+// Date columns are read back as text, in one of the driver's formats,
+// the ones with a zone too; the times are returned in UTC, as they are
+// stored.
+func parseTime(value sql.NullString) time.Time {
+	for _, layout := range sqlite3.SQLiteTimestampFormats {
+		if t, err := time.Parse(layout, value.String); err == nil {
+			return t.UTC()
+		}
+	}
+	return time.Time{}
+}
+
+// Converts the seconds since the epoch to a time, the zero time if
+// there are none.
+func unixTime(sec sql.NullInt64) time.Time {
+	if !sec.Valid {
+		return time.Time{}
+	}
+	return time.Unix(sec.Int64, 0)
 }
 
 // Inserts/updates the given CachedDriveFile. Files are markable for
 // downloading or uploading, later will be consumed by download and
 // upload queues.
-func (m *MetaService) upsertFile(
-	file *CachedDriveFile, download bool, upload bool) (err error) {
-	_, err = m.db.Exec(sqlUpsert,
+func upsertFile(
+	conn dbConn, file *CachedDriveFile, download bool, upload bool) (err error) {
+	_, err = conn.Exec(sqlUpsert,
 		file.Id, file.ParentId, file.Name, file.MimeType, file.FileSize,
-		file.Md5Checksum, file.LastMod, download, upload)
+		file.Md5Checksum, file.Title, file.Version, file.TargetId, file.DownloadUrl, file.ExportFormat, file.Unsupported, file.Uncached, file.LastMod, file.Created,
+		file.StaleChecksum, file.ContentMd5, file.ChangeId, file.VerifiedAt, file.StaleChecksum != "", download, upload)
 	return err
 }
 
@@ -110,15 +341,61 @@ func (m *MetaService) updateIOQueue(name string, id string, value int) (err erro
 }
 
 // Deletes the file/folder identified with id.
-func (m *MetaService) deleteFile(id string) error {
-	_, err := m.db.Exec(fmt.Sprintf(sqlDelete, id))
+func deleteFile(conn dbConn, id string) error {
+	if _, err := conn.Exec(fmt.Sprintf(sqlDelete, id)); err != nil {
+		return err
+	}
+	if _, err := conn.Exec(sqlUnlinkParents, id); err != nil {
+		return err
+	}
+	_, err := conn.Exec(sqlUnlinkChildren, id)
 	return err
 }
 
+// Deletes all files, the journal, the largest change ids and the page
+// tokens.
+func (m *MetaService) clear() (err error) {
+	if _, err = m.db.Exec(sqlClearFiles); err != nil {
+		return
+	}
+	if _, err = m.db.Exec(sqlClearLinks); err != nil {
+		return
+	}
+	if _, err = m.db.Exec(sqlJournalClear); err != nil {
+		return
+	}
+	if _, err = m.db.Exec(sqlPendingClear); err != nil {
+		return
+	}
+	if _, err = m.db.Exec(sqlDeleteValue, keyJournalPruned); err != nil {
+		return
+	}
+	if _, err = m.db.Exec(sqlDeletePrefixed, m.changeIdKey(keyPrefixDriveChangeId)); err != nil {
+		return
+	}
+	if _, err = m.db.Exec(sqlDeletePrefixed, m.changeIdKey(keyPrefixPageToken)); err != nil {
+		return
+	}
+	if _, err = m.db.Exec(sqlDeletePrefixed, keyPrefixUploadSession); err != nil {
+		return
+	}
+	for _, key := range []string{keyLastSyncTime, keyLastSyncAttempt, keyLastSyncError, keyRootId} {
+		if _, err = m.db.Exec(sqlDeleteValue, key); err != nil {
+			return
+		}
+	}
+	_, err = m.db.Exec(sqlDeleteValue, m.changeIdKey(keyLargestChangeId))
+	return
+}
+
 // Gets a value.
 func (m *MetaService) getValue(key string) (value string, err error) {
+	return getValue(m.db, key)
+}
+
+func getValue(conn dbConn, key string) (value string, err error) {
 	var rows *sql.Rows
-	if rows, err = m.db.Query(fmt.Sprintf(sqlGetValue, key)); err != nil {
+	if rows, err = conn.Query(sqlGetValue, key); err != nil {
 		return
 	}
 	defer rows.Close()
@@ -131,6 +408,10 @@ func (m *MetaService) getValue(key string) (value string, err error) {
 
 // Sets a value.
 func (m *MetaService) setValue(key string, value string) error {
-	_, err := m.db.Exec(sqlSetValue, key, value)
+	return setValue(m.db, key, value)
+}
+
+func setValue(conn dbConn, key string, value string) error {
+	_, err := conn.Exec(sqlSetValue, key, value)
 	return err
 }
@@ -0,0 +1,75 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"time"
+)
+
+const (
+	keyLastSyncTime    = "last-sync-time"
+	keyLastSyncAttempt = "last-sync-attempt"
+	keyLastSyncError   = "last-sync-error"
+)
+
+// Records a sync that ended at the given time with syncErr, nil if it
+// was successful. The time of the last successful sync is kept apart
+// from the last attempt, so that a failing sync can be told from a
+// stale one.
+func (m *MetaService) SaveSyncAttempt(at time.Time, syncErr error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	message := ""
+	if syncErr != nil {
+		message = syncErr.Error()
+	}
+	if err := m.setValue(keyLastSyncAttempt, at.UTC().Format(time.RFC3339Nano)); err != nil {
+		return err
+	}
+	if err := m.setValue(keyLastSyncError, message); err != nil {
+		return err
+	}
+	if syncErr != nil {
+		return nil
+	}
+	return m.setValue(keyLastSyncTime, at.UTC().Format(time.RFC3339Nano))
+}
+
+// Gets the time of the last successful sync, zero if there was none.
+func (m *MetaService) GetLastSyncTime() (time.Time, error) {
+	m.mu.acquire()
+	defer m.mu.release()
+	return m.timeValue(keyLastSyncTime)
+}
+
+// Gets the time the last sync ended at and its error, empty if it was
+// successful. The time is zero if there was none.
+func (m *MetaService) GetLastSyncAttempt() (at time.Time, message string, err error) {
+	m.mu.acquire()
+	defer m.mu.release()
+	if at, err = m.timeValue(keyLastSyncAttempt); err != nil {
+		return
+	}
+	message, err = m.getValue(keyLastSyncError)
+	return
+}
+
+func (m *MetaService) timeValue(key string) (time.Time, error) {
+	val, err := m.getValue(key)
+	if err != nil || val == "" {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, val)
+}
@@ -0,0 +1,87 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"time"
+)
+
+const (
+	// Columns of the trash in the order of sqlColumns, the ones of the
+	// downloads are not kept.
+	sqlTrashColumns = "remoteId, parentId, name, mimetype, size, md5checksum, title, version, null, targetId, downloadUrl, exportFormat, null, null, null, unsupported, uncached, lastMod, created, null, null, null, null"
+
+	sqlTrash         = "insert or replace into trash (" + sqlFileColumns + ", trashedAt) select " + sqlFileColumns + ", ? from files where remoteId = ?"
+	sqlGetTrashed    = "select " + sqlTrashColumns + " from trash where remoteId = ?"
+	sqlTrashedBefore = "select " + sqlTrashColumns + " from trash where trashedAt <= ? order by trashedAt"
+	sqlDeleteTrashed = "delete from trash where remoteId = ?"
+)
+
+// Moves the metadata of the file identified by id into the trash as a
+// part of the batch, e.g. of a file deleted on Drive, so that it can
+// be restored. The file is not listed anymore.
+func (b *Batch) Trash(id string, at time.Time) error {
+	if _, err := b.tx.Exec(sqlTrash, at.Unix(), id); err != nil {
+		return err
+	}
+	return deleteFile(b.tx, id)
+}
+
+// Gets the metadata of the trashed file identified by id.
+func (m *MetaService) GetTrashed(id string) (*CachedDriveFile, error) {
+	m.mu.acquire()
+	defer m.mu.release()
+	return getTrashed(m.db, id)
+}
+
+// Gets the metadata of the trashed file identified by id, including the
+// writes of the batch.
+func (b *Batch) GetTrashed(id string) (*CachedDriveFile, error) {
+	return getTrashed(b.tx, id)
+}
+
+func getTrashed(conn dbConn, id string) (*CachedDriveFile, error) {
+	files, err := listFiles(conn, sqlGetTrashed, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, ErrNotFound
+	}
+	return files[0], nil
+}
+
+// Lists the files that were trashed before, or at, the given time, the
+// earliest first.
+func (m *MetaService) ListTrash(before time.Time) ([]*CachedDriveFile, error) {
+	m.mu.acquire()
+	defer m.mu.release()
+	return listFiles(m.db, sqlTrashedBefore, before.Unix())
+}
+
+// Removes the trashed file identified by id from the trash.
+func (m *MetaService) DeleteTrashed(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.db.Exec(sqlDeleteTrashed, id)
+	return err
+}
+
+// Removes the trashed file identified by id from the trash as a part
+// of the batch.
+func (b *Batch) DeleteTrashed(id string) error {
+	_, err := b.tx.Exec(sqlDeleteTrashed, id)
+	return err
+}
@@ -0,0 +1,69 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"strings"
+)
+
+const (
+	// Prefix of the keys of the resumable upload sessions in the info
+	// table.
+	keyPrefixUploadSession = "upload-session:"
+)
+
+// UploadSession is a resumable upload of the content of a file to
+// Drive in progress.
+type UploadSession struct {
+	// Uri the content is uploaded to.
+	Uri string
+
+	// Md5 digest in hex of the content being uploaded, the upload
+	// can't be resumed once the content changes.
+	Md5 string
+}
+
+// Gets the resumable upload session of the file identified by id, nil
+// if there is none.
+func (m *MetaService) GetUploadSession(id string) (*UploadSession, error) {
+	m.mu.acquire()
+	defer m.mu.release()
+	val, err := m.getValue(keyPrefixUploadSession + id)
+	if err != nil {
+		return nil, err
+	}
+	md5, uri, ok := strings.Cut(val, " ")
+	if !ok {
+		return nil, nil
+	}
+	return &UploadSession{Uri: uri, Md5: md5}, nil
+}
+
+// Persists the resumable upload session of the file identified by id,
+// so that the upload survives restarts.
+func (m *MetaService) SaveUploadSession(id string, session *UploadSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.setValue(keyPrefixUploadSession+id, session.Md5+" "+session.Uri)
+}
+
+// Removes the resumable upload session of the file identified by id,
+// once the upload is done or can't be resumed.
+func (m *MetaService) DeleteUploadSession(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.db.Exec(sqlDeleteValue, keyPrefixUploadSession+id)
+	return err
+}
@@ -15,27 +15,48 @@
 package mount
 
 import (
+	"context"
+	"errors"
 	"os"
+	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/rakyll/drivefuse/blob"
 	"github.com/rakyll/drivefuse/fileio"
+	"github.com/rakyll/drivefuse/logger"
 	"github.com/rakyll/drivefuse/metadata"
 	"github.com/rakyll/drivefuse/third_party/code.google.com/p/rsc/fuse"
 )
 
 var (
+	// Stops listing a folder once the request is interrupted.
+	errInterrupted = errors.New("mount: interrupted")
+
 	metaService *metadata.MetaService
 	blobManager *blob.Manager
 	downloader  *fileio.Downloader
+	opts        Options
 )
 
+// Options configures the mounted file system.
+type Options struct {
+	// If set, Drive shortcuts are represented as symlinks to their
+	// targets. Otherwise they look like their targets.
+	ShortcutsAsSymlinks bool
+}
+
 type GoogleDriveFS struct{}
 
-func MountAndServe(mountPoint string, meta *metadata.MetaService, blogMngr *blob.Manager, down *fileio.Downloader) error {
+// Mounts the file system at mountPoint and serves it. A nil mountOpts
+// uses the default options.
+func MountAndServe(mountPoint string, meta *metadata.MetaService, blogMngr *blob.Manager, down *fileio.Downloader, mountOpts *Options) error {
 	metaService = meta
 	blobManager = blogMngr
 	downloader = down
+	if mountOpts != nil {
+		opts = *mountOpts
+	}
 	c, err := fuse.Mount(mountPoint)
 	if err != nil {
 		return err
@@ -56,6 +77,15 @@ type GoogleDriveFolder struct {
 	LastMod  time.Time
 }
 
+// GoogleDriveShortcut is a Drive shortcut represented as a symlink.
+type GoogleDriveShortcut struct {
+	Id       string
+	Name     string
+	ParentId string
+	TargetId string
+	LastMod  time.Time
+}
+
 type GoogleDriveFile struct {
 	Id          string
 	Name        string
@@ -63,6 +93,10 @@ type GoogleDriveFile struct {
 	Md5Checksum string
 	Size        int64
 	LastMod     time.Time
+	Created     time.Time
+
+	// Set if the content is not cached, see syncer.SyncOptions.MaxBlobSize.
+	Uncached bool
 }
 
 func (f GoogleDriveFolder) Attr() fuse.Attr {
@@ -86,21 +120,66 @@ func (f GoogleDriveFolder) Lookup(name string, intr fuse.Intr) (fuse.Node, fuse.
 	if err != nil || file == nil {
 		return nil, fuse.ENOENT
 	}
+	if file.IsShortcut() {
+		if opts.ShortcutsAsSymlinks {
+			return GoogleDriveShortcut{
+				Id:       file.Id,
+				Name:     file.Name,
+				ParentId: file.ParentId,
+				TargetId: file.TargetId,
+				LastMod:  file.LastMod}, nil
+		}
+		// shown as the target, under the name of the shortcut
+		target, err := metaService.Get(file.TargetId)
+		if err != nil || target.IsShortcut() {
+			// the target is not synced, e.g. it is not shared anymore
+			return nil, fuse.ENOENT
+		}
+		target.Name = file.Name
+		file = target
+	}
+	return newNode(file), nil
+}
+
+func newNode(file *metadata.CachedDriveFile) fuse.Node {
 	if file.MimeType == metadata.MimeTypeFolder {
-		return &GoogleDriveFolder{Id: file.Id, Name: file.Name, Size: file.FileSize}, nil
+		return &GoogleDriveFolder{Id: file.Id, Name: file.Name, Size: file.FileSize}
+	}
+	size := file.FileSize
+	if file.StaleChecksum != "" {
+		// the stale content is read until the new one is downloaded
+		if staleSize, err := blobManager.Size(file.Id, file.StaleChecksum); err == nil {
+			size = staleSize
+		}
 	}
 	return GoogleDriveFile{
 		Id:          file.Id,
 		Name:        file.Name,
-		Size:        file.FileSize,
-		Md5Checksum: file.Md5Checksum}, nil
+		Size:        size,
+		Md5Checksum: file.ActiveChecksum(),
+		Created:     file.Created,
+		Uncached:    file.Uncached}
 }
 
 func (f GoogleDriveFolder) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
 	ents := []fuse.Dirent{}
-	children, _ := metaService.GetChildren(f.Id)
-	for _, item := range children {
+	// the fuse library needs the whole listing, but streaming the
+	// children keeps only their names in memory, not their metadata
+	err := metaService.EachChild(f.Id, func(item *metadata.CachedDriveFile) error {
+		select {
+		case <-intr:
+			return errInterrupted
+		default:
+		}
 		ents = append(ents, fuse.Dirent{Name: item.Name})
+		return nil
+	})
+	if err == errInterrupted {
+		return nil, fuse.Errno(syscall.EINTR)
+	}
+	if err != nil {
+		logger.V("error listing", f.Id, err)
+		return nil, fuse.EIO
 	}
 	return ents, nil
 }
@@ -112,20 +191,95 @@ func (f GoogleDriveFile) Attr() fuse.Attr {
 		Gid:   uint32(os.Getgid()),
 		Size:  uint64(f.Size),
 		Mtime: f.LastMod,
+		// reported as the birth time on OS X only
+		Crtime: f.Created,
 	}
 }
 
 func (f GoogleDriveFile) Read(req *fuse.ReadRequest, res *fuse.ReadResponse, intr fuse.Intr) fuse.Error {
-	var blob []byte
+	var data []byte
+	var size int64
 	var err error
 
-	if blob, _, err = blobManager.Read(f.Id, f.Md5Checksum, req.Offset, req.Size); err != nil {
+	if f.Uncached {
+		logger.V("refusing to read", f.Id, "its content is not cached")
+		return fuse.EIO
+	}
+	ctx, cancel := intrContext(intr)
+	defer cancel()
+	data, size, err = blobManager.ReadContext(ctx, f.Id, f.Md5Checksum, req.Offset, req.Size)
+	if (os.IsNotExist(err) || err == blob.ErrCacheMiss) && downloader != nil {
+		// e.g. the blob was evicted, fetched before it is read
+		data, size, err = f.readFetched(ctx, req)
+	}
+	if err != nil {
+		if err == context.Canceled {
+			return fuse.Errno(syscall.EINTR)
+		}
 		// TODO: add a loading icon and etc
-		// TODO: force add the file to the download queue
 		return nil
 	}
-	res.Data = blob
+	// reads at the end of the file are short
+	res.Data = data[:size]
 	return nil
 }
 
+// Downloads the content of the file, then reads it. The checksum of
+// the file is looked up again, the stale content it was read with is
+// replaced by the download.
+func (f GoogleDriveFile) readFetched(ctx context.Context, req *fuse.ReadRequest) ([]byte, int64, error) {
+	if err := downloader.EnsureBlob(ctx, f.Id); err != nil {
+		logger.V("error fetching", f.Id, err)
+		return nil, 0, err
+	}
+	file, err := metaService.Get(f.Id)
+	if err != nil {
+		return nil, 0, err
+	}
+	return blobManager.ReadContext(ctx, f.Id, file.ActiveChecksum(), req.Offset, req.Size)
+}
+
+// Returns a context done once the request is interrupted.
+func intrContext(intr fuse.Intr) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-intr:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (s GoogleDriveShortcut) Attr() fuse.Attr {
+	return fuse.Attr{
+		Mode:  os.ModeSymlink | 0400,
+		Uid:   uint32(os.Getuid()),
+		Gid:   uint32(os.Getgid()),
+		Mtime: s.LastMod,
+	}
+}
+
+// Returns the path of the target relative to the folder of the
+// shortcut, so that the link works wherever the file system is
+// mounted.
+func (s GoogleDriveShortcut) Readlink(req *fuse.ReadlinkRequest, intr fuse.Intr) (string, fuse.Error) {
+	target, err := metaService.PathOf(s.TargetId)
+	if err != nil {
+		// the target is not synced, e.g. it is not shared anymore
+		logger.V("shortcut", s.Id, "points to", s.TargetId, "which is not cached")
+		return "", fuse.ENOENT
+	}
+	dir, err := metaService.PathOf(s.ParentId)
+	if err != nil {
+		return "", fuse.ENOENT
+	}
+	rel, err := filepath.Rel("/"+dir, "/"+target)
+	if err != nil {
+		return "", fuse.EIO
+	}
+	return filepath.ToSlash(rel), nil
+}
+
 // TODO(burcud): implement mkdir, rename and write
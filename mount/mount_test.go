@@ -0,0 +1,85 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mount
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/rakyll/drivefuse/metadata"
+	"github.com/rakyll/drivefuse/third_party/code.google.com/p/rsc/fuse"
+	T "github.com/rakyll/drivefuse/third_party/launchpad.net/gocheck"
+)
+
+type MountSuite struct{}
+
+var _ = T.Suite(&MountSuite{})
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	T.TestingT(t)
+}
+
+func (s *MountSuite) SetUpTest(c *T.C) {
+	var err error
+	metaService, err = metadata.New(filepath.Join(c.MkDir(), "meta.sql"), nil)
+	c.Assert(err, T.IsNil)
+	save := func(parentId string, id string, mimeType string, targetId string) {
+		file := &metadata.CachedDriveFile{Id: id, ParentId: parentId, Name: id, MimeType: mimeType, TargetId: targetId}
+		c.Assert(metaService.Save(parentId, id, file, false, false), T.IsNil)
+		c.Assert(metaService.InitFile(id), T.IsNil)
+	}
+	save("", metadata.IdRootFolder, metadata.MimeTypeFolder, "")
+	save(metadata.IdRootFolder, "docs", metadata.MimeTypeFolder, "")
+	save("docs", "report", "text/plain", "")
+	save(metadata.IdRootFolder, "links", metadata.MimeTypeFolder, "")
+	save("links", "to-report", metadata.MimeTypeShortcut, "report")
+	save("links", "dangling", metadata.MimeTypeShortcut, "unknown")
+}
+
+func (s *MountSuite) TearDownTest(c *T.C) {
+	metaService.Close()
+	opts = Options{}
+}
+
+func (s *MountSuite) TestShortcutsAsSymlinks(c *T.C) {
+	opts = Options{ShortcutsAsSymlinks: true}
+	links := GoogleDriveFolder{Id: "links"}
+	node, err := links.Lookup("to-report", nil)
+	c.Assert(err, T.IsNil)
+	shortcut, ok := node.(GoogleDriveShortcut)
+	c.Assert(ok, T.Equals, true)
+	target, err := shortcut.Readlink(&fuse.ReadlinkRequest{}, nil)
+	c.Assert(err, T.IsNil)
+	c.Assert(target, T.Equals, "../docs/report")
+
+	node, err = links.Lookup("dangling", nil)
+	c.Assert(err, T.IsNil)
+	_, err = node.(GoogleDriveShortcut).Readlink(&fuse.ReadlinkRequest{}, nil)
+	c.Assert(err, T.Equals, fuse.ENOENT)
+}
+
+func (s *MountSuite) TestShortcutsAsTargets(c *T.C) {
+	links := GoogleDriveFolder{Id: "links"}
+	node, err := links.Lookup("to-report", nil)
+	c.Assert(err, T.IsNil)
+	file, ok := node.(GoogleDriveFile)
+	c.Assert(ok, T.Equals, true)
+	c.Assert(file.Id, T.Equals, "report")
+	c.Assert(file.Name, T.Equals, "to-report")
+
+	_, err = links.Lookup("dangling", nil)
+	c.Assert(err, T.Equals, fuse.ENOENT)
+}
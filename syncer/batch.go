@@ -0,0 +1,184 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/googleapi"
+)
+
+const batchUrl = "https://www.googleapis.com/batch/drive/v2"
+
+// Fetches the files identified by ids, in batches of
+// SyncOptions.BatchSize if SyncOptions.BatchClient is set, one by one
+// otherwise or if the batch endpoint fails. The files that are not
+// found are neither in files nor in failed, which holds the errors of
+// the files that couldn't be fetched, keyed by id. The errors that fail
+// the whole sync are returned instead.
+func (d *CachedSyncer) getFiles(ctx context.Context, ids []string) (files map[string]*client.File, failed map[string]error, err error) {
+	files, failed = make(map[string]*client.File, len(ids)), make(map[string]error)
+	single := ids
+	if d.opts.BatchClient != nil {
+		single = nil
+		for start := 0; start < len(ids); start += d.opts.BatchSize {
+			chunk := ids[start:min(start+d.opts.BatchSize, len(ids))]
+			var fetched map[string]*client.File
+			var retry []string
+			err = d.doWithRetry(ctx, func() (err error) {
+				fetched, retry, err = d.getBatch(ctx, chunk)
+				return
+			})
+			if _, ok := err.(*googleapi.Error); ok && !isUnrecoverable(err) {
+				d.opts.Logger.V("Batch request failed, fetching the files one by one", err)
+				fetched, retry, err = nil, chunk, nil
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			for id, file := range fetched {
+				files[id] = file
+			}
+			single = append(single, retry...)
+		}
+	}
+	for _, id := range single {
+		if err = ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		var file *client.File
+		err = d.doWithRetry(ctx, func() (err error) {
+			file, err = d.remoteService.Files.Get(id).SupportsAllDrives(true).Do()
+			return
+		})
+		switch {
+		case err == nil:
+			files[id] = file
+		case isNotFound(err):
+			// deleted, or not shared with the user anymore
+		case isUnrecoverable(err):
+			return nil, nil, err
+		default:
+			failed[id] = err
+		}
+	}
+	return files, failed, nil
+}
+
+// Fetches the files identified by ids with a single request to the
+// batch endpoint of Drive. Returns the files found, keyed by id, and
+// the ids of the ones to fetch again one by one: their requests failed
+// other than as not found, or have no response in the batch.
+func (d *CachedSyncer) getBatch(ctx context.Context, ids []string) (files map[string]*client.File, retry []string, err error) {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	for i, id := range ids {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", "application/http")
+		header.Set("Content-ID", fmt.Sprintf("<%d>", i))
+		part, err := w.CreatePart(header)
+		if err != nil {
+			return nil, nil, err
+		}
+		fmt.Fprintf(part, "GET /drive/v2/files/%s?supportsAllDrives=true HTTP/1.1\r\n\r\n", url.PathEscape(id))
+	}
+	if err = w.Close(); err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", batchUrl, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+w.Boundary())
+	res, err := d.opts.BatchClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	if err = googleapi.CheckResponse(res); err != nil {
+		if _, ok := err.(*googleapi.Error); !ok {
+			// the body is not an error of the API, e.g. the endpoint
+			// is not served anymore
+			err = &googleapi.Error{Code: res.StatusCode, Message: err.Error()}
+		}
+		return nil, nil, err
+	}
+	_, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, err
+	}
+	files = make(map[string]*client.File, len(ids))
+	answered := make([]bool, len(ids))
+	r := multipart.NewReader(res.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		i, ok := batchIndex(part.Header.Get("Content-ID"), len(ids))
+		if !ok {
+			continue
+		}
+		sub, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		answered[i] = true
+		err = googleapi.CheckResponse(sub)
+		switch {
+		case err == nil:
+			file := &client.File{}
+			if err = json.NewDecoder(sub.Body).Decode(file); err != nil {
+				return nil, nil, err
+			}
+			files[ids[i]] = file
+		case isNotFound(err):
+			// deleted, or not shared with the user anymore
+		default:
+			answered[i] = false
+		}
+	}
+	for i, ok := range answered {
+		if !ok {
+			retry = append(retry, ids[i])
+		}
+	}
+	return files, retry, nil
+}
+
+// Returns the index of the request a part of the response of a batch
+// answers, from its content id, "<response-i>" for the request of
+// content id "<i>".
+func batchIndex(contentId string, n int) (int, bool) {
+	contentId = strings.TrimPrefix(strings.TrimSuffix(contentId, ">"), "<response-")
+	i, err := strconv.Atoi(contentId)
+	return i, err == nil && i >= 0 && i < n
+}
@@ -0,0 +1,136 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rakyll/drivefuse/blob"
+	"github.com/rakyll/drivefuse/metadata"
+)
+
+// Removes the blobs of the files that are not synced anymore and the
+// blobs that are not the content of their file anymore, which the
+// merges failed to delete, see blob.Manager.Collect. The blobs modified
+// since SyncOptions.CollectGrace before the last successful sync are
+// kept, they may be of changes not recorded yet. Nothing is collected
+// before the first sync. Returns the number of bytes reclaimed.
+func (d *CachedSyncer) CollectBlobs() (int64, error) {
+	lastSync, err := d.metaService.GetLastSyncTime()
+	if err != nil || lastSync.IsZero() {
+		return 0, err
+	}
+	reclaimed, err := d.blobManager.Collect(lastSync.Add(-d.opts.CollectGrace), d.isLiveBlob)
+	if reclaimed > 0 {
+		d.opts.Logger.V("Collected", reclaimed, "bytes of blobs")
+	}
+	return reclaimed, err
+}
+
+// Orphans returns the ids of the files that have blobs stored but are
+// not synced, sorted, e.g. to be confirmed before they are removed by
+// Prune. Unlike CollectBlobs, the blobs of any age are listed, and the
+// blobs of another checksum than the one of their file are not.
+func (d *CachedSyncer) Orphans() ([]string, error) {
+	if d.blobManager.IsPassThrough() {
+		return nil, nil
+	}
+	var mu sync.Mutex
+	orphans := make(map[string]bool)
+	err := d.blobManager.ForEach(func(e *blob.Entry) error {
+		orphan, err := d.isOrphan(e.Id)
+		if err != nil || !orphan {
+			return err
+		}
+		mu.Lock()
+		orphans[e.Id] = true
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(orphans))
+	for id := range orphans {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Prune removes the blobs of the files identified by ids, as listed by
+// Orphans. The files synced since they were listed keep their blobs.
+func (d *CachedSyncer) Prune(ids ...string) error {
+	for _, id := range ids {
+		orphan, err := d.isOrphan(id)
+		if err != nil {
+			return err
+		}
+		if !orphan {
+			d.opts.Logger.V("not pruning the blobs of", id, "it is synced")
+			continue
+		}
+		d.opts.Logger.V("Pruning the blobs of", id)
+		if err = d.blobManager.Delete(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns true if the file identified by id is not synced.
+func (d *CachedSyncer) isOrphan(id string) (bool, error) {
+	_, err := d.metaService.Get(id)
+	if err == metadata.ErrNotFound {
+		return true, nil
+	}
+	return false, err
+}
+
+// Returns true if the blob of the entry is the content of its file,
+// or may be.
+func (d *CachedSyncer) isLiveBlob(e *blob.Entry) bool {
+	file, err := d.metaService.Get(e.Id)
+	if err == metadata.ErrNotFound {
+		return false
+	}
+	if err != nil {
+		d.opts.Logger.V("error checking blob", e.Id, err)
+		return true
+	}
+	// the edits of the file, not pushed yet, or the stale content read
+	// while the new one is downloaded
+	return e.IsDirty() || strings.EqualFold(e.Checksum, file.Md5Checksum) || strings.EqualFold(e.Checksum, file.StaleChecksum)
+}
+
+// Collects the blobs every SyncOptions.CollectInterval, the first time
+// right away, until ctx is done.
+func (d *CachedSyncer) collectPeriodically(ctx context.Context) {
+	for ctx.Err() == nil {
+		if _, err := d.CollectBlobs(); err != nil {
+			d.opts.Logger.V("error collecting blobs", err)
+		}
+		timer := time.NewTimer(d.opts.CollectInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/rakyll/drivefuse/blob"
+	"github.com/rakyll/drivefuse/metadata"
+)
+
+// ConflictPolicy controls how the content of a file edited both
+// locally and on Drive since the last sync is merged.
+type ConflictPolicy int
+
+const (
+	// Keeps the local content as a new file next to the file, named
+	// after it, which is pushed to Drive. The file gets the content of
+	// Drive. The default.
+	ConflictKeepBoth ConflictPolicy = iota
+
+	// Keeps the local content, which replaces the one of Drive once it
+	// is pushed.
+	ConflictPreferLocal
+
+	// Replaces the local content by the one of Drive, the local edit
+	// is lost.
+	ConflictPreferRemote
+)
+
+var conflictPolicyNames = map[string]ConflictPolicy{
+	"keep_both":     ConflictKeepBoth,
+	"prefer_local":  ConflictPreferLocal,
+	"prefer_remote": ConflictPreferRemote,
+}
+
+// Parses a conflict policy name, one of keep_both, prefer_local or
+// prefer_remote.
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	policy, ok := conflictPolicyNames[name]
+	if !ok {
+		return ConflictKeepBoth, errors.New("syncer: unknown conflict policy " + name)
+	}
+	return policy, nil
+}
+
+// localEdit is a local edit of the content of a file, cached as a
+// dirty blob, that is not pushed to Drive yet.
+type localEdit struct {
+	entry blob.Entry
+
+	// Set if the content changed on Drive too, to another one. The
+	// md5 digest in hex and the size of the local content then.
+	conflicting bool
+	md5         string
+	size        int64
+}
+
+// Returns the local edit of the file that data is the new metadata of
+// on Drive, nil if there is none or it is the same content as the one
+// on Drive.
+func (d *CachedSyncer) localEdit(data *metadata.CachedDriveFile) (*localEdit, error) {
+	entry, ok := d.blobManager.Stat(data.Id)
+	if !ok || !entry.IsDirty() {
+		return nil, nil
+	}
+	prev, err := d.getFile(data.Id)
+	if err != nil {
+		// not cached, nor edited then
+		return nil, nil
+	}
+	if queued, err := d.isQueuedForUpload(data.Id); err != nil || !queued {
+		return nil, err
+	}
+	if prev.Md5Checksum == data.Md5Checksum {
+		// only the metadata changed on Drive
+		return &localEdit{entry: entry}, nil
+	}
+	edit, err := d.conflictingEdit(entry)
+	if err != nil || edit.md5 == data.Md5Checksum {
+		return nil, err
+	}
+	return edit, nil
+}
+
+// Returns the local edit cached as the dirty blob of the entry, which
+// conflicts with the content of the file on Drive, along with the md5
+// digest and the size of its content.
+func (d *CachedSyncer) conflictingEdit(entry blob.Entry) (*localEdit, error) {
+	content, err := d.blobManager.OpenEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	edit := &localEdit{entry: entry, conflicting: true}
+	hash := md5.New()
+	if edit.size, err = io.Copy(hash, content); err != nil {
+		return nil, err
+	}
+	edit.md5 = fmt.Sprintf("%x", hash.Sum(nil))
+	return edit, nil
+}
+
+// Returns true if the local edit is to be pushed rather than replaced
+// by the content of the file on Drive.
+func (d *CachedSyncer) keepsLocal(edit *localEdit) bool {
+	return edit != nil && (!edit.conflicting || d.opts.Conflicts == ConflictPreferLocal)
+}
+
+// Returns the id of the local copy of the conflicting edit of the file
+// identified by id, merged along with the change identified by
+// changeId.
+func conflictedCopyId(id string, changeId int64) string {
+	return fmt.Sprintf("%s%s-conflict-%d", metadata.LocalIdPrefix, id, changeId)
+}
+
+// Saves the content of the conflicting edit as the blob of the local
+// copy identified by copyId.
+func (d *CachedSyncer) saveConflictedContent(copyId string, edit *localEdit) error {
+	content, err := d.blobManager.OpenEntry(edit.entry)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	return d.blobManager.Save(copyId, edit.md5, content)
+}
+
+// Saves the local copy of the file prev, of the conflicting edit, as a
+// part of the batch. The copy is queued for upload, as a new file.
+func (d *CachedSyncer) saveConflictedCopy(b *metadata.Batch, prev *metadata.CachedDriveFile, copyId string, edit *localEdit) (*metadata.CachedDriveFile, error) {
+	d.opts.Logger.V("keeping the local edit of", prev.Id, "as", copyId)
+	name := conflictedName(prev.Name, d.opts.MaxNameLength)
+	data := &metadata.CachedDriveFile{
+		Id:          copyId,
+		ParentId:    prev.ParentId,
+		Name:        name,
+		Title:       name,
+		MimeType:    prev.MimeType,
+		FileSize:    edit.size,
+		Md5Checksum: edit.md5,
+		LastMod:     prev.LastMod,
+		Created:     prev.LastMod,
+	}
+	if err := d.resolveConflicts(b, []string{data.ParentId}, copyId, data); err != nil {
+		return nil, err
+	}
+	return data, b.Save(data.ParentId, copyId, data, false, true)
+}
+
+// Records the conflict of the file identified by id in the result of
+// the sync in progress, if any.
+func (d *CachedSyncer) recordConflict(id string) {
+	if r := d.result; r != nil {
+		r.Conflicts = append(r.Conflicts, id)
+	}
+}
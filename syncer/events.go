@@ -0,0 +1,144 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+// Number of events buffered for a slow consumer, the later ones are
+// dropped until it catches up.
+const eventBufferSize = 256
+
+// SyncEventKind is the type of a SyncEvent.
+type SyncEventKind int
+
+const (
+	SyncStarted SyncEventKind = iota + 1
+	FileSynced
+	FileDeleted
+	PageProcessed
+	SyncFinished
+	UploadProgress
+	QuotaWarning
+)
+
+func (k SyncEventKind) String() string {
+	switch k {
+	case SyncStarted:
+		return "sync started"
+	case FileSynced:
+		return "file synced"
+	case FileDeleted:
+		return "file deleted"
+	case PageProcessed:
+		return "page processed"
+	case SyncFinished:
+		return "sync finished"
+	case UploadProgress:
+		return "upload progress"
+	case QuotaWarning:
+		return "quota warning"
+	}
+	return "unknown"
+}
+
+// SyncEvent reports the progress of a sync, see CachedSyncer.Events.
+type SyncEvent struct {
+	Kind SyncEventKind
+
+	// Id and local name of the file of FileSynced, FileDeleted and
+	// UploadProgress.
+	Id   string
+	Name string
+
+	// Size of the content of FileSynced queued for download, zero if
+	// it is unchanged or the file has no content. Bytes of the content
+	// of UploadProgress uploaded so far, out of Total. Size of the
+	// contents stored on Drive of QuotaWarning, more than the cap of
+	// the cache in Total.
+	Bytes int64
+	Total int64
+
+	// Largest change id of PageProcessed, of the feed of the page, and
+	// the progress of the sync once the page is processed.
+	ChangeId int64
+	Progress SyncProgress
+
+	// Result and error of SyncFinished.
+	Result *SyncResult
+	Err    error
+}
+
+// Events returns the channel the progress of the syncs is published
+// to. Events are dropped while the channel is full, the syncer never
+// waits for a consumer.
+func (d *CachedSyncer) Events() <-chan SyncEvent {
+	return d.events
+}
+
+func (d *CachedSyncer) publish(e SyncEvent) {
+	select {
+	case d.events <- e:
+	default:
+		// nobody is listening, or not fast enough
+	}
+}
+
+// InvalidateKind is the type of an InvalidateEvent.
+type InvalidateKind int
+
+const (
+	// The attributes or the content of the file changed.
+	InvalidateAttr InvalidateKind = iota + 1
+	// The file was added to, removed from or renamed in the folder.
+	InvalidateEntry
+)
+
+func (k InvalidateKind) String() string {
+	switch k {
+	case InvalidateAttr:
+		return "attributes"
+	case InvalidateEntry:
+		return "entry"
+	}
+	return "unknown"
+}
+
+// InvalidateEvent reports a change of the metadata merged by a sync,
+// for the FUSE binding to drop what it cached of it, see
+// CachedSyncer.Invalidations.
+type InvalidateEvent struct {
+	FileId string
+	// Local id of the folder the entry of the file is listed in.
+	ParentId string
+	Kind     InvalidateKind
+}
+
+// Invalidations returns the channel the invalidations of the merged
+// changes are published to. Like the events, they are dropped while
+// the channel is full.
+func (d *CachedSyncer) Invalidations() <-chan InvalidateEvent {
+	return d.invalidations
+}
+
+func (d *CachedSyncer) invalidate(events []InvalidateEvent) {
+	if d.opts.DryRun {
+		// nothing changes
+		return
+	}
+	for _, e := range events {
+		select {
+		case d.invalidations <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/rakyll/drivefuse/metadata"
+	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
+)
+
+// Parses comma separated MIME types, or patterns of them such as
+// "image/*", into SyncOptions.MimeTypes or SyncOptions.ExcludeMimeTypes.
+func ParseMimeTypes(value string) ([]string, error) {
+	patterns := []string{}
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil || !strings.Contains(pattern, "/") {
+			return nil, fmt.Errorf("invalid mime type %q, expected type/subtype or a pattern such as image/*", pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// Returns true if the mime type matches one of the patterns, regardless
+// of case.
+func matchesMimeType(patterns []string, mimeType string) bool {
+	mimeType = strings.ToLower(mimeType)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), mimeType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the file is not synced by its MIME type, see
+// SyncOptions.MimeTypes and SyncOptions.ExcludeMimeTypes. Folders are
+// always synced.
+func (d *CachedSyncer) filtersOut(file *client.File) bool {
+	if file.MimeType == metadata.MimeTypeFolder {
+		return false
+	}
+	if len(d.opts.MimeTypes) > 0 && !matchesMimeType(d.opts.MimeTypes, file.MimeType) {
+		return true
+	}
+	return matchesMimeType(d.opts.ExcludeMimeTypes, file.MimeType)
+}
+
+// Counts a file filtered out by its MIME type in the result of the sync
+// in progress, if any.
+func (d *CachedSyncer) recordFiltered() {
+	if r := d.result; r != nil {
+		r.FilesFiltered++
+	}
+}
+
+// Removes the folders left without any file in their subtrees, e.g.
+// since their files are filtered out, see SyncOptions.PruneEmptyFolders.
+// The root folders, the synced folders and the folders with local
+// changes are kept.
+func (d *CachedSyncer) pruneFolders(rootId string) error {
+	kept := map[string]bool{metadata.IdRootFolder: true}
+	for _, id := range append(append([]string{}, d.opts.FolderIds...), d.opts.SharedDrives...) {
+		kept[id] = true
+	}
+	children := make(map[string]int)
+	folders := make(map[string]*metadata.CachedDriveFile)
+	err := d.metaService.Walk(func(p string, file *metadata.CachedDriveFile) error {
+		children[file.ParentId]++
+		if file.IsFolder() && !kept[file.Id] && !file.IsLocal() {
+			folders[file.Id] = file
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	empty := []string{}
+	for id := range folders {
+		if children[id] == 0 {
+			empty = append(empty, id)
+		}
+	}
+	checkpoint, _ := d.metaService.GetLargestChangeId()
+	for len(empty) > 0 {
+		id := empty[len(empty)-1]
+		empty = empty[:len(empty)-1]
+		if pending, err := d.metaService.GetPending(id); err != nil || pending != nil {
+			// renamed or moved locally, not pushed yet
+			continue
+		}
+		d.opts.Logger.V("pruning the empty folder", id)
+		if err = d.mergeChange(rootId, &client.Change{Id: checkpoint, FileId: id, Deleted: true}); err != nil {
+			return err
+		}
+		parentId := folders[id].ParentId
+		if children[parentId]--; children[parentId] == 0 && folders[parentId] != nil {
+			empty = append(empty, parentId)
+		}
+	}
+	return nil
+}
+
+// Fetches the folders pruned by SyncOptions.PruneEmptyFolders that the
+// files of the latest changes of the page are merged into, and their
+// pruned parents in turn. Returns their changes, the parents first, to
+// be merged ahead of the page. Folders are fetched once by a sync, the
+// ones still not cached are out of the synced folders.
+func (d *CachedSyncer) restorePruned(ctx context.Context, rootId string, items []*client.Change, latest map[string]int64) ([]*client.Change, error) {
+	inPage := make(map[string]bool, len(items))
+	level := []*client.Change{}
+	for _, item := range items {
+		inPage[item.FileId] = true
+		if !item.Deleted && item.File != nil && !item.File.Labels.Trashed && !d.filtersOut(item.File) && item.Id >= latest[item.FileId] {
+			level = append(level, item)
+		}
+	}
+	if d.restoring == nil {
+		d.restoring = make(map[string]bool)
+	}
+	restored := []*client.Change{}
+	for len(level) > 0 {
+		ids := []string{}
+		changeIds := make(map[string]int64)
+		for _, item := range level {
+			for _, parent := range item.File.Parents {
+				id := cachedParentId(rootId, parent)
+				if id == metadata.IdRootFolder || inPage[id] || d.restoring[id] {
+					continue
+				}
+				if _, err := d.getFile(id); err == nil {
+					continue
+				}
+				d.restoring[id] = true
+				ids = append(ids, id)
+				changeIds[id] = max(item.Id, latest[id])
+			}
+		}
+		if len(ids) == 0 {
+			break
+		}
+		files, _, err := d.getFiles(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		level = []*client.Change{}
+		for _, id := range ids {
+			// the ones not found or failing are left out, their children
+			// are merged on their own
+			if file := files[id]; file != nil && file.MimeType == metadata.MimeTypeFolder {
+				d.opts.Logger.V("restoring the pruned folder", id)
+				level = append(level, &client.Change{Id: changeIds[id], FileId: id, File: file})
+			}
+		}
+		restored = append(append([]*client.Change{}, level...), restored...)
+	}
+	return restored, nil
+}
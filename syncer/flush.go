@@ -0,0 +1,209 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rakyll/drivefuse/blob"
+	"github.com/rakyll/drivefuse/metadata"
+	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
+)
+
+var errParentNotPushed = errors.New("parent folder is not on Drive yet")
+
+// Pushes the local operations recorded in the metadata to Drive, see
+// metadata.MarkPending, in dependency order: the parents before their
+// children, the deletes last. The content written locally is checked
+// against the one of Drive first; if it changed there too since the
+// last sync, the conflict is merged as SyncOptions.Conflicts tells. A
+// file that fails to be flushed doesn't stop the others, its operations
+// stay recorded; the number of failures is returned with the first
+// error.
+func (d *CachedSyncer) flushPending(ctx context.Context) error {
+	changes, err := d.metaService.ListPending()
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+	depths := make(map[string]int, len(changes))
+	for _, change := range changes {
+		depths[change.Id] = d.depthOf(change)
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return depths[changes[i].Id] < depths[changes[j].Id]
+	})
+	failures := 0
+	var firstErr error
+	for _, change := range changes {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if err = d.flush(ctx, change); err != nil {
+			d.opts.Logger.V("error flushing", change.Id, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			failures++
+		}
+	}
+	if failures > 0 {
+		return fmt.Errorf("failed to flush %d files: %v", failures, firstErr)
+	}
+	return nil
+}
+
+// Returns the number of the parents of the file of the change up to the
+// root folder, or a depth past all of them if it is deleted.
+func (d *CachedSyncer) depthOf(change *metadata.PendingChange) int {
+	if change.Ops&metadata.PendingDelete != 0 {
+		return int(^uint(0) >> 1)
+	}
+	depth := 0
+	// bounded in case the parents loop
+	for id := change.Id; id != metadata.IdRootFolder && depth < 1<<10; depth++ {
+		file, err := d.metaService.Get(id)
+		if err != nil {
+			break
+		}
+		id = file.ParentId
+	}
+	return depth
+}
+
+// Pushes the local operations of the change, and clears them unless
+// more were recorded meanwhile.
+func (d *CachedSyncer) flush(ctx context.Context, change *metadata.PendingChange) error {
+	id := change.Id
+	if change.Ops&metadata.PendingDelete != 0 {
+		if !strings.HasPrefix(id, metadata.LocalIdPrefix) {
+			d.opts.Logger.V("Trashing", id)
+			err := d.doWithRetry(ctx, func() error {
+				_, err := d.remoteService.Files.Trash(id).Do()
+				return err
+			})
+			if err != nil && !isNotFound(err) {
+				return err
+			}
+		}
+		return d.metaService.ClearPending(id, change.Version)
+	}
+	file, err := d.metaService.Get(id)
+	if err == metadata.ErrNotFound {
+		// deleted since, the delete is recorded on its own
+		return d.metaService.ClearPending(id, change.Version)
+	}
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(file.ParentId, metadata.LocalIdPrefix) {
+		return errParentNotPushed
+	}
+	switch {
+	case change.Ops&metadata.PendingCreate != 0 || file.IsLocal():
+		if id, err = d.push(ctx, file); err != nil {
+			return err
+		}
+	case change.Ops&metadata.PendingUpdate != 0:
+		if err = d.flushUpdate(ctx, file); err != nil {
+			return err
+		}
+	default:
+		if err = d.pushMetadata(ctx, file); err != nil {
+			return err
+		}
+	}
+	// the operations of a local file move to the id Drive assigns it
+	return d.metaService.ClearPending(id, change.Version)
+}
+
+// Pushes the content written locally to the file, unless its content
+// changed on Drive too since the last sync and the conflict policy
+// prefers the content of Drive. The local content is kept as a new
+// local file next to it then, if the policy keeps both.
+func (d *CachedSyncer) flushUpdate(ctx context.Context, file *metadata.CachedDriveFile) error {
+	var remote *client.File
+	err := d.doWithRetry(ctx, func() (err error) {
+		remote, err = d.remoteService.Files.Get(file.Id).Do()
+		return
+	})
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	if err == nil && remote.Md5Checksum == file.Md5Checksum {
+		_, err = d.push(ctx, file)
+		return err
+	}
+	// edited or deleted on Drive too
+	d.opts.Logger.V("edited both locally and on Drive", file.Id)
+	d.recordConflict(file.Id)
+	if d.opts.Conflicts == ConflictPreferLocal && remote != nil {
+		_, err = d.push(ctx, file)
+		return err
+	}
+	entry, ok := d.blobManager.Stat(file.Id)
+	if d.opts.Conflicts != ConflictPreferRemote && ok && entry.IsDirty() {
+		if err = d.keepFlushedEdit(file, entry); err != nil {
+			return err
+		}
+	}
+	// the inbound sync merges the content of Drive instead
+	if err = d.blobManager.Delete(file.Id); err != nil {
+		return err
+	}
+	return d.metaService.DequeueFromIO("upload", file.Id)
+}
+
+// Saves the conflicting local content of the file, cached by the entry,
+// as a new local file next to it, which is pushed along with the other
+// files queued for upload.
+func (d *CachedSyncer) keepFlushedEdit(file *metadata.CachedDriveFile, entry blob.Entry) error {
+	edit, err := d.conflictingEdit(entry)
+	if err != nil {
+		return err
+	}
+	changeId, err := d.metaService.GetLargestChangeId()
+	if err != nil {
+		return err
+	}
+	// the changes merged next have larger ids, their copies don't
+	// collide with this one
+	copyId := conflictedCopyId(file.Id, changeId)
+	if err = d.saveConflictedContent(copyId, edit); err != nil {
+		return err
+	}
+	return d.writeBatch(func(b *metadata.Batch) error {
+		_, err := d.saveConflictedCopy(b, file, copyId, edit)
+		return err
+	})
+}
+
+// Pushes the title and the parent of the file renamed or moved locally
+// to Drive, without its content, and saves the metadata Drive returns.
+func (d *CachedSyncer) pushMetadata(ctx context.Context, file *metadata.CachedDriveFile) error {
+	d.opts.Logger.V("Pushing the metadata of", file.Id, file.Name)
+	var remote *client.File
+	err := d.doWithRetry(ctx, func() (err error) {
+		remote, err = d.remoteService.Files.Update(file.Id, remoteOf(file)).Do()
+		return
+	})
+	if err != nil {
+		return err
+	}
+	return d.savePushed(file, remote)
+}
@@ -0,0 +1,56 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"errors"
+	"net/http"
+)
+
+var errNoClient = errors.New("syncer: client is nil")
+
+// Returns a client sending its requests through c, limited along with
+// the requests of the syncer to SyncOptions.MaxConcurrentRequests in
+// flight at the same time, e.g. for the downloads of the contents.
+func (d *CachedSyncer) LimitClient(c *http.Client) *http.Client {
+	base := c.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	limited := *c
+	limited.Transport = &limitedTransport{base: base, slots: d.requests}
+	return &limited
+}
+
+// limitedTransport sends the requests through base once one of the
+// slots is free. A request holds its slot until its response headers
+// are received, the response body is read after.
+type limitedTransport struct {
+	base  http.RoundTripper
+	slots chan struct{}
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case t.slots <- struct{}{}:
+	case <-req.Context().Done():
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, req.Context().Err()
+	}
+	defer func() { <-t.slots }()
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,71 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/rakyll/drivefuse/metadata"
+	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
+)
+
+// Opens the docs whose links don't tell their url.
+const openUrl = "https://drive.google.com/open?id="
+
+// docLink is the content of the link to a native doc, in the format of
+// the .gdoc files of the Drive clients.
+type docLink struct {
+	Url   string `json:"url"`
+	DocId string `json:"doc_id"`
+}
+
+// Returns the content of the link to the native doc.
+func linkContent(file *client.File) []byte {
+	link := docLink{Url: file.AlternateLink, DocId: file.Id}
+	if link.Url == "" {
+		link.Url = openUrl + file.Id
+	}
+	content, _ := json.Marshal(link)
+	return append(content, '\n')
+}
+
+// Sets the name, the size and the checksum of the link to the native
+// doc in its metadata.
+func (d *CachedSyncer) buildLink(data *metadata.CachedDriveFile, file *client.File) {
+	content := linkContent(file)
+	data.Name = d.localName(withExtension(file.Title, metadata.LinkExtension(file.MimeType)))
+	data.FileSize = int64(len(content))
+	data.Md5Checksum = fmt.Sprintf("%x", md5.Sum(content))
+}
+
+// Stores the content the syncer generates for the file, the link to
+// it or nothing at all if it is unsupported, unless it is stored
+// already, and makes the file visible.
+func (d *CachedSyncer) saveGenerated(data *metadata.CachedDriveFile, file *client.File) error {
+	if !d.blobManager.Exists(data.Id, data.Md5Checksum) {
+		var content []byte
+		if data.IsLink() {
+			content = linkContent(file)
+		}
+		if err := d.blobManager.Save(data.Id, data.Md5Checksum, ioutil.NopCloser(bytes.NewReader(content))); err != nil {
+			return err
+		}
+	}
+	return d.initFile(data.Id)
+}
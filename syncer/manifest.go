@@ -0,0 +1,110 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/rakyll/drivefuse/metadata"
+)
+
+// ManifestEntry is a file or a folder of the cached tree in the
+// manifest written by ExportManifest.
+type ManifestEntry struct {
+	Id string `json:"id"`
+
+	// Id of the folder the file is saved under, then the ones of the
+	// other folders it is linked under.
+	ParentIds []string `json:"parent_ids"`
+
+	// Slash separated local path of the file from the root folder, see
+	// metadata.MetaService.Resolve. The first one walked of a file
+	// linked under several folders.
+	Path string `json:"path"`
+
+	Name     string `json:"name"`
+	MimeType string `json:"mime_type"`
+	Size     int64  `json:"size"`
+
+	// Md5 checksum of the content, the one computed when it was
+	// downloaded if Drive gives none, see
+	// metadata.CachedDriveFile.ContentMd5.
+	Checksum string    `json:"checksum,omitempty"`
+	LastMod  time.Time `json:"mtime"`
+
+	// Whether the blob of the content is stored locally.
+	Cached bool `json:"cached"`
+}
+
+// ExportManifest writes the cached tree to w as a JSON array of
+// ManifestEntry, one per file, the folders before their children. The
+// entries are written as the tree is walked, rather than held in
+// memory; the writes to the metadata are blocked meanwhile, so that the
+// manifest is a consistent snapshot.
+func (d *CachedSyncer) ExportManifest(w io.Writer) error {
+	others, err := d.metaService.AllOtherParents()
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	bw.WriteString("[")
+	sep := "\n"
+	seen := make(map[string]bool)
+	err = d.metaService.Walk(func(p string, file *metadata.CachedDriveFile) error {
+		if seen[file.Id] {
+			// walked again under another parent
+			return nil
+		}
+		seen[file.Id] = true
+		entry := ManifestEntry{
+			Id:        file.Id,
+			ParentIds: append([]string{file.ParentId}, others[file.Id]...),
+			Path:      strings.TrimPrefix(p, "/"),
+			Name:      file.Name,
+			MimeType:  file.MimeType,
+			Size:      file.FileSize,
+			Checksum:  file.Md5Checksum,
+			LastMod:   file.LastMod,
+		}
+		if entry.Checksum == "" {
+			// computed when the content was downloaded
+			entry.Checksum = file.ContentMd5
+		}
+		if !file.IsFolder() {
+			entry.Cached = d.blobManager.Exists(file.Id, file.ActiveChecksum())
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		bw.WriteString(sep)
+		sep = ",\n"
+		// fails once a write of the buffer does
+		_, err = bw.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if sep != "\n" {
+		bw.WriteString("\n")
+	}
+	bw.WriteString("]\n")
+	return bw.Flush()
+}
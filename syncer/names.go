@@ -0,0 +1,182 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rakyll/drivefuse/metadata"
+)
+
+const (
+	// Number of hex characters of the title hash appended to
+	// truncated names.
+	lenNameHash = 8
+
+	// Extensions longer than this are not preserved on truncation.
+	maxLenExtension = 16
+)
+
+// NamePolicy controls which characters and names can't be local file
+// names, after the file system the files are served on. Drive titles
+// hold any of them; they are replaced in the local names, the titles
+// are kept apart and pushed back as they are.
+type NamePolicy int
+
+const (
+	// Names can't hold slashes nor NULs, nor be "." or "..". The
+	// default.
+	NamesPosix NamePolicy = iota
+
+	// Names can't hold what the POSIX ones can't either, nor the
+	// characters Windows reserves: <>:"\|?* and the control characters,
+	// nor end with a dot or a space. The device names, such as CON,
+	// NUL, COM1 or LPT1, are reserved with any extension.
+	NamesWindows
+)
+
+var namePolicyNames = map[string]NamePolicy{
+	"posix":   NamesPosix,
+	"windows": NamesWindows,
+}
+
+// Parses a name policy name, one of posix or windows.
+func ParseNamePolicy(name string) (NamePolicy, error) {
+	policy, ok := namePolicyNames[name]
+	if !ok {
+		return NamesPosix, errors.New("syncer: unknown name policy " + name)
+	}
+	return policy, nil
+}
+
+// Replaces the characters that can't be in a local name under the
+// policy by underscores, and appends one to the names that are
+// reserved, before their extension. Distinct names may be sanitized
+// alike, the siblings of the same name are told apart as usual, see
+// uniqueName.
+func sanitizeName(name string, policy NamePolicy) string {
+	illegal := func(r rune) bool { return r == '/' || r == 0 }
+	if policy == NamesWindows {
+		illegal = func(r rune) bool { return r < 32 || strings.ContainsRune(`<>:"/\|?*`, r) }
+	}
+	name = strings.Map(func(r rune) rune {
+		if illegal(r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "." || name == ".." {
+		return strings.Repeat("_", len(name))
+	}
+	if policy != NamesWindows {
+		return name
+	}
+	trimmed := strings.TrimRight(name, ". ")
+	name = trimmed + strings.Repeat("_", len(name)-len(trimmed))
+	if base, ext, found := strings.Cut(name, "."); isReservedName(base) && found {
+		return base + "_." + ext
+	} else if isReservedName(base) {
+		return base + "_"
+	}
+	return name
+}
+
+// Returns true if name is one of the device names Windows reserves.
+func isReservedName(name string) bool {
+	switch name = strings.ToUpper(strings.TrimRight(name, " ")); name {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+	return len(name) == 4 && (strings.HasPrefix(name, "COM") || strings.HasPrefix(name, "LPT")) && name[3] >= '1' && name[3] <= '9'
+}
+
+// Converts a Drive title, with the extension appended if any, into a
+// local file name, see sanitizeName and localName.
+func (d *CachedSyncer) localName(title string) string {
+	return localName(sanitizeName(title, d.opts.Names), d.opts.MaxNameLength)
+}
+
+// Converts a Drive title into a local file name no longer than
+// maxLen bytes. Over-length titles are truncated, keeping their
+// extension and appending a short hash of the full title so that
+// distinct titles sharing a long prefix don't collide.
+func localName(title string, maxLen int) string {
+	if len(title) <= maxLen {
+		return title
+	}
+	return appendHash(title, title, maxLen)
+}
+
+// Appends a short hash of key to name before its extension, truncating
+// name so that the result is no longer than maxLen bytes.
+func appendHash(name string, key string, maxLen int) string {
+	hash := fmt.Sprintf("~%x", md5.Sum([]byte(key)))[:lenNameHash+1]
+	if maxLen < len(hash) {
+		// no room for any of the name, only for a part of the hash
+		return hash[1 : maxLen+1]
+	}
+	ext := path.Ext(name)
+	if len(ext) > maxLenExtension || len(ext) == len(name) || len(ext)+len(hash) >= maxLen {
+		ext = ""
+	}
+	base := truncateUTF8(name[:len(name)-len(ext)], maxLen-len(ext)-len(hash))
+	return base + hash + ext
+}
+
+// Truncates s to at most n bytes without splitting a multi-byte rune.
+func truncateUTF8(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// Returns a local name for the file identified by id, distinct from
+// the siblings sharing name. A short hash of the id is appended before
+// the extension, so that the name stays the same across syncs.
+func uniqueName(name string, id string, maxLen int) string {
+	return appendHash(name, id, maxLen)
+}
+
+// Returns the name of the local copy of a conflicting edit of the file
+// called name, see ConflictKeepBoth.
+func conflictedName(name string, maxLen int) string {
+	ext := path.Ext(name)
+	if len(ext) > maxLenExtension || len(ext) == len(name) {
+		ext = ""
+	}
+	return localName(name[:len(name)-len(ext)]+" (conflicted copy)"+ext, maxLen)
+}
+
+// Returns true if file should give up its name to a sibling of the
+// same name. Folders keep their names over files, otherwise the one
+// with the smaller id does, whichever is synced first.
+func yieldsName(file *metadata.CachedDriveFile, sibling *metadata.CachedDriveFile) bool {
+	if file.IsFolder() != sibling.IsFolder() {
+		return !file.IsFolder()
+	}
+	return file.Id > sibling.Id
+}
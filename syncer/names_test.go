@@ -0,0 +1,99 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Contains tests for syncer package.
+package syncer
+
+import (
+	"strings"
+	"testing"
+
+	T "github.com/rakyll/drivefuse/third_party/launchpad.net/gocheck"
+)
+
+type NamesSuite struct{}
+
+var _ = T.Suite(&NamesSuite{})
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	T.TestingT(t)
+}
+
+func (s *NamesSuite) TestShortNameUnchanged(c *T.C) {
+	c.Assert(localName("report.pdf", DefaultMaxNameLength), T.Equals, "report.pdf")
+}
+
+func (s *NamesSuite) TestOverLengthName(c *T.C) {
+	title := strings.Repeat("a", 300) + ".pdf"
+	other := strings.Repeat("a", 300) + "b.pdf"
+
+	name := localName(title, DefaultMaxNameLength)
+	c.Assert(len(name) <= DefaultMaxNameLength, T.Equals, true)
+	c.Assert(strings.HasSuffix(name, ".pdf"), T.Equals, true)
+	c.Assert(strings.HasPrefix(name, "aaaa"), T.Equals, true)
+	c.Assert(localName(title, DefaultMaxNameLength), T.Equals, name)
+	c.Assert(localName(other, DefaultMaxNameLength), T.Not(T.Equals), name)
+}
+
+func (s *NamesSuite) TestOverLengthMultiByteName(c *T.C) {
+	name := localName(strings.Repeat("é", 200), DefaultMaxNameLength)
+	c.Assert(len(name) <= DefaultMaxNameLength, T.Equals, true)
+	c.Assert(strings.ToValidUTF8(name, "?"), T.Equals, name)
+}
+
+func (s *NamesSuite) TestNameLengthShorterThanHash(c *T.C) {
+	title := strings.Repeat("a", 20) + ".pdf"
+	for maxLen := 1; maxLen <= 12; maxLen++ {
+		name := localName(title, maxLen)
+		c.Assert(len(name) <= maxLen, T.Equals, true)
+		c.Assert(name, T.Not(T.Equals), "")
+	}
+}
+
+func (s *NamesSuite) TestConflictedName(c *T.C) {
+	c.Assert(conflictedName("report.pdf", DefaultMaxNameLength), T.Equals, "report (conflicted copy).pdf")
+	c.Assert(conflictedName("notes", DefaultMaxNameLength), T.Equals, "notes (conflicted copy)")
+	c.Assert(conflictedName(".profile", DefaultMaxNameLength), T.Equals, ".profile (conflicted copy)")
+	name := conflictedName(strings.Repeat("a", 250)+".pdf", DefaultMaxNameLength)
+	c.Assert(len(name) <= DefaultMaxNameLength, T.Equals, true)
+	c.Assert(strings.HasSuffix(name, ".pdf"), T.Equals, true)
+}
+
+func (s *NamesSuite) TestIllegalNamesAreSanitized(c *T.C) {
+	posix := map[string]string{
+		"a/b.txt":   "a_b.txt",
+		"nul\x00":   "nul_",
+		"..":        "__",
+		"CON.txt":   "CON.txt",
+		"trailing.": "trailing.",
+	}
+	for name, sanitized := range posix {
+		c.Assert(sanitizeName(name, NamesPosix), T.Equals, sanitized)
+	}
+	windows := map[string]string{
+		"a/b.txt":        "a_b.txt",
+		`what?<>:"\|*`:   "what________",
+		"CON":            "CON_",
+		"con.txt":        "con_.txt",
+		"LPT1.tar.gz":    "LPT1_.tar.gz",
+		"COM0.txt":       "COM0.txt",
+		"CONSOLE.txt":    "CONSOLE.txt",
+		"trailing. ":     "trailing__",
+		"tab\tseparated": "tab_separated",
+	}
+	for name, sanitized := range windows {
+		c.Assert(sanitizeName(name, NamesWindows), T.Equals, sanitized, T.Commentf("%q", name))
+	}
+}
@@ -0,0 +1,506 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rakyll/drivefuse/logger"
+	"github.com/rakyll/drivefuse/metadata"
+)
+
+const (
+	// Most local filesystems limit a file name to 255 bytes.
+	DefaultMaxNameLength = 255
+
+	// The interval between the syncs grows from the default up to the
+	// max while there are no changes, see SyncOptions.MaxInterval.
+	DefaultSyncInterval    = 30 * time.Second
+	DefaultMaxSyncInterval = 5 * time.Minute
+
+	// Jitter of the syncs of the instances started together, short
+	// enough not to be noticed by a single one, see
+	// SyncOptions.StartJitter and SyncOptions.IntervalJitter.
+	DefaultStartJitter    = 5 * time.Second
+	DefaultIntervalJitter = 0.1
+
+	// Metadata calls are small, fail them fast.
+	DefaultMetadataTimeout = 30 * time.Second
+
+	// Writes to the metadata database are retried this many times
+	// while it is locked by readers.
+	DefaultBusyAttempts = 5
+
+	// Delay before retrying a write to the locked metadata database,
+	// doubled after each retry.
+	busyRetryDelay = 100 * time.Millisecond
+
+	// Metadata calls to Drive are retried this many times while they
+	// are rate limited or fail on the server side.
+	DefaultApiAttempts = 5
+
+	// Delay before retrying a metadata call to Drive unless it tells
+	// otherwise, doubled after each retry and jittered.
+	DefaultApiRetryDelay = time.Second
+
+	// Longest delay of the backoff of the metadata calls to Drive, see
+	// SyncOptions.ApiMaxRetryDelay.
+	DefaultApiMaxRetryDelay = time.Minute
+
+	// Longest Retry-After of Drive honored, see SyncOptions.MaxRetryAfter.
+	DefaultMaxRetryAfter = 5 * time.Minute
+
+	// Interval between the connectivity checks while Drive can't be
+	// reached. A check is cheaper than a sync.
+	DefaultConnectivityInterval = 10 * time.Second
+
+	// Contents of at least this size are uploaded in chunks, an
+	// interrupted upload resumes from the last chunk Drive received.
+	DefaultResumableThreshold = 8 << 20
+	DefaultUploadChunkSize    = 8 << 20
+
+	// Drive takes chunks of multiples of this size, but the last one.
+	uploadChunkUnit = 256 << 10
+
+	// Blobs modified within this time before the last sync are not
+	// collected, see SyncOptions.CollectGrace.
+	DefaultCollectGrace = time.Hour
+
+	// Lifetime of the channels notifying the changes, see
+	// SyncOptions.WatchTTL.
+	DefaultWatchTTL = 24 * time.Hour
+
+	// Requests to Drive in flight at the same time, see
+	// SyncOptions.MaxConcurrentRequests.
+	DefaultMaxConcurrentRequests = 10
+
+	// Changes listed by each page of the change feed, see
+	// SyncOptions.MaxResults, and the most Drive lists.
+	DefaultMaxResults = 100
+	MaxResultsLimit   = 1000
+
+	// Files fetched by each request to the batch endpoint of Drive,
+	// see SyncOptions.BatchSize, and the most Drive takes.
+	DefaultBatchSize = 100
+	BatchSizeLimit   = 100
+)
+
+// SyncOptions configures the behavior of a CachedSyncer.
+type SyncOptions struct {
+	// Maximum length of a local file name in bytes, titles longer
+	// than this are truncated. Defaults to DefaultMaxNameLength.
+	MaxNameLength int
+
+	// Characters and names the local file names can't hold, see
+	// NamePolicy. Defaults to NamesPosix.
+	Names NamePolicy
+
+	// Interval between the periodic syncs. Defaults to
+	// DefaultSyncInterval.
+	Interval time.Duration
+
+	// Maximum interval between the periodic syncs. The interval is
+	// doubled after each sync finding no changes, up to this, and
+	// halved back towards Interval after each sync finding some.
+	// Defaults to DefaultMaxSyncInterval, or to Interval if that is
+	// longer.
+	MaxInterval time.Duration
+
+	// Maximum random delay of the first sync once the syncer is
+	// started, so that many instances started at once, e.g. of several
+	// accounts, don't all call Drive at the same time. A trigger syncs
+	// right away. If zero, the first sync starts on start.
+	StartJitter time.Duration
+
+	// Fraction of the interval between the periodic syncs by which each
+	// one is randomly shortened or lengthened, so that the instances
+	// don't keep syncing in lockstep. Capped to 1. If zero, the syncs
+	// are not jittered.
+	IntervalJitter float64
+
+	// Time limit of each metadata call to Drive, such as fetching a
+	// page of changes. Defaults to DefaultMetadataTimeout.
+	MetadataTimeout time.Duration
+
+	// Number of attempts of a write to the metadata database while it
+	// is locked, e.g. by reads of the mounted file system. Defaults to
+	// DefaultBusyAttempts.
+	BusyAttempts int
+
+	// Number of attempts of a metadata call to Drive while it is rate
+	// limited or fails with a server error. Defaults to
+	// DefaultApiAttempts.
+	ApiAttempts int
+
+	// Delay before the first retry of a metadata call to Drive, unless
+	// it returns a Retry-After. Defaults to DefaultApiRetryDelay.
+	ApiRetryDelay time.Duration
+
+	// Longest delay before a retry of a metadata call to Drive the
+	// backoff doubles up to. Defaults to DefaultApiMaxRetryDelay.
+	ApiMaxRetryDelay time.Duration
+
+	// If set, refreshes the access token of the requests to Drive, e.g.
+	// auth.Transport.Reauthorize. A metadata call to Drive rejected as
+	// unauthorized is retried once after the refresh; it fails as it is
+	// if not set.
+	RefreshToken func() error
+
+	// Longest delay requested by the Retry-After of Drive that is
+	// waited before a retry, longer ones are cut to it so that a buggy
+	// header doesn't stall the syncs. Defaults to DefaultMaxRetryAfter.
+	MaxRetryAfter time.Duration
+
+	// If set, only the files of these ids are synced. They are fetched
+	// one by one on each sync instead of following the change feed,
+	// which is far cheaper for a few files. The files are placed into
+	// the root folder, since their folders are not synced.
+	FileIds []string
+
+	// If set, only these folders of My Drive and the files under them
+	// are synced, the folders are placed into the root folder. The
+	// whole change feed is still read, the changes of other files are
+	// skipped. Files moved out of the folders are deleted. The files
+	// of a folder moved under one of them are synced by the next
+	// forced sync, see Syncer.Sync.
+	FolderIds []string
+
+	// If set, only the files of the MIME types matching one of these
+	// patterns are synced, e.g. "application/pdf" or "image/*", see
+	// path.Match. The files of other types are not listed, and removed
+	// if they were synced, see SyncResult.FilesFiltered. Folders are
+	// always synced.
+	MimeTypes []string
+
+	// The files of the MIME types matching one of these patterns are
+	// not synced, even if they match MimeTypes.
+	ExcludeMimeTypes []string
+
+	// If set, the folders left without any file in their subtrees,
+	// e.g. by MimeTypes, are removed at the end of each sync. They are
+	// fetched again once a file is synced into them.
+	PruneEmptyFolders bool
+
+	// If set, the changes of the files outside of My Drive the user
+	// has access to, e.g. shared with the user, are synced too. They
+	// are not under any synced folder.
+	IncludeSubscribed bool
+
+	// If set, initial syncs also list the changes of deleted files,
+	// e.g. for the consumers of the sync events. Otherwise only the
+	// later syncs do, since an initial sync has nothing to delete.
+	IncludeDeletedInitially bool
+
+	// Formats the native docs are exported to, keyed by their mime
+	// type, overriding the default ones. If Drive doesn't offer the
+	// format for a doc, it is exported to PDF if it can be. Docs of
+	// the metadata.MimeTypeLink format are stored as links to open
+	// them online instead, like the .gdoc files of the Drive clients.
+	ExportFormats map[string]string
+
+	// If set, the extension of the mime type of a file is appended to
+	// its local name unless its title already ends with one of the
+	// extensions of the mime type, see metadata.FileExtensions, e.g. of
+	// the files uploaded without one. Keyed by mime type, see
+	// metadata.DefaultFileExtensions. The titles on Drive are kept.
+	Extensions map[string]string
+
+	// Ids of the shared drives to sync besides My Drive. Each one is
+	// placed into the root folder, as a folder named after the drive.
+	SharedDrives []string
+
+	// How the files edited both locally and on Drive since the last
+	// sync are merged. Defaults to ConflictKeepBoth.
+	Conflicts ConflictPolicy
+
+	// If set, thumbnails of the synced files are fetched into it.
+	Thumbnails ThumbnailCache
+
+	// If set, the syncer starts offline, see CachedSyncer.SetOffline.
+	Offline bool
+
+	// If set, returns the errors of the work done apart from the syncs
+	// since it was last called, e.g. fileio.Downloader.HookErrors. They
+	// are added to the SyncResult.Errors of the next sync.
+	Errors func() []error
+
+	// If set, the syncs only report what they would change: the change
+	// feed is walked and the SyncResult computed, but nothing is
+	// downloaded, pushed nor written, the metadata is rolled back and
+	// the sync position doesn't move. The metadata is locked during
+	// the whole sync, it is meant for a single sync, e.g. SyncOnce.
+	DryRun bool
+
+	// Interval between the checks whether Drive can be reached again,
+	// once a sync failed to reach it. Defaults to
+	// DefaultConnectivityInterval.
+	ConnectivityInterval time.Duration
+
+	// Client the resumable uploads are sent with, authorized like the
+	// Drive service. If nil, contents are uploaded in a single request
+	// whatever their size.
+	UploadClient *http.Client
+
+	// Size from which contents are uploaded in chunks of
+	// UploadChunkSize, rounded up to a multiple of 256 KiB, if
+	// UploadClient is set. They default to DefaultResumableThreshold
+	// and DefaultUploadChunkSize.
+	ResumableThreshold int64
+	UploadChunkSize    int64
+
+	// Interval between the collections of the blobs left without a
+	// file once the syncer is started, see CachedSyncer.CollectBlobs.
+	// The first one runs on start. If zero, blobs are not collected.
+	CollectInterval time.Duration
+
+	// Blobs modified since this time before the last sync are never
+	// collected. Defaults to DefaultCollectGrace.
+	CollectGrace time.Duration
+
+	// Size in bytes from which the contents of the files are not
+	// cached: their metadata is synced, they are listed with their
+	// size, but they are not downloaded, see SyncResult.FilesSkipped.
+	// Once it is raised, the skipped files are cached by their next
+	// change or by a full sync. If zero, the contents of all of the
+	// files are cached.
+	MaxBlobSize int64
+
+	// Blobs verified sound more recently than this are not read again
+	// by Verify, see metadata.CachedDriveFile.VerifiedAt. If zero, all
+	// of the blobs are read.
+	VerifyInterval time.Duration
+
+	// If set, the files deleted or trashed on Drive are moved into a
+	// local trash, their metadata and contents, rather than deleted,
+	// see CachedSyncer.Restore. The files trashed this long ago are
+	// purged after each successful sync, see CachedSyncer.EmptyTrash.
+	// If zero, the files are deleted right away.
+	TrashRetention time.Duration
+
+	// If set, Drive is requested to notify this https url of the
+	// changes, which must be routed to CachedSyncer.NotificationHandler,
+	// and a notification triggers a sync. Drive is still polled every
+	// MaxInterval for the lost notifications, and every Interval while
+	// the changes can't be watched.
+	WebhookAddress string
+
+	// Lifetime requested for the channels notifying the changes, they
+	// are renewed before they expire. Defaults to DefaultWatchTTL.
+	WatchTTL time.Duration
+
+	// Maximum number of requests to Drive in flight at the same time,
+	// shared by the syncer built with NewCachedSyncerWithClient and the
+	// clients of CachedSyncer.LimitClient, e.g. of the downloads, so
+	// that bursts don't trip the rate limits. Defaults to
+	// DefaultMaxConcurrentRequests.
+	MaxConcurrentRequests int
+
+	// Maximum number of changes listed by each page of the change
+	// feed. Larger pages take fewer requests, e.g. on the initial sync
+	// of a large account. Defaults to DefaultMaxResults, capped at
+	// MaxResultsLimit.
+	MaxResults int64
+
+	// Client the files are fetched with in batches, e.g. the ones of
+	// the changes that don't carry their metadata, authorized like the
+	// Drive service. If nil, files are fetched one by one.
+	BatchClient *http.Client
+
+	// Maximum number of files fetched by each batch request. Defaults
+	// to DefaultBatchSize, capped at BatchSizeLimit.
+	BatchSize int
+
+	// Receives the logs of the syncer, the ones of each page of changes
+	// at the debug level. Defaults to logger.Default.
+	Logger logger.Logger
+}
+
+// ThumbnailCache caches the thumbnails of Drive files. Implemented by
+// fileio.Thumbnails.
+type ThumbnailCache interface {
+	// Fetches the thumbnail of the file identified by id from link.
+	Fetch(id string, link string) error
+
+	// Removes the thumbnail of the file identified by id.
+	Delete(id string) error
+}
+
+// Returns a copy of the options with the defaults applied.
+func (o *SyncOptions) withDefaults() *SyncOptions {
+	opts := &SyncOptions{}
+	if o != nil {
+		*opts = *o
+	}
+	if opts.MaxNameLength <= 0 {
+		opts.MaxNameLength = DefaultMaxNameLength
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultSyncInterval
+	}
+	if opts.MaxInterval <= 0 {
+		opts.MaxInterval = DefaultMaxSyncInterval
+	}
+	if opts.MaxInterval < opts.Interval {
+		opts.MaxInterval = opts.Interval
+	}
+	opts.IntervalJitter = min(max(opts.IntervalJitter, 0), 1)
+	if opts.MetadataTimeout <= 0 {
+		opts.MetadataTimeout = DefaultMetadataTimeout
+	}
+	if opts.BusyAttempts <= 0 {
+		opts.BusyAttempts = DefaultBusyAttempts
+	}
+	if opts.ApiAttempts <= 0 {
+		opts.ApiAttempts = DefaultApiAttempts
+	}
+	if opts.ApiRetryDelay <= 0 {
+		opts.ApiRetryDelay = DefaultApiRetryDelay
+	}
+	if opts.ApiMaxRetryDelay <= 0 {
+		opts.ApiMaxRetryDelay = DefaultApiMaxRetryDelay
+	}
+	if opts.ApiMaxRetryDelay < opts.ApiRetryDelay {
+		opts.ApiMaxRetryDelay = opts.ApiRetryDelay
+	}
+	if opts.MaxRetryAfter <= 0 {
+		opts.MaxRetryAfter = DefaultMaxRetryAfter
+	}
+	if opts.ConnectivityInterval <= 0 {
+		opts.ConnectivityInterval = DefaultConnectivityInterval
+	}
+	if opts.ResumableThreshold <= 0 {
+		opts.ResumableThreshold = DefaultResumableThreshold
+	}
+	if opts.UploadChunkSize <= 0 {
+		opts.UploadChunkSize = DefaultUploadChunkSize
+	}
+	opts.UploadChunkSize = (opts.UploadChunkSize + uploadChunkUnit - 1) / uploadChunkUnit * uploadChunkUnit
+	if opts.CollectGrace <= 0 {
+		opts.CollectGrace = DefaultCollectGrace
+	}
+	if opts.WatchTTL <= 0 {
+		opts.WatchTTL = DefaultWatchTTL
+	}
+	if opts.Logger == nil {
+		opts.Logger = logger.Default
+	}
+	if opts.MaxResults <= 0 {
+		opts.MaxResults = DefaultMaxResults
+	}
+	opts.MaxResults = min(opts.MaxResults, MaxResultsLimit)
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	opts.BatchSize = min(opts.BatchSize, BatchSizeLimit)
+	if opts.MaxConcurrentRequests <= 0 {
+		opts.MaxConcurrentRequests = DefaultMaxConcurrentRequests
+	}
+	return opts
+}
+
+// Returns the interval until the sync following a sync that was
+// started after interval, and found changes if changed.
+func (o *SyncOptions) nextInterval(interval time.Duration, changed bool) time.Duration {
+	if changed {
+		interval /= 2
+	} else {
+		interval *= 2
+	}
+	if interval < o.Interval {
+		return o.Interval
+	}
+	if interval > o.MaxInterval {
+		return o.MaxInterval
+	}
+	return interval
+}
+
+// Returns the wait, randomly shortened or lengthened by up to
+// IntervalJitter of it.
+func (o *SyncOptions) jittered(wait time.Duration) time.Duration {
+	if o.IntervalJitter <= 0 || wait <= 0 {
+		return wait
+	}
+	spread := float64(wait) * o.IntervalJitter
+	return wait + time.Duration((2*rand.Float64()-1)*spread)
+}
+
+// Returns a random delay of the first sync, up to StartJitter.
+func (o *SyncOptions) startDelay() time.Duration {
+	if o.StartJitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(o.StartJitter) + 1))
+}
+
+// Parses export formats of the form "document=pdf,spreadsheet=xlsx"
+// into SyncOptions.ExportFormats. Kinds of docs are the mime types
+// without their "application/vnd.google-apps." prefix, formats are
+// either file extensions, mime types or "link" to store the docs as
+// links.
+func ParseExportFormats(value string) (map[string]string, error) {
+	formats := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kind, format, ok := strings.Cut(pair, "=")
+		if !ok || kind == "" || format == "" {
+			return nil, fmt.Errorf("invalid export format %q, expected kind=format", pair)
+		}
+		if format == "link" {
+			format = metadata.MimeTypeLink
+		} else if !strings.Contains(format, "/") {
+			ext := format
+			if format = metadata.ExportMimeTypeByExtension("." + strings.TrimPrefix(ext, ".")); format == "" {
+				return nil, fmt.Errorf("unknown export format %q", ext)
+			}
+		}
+		formats[metadata.MimeTypePrefixGoogleApps+kind] = format
+	}
+	return formats, nil
+}
+
+// Parses extensions of the form "default,image/heic=heic,text/plain="
+// into SyncOptions.Extensions. "default" stands for the extensions of
+// metadata.DefaultFileExtensions, the following pairs override them;
+// an empty extension appends none to the files of the mime type.
+func ParseExtensions(value string) (map[string]string, error) {
+	exts := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		if pair == "default" {
+			for mimeType, ext := range metadata.DefaultFileExtensions() {
+				exts[mimeType] = ext
+			}
+			continue
+		}
+		mimeType, ext, ok := strings.Cut(pair, "=")
+		if !ok || !strings.Contains(mimeType, "/") || strings.Contains(ext, "/") {
+			return nil, fmt.Errorf("invalid extension %q, expected mimetype=extension", pair)
+		}
+		if ext = strings.TrimPrefix(ext, "."); ext != "" {
+			ext = "." + ext
+		}
+		exts[mimeType] = ext
+	}
+	return exts, nil
+}
@@ -0,0 +1,222 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/rakyll/drivefuse/metadata"
+	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
+)
+
+var errNotCached = errors.New("content is not cached")
+
+// Pushes the local changes of the whole tree to Drive: the recorded
+// local operations first, see flushPending, then the files queued for
+// upload, if there are any.
+func (d *CachedSyncer) syncPending(ctx context.Context) error {
+	flushErr := d.flushPending(ctx)
+	if ctx.Err() != nil {
+		return flushErr
+	}
+	queued, err := d.metaService.HasQueuedForIO("upload")
+	if err == nil && queued {
+		err = d.syncOutbound(ctx, metadata.IdRootFolder, true, false)
+	}
+	return errors.Join(flushErr, err)
+}
+
+// Pushes the files and folders under the folder identified by rootId
+// that are modified or created locally to Drive, descending into the
+// subfolders if isRecursive. The ones queued for upload are taken as
+// modified, isForce pushes all of them. Local files and folders are
+// re-keyed by the ids Drive assigns them. A file that fails to be
+// pushed doesn't stop the others, it stays queued; the number of
+// failures is returned with the first error.
+func (d *CachedSyncer) syncOutbound(ctx context.Context, rootId string, isRecursive bool, isForce bool) error {
+	failures := 0
+	var firstErr error
+	d.pushChildren(ctx, rootId, isRecursive, isForce, func(id string, err error) {
+		d.opts.Logger.V("error pushing", id, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+		failures++
+	})
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if failures > 0 {
+		return fmt.Errorf("failed to push %d files: %v", failures, firstErr)
+	}
+	return nil
+}
+
+func (d *CachedSyncer) pushChildren(ctx context.Context, parentId string, isRecursive bool, isForce bool, fail func(id string, err error)) {
+	children, err := d.metaService.GetAllChildren(parentId)
+	if err != nil {
+		fail(parentId, err)
+		return
+	}
+	for _, child := range children {
+		if ctx.Err() != nil {
+			return
+		}
+		id := child.Id
+		dirty, err := d.metaService.IsQueuedForIO("upload", id)
+		var pending *metadata.PendingChange
+		if err == nil {
+			// flushed by flushPending instead
+			pending, err = d.metaService.GetPending(id)
+		}
+		if err == nil && pending == nil && (dirty || isForce || child.IsLocal()) {
+			id, err = d.push(ctx, child)
+		}
+		if err != nil {
+			// the subtree of a folder that is not on Drive can't be
+			// pushed either
+			fail(child.Id, err)
+			continue
+		}
+		if child.IsFolder() && isRecursive {
+			d.pushChildren(ctx, id, isRecursive, isForce, fail)
+		}
+	}
+}
+
+// Creates or updates the file on Drive, uploading its cached content
+// unless it is a folder, and saves the metadata Drive returns. Large
+// contents are uploaded in chunks, see uploadResumable. Returns the id
+// of the file on Drive.
+func (d *CachedSyncer) push(ctx context.Context, file *metadata.CachedDriveFile) (id string, err error) {
+	if file.IsNativeDoc() || file.IsShortcut() {
+		// there is no content to upload, nor can it be edited locally
+		return file.Id, d.metaService.DequeueFromIO("upload", file.Id)
+	}
+	remote := remoteOf(file)
+	var content io.ReadCloser
+	checksum, size, resumable := d.resumable(file)
+	if !file.IsFolder() && !resumable {
+		if content, err = d.openContent(file); err != nil {
+			return
+		}
+		defer content.Close()
+	}
+
+	d.opts.Logger.V("Pushing", file.Id, remote.Title)
+	if resumable {
+		remote, err = d.uploadResumable(ctx, file, remote, checksum, size)
+	} else if file.IsLocal() {
+		call := d.remoteService.Files.Insert(remote)
+		if content != nil {
+			call.Media(content)
+		}
+		remote, err = call.Do()
+	} else {
+		call := d.remoteService.Files.Update(file.Id, remote)
+		if content != nil {
+			call.Media(content)
+		}
+		remote, err = call.Do()
+	}
+	if err != nil {
+		return
+	}
+	return remote.Id, d.savePushed(file, remote)
+}
+
+// Returns the metadata of the file pushed to Drive: its title, type
+// and parent.
+func remoteOf(file *metadata.CachedDriveFile) *client.File {
+	title := file.Title
+	if title == "" {
+		title = file.Name
+	}
+	return &client.File{
+		Title:    title,
+		MimeType: file.MimeType,
+		Parents:  []*client.ParentReference{{Id: file.ParentId}},
+	}
+}
+
+// Opens the cached content of the file, an empty one if a local file
+// has no content yet.
+func (d *CachedSyncer) openContent(file *metadata.CachedDriveFile) (io.ReadCloser, error) {
+	entry, ok := d.blobManager.Stat(file.Id)
+	if !ok {
+		if file.IsLocal() && file.FileSize == 0 {
+			return ioutil.NopCloser(strings.NewReader("")), nil
+		}
+		return nil, errNotCached
+	}
+	return d.blobManager.OpenEntry(entry)
+}
+
+// Replaces the metadata of the pushed file by the one returned by
+// Drive, moving the children and the content of a local file to its
+// new id.
+func (d *CachedSyncer) savePushed(file *metadata.CachedDriveFile, remote *client.File) error {
+	data := d.buildMetadata(remote.Id, file.ParentId, remote)
+	// keep the name it is disambiguated by
+	data.Name = file.Name
+	err := d.writeBatch(func(b *metadata.Batch) error {
+		if err := b.Save(file.ParentId, remote.Id, data, false, false); err != nil {
+			return err
+		}
+		if remote.Id == file.Id {
+			return nil
+		}
+		if err := b.MoveChildren(file.Id, remote.Id); err != nil {
+			return err
+		}
+		if err := b.RekeyPending(file.Id, remote.Id); err != nil {
+			return err
+		}
+		return b.Delete(file.Id)
+	})
+	if err != nil || file.IsFolder() {
+		return err
+	}
+	if err = d.rekeyContent(file, data); err != nil {
+		return err
+	}
+	return d.metaService.InitFile(remote.Id)
+}
+
+// Stores the cached content of the file under its id and checksum on
+// Drive, if they changed.
+func (d *CachedSyncer) rekeyContent(file *metadata.CachedDriveFile, data *metadata.CachedDriveFile) error {
+	entry, ok := d.blobManager.Stat(file.Id)
+	if !ok || (entry.Id == data.Id && entry.Checksum == data.Md5Checksum) {
+		return nil
+	}
+	content, err := d.blobManager.OpenEntry(entry)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	if err = d.blobManager.Save(data.Id, data.Md5Checksum, content); err != nil {
+		return err
+	}
+	if data.Id != file.Id {
+		return d.blobManager.Delete(file.Id)
+	}
+	return nil
+}
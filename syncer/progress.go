@@ -0,0 +1,68 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+// SyncProgress reports how far the sync in progress is through the
+// change feed, see SyncEvent.Progress and SyncStats.Progress.
+type SyncProgress struct {
+	// Set if the sync is the initial one, the only one the whole feed
+	// is walked by, and the only one the total is estimated for.
+	Initial bool
+
+	// Number of the changes processed so far, one per file on the
+	// initial sync, and the estimated number of the changes to process
+	// in total, zero if it is unknown.
+	Processed int64
+	Total     int64
+}
+
+// Returns the fraction of the changes processed, from 0 to 1, or false
+// if the total is unknown.
+func (p SyncProgress) Fraction() (float64, bool) {
+	if p.Total <= 0 {
+		return 0, false
+	}
+	return min(float64(p.Processed)/float64(p.Total), 1), true
+}
+
+// Records the progress of the page of changes merged by the sync, the
+// ones from first to last change id of the feed, of which largestId is
+// the largest change id. The total of the initial sync of My Drive is
+// estimated from the rate of the changes per change id so far; the
+// initial feed lists the latest change of each file only.
+func (d *CachedSyncer) recordPage(driveId string, first int64, last int64, largestId int64, n int, done bool) {
+	p := &d.progress
+	p.Processed += int64(n)
+	if p.Initial && driveId == "" && n > 0 {
+		if d.progressFrom == 0 {
+			d.progressFrom = first
+		}
+		switch {
+		case done:
+			p.Total = p.Processed
+		case last >= d.progressFrom && largestId > last:
+			rate := float64(p.Processed) / float64(last-d.progressFrom+1)
+			p.Total = p.Processed + int64(rate*float64(largestId-last))
+		}
+		d.opts.Logger.V("Initial sync processed", p.Processed, "of about", p.Total, "changes")
+	}
+	d.storeProgress()
+}
+
+// Publishes the progress of the sync in progress to the stats.
+func (d *CachedSyncer) storeProgress() {
+	progress := d.progress
+	d.stats.progress.Store(&progress)
+}
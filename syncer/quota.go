@@ -0,0 +1,48 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"context"
+
+	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
+)
+
+// Fetches the storage quota of the Drive account and records it in the
+// stats, see SyncStats.QuotaTotal. Publishes a QuotaWarning if the cap
+// of the cache is smaller than the contents stored on Drive, most of
+// the contents would be evicted before they are read again. The quota
+// is advisory, failing to fetch it doesn't fail the sync.
+func (d *CachedSyncer) checkQuota(ctx context.Context) {
+	var about *client.About
+	err := d.doWithRetry(ctx, func() (err error) {
+		about, err = d.remoteService.About.Get().Do()
+		return
+	})
+	if err != nil {
+		d.opts.Logger.V("error fetching the storage quota", err)
+		return
+	}
+	// the trashed files are not synced
+	used := max(about.QuotaBytesUsed-about.QuotaBytesUsedInTrash, 0)
+	d.stats.quotaTotal.Store(about.QuotaBytesTotal)
+	d.stats.quotaUsed.Store(used)
+	capacity := d.blobManager.MaxSize()
+	if capacity <= 0 || d.blobManager.IsPassThrough() || used <= capacity {
+		return
+	}
+	d.opts.Logger.V("Warning: the cache is capped at", capacity, "bytes, Drive holds", used, "bytes, expect heavy eviction")
+	d.publish(SyncEvent{Kind: QuotaWarning, Bytes: used, Total: capacity})
+}
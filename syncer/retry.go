@@ -0,0 +1,121 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/googleapi"
+)
+
+// errorClass tells how a failed call to Drive is handled by doWithRetry.
+type errorClass int
+
+const (
+	// Returned as it is: the call fails the same way if it is retried,
+	// e.g. a file not found or a lack of permissions, or it is handled
+	// by the sync itself, e.g. Drive can't be reached.
+	errorFatal errorClass = iota
+
+	// Rate limits and server errors of Drive, retried with a backoff.
+	errorRetryable
+
+	// Rejected as unauthorized, retried once with a refreshed token,
+	// see SyncOptions.RefreshToken.
+	errorAuth
+)
+
+// Returns the class of err, and the delay requested by the Retry-After
+// of Drive for a retryable error, zero if there is none.
+func classifyError(err error) (errorClass, time.Duration) {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return errorFatal, 0
+	}
+	switch {
+	case apiErr.Code == http.StatusUnauthorized:
+		return errorAuth, 0
+	case apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500:
+	case apiErr.Code == http.StatusForbidden && isRateLimit(apiErr):
+	default:
+		return errorFatal, 0
+	}
+	header := apiErr.Header.Get("Retry-After")
+	if secs, err := strconv.Atoi(header); err == nil && secs > 0 {
+		return errorRetryable, time.Duration(secs) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return errorRetryable, time.Until(date)
+	}
+	return errorRetryable, 0
+}
+
+// Returns true if the 403 is due to a rate limit rather than a lack of
+// permissions.
+func isRateLimit(apiErr *googleapi.Error) bool {
+	for _, item := range apiErr.Errors {
+		if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs a metadata call to Drive with withTimeout, retrying it by the
+// class of its error, up to SyncOptions.ApiAttempts attempts. While
+// Drive rate limits the call or fails on the server side, it is retried
+// with an exponential backoff from SyncOptions.ApiRetryDelay up to
+// SyncOptions.ApiMaxRetryDelay, or after the Retry-After of the
+// response if there is one, up to SyncOptions.MaxRetryAfter. A call
+// rejected as unauthorized is retried once the token is refreshed.
+func (d *CachedSyncer) doWithRetry(ctx context.Context, call func() error) (err error) {
+	delay := d.opts.ApiRetryDelay
+	refreshed := false
+	for attempt := 1; ; attempt++ {
+		err = d.withTimeout(ctx, call)
+		class, wait := classifyError(err)
+		if class == errorFatal || attempt >= d.opts.ApiAttempts {
+			return
+		}
+		if class == errorAuth {
+			if refreshed || d.opts.RefreshToken == nil {
+				return
+			}
+			d.opts.Logger.V("Drive call is unauthorized, refreshing the token", err)
+			if refreshErr := d.opts.RefreshToken(); refreshErr != nil {
+				return refreshErr
+			}
+			refreshed = true
+			continue
+		}
+		if wait > 0 {
+			wait = min(wait, d.opts.MaxRetryAfter)
+			d.opts.Logger.V("Drive call failed, retrying in", wait, "as Drive asks", err)
+		} else {
+			// spread the retries of concurrent clients
+			wait = delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+			d.opts.Logger.V("Drive call failed, retrying in", wait, err)
+		}
+		if waitErr := d.wait(ctx, wait); waitErr != nil {
+			return waitErr
+		}
+		delay = min(2*delay, d.opts.ApiMaxRetryDelay)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rakyll/drivefuse/auth"
+	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/googleapi"
+	T "github.com/rakyll/drivefuse/third_party/launchpad.net/gocheck"
+)
+
+type RetrySuite struct{}
+
+var _ = T.Suite(&RetrySuite{})
+
+// scriptedTransport serves the responses in order, then the last one
+// over again, and counts the requests.
+type scriptedTransport struct {
+	responses []fakeFailure // a zero code is a file
+	requests  int
+}
+
+func (t *scriptedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	e := t.responses[min(t.requests, len(t.responses)-1)]
+	t.requests++
+	res := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Request: req}
+	body := `{"id": "file"}`
+	if e.code != 0 {
+		res.StatusCode = e.code
+		if e.retryAfter != "" {
+			res.Header.Set("Retry-After", e.retryAfter)
+		}
+		body = fmt.Sprintf(`{"error": {"code": %d, "message": "failed", "errors": [{"reason": %q}]}}`, e.code, e.reason)
+	}
+	res.Body = io.NopCloser(strings.NewReader(body))
+	return res, nil
+}
+
+func apiError(code int, reason string, retryAfter string) error {
+	err := &googleapi.Error{Code: code, Header: make(http.Header)}
+	if reason != "" {
+		err.Errors = []googleapi.ErrorItem{{Reason: reason}}
+	}
+	if retryAfter != "" {
+		err.Header.Set("Retry-After", retryAfter)
+	}
+	return err
+}
+
+func (s *RetrySuite) TestErrorsAreClassified(c *T.C) {
+	cases := []struct {
+		err   error
+		class errorClass
+		wait  time.Duration
+	}{
+		{apiError(http.StatusTooManyRequests, "", ""), errorRetryable, 0},
+		{apiError(http.StatusServiceUnavailable, "backendError", ""), errorRetryable, 0},
+		{apiError(http.StatusInternalServerError, "", "3"), errorRetryable, 3 * time.Second},
+		{apiError(http.StatusForbidden, "userRateLimitExceeded", ""), errorRetryable, 0},
+		{apiError(http.StatusForbidden, "rateLimitExceeded", "7"), errorRetryable, 7 * time.Second},
+		{fmt.Errorf("fetching: %w", apiError(http.StatusTooManyRequests, "", "")), errorRetryable, 0},
+		{apiError(http.StatusUnauthorized, "authError", ""), errorAuth, 0},
+		{apiError(http.StatusForbidden, "insufficientPermissions", ""), errorFatal, 0},
+		{apiError(http.StatusNotFound, "notFound", ""), errorFatal, 0},
+		{apiError(http.StatusBadRequest, "invalid", "7"), errorFatal, 0},
+		{fmt.Errorf("%w: token revoked", auth.ErrAuth), errorFatal, 0},
+		{context.Canceled, errorFatal, 0},
+		{nil, errorFatal, 0},
+	}
+	for _, tc := range cases {
+		class, wait := classifyError(tc.err)
+		c.Check(class, T.Equals, tc.class, T.Commentf("%v", tc.err))
+		c.Check(wait, T.Equals, tc.wait, T.Commentf("%v", tc.err))
+	}
+}
+
+func (s *RetrySuite) TestCallsAreRetriedByErrorClass(c *T.C) {
+	unauthorized := fakeFailure{code: http.StatusUnauthorized, reason: "authError"}
+	cases := []struct {
+		name      string
+		responses []fakeFailure
+		refresh   bool // whether the token can be refreshed
+		code      int  // of the error returned, zero if none
+		requests  int
+		refreshes int
+		delays    []time.Duration
+	}{
+		{name: "success", responses: []fakeFailure{{}}, requests: 1},
+		{
+			name:      "retryable",
+			responses: []fakeFailure{{code: http.StatusServiceUnavailable}, {code: http.StatusTooManyRequests, retryAfter: "9"}, {}},
+			requests:  3,
+			delays:    []time.Duration{time.Second, 9 * time.Second},
+		},
+		{
+			name:      "retries run out",
+			responses: []fakeFailure{{code: http.StatusInternalServerError}},
+			code:      http.StatusInternalServerError,
+			requests:  4,
+			delays:    []time.Duration{time.Second, 2 * time.Second, 3 * time.Second},
+		},
+		{name: "fatal", responses: []fakeFailure{{code: http.StatusNotFound}}, code: http.StatusNotFound, requests: 1},
+		{name: "auth", responses: []fakeFailure{unauthorized, {}}, refresh: true, requests: 2, refreshes: 1},
+		{
+			name:      "auth refreshed once",
+			responses: []fakeFailure{unauthorized},
+			refresh:   true,
+			code:      http.StatusUnauthorized,
+			requests:  2,
+			refreshes: 1,
+		},
+		{name: "auth without refresh", responses: []fakeFailure{unauthorized}, code: http.StatusUnauthorized, requests: 1},
+	}
+	for _, tc := range cases {
+		transport := &scriptedTransport{responses: tc.responses}
+		opts := &SyncOptions{ApiAttempts: 4, ApiRetryDelay: time.Second, ApiMaxRetryDelay: 3 * time.Second}
+		refreshes := 0
+		if tc.refresh {
+			opts.RefreshToken = func() error {
+				refreshes++
+				return nil
+			}
+		}
+		service, _ := client.New(&http.Client{Transport: transport})
+		d := NewCachedSyncer(service, nil, nil, opts)
+		delays := []time.Duration{}
+		d.wait = func(ctx context.Context, wait time.Duration) error {
+			delays = append(delays, wait)
+			return nil
+		}
+		err := d.doWithRetry(context.Background(), func() error {
+			_, err := service.Files.Get("file").Do()
+			return err
+		})
+		comment := T.Commentf(tc.name)
+		if tc.code == 0 {
+			c.Check(err, T.IsNil, comment)
+		} else if apiErr, ok := err.(*googleapi.Error); c.Check(ok, T.Equals, true, comment) {
+			c.Check(apiErr.Code, T.Equals, tc.code, comment)
+		}
+		c.Check(transport.requests, T.Equals, tc.requests, comment)
+		c.Check(refreshes, T.Equals, tc.refreshes, comment)
+		c.Check(delays, T.HasLen, len(tc.delays), comment)
+		for i := 0; i < len(delays) && i < len(tc.delays); i++ {
+			// jittered by up to a half of the backoff
+			c.Check(delays[i] >= tc.delays[i] && delays[i] <= tc.delays[i]*3/2, T.Equals, true, T.Commentf("%v: delay %v of %v", tc.name, delays[i], tc.delays[i]))
+		}
+	}
+}
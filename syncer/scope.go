@@ -0,0 +1,146 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"github.com/rakyll/drivefuse/metadata"
+	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
+)
+
+// deferredChanges holds the changes of the files whose parents are not
+// known to be under the synced folders yet during a sync, see
+// SyncOptions.FolderIds.
+type deferredChanges struct {
+	changes  map[string]*client.Change // keyed by file id
+	byParent map[string][]string       // file ids keyed by parent id
+}
+
+func newDeferredChanges() *deferredChanges {
+	return &deferredChanges{changes: make(map[string]*client.Change), byParent: make(map[string][]string)}
+}
+
+func (c *deferredChanges) add(item *client.Change) {
+	c.changes[item.FileId] = item
+	for _, parent := range item.File.Parents {
+		c.byParent[parent.Id] = append(c.byParent[parent.Id], item.FileId)
+	}
+}
+
+// Removes and returns the changes of the children of the folder
+// identified by parentId.
+func (c *deferredChanges) takeChildren(parentId string) []*client.Change {
+	children := []*client.Change{}
+	for _, id := range c.byParent[parentId] {
+		if item, ok := c.changes[id]; ok && hasParent(item.File, parentId) {
+			delete(c.changes, id)
+			children = append(children, item)
+		}
+	}
+	delete(c.byParent, parentId)
+	return children
+}
+
+func hasParent(file *client.File, parentId string) bool {
+	for _, parent := range file.Parents {
+		if parent.Id == parentId {
+			return true
+		}
+	}
+	return false
+}
+
+// Merges the change of a file of My Drive if it is one of the folders
+// of SyncOptions.FolderIds or under one of them, which are placed into
+// the root folder identified by rootId. The change is deferred if the
+// parents of the file are not known yet, until one of them is merged.
+// A file moved out of the folders is deleted.
+func (d *CachedSyncer) mergeInScope(rootId string, item *client.Change) error {
+	if len(d.opts.FolderIds) == 0 || d.deferred == nil {
+		return d.mergeChange(rootId, item)
+	}
+	// a later change supersedes the deferred one
+	delete(d.deferred.changes, item.FileId)
+	if item.Deleted || item.File == nil || item.File.Labels.Trashed {
+		return d.mergeChange(rootId, item)
+	}
+	inScope, known := d.inScope(rootId, item.File)
+	switch {
+	case !known:
+		d.deferred.add(item)
+		return nil
+	case !inScope:
+		return d.mergeOutOfScope(rootId, item)
+	}
+	if err := d.mergeChange(rootId, item); err != nil {
+		return err
+	}
+	for _, child := range d.deferred.takeChildren(item.FileId) {
+		if err := d.mergeInScope(rootId, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns true if the file is one of the synced folders or under one
+// of them, and whether it is known yet: its parents are either synced,
+// or the root folder which only holds the synced folders.
+func (d *CachedSyncer) inScope(rootId string, file *client.File) (inScope bool, known bool) {
+	for _, id := range d.opts.FolderIds {
+		if id == file.Id {
+			file.Parents = []*client.ParentReference{{Id: rootId}}
+			return true, true
+		}
+	}
+	known = true
+	for _, parent := range file.Parents {
+		id := cachedParentId(rootId, parent)
+		if id == metadata.IdRootFolder {
+			continue
+		}
+		if _, err := d.getFile(id); err == nil {
+			return true, true
+		}
+		known = false
+	}
+	return false, known
+}
+
+// Deletes the file of the change if it was synced, it is not under the
+// synced folders anymore.
+func (d *CachedSyncer) mergeOutOfScope(rootId string, item *client.Change) error {
+	if _, err := d.getFile(item.FileId); err != nil {
+		return nil
+	}
+	deleted := *item
+	deleted.Deleted, deleted.File = true, nil
+	return d.mergeChange(rootId, &deleted)
+}
+
+// Drops the changes deferred by the sync, the files of which are not
+// under the synced folders.
+func (d *CachedSyncer) dropDeferred(rootId string) (err error) {
+	deferred := d.deferred
+	d.deferred = nil
+	if deferred == nil {
+		return nil
+	}
+	for _, item := range deferred.changes {
+		if err = d.mergeOutOfScope(rootId, item); err != nil {
+			return
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SyncStats is a snapshot of the counters the syncer accumulates
+// across the syncs since it was created, see CachedSyncer.Stats.
+type SyncStats struct {
+	// Number of the syncs run, and of the ones that failed. Syncs that
+	// didn't start, e.g. while another one was running, are not.
+	Syncs    int64
+	Failures int64
+
+	// Number and total size of the files whose contents were queued
+	// for download. Contents are downloaded in the background by the
+	// download queues, see fileio.Downloader.
+	FilesQueued int64
+	BytesQueued int64
+
+	// Largest change id synchronized, after the last sync.
+	ChangeId int64
+
+	// Time the last sync took, and the time the last successful sync
+	// finished, zero if there was none yet.
+	LastDuration time.Duration
+	LastSuccess  time.Time
+
+	// Time the periodic syncing of Start waits before the next sync,
+	// backed off while there are no changes or Drive can't be reached.
+	Interval time.Duration
+
+	// Storage quota of the Drive account in bytes, and the size of the
+	// contents stored in it outside of the trash, as of the last full
+	// sync. Zero until they are known.
+	QuotaTotal int64
+	QuotaUsed  int64
+
+	// Set while the syncing is paused, see CachedSyncer.Pause.
+	Paused bool
+
+	// Progress of the sync in progress, zero if none is running.
+	Progress SyncProgress
+}
+
+// Returns the counters as named metrics, in the style of Prometheus,
+// e.g. to be exported by a collector of the caller. Durations are in
+// seconds, times in seconds since the epoch.
+func (s *SyncStats) Metrics() map[string]float64 {
+	metrics := map[string]float64{
+		"drivefuse_syncs_total":                float64(s.Syncs),
+		"drivefuse_sync_failures_total":        float64(s.Failures),
+		"drivefuse_files_queued_total":         float64(s.FilesQueued),
+		"drivefuse_bytes_queued_total":         float64(s.BytesQueued),
+		"drivefuse_change_id":                  float64(s.ChangeId),
+		"drivefuse_last_sync_duration_seconds": s.LastDuration.Seconds(),
+		"drivefuse_sync_interval_seconds":      s.Interval.Seconds(),
+		"drivefuse_quota_bytes_total":          float64(s.QuotaTotal),
+		"drivefuse_quota_bytes_used":           float64(s.QuotaUsed),
+		"drivefuse_paused":                     0,
+	}
+	if s.Paused {
+		metrics["drivefuse_paused"] = 1
+	}
+	if s.Progress.Processed > 0 {
+		metrics["drivefuse_sync_changes_processed"] = float64(s.Progress.Processed)
+	}
+	if fraction, ok := s.Progress.Fraction(); ok {
+		metrics["drivefuse_sync_progress_ratio"] = fraction
+	}
+	if !s.LastSuccess.IsZero() {
+		metrics["drivefuse_last_success_timestamp_seconds"] = float64(s.LastSuccess.UnixNano()) / 1e9
+	}
+	return metrics
+}
+
+// syncStats holds the counters of SyncStats, updated atomically by the
+// syncs and the periodic syncing.
+type syncStats struct {
+	syncs        atomic.Int64
+	failures     atomic.Int64
+	filesQueued  atomic.Int64
+	bytesQueued  atomic.Int64
+	changeId     atomic.Int64
+	lastDuration atomic.Int64 // in nanoseconds
+	lastSuccess  atomic.Int64 // in nanoseconds since the epoch, zero if none
+	interval     atomic.Int64 // in nanoseconds
+	quotaTotal   atomic.Int64
+	quotaUsed    atomic.Int64
+	progress     atomic.Pointer[SyncProgress] // nil if no sync is running
+}
+
+// Stats returns a snapshot of the counters accumulated by the syncs.
+// Safe to be called from multiple goroutines, e.g. while syncing.
+func (d *CachedSyncer) Stats() SyncStats {
+	s := &d.stats
+	stats := SyncStats{
+		Syncs:        s.syncs.Load(),
+		Failures:     s.failures.Load(),
+		FilesQueued:  s.filesQueued.Load(),
+		BytesQueued:  s.bytesQueued.Load(),
+		ChangeId:     s.changeId.Load(),
+		LastDuration: time.Duration(s.lastDuration.Load()),
+		Interval:     time.Duration(s.interval.Load()),
+		QuotaTotal:   s.quotaTotal.Load(),
+		QuotaUsed:    s.quotaUsed.Load(),
+		Paused:       d.IsPaused(),
+	}
+	if p := s.progress.Load(); p != nil {
+		stats.Progress = *p
+	}
+	if t := s.lastSuccess.Load(); t != 0 {
+		stats.LastSuccess = time.Unix(0, t)
+	}
+	return stats
+}
+
+// Records the sync started at start, that synchronized up to changeId
+// and failed with err if it is set.
+func (d *CachedSyncer) recordSync(start time.Time, changeId int64, err error) {
+	s := &d.stats
+	s.syncs.Add(1)
+	s.lastDuration.Store(int64(time.Since(start)))
+	s.changeId.Store(changeId)
+	if err != nil {
+		s.failures.Add(1)
+		return
+	}
+	s.lastSuccess.Store(time.Now().UnixNano())
+}
@@ -15,65 +15,553 @@
 package syncer
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/rakyll/drivefuse/auth"
 	"github.com/rakyll/drivefuse/blob"
-	"github.com/rakyll/drivefuse/logger"
 	"github.com/rakyll/drivefuse/metadata"
 	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/googleapi"
 )
 
-const (
-	intervalSync   = 30 * time.Second // TODO: should be adaptive
-	layoutDateTime = "2013-09-19T14:29:12.570Z"
+// Native docs are exported to PDF if Drive doesn't offer their
+// configured format.
+const mimeTypePdf = "application/pdf"
+
+var (
+	// Syncing is paused, see CachedSyncer.SetOffline. The cached
+	// metadata and contents are still served.
+	ErrOffline = errors.New("syncer: offline")
+
+	// Syncing is paused by the user, see CachedSyncer.Pause.
+	ErrPaused = errors.New("syncer: paused")
+
+	// Another sync is running, see CachedSyncer.SyncContext.
+	ErrSyncInProgress = errors.New("syncer: a sync is already in progress")
+
+	// The position a sync resumed the change feed from, a saved page
+	// token or the largest change id synced, is not taken by Drive
+	// anymore. The sync recovers by walking the feed from an older
+	// position, the error is only reported in SyncResult.Errors.
+	ErrChangeTokenExpired = errors.New("syncer: the position in the change feed expired")
+
+	// Reported in SyncResult.Errors for each file whose downloads are
+	// stopped after failing repeatedly, see fileio.QuarantinePolicy.
+	ErrDownloadsStopped = errors.New("syncer: the downloads of the file are stopped")
+
+	// Rolls back the metadata written by a dry run, see SyncOptions.DryRun.
+	errDryRun = errors.New("syncer: dry run")
 )
 
 type CachedSyncer struct {
 	remoteService *client.Service
 	metaService   *metadata.MetaService
 	blobManager   *blob.Manager
+	opts          *SyncOptions
 
 	mu sync.RWMutex
+
+	muCancel     sync.Mutex
+	cancel       context.CancelFunc // cancels the in-flight sync, if any
+	resetPending bool
+
+	muSynced  sync.Mutex
+	ready     chan struct{} // closed after the first successful sync
+	nextSync  chan struct{} // closed after the next successful sync
+	readyOnce sync.Once
+
+	trigger chan struct{} // requests an out-of-band sync
+
+	muWatch sync.Mutex
+	channel *client.Channel // notifying the changes, if any
+
+	requests chan struct{} // a slot per request to Drive in flight, see LimitClient
+
+	muThumbs      sync.Mutex
+	pendingThumbs map[string]string // thumbnail links to fetch, keyed by file id
+	thumbsQueued  chan struct{}     // wakes up the thumbnail fetcher
+	thumbsOnce    sync.Once
+
+	result *SyncResult // of the sync in progress, guarded by mu
+	events chan SyncEvent
+
+	// progress of the sync in progress, and the first change id of the
+	// initial feed it walked, see recordPage, guarded by mu
+	progress     SyncProgress
+	progressFrom int64
+
+	invalidations chan InvalidateEvent
+
+	stats syncStats
+
+	// changes deferred by the sync in progress, see mergeInScope,
+	// guarded by mu
+	deferred *deferredChanges
+
+	// ids of the pruned folders fetched by the sync in progress, see
+	// restorePruned, guarded by mu
+	restoring map[string]bool
+
+	// batch of the page of changes being merged, see mergeChanges, and
+	// the calls to run once it is committed, guarded by mu
+	page      *metadata.Batch
+	committed []func()
+
+	muOffline    sync.Mutex
+	offline      bool // set by SetOffline
+	paused       bool // set by Pause
+	disconnected bool // Drive couldn't be reached by the last sync
+
+	batch func(fn func(b *metadata.Batch) error) error
+	sleep func(d time.Duration)
+	wait  func(ctx context.Context, d time.Duration) error
+	ping  func(ctx context.Context) error // checks that Drive can be reached
 }
 
-func NewCachedSyncer(service *client.Service, metaService *metadata.MetaService, blobManager *blob.Manager) *CachedSyncer {
-	return &CachedSyncer{
+// Creates a new syncer. A nil opts uses the default options.
+func NewCachedSyncer(service *client.Service, metaService *metadata.MetaService, blobManager *blob.Manager, opts *SyncOptions) *CachedSyncer {
+	d := &CachedSyncer{
 		remoteService: service,
 		metaService:   metaService,
 		blobManager:   blobManager,
+		opts:          opts.withDefaults(),
+		ready:         make(chan struct{}),
+		nextSync:      make(chan struct{}),
+		trigger:       make(chan struct{}, 1),
+		pendingThumbs: make(map[string]string),
+		thumbsQueued:  make(chan struct{}, 1),
+		events:        make(chan SyncEvent, eventBufferSize),
+		invalidations: make(chan InvalidateEvent, eventBufferSize),
+		sleep:         time.Sleep,
+		wait:          sleepContext,
+		offline:       opts != nil && opts.Offline,
+	}
+	d.requests = make(chan struct{}, d.opts.MaxConcurrentRequests)
+	d.ping = d.pingDrive
+	d.batch = d.pageBatch
+	return d
+}
+
+// Creates a new syncer sending its requests to Drive through
+// httpClient, which authorizes them, e.g. the client of an
+// auth.Transport wrapped in a transport with timeouts or a proxy. The
+// content is uploaded and the files are fetched in batches through it
+// too, unless SyncOptions.UploadClient or SyncOptions.BatchClient is
+// set. The requests are limited, see
+// SyncOptions.MaxConcurrentRequests. A nil opts uses the default
+// options.
+func NewCachedSyncerWithClient(httpClient *http.Client, metaService *metadata.MetaService, blobManager *blob.Manager, opts *SyncOptions) (*CachedSyncer, error) {
+	if httpClient == nil {
+		return nil, errNoClient
+	}
+	d := NewCachedSyncer(nil, metaService, blobManager, opts)
+	service, err := client.New(d.LimitClient(httpClient))
+	if err != nil {
+		return nil, err
 	}
+	d.remoteService = service
+	if d.opts.UploadClient == nil {
+		d.opts.UploadClient = httpClient
+	}
+	d.opts.UploadClient = d.LimitClient(d.opts.UploadClient)
+	if d.opts.BatchClient == nil {
+		d.opts.BatchClient = httpClient
+	}
+	d.opts.BatchClient = d.LimitClient(d.opts.BatchClient)
+	return d, nil
+}
+
+// WaitReady blocks until the first sync has completed successfully.
+func (d *CachedSyncer) WaitReady() {
+	<-d.ready
+}
+
+// NextSync returns a channel that is closed once the next sync
+// completes successfully.
+func (d *CachedSyncer) NextSync() <-chan struct{} {
+	d.muSynced.Lock()
+	defer d.muSynced.Unlock()
+	return d.nextSync
 }
 
-func (d *CachedSyncer) Start() {
+// Wakes up the goroutines waiting for a successful sync.
+func (d *CachedSyncer) notifySynced() {
+	d.readyOnce.Do(func() { close(d.ready) })
+	d.muSynced.Lock()
+	close(d.nextSync)
+	d.nextSync = make(chan struct{})
+	d.muSynced.Unlock()
+}
+
+// Start syncs periodically and whenever a sync is triggered, until ctx
+// is done, each time with SyncOnce. A sync in progress is cancelled
+// along with ctx. The syncs are spaced out while there are no changes,
+// see SyncOptions.MaxInterval, and while Drive notifies the changes,
+// see SyncOptions.WebhookAddress. Once a sync fails to reach Drive, the
+// syncs are paused until a connectivity check succeeds, see
+// SyncOptions.ConnectivityInterval.
+func (d *CachedSyncer) Start(ctx context.Context) {
+	if d.opts.CollectInterval > 0 {
+		go d.collectPeriodically(ctx)
+	}
+	if d.opts.WebhookAddress != "" {
+		go d.watchChanges(ctx)
+	}
 	go func() {
-		for {
-			d.Sync(false)
-			<-time.After(intervalSync)
+		if delay := d.opts.startDelay(); delay > 0 {
+			d.opts.Logger.V("Delaying the first sync by", delay)
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-d.trigger:
+			case <-ctx.Done():
+			}
+			timer.Stop()
+		}
+		interval := d.opts.Interval
+		for ctx.Err() == nil {
+			wait := interval
+			switch offline, disconnected := d.offlineState(); {
+			case d.IsPaused():
+				// until Resume triggers a sync
+			case offline:
+				// until SetOffline(false) triggers a sync
+			case disconnected:
+				if err := d.ping(ctx); err == nil {
+					d.opts.Logger.V("Drive is reachable again, resuming the syncs")
+					d.setDisconnected(false)
+					continue
+				}
+				wait = d.opts.ConnectivityInterval
+			default:
+				changed, err := d.syncChanged(ctx)
+				if err == nil {
+					interval = d.opts.nextInterval(interval, changed)
+					if d.watching() {
+						// the notifications trigger the syncs, polling
+						// only catches the ones that are lost
+						wait = d.opts.MaxInterval
+					}
+				} else if errors.Is(err, auth.ErrAuth) {
+					d.opts.Logger.V("Drive rejects the authorization of the account:", err)
+				} else if isNetworkError(err) && ctx.Err() == nil {
+					d.opts.Logger.V("Drive can't be reached, pausing the syncs")
+					d.setDisconnected(true)
+					wait = d.opts.ConnectivityInterval
+				}
+			}
+			wait = d.opts.jittered(wait)
+			d.stats.interval.Store(int64(wait))
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-d.trigger:
+			case <-ctx.Done():
+			}
+			timer.Stop()
 		}
 	}()
 }
 
-func (d *CachedSyncer) Sync(isForce bool) (err error) {
-	d.mu.Lock()
+// Syncs and returns true if any changes were synced, that is if the
+// sync position moved.
+func (d *CachedSyncer) syncChanged(ctx context.Context) (changed bool, err error) {
+	// there is no sync position before the first change
+	before, _ := d.metaService.GetLargestChangeId()
+	if _, err = d.SyncOnce(ctx); err != nil {
+		return
+	}
+	after, _ := d.metaService.GetLargestChangeId()
+	return after != before, nil
+}
+
+// Trigger requests a sync out of the periodic schedule started by
+// Start, returns immediately. Triggers that arrive while a sync is
+// pending or in progress are coalesced into a single sync. Safe to be
+// called from multiple goroutines.
+func (d *CachedSyncer) Trigger() {
+	select {
+	case d.trigger <- struct{}{}:
+	default:
+		// a sync is already requested
+	}
+}
+
+// SetOffline pauses the syncing if offline is set, until it is called
+// again with offline unset. Syncs return ErrOffline in between, while
+// the cached metadata and contents are still served. A sync in
+// progress is finished.
+func (d *CachedSyncer) SetOffline(offline bool) {
+	d.muOffline.Lock()
+	d.offline = offline
+	if !offline {
+		// connectivity is checked again by the next sync
+		d.disconnected = false
+	}
+	d.muOffline.Unlock()
+	if !offline {
+		d.Trigger()
+	}
+}
+
+// Returns true if the syncing is paused, either by SetOffline or since
+// Drive couldn't be reached.
+func (d *CachedSyncer) IsOffline() bool {
+	offline, disconnected := d.offlineState()
+	return offline || disconnected
+}
+
+// Pause pauses the syncing until Resume is called, e.g. while the user
+// runs a large local operation: the periodic syncing of Start skips
+// its syncs, and the syncs called explicitly return ErrPaused. Unlike
+// stopping the syncer, the periodic syncing keeps running, along with
+// its interval, and so does the serving of the cached metadata and
+// contents. A sync in progress is finished.
+func (d *CachedSyncer) Pause() {
+	d.muOffline.Lock()
+	defer d.muOffline.Unlock()
+	d.paused = true
+}
+
+// Resume resumes the syncing paused by Pause, and triggers a sync to
+// catch up with the changes made meanwhile.
+func (d *CachedSyncer) Resume() {
+	d.muOffline.Lock()
+	d.paused = false
+	d.muOffline.Unlock()
+	d.Trigger()
+}
+
+// Returns true if the syncing is paused by Pause.
+func (d *CachedSyncer) IsPaused() bool {
+	d.muOffline.Lock()
+	defer d.muOffline.Unlock()
+	return d.paused
+}
+
+func (d *CachedSyncer) offlineState() (offline bool, disconnected bool) {
+	d.muOffline.Lock()
+	defer d.muOffline.Unlock()
+	return d.offline, d.disconnected
+}
+
+func (d *CachedSyncer) setDisconnected(disconnected bool) {
+	d.muOffline.Lock()
+	defer d.muOffline.Unlock()
+	d.disconnected = disconnected
+}
+
+// Checks that Drive can be reached with a small metadata call.
+func (d *CachedSyncer) pingDrive(ctx context.Context) error {
+	return d.withTimeout(ctx, func() error {
+		_, err := d.remoteService.About.Get().MaxChangeIdCount(1).Do()
+		return err
+	})
+}
+
+// Returns true if err is a failure to reach Drive, such as a failed
+// DNS lookup or connection, rather than an error response of Drive.
+// Failures to authorize a request are not, Drive was reached but the
+// account has to be authorized again, see auth.ErrAuth.
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && !errors.Is(err, auth.ErrAuth)
+}
+
+func (d *CachedSyncer) Sync(isForce bool) (*SyncResult, error) {
+	return d.SyncContext(context.Background(), isForce)
+}
+
+// SyncOnce runs a single pass of the periodic syncing of Start, an
+// incremental sync, e.g. for the callers scheduling the syncs on their
+// own. Returns early with the error of ctx once ctx is done, and
+// ErrSyncInProgress right away if another sync is running.
+func (d *CachedSyncer) SyncOnce(ctx context.Context) (*SyncResult, error) {
+	return d.SyncContext(ctx, false)
+}
+
+// SyncContext is like Sync, but returns early with the error of ctx
+// once ctx is done. Returns ErrSyncInProgress right away, rather than
+// waiting, if another sync or a reset is running.
+func (d *CachedSyncer) SyncContext(parent context.Context, isForce bool) (result *SyncResult, err error) {
+	if d.IsPaused() {
+		return &SyncResult{}, ErrPaused
+	}
+	if d.IsOffline() {
+		return &SyncResult{}, ErrOffline
+	}
+	if !d.mu.TryLock() {
+		return &SyncResult{}, ErrSyncInProgress
+	}
 	defer d.mu.Unlock()
+	return d.syncLocked(parent, isForce)
+}
+
+// Syncs, the caller holds the lock of the syncs.
+func (d *CachedSyncer) syncLocked(parent context.Context, isForce bool) (result *SyncResult, err error) {
+	result = &SyncResult{}
+	d.result = result
+	d.progress, d.progressFrom = SyncProgress{}, 0
+	d.publish(SyncEvent{Kind: SyncStarted})
+	start := time.Now()
+	defer func() {
+		d.result = nil
+		d.stats.progress.Store(nil)
+		result.NewChangeId, _ = d.metaService.GetLargestChangeId()
+		if !d.opts.DryRun {
+			d.recordSync(start, result.NewChangeId, err)
+		}
+		d.publish(SyncEvent{Kind: SyncFinished, Result: result, Err: err})
+	}()
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	d.muCancel.Lock()
+	d.cancel = cancel
+	if d.resetPending {
+		// a reset is waiting for the lock, don't start a new sync
+		cancel()
+	}
+	d.muCancel.Unlock()
+	defer func() {
+		d.muCancel.Lock()
+		d.cancel = nil
+		d.muCancel.Unlock()
+	}()
 
-	logger.V("Started syncer...")
-	err = d.syncInbound(isForce)
+	d.opts.Logger.V("Started syncer...")
+	if d.opts.DryRun {
+		d.opts.Logger.V("Dry run, nothing is downloaded, pushed nor written")
+		return result, d.dryRun(func() error { return d.syncInbound(ctx, isForce) })
+	}
+	if outErr := d.syncPending(ctx); outErr != nil {
+		// the failed files stay queued, they are retried next time
+		d.opts.Logger.V("error during outbound sync", outErr)
+		result.Errors = append(result.Errors, outErr)
+	}
+	err = d.syncInbound(ctx, isForce)
+	if saveErr := d.metaService.SaveSyncAttempt(time.Now(), err); saveErr != nil {
+		d.opts.Logger.V("error recording the sync", saveErr)
+	}
 	if err != nil {
-		logger.V("error during sync", err)
+		d.opts.Logger.V("error during sync", err)
 		return
 	}
-	logger.V("Done syncing...")
+	d.notifySynced()
+	if d.opts.TrashRetention > 0 {
+		if trashErr := d.EmptyTrash(d.opts.TrashRetention); trashErr != nil {
+			d.opts.Logger.V("error emptying the trash", trashErr)
+		}
+	}
+	if d.opts.Errors != nil {
+		result.Errors = append(result.Errors, d.opts.Errors()...)
+	}
+	result.Errors = append(result.Errors, d.quarantinedErrors()...)
+	if len(result.Classes) > 0 {
+		d.opts.Logger.V("Synced files by class:", result.Classes)
+	}
+	d.opts.Logger.V("Done syncing...")
 	return
 }
 
-func (d *CachedSyncer) syncOutbound(rootId string, isRecursive bool, isForce bool) error {
-	panic("not implemented")
+// Returns an error for each file whose downloads are stopped, with the
+// number of its failed downloads and the error of the last one.
+func (d *CachedSyncer) quarantinedErrors() []error {
+	files, err := d.metaService.ListQuarantined(time.Now())
+	if err != nil {
+		d.opts.Logger.V("error listing the quarantined files", err)
+		return nil
+	}
+	var errs []error
+	for _, file := range files {
+		errs = append(errs, fmt.Errorf("%w: %v after %d failed downloads, until %v: %v", ErrDownloadsStopped, file.Id, file.DownloadFailures, file.QuarantinedUntil.Format(time.RFC3339), file.DownloadError))
+	}
+	return errs
+}
+
+// Runs fn, the inbound sync of a dry run, with the metadata written to
+// a batch that is rolled back once fn returns, see SyncOptions.DryRun.
+func (d *CachedSyncer) dryRun(fn func() error) error {
+	var committed []func()
+	err := d.metaService.Batch(func(b *metadata.Batch) error {
+		d.page, d.committed = b, nil
+		defer func() {
+			committed = d.committed
+			d.page, d.committed = nil, nil
+		}()
+		if err := fn(); err != nil {
+			return err
+		}
+		return errDryRun
+	})
+	if err != errDryRun {
+		return err
+	}
+	// the changes are recorded as if they were
+	for _, fn := range committed {
+		fn()
+	}
 	return nil
 }
 
-func (d *CachedSyncer) syncInbound(isForce bool) (err error) {
+// Reset aborts the in-flight sync if there is one, and clears the
+// cached metadata and the sync position so that the next sync is an
+// initial sync.
+func (d *CachedSyncer) Reset() error {
+	d.lockForReset()
+	defer d.mu.Unlock()
+	d.opts.Logger.V("Resetting syncer...")
+	return d.metaService.Clear()
+}
+
+// Aborts the in-flight sync if there is one and takes the lock of the
+// syncs, ahead of the syncs waiting for it.
+func (d *CachedSyncer) lockForReset() {
+	d.muCancel.Lock()
+	d.resetPending = true
+	if d.cancel != nil {
+		d.cancel()
+	}
+	d.muCancel.Unlock()
+
+	d.mu.Lock()
+	d.muCancel.Lock()
+	d.resetPending = false
+	d.muCancel.Unlock()
+}
+
+// ResetAndResync clears the cached metadata and the sync position like
+// Reset, and the cached contents too if purgeBlobs is set, then syncs
+// everything again as an initial sync, without another sync in
+// between. Returns what the sync did. Local files not uploaded yet are
+// lost, like with Reset. Returns ErrOffline without clearing anything
+// while offline.
+func (d *CachedSyncer) ResetAndResync(ctx context.Context, purgeBlobs bool) (*SyncResult, error) {
+	if d.IsOffline() {
+		return &SyncResult{}, ErrOffline
+	}
+	d.lockForReset()
+	defer d.mu.Unlock()
+	d.opts.Logger.V("Resetting syncer for a full resync...")
+	if err := d.metaService.Clear(); err != nil {
+		return &SyncResult{}, err
+	}
+	if purgeBlobs {
+		if err := d.blobManager.Clear(); err != nil {
+			return &SyncResult{}, err
+		}
+	}
+	return d.syncLocked(ctx, true)
+}
+
+func (d *CachedSyncer) syncInbound(ctx context.Context, isForce bool) (err error) {
 	var largestChangeId int64
 	largestChangeId, err = d.metaService.GetLargestChangeId()
 	isInitialSync := largestChangeId == 0
@@ -82,101 +570,1077 @@ func (d *CachedSyncer) syncInbound(isForce bool) (err error) {
 	} else {
 		largestChangeId += 1
 	}
+	d.progress.Initial = isInitialSync
+	d.storeProgress()
+	if isForce || isInitialSync {
+		d.checkQuota(ctx)
+	}
 
 	// retrieve metadata about root
 	var rootFile *client.File
-	if rootFile, err = d.remoteService.Files.Get(metadata.IdRootFolder).Do(); err != nil {
+	err = d.doWithRetry(ctx, func() (err error) {
+		rootFile, err = d.remoteService.Files.Get(metadata.IdRootFolder).Do()
+		return
+	})
+	if err != nil {
 		return
 	}
 
-	data := buildMetadata(metadata.IdRootFolder, "", rootFile)
-	if err = d.metaService.Save("", metadata.IdRootFolder, data, false, false); err != nil {
+	if err = d.saveRoot(rootFile); err != nil {
+		return
+	}
+	if len(d.opts.FileIds) > 0 {
+		return d.syncFiles(ctx, rootFile.Id)
+	}
+	if len(d.opts.FolderIds) > 0 {
+		d.deferred = newDeferredChanges()
+	}
+	d.restoring = make(map[string]bool)
+	if err = d.mergeFeed(ctx, isInitialSync, !isForce, rootFile.Id, "", largestChangeId); err != nil {
+		d.deferred = nil
+		return
+	}
+	if err = d.dropDeferred(rootFile.Id); err != nil {
 		return
 	}
+	for _, driveId := range d.opts.SharedDrives {
+		if err = d.syncSharedDrive(ctx, isForce, rootFile.Id, driveId); err != nil {
+			return
+		}
+	}
+	if d.opts.PruneEmptyFolders && !d.opts.DryRun {
+		// the metadata merged by a dry run is not committed to be read
+		err = d.pruneFolders(rootFile.Id)
+	}
+	return
+}
+
+// Saves the metadata of the root folder of My Drive, unless it is
+// cached as it is already. The root is cached with the modification
+// date it had on Drive, the one it was cached with if Drive tells none.
+func (d *CachedSyncer) saveRoot(rootFile *client.File) error {
+	data := d.buildMetadata(metadata.IdRootFolder, "", rootFile)
+	// the root folder once its id is saved
+	prev, err := d.getFile(rootFile.Id)
+	cached := err == nil && prev.Id == metadata.IdRootFolder
+	if _, ok := d.fileTime(rootFile); !ok && cached {
+		data.LastMod, data.Created = prev.LastMod, prev.Created
+	}
+	if cached && prev.Name == data.Name && prev.Title == data.Title && prev.LastMod.Equal(data.LastMod) && prev.Created.Equal(data.Created) {
+		return nil
+	}
+	return d.writeBatch(func(b *metadata.Batch) error {
+		if err := b.Save("", metadata.IdRootFolder, data, false, false); err != nil {
+			return err
+		}
+		// the changes refer to the root by its id on Drive
+		return b.SaveRootId(rootFile.Id)
+	})
+}
+
+// Merges the pages of the change feed of the shared drive identified
+// by driveId, or of My Drive if it is empty, starting with
+// startChangeId. The token of the next page is saved once a page is
+// merged, if resume is set a walk interrupted by a restart resumes
+// with it rather than starting over, unless Drive doesn't take it
+// anymore.
+func (d *CachedSyncer) mergeFeed(ctx context.Context, isInitialSync bool, resume bool, rootId string, driveId string, startChangeId int64) (err error) {
 	pageToken := ""
+	if resume {
+		pageToken, _ = d.metaService.GetPageToken(driveId)
+	}
+	if pageToken != "" {
+		d.opts.Logger.V("Resuming the changes of", driveId, "with pageToken:", pageToken)
+	}
+	latest := make(map[string]int64)
 	for {
-		pageToken, err = d.mergeChanges(isInitialSync, rootFile.Id, largestChangeId, pageToken)
-		if err != nil || pageToken == "" {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		var next string
+		next, err = d.mergeChanges(ctx, isInitialSync, rootId, driveId, startChangeId, pageToken, latest)
+		if resume && pageToken != "" && isExpired(err) {
+			// walked again from the largest change id synced
+			d.positionExpired(driveId, "page token "+pageToken, err)
+			if !d.opts.DryRun {
+				d.retryBusy(func() error { return d.metaService.SavePageToken(driveId, "") })
+			}
+			resume, pageToken = false, ""
+			continue
+		}
+		if pageToken == "" && startChangeId > 0 && isExpired(err) {
+			// walked again from the start, as a forced sync is
+			d.positionExpired(driveId, fmt.Sprint("change id ", startChangeId), err)
+			resume, startChangeId = false, 0
+			continue
+		}
+		resume = false
+		if err != nil || d.opts.DryRun && next == "" {
 			return
 		}
+		if d.opts.DryRun {
+			// the walk isn't resumed from the pages of a dry run
+			pageToken = next
+			continue
+		}
+		if err = d.retryBusy(func() error { return d.metaService.SavePageToken(driveId, next) }); err != nil || next == "" {
+			return
+		}
+		pageToken = next
 	}
-	return
 }
 
-func (d *CachedSyncer) mergeChanges(isInitialSync bool, rootId string, startChangeId int64, pageToken string) (nextPageToken string, err error) {
-	logger.V("merging changes starting with pageToken:", pageToken, "and startChangeId", startChangeId)
+// Returns true if err is a request of the change feed Drive rejects as
+// invalid or not found, e.g. with a page token that expired.
+func isExpired(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && (apiErr.Code == http.StatusBadRequest || apiErr.Code == http.StatusNotFound)
+}
+
+// Records that the position of the change feed of the shared drive
+// identified by driveId, or of My Drive if it is empty, is rejected by
+// Drive with err, in the result of the sync in progress, if any.
+func (d *CachedSyncer) positionExpired(driveId string, position string, err error) {
+	d.opts.Logger.V(position, "of the changes of", driveId, "is rejected, starting over", err)
+	if r := d.result; r != nil {
+		r.Errors = append(r.Errors, fmt.Errorf("%w: %v of the changes of %q: %v", ErrChangeTokenExpired, position, driveId, err))
+	}
+}
+
+// Syncs the shared drive identified by driveId into a folder of the
+// root folder named after the drive, following the change feed of the
+// drive from its own sync position.
+func (d *CachedSyncer) syncSharedDrive(ctx context.Context, isForce bool, rootId string, driveId string) (err error) {
+	var largestChangeId int64
+	largestChangeId, err = d.metaService.GetDriveChangeId(driveId)
+	isInitialSync := largestChangeId == 0
+	if isForce || err != nil {
+		largestChangeId = 0
+	} else {
+		largestChangeId += 1
+	}
+
+	var driveFile *client.File
+	err = d.doWithRetry(ctx, func() (err error) {
+		driveFile, err = d.remoteService.Files.Get(driveId).SupportsAllDrives(true).Do()
+		return
+	})
+	checkpoint, _ := d.metaService.GetLargestChangeId()
+	if isNotFound(err) {
+		// deleted, or not shared with the user anymore
+		d.opts.Logger.V("shared drive", driveId, "is not found, removing it")
+		return d.mergeChange(rootId, &client.Change{Id: checkpoint, FileId: driveId, Deleted: true})
+	}
+	if err != nil {
+		return
+	}
+	// the root folder of a shared drive has no parents
+	driveFile.Parents = []*client.ParentReference{{Id: rootId}}
+	if err = d.mergeChange(rootId, &client.Change{Id: checkpoint, FileId: driveId, File: driveFile}); err != nil {
+		return
+	}
+	return d.mergeFeed(ctx, isInitialSync, !isForce, rootId, driveId, largestChangeId)
+}
+
+// Fetches the configured files, in batches, see getFiles, and merges
+// the ones changed since the last sync into the root folder. The files
+// that are not found anymore are deleted. The changes are journaled
+// with the largest change id at the time of the sync.
+func (d *CachedSyncer) syncFiles(ctx context.Context, rootId string) (err error) {
+	var about *client.About
+	err = d.doWithRetry(ctx, func() (err error) {
+		about, err = d.remoteService.About.Get().Do()
+		return
+	})
+	if err != nil {
+		return
+	}
+	files, failed, err := d.getFiles(ctx, d.opts.FileIds)
+	if err != nil {
+		return
+	}
+	for _, id := range d.opts.FileIds {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if err = failed[id]; err != nil {
+			return
+		}
+		file := files[id]
+		item := &client.Change{Id: about.LargestChangeId, FileId: id, File: file}
+		if file == nil {
+			// deleted, or not shared with the user anymore
+			item.Deleted = true
+		}
+		if !item.Deleted {
+			if prev, getErr := d.getFile(id); getErr == nil && prev.Title == file.Title && prev.Version == contentVersion(file) {
+				// unchanged, don't journal it again
+				continue
+			}
+			file.Parents = []*client.ParentReference{{Id: rootId}}
+		}
+		if err = d.mergeChange(rootId, item); err != nil {
+			if isUnrecoverable(err) {
+				return
+			}
+			err = d.skipChange(id, err)
+		}
+	}
+	if d.opts.DryRun {
+		return nil
+	}
+	return d.retryBusy(func() error {
+		return d.metaService.SaveLargestChangeId(about.LargestChangeId)
+	})
+}
+
+// Merges a page of the change feed of the shared drive identified by
+// driveId, or of My Drive if it is empty. Only the latest change of
+// each file is merged, the ids of the latest changes seen by the pages
+// of the feed so far are kept in latest by file id. The changes of
+// shared drives are journaled at the sync position of My Drive, which
+// is the one the journal is read by.
+func (d *CachedSyncer) mergeChanges(ctx context.Context, isInitialSync bool, rootId string, driveId string, startChangeId int64, pageToken string, latest map[string]int64) (nextPageToken string, err error) {
+	d.opts.Logger.D("merging changes of", driveId, "starting with pageToken:", pageToken, "and startChangeId", startChangeId)
 
 	req := d.remoteService.Changes.List()
-	req.IncludeSubscribed(false)
+	req.IncludeSubscribed(d.opts.IncludeSubscribed).MaxResults(d.opts.MaxResults)
+	var checkpoint int64
+	if driveId != "" {
+		req.DriveId(driveId).SupportsAllDrives(true).IncludeItemsFromAllDrives(true)
+		checkpoint, _ = d.metaService.GetLargestChangeId()
+	}
 	if pageToken != "" {
 		req.PageToken(pageToken)
 	} else if startChangeId > 0 { // can't set page token and start change mutually
 		req.StartChangeId(startChangeId)
 	}
-	if isInitialSync {
+	if isInitialSync && !d.opts.IncludeDeletedInitially {
+		// there is nothing cached to delete yet
 		req.IncludeDeleted(false)
 	}
 
 	var changes *client.ChangeList
-	if changes, err = req.Do(); err != nil {
+	err = d.doWithRetry(ctx, func() (err error) {
+		changes, err = req.Do()
+		return
+	})
+	if err != nil {
 		return
 	}
 
 	var largestId int64
 	nextPageToken = changes.NextPageToken
 	for _, item := range changes.Items {
-		if err = d.mergeChange(rootId, item); err != nil {
+		latest[item.FileId] = max(latest[item.FileId], item.Id)
+	}
+	failed, err := d.fetchMissing(ctx, changes.Items, latest)
+	if err != nil {
+		return
+	}
+	items := changes.Items
+	if d.opts.PruneEmptyFolders {
+		var restored []*client.Change
+		if restored, err = d.restorePruned(ctx, rootId, items, latest); err != nil {
 			return
 		}
-		largestId = item.Id
+		items = append(restored, items...)
+	}
+	// the changes of the page are written in a single transaction along
+	// with the largest change id, a page that fails partway is rolled
+	// back and merged again by the next sync
+	var committed []func()
+	batch, outer := d.metaService.Batch, d.page
+	if outer != nil {
+		// merged into the batch of a dry run, which is rolled back
+		batch = outer.Savepoint
+	}
+	err = batch(func(page *metadata.Batch) (err error) {
+		d.page, d.committed = page, nil
+		defer func() {
+			committed = d.committed
+			d.page, d.committed = outer, nil
+		}()
+		for _, item := range items {
+			if err = ctx.Err(); err != nil {
+				return
+			}
+			if item.Id < latest[item.FileId] {
+				// superseded by a later change of the file
+				largestId = max(largestId, item.Id)
+				continue
+			}
+			if fetchErr := failed[item.FileId]; fetchErr != nil {
+				err = d.skipChange(item.FileId, fetchErr)
+				largestId = max(largestId, item.Id)
+				continue
+			}
+			merged, merge := item, d.mergeInScope
+			if driveId != "" {
+				journaled := *item
+				journaled.Id = checkpoint
+				merged, merge = &journaled, d.mergeChange
+			}
+			if err = merge(rootId, merged); err != nil {
+				if isUnrecoverable(err) {
+					return
+				}
+				// skipped, a single file doesn't hold back the others
+				err = d.skipChange(item.FileId, err)
+			}
+			largestId = max(largestId, item.Id)
+		}
+		if largestId == 0 {
+			return nil
+		}
+		if driveId != "" {
+			return page.SaveDriveChangeId(driveId, largestId)
+		}
+		return page.SaveLargestChangeId(largestId)
+	})
+	if err != nil {
+		return
+	}
+	for _, fn := range committed {
+		fn()
+	}
+	if n := len(changes.Items); n > 0 {
+		d.recordPage(driveId, changes.Items[0].Id, changes.Items[n-1].Id, changes.LargestChangeId, n, nextPageToken == "")
 	}
 	if largestId > 0 {
-		// persist largest change id
-		d.metaService.SaveLargestChangeId(largestId)
+		d.publish(SyncEvent{Kind: PageProcessed, ChangeId: largestId, Progress: d.progress})
 	}
 	return
 }
 
+// Fetches the files of the latest changes of the page that don't carry
+// them, e.g. the minimal ones, in batches, see getFiles. The changes of
+// the files not found are deleted. Returns the errors of the files that
+// couldn't be fetched, keyed by id, the changes of which are skipped.
+func (d *CachedSyncer) fetchMissing(ctx context.Context, items []*client.Change, latest map[string]int64) (map[string]error, error) {
+	ids := []string{}
+	for _, item := range items {
+		if !item.Deleted && item.File == nil && item.Id >= latest[item.FileId] {
+			ids = append(ids, item.FileId)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	files, failed, err := d.getFiles(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if item.Deleted || item.File != nil || item.Id < latest[item.FileId] {
+			continue
+		}
+		if file, ok := files[item.FileId]; ok {
+			item.File = file
+		} else if failed[item.FileId] == nil {
+			item.Deleted = true
+		}
+	}
+	return failed, nil
+}
+
+// Runs the metadata write op, retrying it with a backoff while the
+// database is locked, up to the configured number of attempts.
+func (d *CachedSyncer) retryBusy(op func() error) (err error) {
+	delay := busyRetryDelay
+	for attempt := 1; ; attempt++ {
+		if err = op(); !metadata.IsBusy(err) || attempt >= d.opts.BusyAttempts {
+			return
+		}
+		d.opts.Logger.V("metadata is locked, retrying in", delay)
+		d.sleep(delay)
+		delay *= 2
+	}
+}
+
+// Runs fn in a metadata batch, retrying it while the database is
+// locked.
+func (d *CachedSyncer) writeBatch(fn func(b *metadata.Batch) error) error {
+	return d.retryBusy(func() error {
+		return d.batch(fn)
+	})
+}
+
+// Runs fn in a metadata batch of its own, or as a part of the batch of
+// the page of changes being merged if any, rolling back the writes of
+// fn alone if it fails.
+func (d *CachedSyncer) pageBatch(fn func(b *metadata.Batch) error) error {
+	if d.page != nil {
+		return d.page.Savepoint(fn)
+	}
+	return d.metaService.Batch(fn)
+}
+
+// Runs fn once the metadata written so far is committed: after the
+// page of changes being merged if any, right away otherwise.
+func (d *CachedSyncer) afterCommit(fn func()) {
+	if d.page != nil {
+		d.committed = append(d.committed, fn)
+		return
+	}
+	fn()
+}
+
+// Gets the metadata of the file identified by id, including the writes
+// of the page of changes being merged if any. The merges read the
+// metadata through it, the page holds the lock of the metadata.
+func (d *CachedSyncer) getFile(id string) (*metadata.CachedDriveFile, error) {
+	if d.page != nil {
+		return d.page.Get(id)
+	}
+	return d.metaService.Get(id)
+}
+
+// Like getFile, gets the metadata of the trashed file identified by id.
+func (d *CachedSyncer) getTrashed(id string) (*metadata.CachedDriveFile, error) {
+	if d.page != nil {
+		return d.page.GetTrashed(id)
+	}
+	return d.metaService.GetTrashed(id)
+}
+
+// Like getFile, returns true if the file identified by id is queued
+// for upload.
+func (d *CachedSyncer) isQueuedForUpload(id string) (bool, error) {
+	if d.page != nil {
+		return d.page.IsQueuedForIO("upload", id)
+	}
+	return d.metaService.IsQueuedForIO("upload", id)
+}
+
+// Marks the file identified by id as downloaded or generated, as a part
+// of the page of changes being merged if any.
+func (d *CachedSyncer) initFile(id string) error {
+	if d.page != nil {
+		return d.page.InitFile(id)
+	}
+	return d.metaService.InitFile(id)
+}
+
 func (d *CachedSyncer) mergeChange(rootId string, item *client.Change) (err error) {
-	if item.Deleted || item.File.Labels.Trashed {
+	// the kind of change applied, if any, the local name of the file
+	// and the bytes to download
+	var kind metadata.ChangeKind
+	var name string
+	var queued int64
+	var class FileClass
+	// and the cached entries and attributes it invalidates
+	var invalidations []InvalidateEvent
+	if !item.Deleted && item.File != nil && !item.File.Labels.Trashed && d.filtersOut(item.File) {
+		// not synced, removed if it was
+		d.recordFiltered()
+		filtered := *item
+		filtered.Deleted, filtered.File = true, nil
+		item = &filtered
+	}
+	defer func() {
+		if err == nil {
+			d.afterCommit(func() {
+				d.recordChange(kind, item.FileId, name, queued)
+				d.recordClass(kind, class)
+				d.invalidate(invalidations)
+			})
+		}
+	}()
+	if item.Deleted || item.File == nil || item.File.Labels.Trashed {
 		// TODO(burcud): Handle directory deletions
-		if d.metaService.Delete(item.FileId); err != nil {
+		trashed := false
+		err = d.writeBatch(func(b *metadata.Batch) error {
+			kind, invalidations, trashed = 0, nil, false
+			prev, err := b.Get(item.FileId)
+			if err != nil {
+				// never cached, there is no deletion to record
+				return nil
+			}
+			name = prev.Name
+			trashed = d.opts.TrashRetention > 0 && prev.MimeType != metadata.MimeTypeFolder
+			if trashed {
+				if err := b.Trash(item.FileId, time.Now()); err != nil {
+					return err
+				}
+			} else if err := b.Delete(item.FileId); err != nil {
+				return err
+			}
+			kind = metadata.ChangeDeleted
+			invalidations = []InvalidateEvent{{FileId: item.FileId, ParentId: prev.ParentId, Kind: InvalidateEntry}}
+			return b.Journal(item.Id, item.FileId, kind)
+		})
+		if err != nil || d.opts.DryRun {
 			return
 		}
+		if d.opts.Thumbnails != nil {
+			d.muThumbs.Lock()
+			delete(d.pendingThumbs, item.FileId)
+			d.muThumbs.Unlock()
+			d.opts.Thumbnails.Delete(item.FileId)
+		}
+		if trashed {
+			// kept until the trash is emptied
+			return d.blobManager.Trash(item.FileId)
+		}
 		// delete contents
-		if d.blobManager.Delete(item.FileId); err != nil {
+		err = d.blobManager.Delete(item.FileId)
+	} else {
+		fileId := item.FileId
+		parentId, otherParentIds := splitParents(rootId, item.File.Parents)
+		data := d.buildMetadata(item.FileId, parentId, item.File)
+		data.ChangeId = item.Id
+		contentChanged := false
+		class = classify(data)
+		// too large to be cached, only listed
+		data.Uncached = class == ClassDownloadable && d.opts.MaxBlobSize > 0 && data.FileSize > d.opts.MaxBlobSize
+		// the content edited locally and not pushed yet is kept, unless
+		// it conflicts with the one of Drive, see SyncOptions.Conflicts
+		var edit *localEdit
+		if edit, err = d.localEdit(data); err != nil {
 			return
 		}
-	} else {
-		if item.File.DownloadUrl == "" && item.File.MimeType != metadata.MimeTypeFolder {
+		conflicted := edit != nil && edit.conflicting
+		copyId := ""
+		if conflicted && d.opts.Conflicts == ConflictKeepBoth {
+			copyId = conflictedCopyId(fileId, item.Id)
+			if d.opts.DryRun {
+				// only the metadata of the copy is saved then
+			} else if err = d.saveConflictedContent(copyId, edit); err != nil {
+				return
+			}
+		}
+		downloadable := class == ClassDownloadable && edit == nil && !data.Uncached
+		copied := d.untrashContent(data, downloadable) || downloadable && d.copyContent(data)
+		// a folder move changes the location of its whole subtree,
+		// check and apply it in a single transaction
+		err = d.writeBatch(func(b *metadata.Batch) error {
+			kind, queued, invalidations = 0, 0, nil
+			if createsCycle(b.Get, fileId, parentId) {
+				d.opts.Logger.V("refusing to move", fileId, "under", parentId, "would create a cycle")
+				return nil
+			}
+			change := metadata.ChangeModified
+			prev, err := b.Get(fileId)
+			if err != nil {
+				change, prev = metadata.ChangeCreated, nil
+			}
+			contentChanged = err != nil || prev.Version != data.Version
+			if err := d.resolveConflicts(b, append([]string{parentId}, otherParentIds...), fileId, data); err != nil {
+				return err
+			}
+			// folders and shortcuts have no content to download
+			download := (class == ClassDownloadable || class == ClassExportable) && !d.keepsLocal(edit) && !copied && !data.Uncached
+			data.StaleChecksum = ""
+			if download && edit == nil && prev != nil {
+				data.StaleChecksum = d.staleChecksum(prev, data)
+			}
+			if err := b.Save(parentId, fileId, data, download, d.keepsLocal(edit)); err != nil {
+				return err
+			}
+			if err := b.SetOtherParents(fileId, otherParentIds); err != nil {
+				return err
+			}
+			if err := b.DeleteTrashed(fileId); err != nil {
+				return err
+			}
+			if download && contentChanged {
+				queued = data.FileSize
+			}
+			kind, name = change, data.Name
+			invalidations = invalidationsOf(prev, data, parentId)
+			if copyId != "" && prev != nil {
+				copied, err := d.saveConflictedCopy(b, prev, copyId, edit)
+				if err != nil {
+					return err
+				}
+				invalidations = append(invalidations, InvalidateEvent{FileId: copyId, ParentId: copied.ParentId, Kind: InvalidateEntry})
+				if err := b.Journal(item.Id, copyId, metadata.ChangeCreated); err != nil {
+					return err
+				}
+			}
+			return b.Journal(item.Id, fileId, kind)
+		})
+		if err != nil || kind == 0 {
+			// not merged, nor is the copy
+			if copyId != "" && !d.opts.DryRun {
+				d.blobManager.Delete(copyId)
+			}
 			return
 		}
+		if conflicted {
+			d.opts.Logger.V("edited both locally and on Drive", fileId)
+			d.recordConflict(fileId)
+			if !d.keepsLocal(edit) && !d.opts.DryRun {
+				// the content of Drive is downloaded instead
+				if err = d.blobManager.Delete(fileId); err != nil {
+					return
+				}
+			}
+		}
+		if (class == ClassLink || class == ClassUnsupported) && !d.opts.DryRun {
+			if err = d.saveGenerated(data, item.File); err != nil {
+				return
+			}
+		}
+		if copied || data.Uncached {
+			if err = d.initFile(fileId); err != nil {
+				return
+			}
+		}
+		if data.Uncached && contentChanged {
+			d.opts.Logger.V("not caching", fileId, "of", data.FileSize, "bytes")
+			d.recordSkipped(data.FileSize)
+		}
+		if contentChanged && item.File.ThumbnailLink != "" && !d.opts.DryRun {
+			d.queueThumbnail(fileId, item.File.ThumbnailLink)
+		}
+	}
+	return
+}
 
-		fileId := item.FileId
-		parentId := ""
-		if len(item.File.Parents) > 0 {
-			parentId = item.File.Parents[0].Id
+// Returns the checksum of the content of prev, the file before the
+// merge of data, if it is cached and read until the content of data is
+// downloaded, see metadata.CachedDriveFile.StaleChecksum. Returns an
+// empty checksum if there is none.
+func (d *CachedSyncer) staleChecksum(prev *metadata.CachedDriveFile, data *metadata.CachedDriveFile) string {
+	active := prev.ActiveChecksum()
+	if active == "" || data.Md5Checksum == "" || d.blobManager.IsPassThrough() || !d.blobManager.Exists(prev.Id, active) {
+		return ""
+	}
+	if data.Md5Checksum == prev.Md5Checksum {
+		// not changed again, still downloaded
+		return prev.StaleChecksum
+	}
+	return active
+}
+
+// Stores the content of the file as the one of another file with the
+// same md5 checksum, e.g. of the file it is a copy of, rather than
+// downloading it. Returns false if there is no such file cached, the
+// content is to be downloaded then.
+func (d *CachedSyncer) copyContent(data *metadata.CachedDriveFile) bool {
+	if data.Md5Checksum == "" || d.blobManager.IsPassThrough() || d.blobManager.Exists(data.Id, data.Md5Checksum) {
+		return false
+	}
+	srcId, ok := d.blobManager.LookupChecksumId(data.Md5Checksum)
+	if !ok || srcId == data.Id {
+		return false
+	}
+	if d.opts.DryRun {
+		// it would be copied
+		return true
+	}
+	if err := d.blobManager.Copy(srcId, data.Id, data.Md5Checksum); err != nil {
+		d.opts.Logger.V("can't copy the content of", srcId, "to", data.Id, err)
+		return false
+	}
+	return true
+}
+
+// Returns the invalidations of the merge of data into the folder
+// identified by parentId, prev is nil if the file is new. A move
+// invalidates the entries of both folders.
+func invalidationsOf(prev *metadata.CachedDriveFile, data *metadata.CachedDriveFile, parentId string) []InvalidateEvent {
+	id := data.Id
+	if prev == nil {
+		return []InvalidateEvent{{FileId: id, ParentId: parentId, Kind: InvalidateEntry}}
+	}
+	invalidations := []InvalidateEvent{{FileId: id, ParentId: parentId, Kind: InvalidateAttr}}
+	if prev.ParentId != parentId {
+		invalidations = append(invalidations, InvalidateEvent{FileId: id, ParentId: prev.ParentId, Kind: InvalidateEntry})
+	}
+	if prev.ParentId != parentId || prev.Name != data.Name {
+		invalidations = append(invalidations, InvalidateEvent{FileId: id, ParentId: parentId, Kind: InvalidateEntry})
+	}
+	return invalidations
+}
+
+// Returns true if err is a not found response of Drive.
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && apiErr.Code == http.StatusNotFound
+}
+
+// Returns true if err fails the whole sync rather than the change of a
+// single file: the sync is cancelled, Drive can't be reached or
+// authorized anymore, or the metadata stays locked.
+func isUnrecoverable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusUnauthorized {
+		return true
+	}
+	return isNetworkError(err) || metadata.IsBusy(err)
+}
+
+// Records the failure to merge the change of the file identified by id
+// in the result of the sync in progress, if any. Returns nil so that
+// the sync goes on with the next change.
+func (d *CachedSyncer) skipChange(id string, err error) error {
+	d.opts.Logger.V("skipping the change of", id, err)
+	if r := d.result; r != nil {
+		r.Errors = append(r.Errors, fmt.Errorf("error merging %v: %w", id, err))
+	}
+	return nil
+}
+
+// Records a merged change of the file identified by id in the result
+// of the sync in progress, if any, and publishes it. A zero kind is a
+// change that had no effect. The content queued is counted into the
+// stats, see Stats.
+func (d *CachedSyncer) recordChange(kind metadata.ChangeKind, id string, name string, queued int64) {
+	switch kind {
+	case metadata.ChangeCreated, metadata.ChangeModified:
+		d.publish(SyncEvent{Kind: FileSynced, Id: id, Name: name, Bytes: queued})
+	case metadata.ChangeDeleted:
+		d.publish(SyncEvent{Kind: FileDeleted, Id: id, Name: name})
+	}
+	if queued > 0 {
+		d.stats.filesQueued.Add(1)
+		d.stats.bytesQueued.Add(queued)
+	}
+	r := d.result
+	if r == nil {
+		// merged out of a sync
+		return
+	}
+	r.ChangesProcessed++
+	r.BytesQueued += queued
+	switch kind {
+	case metadata.ChangeCreated:
+		r.FilesAdded++
+	case metadata.ChangeModified:
+		r.FilesUpdated++
+	case metadata.ChangeDeleted:
+		r.FilesDeleted++
+	}
+}
+
+// Records the file of size bytes whose content is not cached in the
+// result of the sync in progress, if any.
+func (d *CachedSyncer) recordSkipped(size int64) {
+	if r := d.result; r != nil {
+		r.FilesSkipped++
+		r.BytesSkipped += size
+	}
+}
+
+// Counts the class of the file added or updated by the sync.
+func (d *CachedSyncer) recordClass(kind metadata.ChangeKind, class FileClass) {
+	r := d.result
+	if r == nil || (kind != metadata.ChangeCreated && kind != metadata.ChangeModified) {
+		return
+	}
+	if r.Classes == nil {
+		r.Classes = make(map[FileClass]int)
+	}
+	r.Classes[class]++
+}
+
+// Disambiguates the name of the file from its siblings of the same
+// name in each of its parents, files and folders alike, as a part of
+// the batch. Either the file or its siblings are renamed, see
+// yieldsName, so that the names don't depend on the order the changes
+// are synced in. The file has a single name in all of its parents, it
+// is renamed if it yields to a sibling in any of them.
+func (d *CachedSyncer) resolveConflicts(b *metadata.Batch, parentIds []string, fileId string, data *metadata.CachedDriveFile) error {
+	name := data.Name
+	conflicts := []*metadata.CachedDriveFile{}
+	for _, parentId := range parentIds {
+		siblings, err := b.LookUpAll(parentId, name)
+		if err != nil {
+			return err
 		}
-		if parentId == rootId {
-			parentId = metadata.IdRootFolder
+		for _, sibling := range siblings {
+			if sibling.Id == fileId {
+				continue
+			}
+			if yieldsName(data, sibling) {
+				data.Name = uniqueName(name, fileId, d.opts.MaxNameLength)
+				return nil
+			}
+			conflicts = append(conflicts, sibling)
 		}
-		metadata := buildMetadata(item.FileId, parentId, item.File)
-		if err = d.metaService.Save(parentId, fileId, metadata, !metadata.IsFolder(), false); err != nil {
-			return
+	}
+	for _, sibling := range conflicts {
+		d.opts.Logger.V("renaming", sibling.Id, "that conflicts with", fileId)
+		if err := b.Rename(sibling.Id, uniqueName(name, sibling.Id, d.opts.MaxNameLength)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Queues the thumbnail of the file identified by id to be fetched from
+// link in the background, replacing the link queued before, if any.
+func (d *CachedSyncer) queueThumbnail(id string, link string) {
+	if d.opts.Thumbnails == nil {
+		return
+	}
+	d.thumbsOnce.Do(func() {
+		go d.fetchThumbnails()
+	})
+	d.muThumbs.Lock()
+	d.pendingThumbs[id] = link
+	d.muThumbs.Unlock()
+	select {
+	case d.thumbsQueued <- struct{}{}:
+	default:
+		// the fetcher is already woken up
+	}
+}
+
+// Fetches the queued thumbnails, one at a time.
+func (d *CachedSyncer) fetchThumbnails() {
+	for range d.thumbsQueued {
+		for {
+			d.muThumbs.Lock()
+			id, link := "", ""
+			for id, link = range d.pendingThumbs {
+				break
+			}
+			delete(d.pendingThumbs, id)
+			d.muThumbs.Unlock()
+			if id == "" {
+				break
+			}
+			// thumbnails are optional, don't fail the sync
+			if err := d.opts.Thumbnails.Fetch(id, link); err != nil {
+				d.opts.Logger.V("error fetching thumbnail of", id, err)
+			}
+		}
+	}
+}
+
+// Runs a metadata call, giving up once the metadata timeout passes or
+// ctx is done. The Drive client doesn't support cancellation, a call
+// that is given up on is left to finish in the background.
+func (d *CachedSyncer) withTimeout(ctx context.Context, call func() error) error {
+	ctx, cancel := context.WithTimeout(ctx, d.opts.MetadataTimeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Sleeps for d, returns early with the error of ctx once it is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns the id the parent is cached under: the root folder of My
+// Drive, identified by rootId on Drive, is cached under
+// metadata.IdRootFolder.
+func cachedParentId(rootId string, parent *client.ParentReference) string {
+	if parent.IsRoot || parent.Id == rootId {
+		return metadata.IdRootFolder
+	}
+	return parent.Id
+}
+
+// Returns the parent to save the file under, the root folder if it is
+// one of them, and the other parents it is also listed in. A file
+// without parents, e.g. one shared with the user, is in no folder.
+func splitParents(rootId string, parents []*client.ParentReference) (parentId string, otherParentIds []string) {
+	ids := []string{}
+	seen := make(map[string]bool)
+	for _, parent := range parents {
+		id := cachedParentId(rootId, parent)
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return "", nil
+	}
+	if seen[metadata.IdRootFolder] {
+		parentId = metadata.IdRootFolder
+	} else {
+		parentId = ids[0]
+	}
+	for _, id := range ids {
+		if id != parentId {
+			otherParentIds = append(otherParentIds, id)
 		}
 	}
 	return
 }
 
-func buildMetadata(id string, parentId string, file *client.File) *metadata.CachedDriveFile {
-	lastMod, _ := time.Parse(layoutDateTime, file.ModifiedDate)
-	return &metadata.CachedDriveFile{
+// Returns true if moving the file identified by id under parentId
+// would make it an ancestor of itself. Unknown ancestors are assumed
+// not to form a cycle.
+func createsCycle(get func(id string) (*metadata.CachedDriveFile, error), id string, parentId string) bool {
+	visited := make(map[string]bool)
+	for parentId != "" && parentId != metadata.IdRootFolder {
+		if parentId == id || visited[parentId] {
+			return true
+		}
+		visited[parentId] = true
+		parent, err := get(parentId)
+		if err != nil {
+			return false
+		}
+		parentId = parent.ParentId
+	}
+	return false
+}
+
+func (d *CachedSyncer) buildMetadata(id string, parentId string, file *client.File) *metadata.CachedDriveFile {
+	lastMod := d.modifiedTime(file)
+	targetId := ""
+	if file.ShortcutDetails != nil {
+		targetId = file.ShortcutDetails.TargetId
+	}
+	data := &metadata.CachedDriveFile{
 		Id:          id,
-		ParentId:    parentId, // ignoring multiple parents
-		Name:        file.Title,
+		ParentId:    parentId, // the others are recorded apart
+		Name:        d.localName(file.Title),
+		Title:       file.Title,
 		MimeType:    file.MimeType,
 		FileSize:    file.FileSize,
 		Md5Checksum: file.Md5Checksum,
 		LastMod:     lastMod,
+		Created:     d.createdTime(file, lastMod),
+		Version:     contentVersion(file),
+		TargetId:    targetId,
+		DownloadUrl: file.DownloadUrl,
+	}
+	if !data.IsFolder() && !data.IsShortcut() && !data.IsNativeDoc() {
+		data.Name = d.localName(d.withMimeExtension(file.Title, file.MimeType))
+	}
+	if data.IsNativeDoc() {
+		data.ExportFormat = d.exportFormat(file)
+		data.Name = d.localName(withExtension(file.Title, metadata.ExportExtension(data.ExportFormat)))
+	}
+	if data.IsLink() {
+		d.buildLink(data, file)
+	}
+	if data.IsNativeDoc() && !data.IsLink() && data.ExportMimeType() == "" {
+		// nothing to fetch, listed as an empty file
+		data.Unsupported, data.FileSize = true, 0
+	}
+	return data
+}
+
+// Returns the format to export the native doc to, the configured or
+// the default one if Drive offers it, or PDF otherwise. Empty if the
+// doc can't be exported.
+func (d *CachedSyncer) exportFormat(file *client.File) string {
+	format, ok := d.opts.ExportFormats[file.MimeType]
+	if !ok || (format == metadata.MimeTypeLink && d.blobManager.IsPassThrough()) {
+		// links are stored locally, there is nowhere to read them from
+		// in pass-through mode
+		format = metadata.DefaultExportMimeType(file.MimeType)
+	}
+	if format == metadata.MimeTypeLink {
+		return format
+	}
+	if file.ExportLinks == nil || file.ExportLinks[format] != "" {
+		// the formats are only listed by the newer versions of the API
+		return format
+	}
+	if file.ExportLinks[mimeTypePdf] != "" {
+		return mimeTypePdf
+	}
+	return format
+}
+
+// Appends ext to the name unless it already ends with it, e.g. if the
+// doc was converted from an uploaded file.
+func withExtension(name string, ext string) string {
+	if ext == "" || strings.HasSuffix(strings.ToLower(name), ext) {
+		return name
+	}
+	return name + ext
+}
+
+// Appends the extension of the mime type to the name of a file, see
+// SyncOptions.Extensions, unless the name already ends with one of the
+// extensions of the mime type.
+func (d *CachedSyncer) withMimeExtension(name string, mimeType string) string {
+	ext := d.opts.Extensions[mimeType]
+	if ext == "" {
+		return name
+	}
+	lower := strings.ToLower(name)
+	for _, compatible := range metadata.FileExtensions(mimeType) {
+		if strings.HasSuffix(lower, compatible) {
+			return name
+		}
+	}
+	return withExtension(name, ext)
+}
+
+// Returns the last time the file was modified, by anyone or else by
+// the user. Drive reports the dates in RFC 3339, with or without the
+// fractional seconds, in any zone; they are normalized to UTC so that
+// they compare and stat alike whatever the zone of Drive and of the
+// host. Falls back to now if there is no valid date.
+func (d *CachedSyncer) modifiedTime(file *client.File) time.Time {
+	if t, ok := d.fileTime(file); ok {
+		return t
+	}
+	return time.Now().UTC()
+}
+
+// Returns the modification date of the file in UTC like modifiedTime,
+// false if it has none that parses.
+func (d *CachedSyncer) fileTime(file *client.File) (time.Time, bool) {
+	for _, date := range []string{file.ModifiedDate, file.ModifiedByMeDate} {
+		if date == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, date)
+		if err == nil {
+			return t.UTC(), true
+		}
+		d.opts.Logger.V("error parsing the modification date of", file.Id, err)
+	}
+	return time.Time{}, false
+}
+
+// Returns the creation date of the file in UTC like modifiedTime,
+// lastMod if it has none.
+func (d *CachedSyncer) createdTime(file *client.File, lastMod time.Time) time.Time {
+	if file.CreatedDate == "" {
+		return lastMod
+	}
+	t, err := time.Parse(time.RFC3339, file.CreatedDate)
+	if err != nil {
+		d.opts.Logger.V("error parsing the creation date of", file.Id, err)
+		return lastMod
+	}
+	return t.UTC()
+}
+
+// Returns a value that changes whenever the content of the file
+// changes. Binary files without a checksum, e.g. some large ones, are
+// versioned by their head revision, which changes with their content
+// only. Native Google docs have neither, their modification date is
+// used instead, which changes with their metadata too.
+func contentVersion(file *client.File) string {
+	if file.Md5Checksum != "" {
+		return file.Md5Checksum
+	}
+	if file.HeadRevisionId != "" {
+		return file.HeadRevisionId
 	}
+	return file.ModifiedDate
 }
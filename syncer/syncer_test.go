@@ -0,0 +1,3614 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rakyll/drivefuse/auth"
+	"github.com/rakyll/drivefuse/blob"
+	"github.com/rakyll/drivefuse/fileio"
+	"github.com/rakyll/drivefuse/metadata"
+	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/googleapi"
+	"github.com/rakyll/drivefuse/third_party/github.com/mattn/go-sqlite3"
+	T "github.com/rakyll/drivefuse/third_party/launchpad.net/gocheck"
+)
+
+// fakeDrive serves a minimal subset of the Drive API from memory.
+type fakeDrive struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	files    map[string]*client.File
+	changes  []*client.Change
+	pageSize int
+	requests []*url.URL
+
+	// Invoked before a changes page is served, if set.
+	onChanges func(query url.Values)
+
+	// Exported contents of native docs, and the number of export
+	// requests to fail with 503, keyed by file id.
+	exports        map[string]string
+	exportFailures map[string]int
+
+	// Uploaded contents keyed by file id, and the titles of the files
+	// whose uploads fail.
+	uploads        map[string]string
+	failingUploads map[string]bool
+	lastId         int
+
+	// Resumable upload sessions keyed by uri path, and the number of
+	// chunks to fail with 503, past the first chunk of an upload.
+	sessions      map[string]*fakeSession
+	chunkFailures int
+
+	// Errors served instead of the next changes pages.
+	changeFailures []fakeFailure
+
+	// Change feeds of the shared drives, keyed by drive id.
+	driveChanges map[string][]*client.Change
+
+	// Storage quota of the account reported by about, and the bytes
+	// used of it, in the trash and in total.
+	quotaTotal, quotaUsed, quotaInTrash int64
+
+	// If set, requests fail as if the network was down.
+	unreachable bool
+
+	// If set, the batch endpoint is not found.
+	batchUnavailable bool
+
+	// If set, requests fail as if the authorization was revoked.
+	unauthorized bool
+
+	// Ids of the channels watching the changes, in order, and of the
+	// stopped ones.
+	watches []*client.Channel
+	stopped []string
+}
+
+// fakeSession is a resumable upload to the fake drive.
+type fakeSession struct {
+	req      *http.Request // starting the session
+	file     *client.File
+	size     int64
+	received []byte
+}
+
+// fakeFailure is an error response of the fake drive.
+type fakeFailure struct {
+	code       int
+	reason     string
+	retryAfter string
+}
+
+func (e fakeFailure) serve(w http.ResponseWriter) {
+	if e.retryAfter != "" {
+		w.Header().Set("Retry-After", e.retryAfter)
+	}
+	w.WriteHeader(e.code)
+	fmt.Fprintf(w, `{"error": {"code": %d, "message": "failed", "errors": [{"reason": %q}]}}`, e.code, e.reason)
+}
+
+func newFakeDrive() *fakeDrive {
+	f := &fakeDrive{
+		files:          make(map[string]*client.File),
+		pageSize:       100,
+		exports:        make(map[string]string),
+		exportFailures: make(map[string]int),
+		uploads:        make(map[string]string),
+		failingUploads: make(map[string]bool),
+		driveChanges:   make(map[string][]*client.Change),
+		sessions:       make(map[string]*fakeSession),
+	}
+	f.files["root"] = &client.File{Id: "rootId", Title: "My Drive", MimeType: metadata.MimeTypeFolder}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+func (f *fakeDrive) Close() {
+	f.server.Close()
+}
+
+// Returns a Drive service whose requests are served by the fake.
+func (f *fakeDrive) service() *client.Service {
+	svc, _ := client.New(&http.Client{Transport: f})
+	return svc
+}
+
+// Redirects requests to the fake server.
+func (f *fakeDrive) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	unreachable, unauthorized := f.unreachable, f.unauthorized
+	f.mu.Unlock()
+	if unreachable {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("network is unreachable")}
+	}
+	if unauthorized {
+		return nil, fmt.Errorf("%w: token revoked", auth.ErrAuth)
+	}
+	u, _ := url.Parse(f.server.URL + req.URL.Path + "?" + req.URL.RawQuery)
+	r := req.Clone(req.Context())
+	r.URL = u
+	r.Host = u.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// Sets the hook invoked before a changes page is served.
+func (f *fakeDrive) setOnChanges(fn func(query url.Values)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onChanges = fn
+}
+
+// Sets the exported content of a doc, failing the given number of
+// export requests first.
+func (f *fakeDrive) setExport(id string, content string, failures int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.exports[id] = content
+	f.exportFailures[id] = failures
+}
+
+// Appends a change and assigns it the next change id.
+func (f *fakeDrive) addChange(item *client.Change) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	item.Id = int64(len(f.changes) + 1)
+	f.changes = append(f.changes, item)
+}
+
+// Appends a change to the feed of the shared drive and assigns it the
+// next change id of the feed.
+func (f *fakeDrive) addDriveChange(driveId string, item *client.Change) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	item.Id = int64(len(f.driveChanges[driveId]) + 1)
+	f.driveChanges[driveId] = append(f.driveChanges[driveId], item)
+}
+
+func (f *fakeDrive) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, req.URL)
+	f.mu.Unlock()
+
+	if strings.HasPrefix(req.URL.Path, "/drive/v3/files/") && strings.HasSuffix(req.URL.Path, "/export") {
+		f.serveExport(w, req)
+		return
+	}
+	if strings.HasPrefix(req.URL.Path, "/upload/sessions/") {
+		f.serveChunk(w, req)
+		return
+	}
+	if req.URL.Path == "/drive/v2/changes/watch" || req.URL.Path == "/drive/v2/channels/stop" {
+		f.serveChannel(w, req)
+		return
+	}
+	if req.URL.Path == "/batch/drive/v2" {
+		f.serveBatch(w, req)
+		return
+	}
+	if req.URL.Query().Get("uploadType") == "resumable" {
+		f.serveResumable(w, req)
+		return
+	}
+	if req.Method == "POST" && (strings.HasSuffix(req.URL.Path, "/trash") || strings.HasSuffix(req.URL.Path, "/untrash")) {
+		f.serveTrash(w, req)
+		return
+	}
+	if req.Method == "POST" || req.Method == "PUT" {
+		f.serveUpload(w, req)
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/drive/v2/")
+	switch {
+	case path == "changes":
+		f.serveChanges(w, req.URL.Query())
+	case path == "about":
+		f.mu.Lock()
+		about := &client.About{QuotaBytesTotal: f.quotaTotal, QuotaBytesUsed: f.quotaUsed, QuotaBytesUsedInTrash: f.quotaInTrash}
+		if n := len(f.changes); n > 0 {
+			about.LargestChangeId = f.changes[n-1].Id
+		}
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(about)
+	case strings.HasPrefix(path, "files/"):
+		f.serveFile(w, strings.TrimPrefix(path, "files/"))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (f *fakeDrive) serveFile(w http.ResponseWriter, id string) {
+	f.mu.Lock()
+	file, ok := f.files[id]
+	f.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": {"code": 404, "message": "File not found"}}`))
+		return
+	}
+	json.NewEncoder(w).Encode(file)
+}
+
+// Serves the gets of the files of a batch request, each in a part of
+// the response.
+func (f *fakeDrive) serveBatch(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	unavailable := f.batchUnavailable
+	f.mu.Unlock()
+	if unavailable {
+		http.NotFound(w, req)
+		return
+	}
+	_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r := multipart.NewReader(req.Body, params["boundary"])
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		sub, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil {
+			break
+		}
+		rec := httptest.NewRecorder()
+		f.serveFile(rec, strings.TrimPrefix(sub.URL.Path, "/drive/v2/files/"))
+		contentId := strings.Trim(part.Header.Get("Content-ID"), "<>")
+		out, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/http"}, "Content-Id": {"<response-" + contentId + ">"}})
+		fmt.Fprintf(out, "HTTP/1.1 %d %s\r\nContent-Type: application/json\r\n\r\n%s", rec.Code, http.StatusText(rec.Code), rec.Body.String())
+	}
+	mw.Close()
+}
+
+// Moves the file of the request to the trash of Drive or restores it
+// from there, and appends the change.
+func (f *fakeDrive) serveTrash(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := path.Base(path.Dir(req.URL.Path))
+	file, ok := f.files[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": {"code": 404, "message": "File not found"}}`))
+		return
+	}
+	file.Labels = &client.FileLabels{Trashed: path.Base(req.URL.Path) == "trash"}
+	f.changes = append(f.changes, &client.Change{Id: int64(len(f.changes) + 1), FileId: id, File: file})
+	json.NewEncoder(w).Encode(file)
+}
+
+// Watches the changes on the channel of the request, or stops it.
+func (f *fakeDrive) serveChannel(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	channel := &client.Channel{}
+	if err := json.NewDecoder(req.Body).Decode(channel); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if strings.HasSuffix(req.URL.Path, "/stop") {
+		f.stopped = append(f.stopped, channel.Id)
+		return
+	}
+	f.watches = append(f.watches, channel)
+	json.NewEncoder(w).Encode(&client.Channel{Kind: "api#channel", Id: channel.Id, ResourceId: "changes", Expiration: channel.Expiration})
+}
+
+// Returns the ids of the watched channels and of the stopped ones.
+func (f *fakeDrive) channels() (watched []string, stopped []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, channel := range f.watches {
+		watched = append(watched, channel.Id)
+	}
+	return watched, append([]string(nil), f.stopped...)
+}
+
+func (f *fakeDrive) serveExport(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/drive/v3/files/"), "/export")
+	content, ok := f.exports[id]
+	switch {
+	case !ok:
+		http.NotFound(w, req)
+	case req.URL.Query().Get("mimeType") == "":
+		w.WriteHeader(http.StatusBadRequest)
+	case f.exportFailures[id] > 0:
+		// still rendering
+		f.exportFailures[id]--
+		w.WriteHeader(http.StatusServiceUnavailable)
+	default:
+		w.Write([]byte(content))
+	}
+}
+
+// Creates a file on POST and updates it on PUT, from the metadata and
+// the media, if any, of the request.
+func (f *fakeDrive) serveUpload(w http.ResponseWriter, req *http.Request) {
+	file := &client.File{}
+	var content []byte
+	mediaType, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if strings.HasPrefix(mediaType, "multipart/") {
+		parts := multipart.NewReader(req.Body, params["boundary"])
+		part, err := parts.NextPart()
+		if err == nil {
+			err = json.NewDecoder(part).Decode(file)
+		}
+		if err == nil {
+			part, err = parts.NextPart()
+		}
+		if err == nil {
+			content, err = ioutil.ReadAll(part)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	} else if err := json.NewDecoder(req.Body).Decode(file); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.saveUpload(w, req, file, content)
+}
+
+// Creates or updates the file like serveUpload, with the content if
+// it is not nil.
+func (f *fakeDrive) saveUpload(w http.ResponseWriter, req *http.Request, file *client.File, content []byte) {
+	if f.failingUploads[file.Title] {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": {"code": 500, "message": "Backend Error"}}`))
+		return
+	}
+	if req.Method == "POST" {
+		f.lastId++
+		file.Id = fmt.Sprintf("pushed-%d", f.lastId)
+	} else {
+		file.Id = path.Base(req.URL.Path)
+		prev, ok := f.files[file.Id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"code": 404, "message": "File not found"}}`))
+			return
+		}
+		file.Md5Checksum = prev.Md5Checksum
+	}
+	if content != nil {
+		f.uploads[file.Id] = string(content)
+		file.Md5Checksum = fmt.Sprintf("%x", md5.Sum(content))
+		file.FileSize = int64(len(content))
+	}
+	file.Labels = &client.FileLabels{}
+	f.files[file.Id] = file
+	json.NewEncoder(w).Encode(file)
+}
+
+// Starts a resumable upload session of the file in the request.
+func (f *fakeDrive) serveResumable(w http.ResponseWriter, req *http.Request) {
+	file := &client.File{}
+	size, err := strconv.ParseInt(req.Header.Get("X-Upload-Content-Length"), 10, 64)
+	if err == nil {
+		err = json.NewDecoder(req.Body).Decode(file)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := fmt.Sprintf("/upload/sessions/%d", len(f.sessions)+1)
+	f.sessions[p] = &fakeSession{req: req, file: file, size: size}
+	w.Header().Set("Location", "https://www.googleapis.com"+p)
+}
+
+// Receives a chunk of a resumable upload, or tells the progress of the
+// upload if the request has no content.
+func (f *fakeDrive) serveChunk(w http.ResponseWriter, req *http.Request) {
+	chunk, _ := ioutil.ReadAll(req.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	session, ok := f.sessions[req.URL.Path]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	var start int64
+	if len(chunk) > 0 {
+		if _, err := fmt.Sscanf(req.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != int64(len(session.received)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if start > 0 && f.chunkFailures > 0 {
+		f.chunkFailures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	session.received = append(session.received, chunk...)
+	if int64(len(session.received)) < session.size {
+		if len(session.received) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(session.received)-1))
+		}
+		w.WriteHeader(308)
+		return
+	}
+	f.saveUpload(w, session.req, session.file, session.received)
+}
+
+func (f *fakeDrive) serveChanges(w http.ResponseWriter, query url.Values) {
+	f.mu.Lock()
+	onChanges := f.onChanges
+	f.mu.Unlock()
+	if onChanges != nil {
+		onChanges(query)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.changeFailures) > 0 {
+		failure := f.changeFailures[0]
+		f.changeFailures = f.changeFailures[1:]
+		failure.serve(w)
+		return
+	}
+	changes := f.changes
+	if driveId := query.Get("driveId"); driveId != "" {
+		changes = f.driveChanges[driveId]
+	}
+	start, _ := strconv.Atoi(query.Get("pageToken"))
+	if id, err := strconv.Atoi(query.Get("startChangeId")); err == nil && start == 0 {
+		start = id - 1
+	}
+	list := &client.ChangeList{}
+	for i := start; i < len(changes) && len(list.Items) < f.pageSize; i++ {
+		list.Items = append(list.Items, changes[i])
+		if i+1 < len(changes) && len(list.Items) == f.pageSize {
+			list.NextPageToken = strconv.Itoa(i + 1)
+		}
+	}
+	if n := len(changes); n > 0 {
+		list.LargestChangeId = changes[n-1].Id
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+type SyncerSuite struct {
+	drive       *fakeDrive
+	metaService *metadata.MetaService
+	syncer      *CachedSyncer
+}
+
+var _ = T.Suite(&SyncerSuite{})
+
+func (s *SyncerSuite) SetUpTest(c *T.C) {
+	dir := c.MkDir()
+	var err error
+	s.metaService, err = metadata.New(filepath.Join(dir, "meta.sql"), nil)
+	c.Assert(err, T.IsNil)
+	s.drive = newFakeDrive()
+	s.syncer = NewCachedSyncer(s.drive.service(), s.metaService, blob.New(filepath.Join(dir, "blob"), nil), nil)
+}
+
+func (s *SyncerSuite) TearDownTest(c *T.C) {
+	s.drive.Close()
+	s.metaService.Close()
+}
+
+// Returns the error of a sync, dropping its result.
+func syncErr(result *SyncResult, err error) error {
+	return err
+}
+
+// Builds a change for a folder with the given parent.
+func folderChange(id string, parentId string) *client.Change {
+	return &client.Change{
+		FileId: id,
+		File: &client.File{
+			Id:       id,
+			Title:    id,
+			MimeType: metadata.MimeTypeFolder,
+			Labels:   &client.FileLabels{},
+			Parents:  []*client.ParentReference{{Id: parentId}},
+		},
+	}
+}
+
+// Builds a change for a binary file in the root folder.
+func fileChange(id string, checksum string) *client.Change {
+	return &client.Change{
+		FileId: id,
+		File: &client.File{
+			Id:          id,
+			Title:       id,
+			MimeType:    "text/plain",
+			DownloadUrl: "https://example.com/" + id,
+			Md5Checksum: checksum,
+			FileSize:    int64(len(id)),
+			Labels:      &client.FileLabels{},
+			Parents:     []*client.ParentReference{{Id: "rootId"}},
+		},
+	}
+}
+
+// Builds a change for a native Google doc in the root folder, last
+// modified at the given date.
+func docChange(id string, modifiedDate string) *client.Change {
+	return &client.Change{
+		FileId: id,
+		File: &client.File{
+			Id:           id,
+			Title:        id,
+			MimeType:     "application/vnd.google-apps.document",
+			ModifiedDate: modifiedDate,
+			Labels:       &client.FileLabels{},
+			Parents:      []*client.ParentReference{{Id: "rootId"}},
+		},
+	}
+}
+
+// Returns the ids of the files queued for download.
+func (s *SyncerSuite) downloads(c *T.C) []string {
+	files, err := s.metaService.ListDownloads(100, 0, 1<<20)
+	c.Assert(err, T.IsNil)
+	ids := []string{}
+	for _, f := range files {
+		ids = append(ids, f.Id)
+	}
+	return ids
+}
+
+func (s *SyncerSuite) TestMoveCreatingCycleIsRefused(c *T.C) {
+	c.Assert(s.syncer.mergeChange("rootId", folderChange("a", "rootId")), T.IsNil)
+	c.Assert(s.syncer.mergeChange("rootId", folderChange("b", "a")), T.IsNil)
+	c.Assert(createsCycle(s.metaService.Get, "a", "b"), T.Equals, true)
+
+	c.Assert(s.syncer.mergeChange("rootId", folderChange("a", "b")), T.IsNil)
+	file, err := s.metaService.Get("a")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.ParentId, T.Equals, metadata.IdRootFolder)
+}
+
+func (s *SyncerSuite) TestMoveWithoutCycleIsApplied(c *T.C) {
+	c.Assert(s.syncer.mergeChange("rootId", folderChange("a", "rootId")), T.IsNil)
+	c.Assert(s.syncer.mergeChange("rootId", folderChange("b", "rootId")), T.IsNil)
+	c.Assert(s.syncer.mergeChange("rootId", folderChange("b", "a")), T.IsNil)
+	file, err := s.metaService.Get("b")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.ParentId, T.Equals, "a")
+}
+
+func (s *SyncerSuite) TestChangesPageSize(c *T.C) {
+	var mu sync.Mutex
+	sizes := []string{}
+	s.drive.setOnChanges(func(query url.Values) {
+		mu.Lock()
+		defer mu.Unlock()
+		sizes = append(sizes, query.Get("maxResults"))
+	})
+	s.drive.addChange(fileChange("file", "md5-1"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(sizes, T.DeepEquals, []string{strconv.Itoa(DefaultMaxResults)})
+
+	s.syncer.opts.MaxResults = 1000
+	s.drive.addChange(fileChange("other", "md5-2"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(sizes[1:], T.DeepEquals, []string{"1000"})
+
+	c.Assert((&SyncOptions{MaxResults: 5000}).withDefaults().MaxResults, T.Equals, int64(MaxResultsLimit))
+	c.Assert((&SyncOptions{MaxResults: -1}).withDefaults().MaxResults, T.Equals, int64(DefaultMaxResults))
+}
+
+func (s *SyncerSuite) TestRootIsFoundByItsDriveId(c *T.C) {
+	s.drive.addChange(fileChange("file", "md5-1"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	file, err := s.metaService.Get("file")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.ParentId, T.Equals, metadata.IdRootFolder)
+	children, err := s.metaService.GetAllChildren(metadata.IdRootFolder)
+	c.Assert(err, T.IsNil)
+	c.Assert(children, T.HasLen, 1)
+
+	// the id of My Drive on Drive is an alias of the root
+	root, err := s.metaService.Get("rootId")
+	c.Assert(err, T.IsNil)
+	c.Assert(root.Id, T.Equals, metadata.IdRootFolder)
+	_, err = s.metaService.Get("unknown")
+	c.Assert(err, T.Equals, metadata.ErrNotFound)
+}
+
+func (s *SyncerSuite) TestMovedFilesLeaveTheirFolders(c *T.C) {
+	root := &metadata.CachedDriveFile{Id: metadata.IdRootFolder, MimeType: metadata.MimeTypeFolder}
+	c.Assert(s.metaService.Save("", metadata.IdRootFolder, root, false, false), T.IsNil)
+	for _, id := range []string{"a", "b", "c"} {
+		c.Assert(s.syncer.mergeChange("rootId", folderChange(id, "rootId")), T.IsNil)
+	}
+	change := fileChange("file", "md5")
+	change.File.Parents = []*client.ParentReference{{Id: "a"}, {Id: "c"}}
+	c.Assert(s.syncer.mergeChange("rootId", change), T.IsNil)
+
+	change = fileChange("file", "md5")
+	change.File.Parents = []*client.ParentReference{{Id: "b"}}
+	c.Assert(s.syncer.mergeChange("rootId", change), T.IsNil)
+	for _, folder := range []string{"a", "c"} {
+		children, err := s.metaService.GetAllChildren(folder)
+		c.Assert(err, T.IsNil)
+		c.Assert(children, T.HasLen, 0, T.Commentf(folder))
+	}
+	file, err := s.metaService.Resolve("b/file")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.ParentId, T.Equals, "b")
+	others, err := s.metaService.OtherParents("file")
+	c.Assert(err, T.IsNil)
+	c.Assert(others, T.HasLen, 0)
+}
+
+func (s *SyncerSuite) TestFileAndFolderOfTheSameName(c *T.C) {
+	// synced in both orders, under different parents
+	root := &metadata.CachedDriveFile{Id: metadata.IdRootFolder, MimeType: metadata.MimeTypeFolder}
+	c.Assert(s.metaService.Save("", metadata.IdRootFolder, root, false, false), T.IsNil)
+	c.Assert(s.syncer.mergeChange("rootId", folderChange("first", "rootId")), T.IsNil)
+	c.Assert(s.syncer.mergeChange("rootId", folderChange("second", "rootId")), T.IsNil)
+	merge := func(parentId string, change *client.Change) {
+		change.File.Title = "report"
+		change.File.Parents = []*client.ParentReference{{Id: parentId}}
+		c.Assert(s.syncer.mergeChange("rootId", change), T.IsNil)
+	}
+	merge("first", folderChange("folder1", "first"))
+	merge("first", fileChange("file1", "md5"))
+	merge("second", fileChange("file2", "md5"))
+	merge("second", folderChange("folder2", "second"))
+
+	names := func(parent string) map[string]string {
+		children, err := s.metaService.GetAllChildren(parent)
+		c.Assert(err, T.IsNil)
+		byId := make(map[string]string)
+		for _, child := range children {
+			byId[child.Id] = child.Name
+			resolved, err := s.metaService.Resolve(parent + "/" + child.Name)
+			c.Assert(err, T.IsNil)
+			c.Assert(resolved.Id, T.Equals, child.Id)
+		}
+		return byId
+	}
+	first, second := names("first"), names("second")
+	// the folders keep the name whichever is synced first
+	c.Assert(first["folder1"], T.Equals, "report")
+	c.Assert(second["folder2"], T.Equals, "report")
+	c.Assert(first["file1"], T.Equals, uniqueName("report", "file1", DefaultMaxNameLength))
+	c.Assert(second["file2"], T.Equals, uniqueName("report", "file2", DefaultMaxNameLength))
+	c.Assert(first["file1"], T.Not(T.Equals), "report")
+
+	// names are stable across syncs of the same files
+	merge("first", fileChange("file1", "md5"))
+	merge("second", folderChange("folder2", "second"))
+	c.Assert(names("first"), T.DeepEquals, first)
+	c.Assert(names("second"), T.DeepEquals, second)
+}
+
+func (s *SyncerSuite) TestShortcutsAreSynced(c *T.C) {
+	shortcut := fileChange("shortcut", "")
+	shortcut.File.MimeType = metadata.MimeTypeShortcut
+	shortcut.File.DownloadUrl = ""
+	shortcut.File.ShortcutDetails = &client.FileShortcutDetails{TargetId: "target"}
+	c.Assert(s.syncer.mergeChange("rootId", shortcut), T.IsNil)
+	file, err := s.metaService.Get("shortcut")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.TargetId, T.Equals, "target")
+	// there is no content to download
+	c.Assert(s.downloads(c), T.HasLen, 0)
+}
+
+func (s *SyncerSuite) TestFilesWithoutDownloadUrlAreSynced(c *T.C) {
+	c.Assert(s.syncer.mergeChange("rootId", fileChange("linked", "md5")), T.IsNil)
+	change := fileChange("unlinked", "md5")
+	change.File.DownloadUrl = ""
+	c.Assert(s.syncer.mergeChange("rootId", change), T.IsNil)
+	c.Assert(s.downloads(c), T.DeepEquals, []string{"linked", "unlinked"})
+	file, err := s.metaService.Get("linked")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.DownloadUrl, T.Equals, "https://example.com/linked")
+}
+
+func (s *SyncerSuite) TestModificationTimesAreParsed(c *T.C) {
+	dates := map[string]string{
+		"fractional": "2013-09-19T14:29:12.570Z",
+		"whole":      "2013-09-19T14:29:12+02:00",
+	}
+	for id, date := range dates {
+		change := fileChange(id, "md5")
+		change.File.ModifiedDate = date
+		c.Assert(s.syncer.mergeChange("rootId", change), T.IsNil)
+	}
+	byMe := fileChange("by-me", "md5")
+	byMe.File.ModifiedByMeDate = "2013-09-20T08:00:00Z"
+	c.Assert(s.syncer.mergeChange("rootId", byMe), T.IsNil)
+	before := time.Now()
+	c.Assert(s.syncer.mergeChange("rootId", fileChange("undated", "md5")), T.IsNil)
+
+	expected := map[string]time.Time{
+		"fractional": time.Date(2013, 9, 19, 14, 29, 12, 570000000, time.UTC),
+		"whole":      time.Date(2013, 9, 19, 12, 29, 12, 0, time.UTC),
+		"by-me":      time.Date(2013, 9, 20, 8, 0, 0, 0, time.UTC),
+	}
+	for id, t := range expected {
+		file, err := s.metaService.Get(id)
+		c.Assert(err, T.IsNil)
+		c.Assert(file.LastMod.Equal(t), T.Equals, true, T.Commentf("%v: %v", id, file.LastMod))
+	}
+	undated, err := s.metaService.Get("undated")
+	c.Assert(err, T.IsNil)
+	c.Assert(undated.LastMod.Before(before.Add(-time.Second)), T.Equals, false)
+}
+
+func (s *SyncerSuite) TestCreationTimesAreParsed(c *T.C) {
+	created := fileChange("created", "md5")
+	created.File.CreatedDate = "2013-09-18T10:00:00Z"
+	created.File.ModifiedDate = "2013-09-19T14:29:12Z"
+	c.Assert(s.syncer.mergeChange("rootId", created), T.IsNil)
+	undated := fileChange("undated", "md5")
+	undated.File.ModifiedDate = "2013-09-19T14:29:12Z"
+	c.Assert(s.syncer.mergeChange("rootId", undated), T.IsNil)
+
+	file, err := s.metaService.Get("created")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Created.Equal(time.Date(2013, 9, 18, 10, 0, 0, 0, time.UTC)), T.Equals, true, T.Commentf("%v", file.Created))
+	file, err = s.metaService.Get("undated")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Created.Equal(file.LastMod), T.Equals, true, T.Commentf("%v", file.Created))
+}
+
+func (s *SyncerSuite) TestLargestChangeIdDoesNotRegress(c *T.C) {
+	s.drive.addChange(fileChange("a", "md5"))
+	s.drive.addChange(fileChange("b", "md5"))
+	// a later position is saved while the page is fetched, its largest
+	// id is lower
+	s.drive.setOnChanges(func(query url.Values) {
+		c.Check(s.metaService.SaveLargestChangeId(100), T.IsNil)
+	})
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	_, err := s.metaService.Get("b")
+	c.Assert(err, T.IsNil)
+	id, err := s.metaService.GetLargestChangeId()
+	c.Assert(err, T.IsNil)
+	c.Assert(id, T.Equals, int64(100))
+}
+
+func (s *SyncerSuite) TestTitlesAreSanitized(c *T.C) {
+	s.syncer.opts.Names = NamesWindows
+	slashed := fileChange("slashed", "md5")
+	slashed.File.Title = "a/b.txt"
+	reserved := fileChange("reserved", "md5")
+	reserved.File.Title = "con.txt"
+	for _, change := range []*client.Change{slashed, reserved} {
+		c.Assert(s.syncer.mergeChange("rootId", change), T.IsNil)
+	}
+	for id, name := range map[string]string{"slashed": "a_b.txt", "reserved": "con_.txt"} {
+		file, err := s.metaService.Get(id)
+		c.Assert(err, T.IsNil)
+		c.Assert(file.Name, T.Equals, name)
+	}
+
+	// the title is pushed back as it is on Drive
+	file, err := s.metaService.Get("slashed")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Title, T.Equals, "a/b.txt")
+	c.Assert(remoteOf(file).Title, T.Equals, "a/b.txt")
+}
+
+func (s *SyncerSuite) TestDatesAreStoredInUTC(c *T.C) {
+	change := fileChange("zoned", "md5")
+	change.File.ModifiedDate = "2013-09-19T14:29:12.5+05:30"
+	change.File.CreatedDate = "2013-09-18T22:00:00-07:00"
+	c.Assert(s.syncer.mergeChange("rootId", change), T.IsNil)
+
+	modified := time.Date(2013, 9, 19, 8, 59, 12, 500000000, time.UTC)
+	created := time.Date(2013, 9, 19, 5, 0, 0, 0, time.UTC)
+	built := s.syncer.buildMetadata("zoned", metadata.IdRootFolder, change.File)
+	file, err := s.metaService.Get("zoned")
+	c.Assert(err, T.IsNil)
+	for _, data := range []*metadata.CachedDriveFile{built, file} {
+		c.Assert(data.LastMod, T.Equals, modified)
+		c.Assert(data.Created, T.Equals, created)
+	}
+}
+
+func (s *SyncerSuite) TestFilesWithMultipleParents(c *T.C) {
+	root := &metadata.CachedDriveFile{Id: metadata.IdRootFolder, Name: "My Drive", MimeType: metadata.MimeTypeFolder}
+	c.Assert(s.metaService.Save("", metadata.IdRootFolder, root, false, false), T.IsNil)
+	c.Assert(s.syncer.mergeChange("rootId", folderChange("a", "rootId")), T.IsNil)
+	c.Assert(s.syncer.mergeChange("rootId", folderChange("b", "rootId")), T.IsNil)
+	change := fileChange("shared", "md5")
+	change.File.Parents = []*client.ParentReference{{Id: "a"}, {Id: "b"}, {Id: "rootId", IsRoot: true}}
+	c.Assert(s.syncer.mergeChange("rootId", change), T.IsNil)
+
+	// listed in each of its folders, saved under the root folder
+	for _, p := range []string{"shared", "a/shared", "b/shared"} {
+		file, err := s.metaService.Resolve(p)
+		c.Assert(err, T.IsNil, T.Commentf(p))
+		c.Assert(file.Id, T.Equals, "shared")
+		c.Assert(file.ParentId, T.Equals, metadata.IdRootFolder)
+	}
+	others, err := s.metaService.OtherParents("shared")
+	c.Assert(err, T.IsNil)
+	c.Assert(others, T.DeepEquals, []string{"a", "b"})
+
+	// removed from a folder
+	change = fileChange("shared", "md5")
+	change.File.Parents = []*client.ParentReference{{Id: "b"}, {Id: "a"}}
+	c.Assert(s.syncer.mergeChange("rootId", change), T.IsNil)
+	file, err := s.metaService.Resolve("b/shared")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.ParentId, T.Equals, "b")
+	_, err = s.metaService.Resolve("shared")
+	c.Assert(err, T.NotNil)
+	others, err = s.metaService.OtherParents("shared")
+	c.Assert(err, T.IsNil)
+	c.Assert(others, T.DeepEquals, []string{"a"})
+
+	// deleted from all of them
+	c.Assert(s.syncer.mergeChange("rootId", &client.Change{FileId: "shared", Deleted: true}), T.IsNil)
+	for _, folder := range []string{"a", "b"} {
+		children, err := s.metaService.GetAllChildren(folder)
+		c.Assert(err, T.IsNil)
+		c.Assert(children, T.HasLen, 0)
+	}
+
+	// files without parents are in no folder
+	orphan := fileChange("orphan", "md5")
+	orphan.File.Parents = nil
+	c.Assert(s.syncer.mergeChange("rootId", orphan), T.IsNil)
+	_, err = s.metaService.Resolve("orphan")
+	c.Assert(err, T.NotNil)
+}
+
+func (s *SyncerSuite) TestNamesConflictingInOtherParents(c *T.C) {
+	root := &metadata.CachedDriveFile{Id: metadata.IdRootFolder, Name: "My Drive", MimeType: metadata.MimeTypeFolder}
+	c.Assert(s.metaService.Save("", metadata.IdRootFolder, root, false, false), T.IsNil)
+	c.Assert(s.syncer.mergeChange("rootId", folderChange("folder", "rootId")), T.IsNil)
+	report := func(id string, parents ...string) *client.Change {
+		change := fileChange(id, "md5")
+		change.File.Title = "report.pdf"
+		change.File.Parents = nil
+		for _, parentId := range parents {
+			change.File.Parents = append(change.File.Parents, &client.ParentReference{Id: parentId})
+		}
+		return change
+	}
+	c.Assert(s.syncer.mergeChange("rootId", report("a-report", "folder")), T.IsNil)
+
+	// the conflict is in the other parent, the larger id yields
+	unique := uniqueName("report.pdf", "z-report", DefaultMaxNameLength)
+	for i := 0; i < 2; i++ {
+		c.Assert(s.syncer.mergeChange("rootId", report("z-report", "rootId", "folder")), T.IsNil)
+		for p, id := range map[string]string{"folder/report.pdf": "a-report", "folder/" + unique: "z-report", unique: "z-report"} {
+			file, err := s.metaService.Resolve(p)
+			c.Assert(err, T.IsNil, T.Commentf(p))
+			c.Assert(file.Id, T.Equals, id)
+		}
+	}
+	_, err := s.metaService.Resolve("report.pdf")
+	c.Assert(err, T.NotNil)
+
+	// a smaller id takes the name in all of the parents
+	c.Assert(s.syncer.mergeChange("rootId", report("0-report", "rootId", "folder")), T.IsNil)
+	file, err := s.metaService.Resolve("folder/report.pdf")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Id, T.Equals, "0-report")
+	file, err = s.metaService.Get("a-report")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Name, T.Equals, uniqueName("report.pdf", "a-report", DefaultMaxNameLength))
+}
+
+func (s *SyncerSuite) TestResetDuringSync(c *T.C) {
+	for i := 0; i < 5; i++ {
+		s.drive.addChange(folderChange("folder"+strconv.Itoa(i), "rootId"))
+	}
+	s.drive.pageSize = 1
+
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	s.drive.setOnChanges(func(query url.Values) {
+		if query.Get("pageToken") == "2" {
+			started <- true
+			<-release
+		}
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- syncErr(s.syncer.Sync(false))
+	}()
+	<-started
+
+	reset := make(chan error, 1)
+	go func() {
+		reset <- s.syncer.Reset()
+	}()
+	// Reset cancels the sync while the page is still being served,
+	// the sync gives up on it without waiting for the response
+	c.Assert(<-done, T.Equals, context.Canceled)
+	c.Assert(<-reset, T.IsNil)
+	close(release)
+
+	children, err := s.metaService.GetChildren(metadata.IdRootFolder)
+	c.Assert(err, T.IsNil)
+	c.Assert(children, T.HasLen, 0)
+	_, err = s.metaService.GetLargestChangeId()
+	c.Assert(err, T.NotNil)
+
+	s.drive.setOnChanges(func(query url.Values) {
+		if query.Get("pageToken") == "" {
+			c.Check(query.Get("startChangeId"), T.Equals, "")
+			c.Check(query.Get("includeDeleted"), T.Equals, "false")
+		}
+	})
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	children, err = s.metaService.GetChildren(metadata.IdRootFolder)
+	c.Assert(err, T.IsNil)
+	c.Assert(children, T.HasLen, 5)
+	id, err := s.metaService.GetLargestChangeId()
+	c.Assert(err, T.IsNil)
+	c.Assert(id, T.Equals, int64(5))
+}
+
+func (s *SyncerSuite) TestInterruptedFeedsAreResumed(c *T.C) {
+	for i := 0; i < 5; i++ {
+		s.drive.addChange(folderChange("folder"+strconv.Itoa(i), "rootId"))
+	}
+	s.drive.pageSize = 2
+	var queries []url.Values
+	s.drive.setOnChanges(func(query url.Values) {
+		queries = append(queries, query)
+		if query.Get("pageToken") == "2" && len(queries) == 2 {
+			// interrupted after the first page
+			s.drive.mu.Lock()
+			s.drive.changeFailures = []fakeFailure{{code: http.StatusForbidden, reason: "insufficientPermissions"}}
+			s.drive.mu.Unlock()
+		}
+	})
+	c.Assert(syncErr(s.syncer.Sync(false)), T.NotNil)
+	token, err := s.metaService.GetPageToken("")
+	c.Assert(err, T.IsNil)
+	c.Assert(token, T.Equals, "2")
+
+	queries = nil
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(queries, T.HasLen, 2)
+	c.Assert(queries[0].Get("pageToken"), T.Equals, "2")
+	c.Assert(queries[0].Get("startChangeId"), T.Equals, "")
+	children, err := s.metaService.GetChildren(metadata.IdRootFolder)
+	c.Assert(err, T.IsNil)
+	c.Assert(children, T.HasLen, 5)
+	// cleared once the feed is walked to its end
+	token, err = s.metaService.GetPageToken("")
+	c.Assert(err, T.IsNil)
+	c.Assert(token, T.Equals, "")
+}
+
+func (s *SyncerSuite) TestRejectedPageTokensStartOver(c *T.C) {
+	s.drive.addChange(folderChange("folder", "rootId"))
+	c.Assert(s.metaService.SavePageToken("", "expired"), T.IsNil)
+	s.drive.changeFailures = []fakeFailure{{code: http.StatusBadRequest, reason: "invalid"}}
+	var tokens []string
+	s.drive.setOnChanges(func(query url.Values) {
+		tokens = append(tokens, query.Get("pageToken"))
+	})
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(tokens, T.DeepEquals, []string{"expired", ""})
+	_, err := s.metaService.Get("folder")
+	c.Assert(err, T.IsNil)
+}
+
+func (s *SyncerSuite) TestExpiredChangeTokensAreReported(c *T.C) {
+	s.drive.addChange(folderChange("first", "rootId"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	s.drive.addChange(folderChange("second", "rootId"))
+	c.Assert(s.metaService.SavePageToken("", "expired"), T.IsNil)
+	// the token, then the change id it would start over from
+	s.drive.changeFailures = []fakeFailure{{code: http.StatusNotFound, reason: "notFound"}}
+	var queries []url.Values
+	s.drive.setOnChanges(func(query url.Values) {
+		queries = append(queries, query)
+	})
+	result, err := s.syncer.Sync(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(queries, T.HasLen, 2)
+	c.Assert(queries[0].Get("pageToken"), T.Equals, "expired")
+	c.Assert(queries[1].Get("pageToken"), T.Equals, "")
+	c.Assert(queries[1].Get("startChangeId"), T.Equals, "2")
+	c.Assert(result.Errors, T.HasLen, 1)
+	c.Assert(errors.Is(result.Errors[0], ErrChangeTokenExpired), T.Equals, true)
+	_, err = s.metaService.Get("second")
+	c.Assert(err, T.IsNil)
+	token, err := s.metaService.GetPageToken("")
+	c.Assert(err, T.IsNil)
+	c.Assert(token, T.Equals, "")
+
+	// the change id the sync starts from expired too, the whole feed is
+	// walked again
+	s.drive.addChange(folderChange("third", "rootId"))
+	c.Assert(s.metaService.SavePageToken("", "expired"), T.IsNil)
+	s.drive.changeFailures = []fakeFailure{{code: http.StatusBadRequest, reason: "invalid"}, {code: http.StatusBadRequest, reason: "invalid"}}
+	queries = nil
+	result, err = s.syncer.Sync(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(queries, T.HasLen, 3)
+	c.Assert(queries[1].Get("startChangeId"), T.Equals, "3")
+	c.Assert(queries[2].Get("pageToken"), T.Equals, "")
+	c.Assert(queries[2].Get("startChangeId"), T.Equals, "")
+	c.Assert(result.Errors, T.HasLen, 2)
+	_, err = s.metaService.Get("third")
+	c.Assert(err, T.IsNil)
+}
+
+func (s *SyncerSuite) TestOnlyTheConfiguredFoldersAreSynced(c *T.C) {
+	s.syncer.opts.FolderIds = []string{"project"}
+	inFolder := func(item *client.Change, parentId string) *client.Change {
+		item.File.Parents = []*client.ParentReference{{Id: parentId}}
+		return item
+	}
+	// children first, they are deferred until their folders are synced
+	s.drive.addChange(inFolder(fileChange("file", "md5-1"), "sub"))
+	s.drive.addChange(folderChange("sub", "project"))
+	s.drive.addChange(folderChange("projects", "rootId"))
+	s.drive.addChange(folderChange("project", "projects"))
+	s.drive.addChange(folderChange("other", "rootId"))
+	s.drive.addChange(inFolder(fileChange("other-file", "md5-2"), "other"))
+	result, err := s.syncer.Sync(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(result.FilesAdded, T.Equals, 3)
+	file, err := s.metaService.Resolve("project/sub/file")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Id, T.Equals, "file")
+	for _, id := range []string{"projects", "other", "other-file"} {
+		_, err = s.metaService.Get(id)
+		c.Assert(err, T.NotNil)
+	}
+
+	// moved out of and into the folder
+	s.drive.addChange(inFolder(fileChange("file", "md5-1"), "other"))
+	s.drive.addChange(inFolder(fileChange("other-file", "md5-2"), "project"))
+	result, err = s.syncer.Sync(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(result.FilesAdded, T.Equals, 1)
+	c.Assert(result.FilesDeleted, T.Equals, 1)
+	_, err = s.metaService.Get("file")
+	c.Assert(err, T.NotNil)
+	_, err = s.metaService.Resolve("project/other-file")
+	c.Assert(err, T.IsNil)
+}
+
+// Builds a change for a binary file of the mime type in the folder.
+func typedChange(id string, mimeType string, parentId string) *client.Change {
+	item := fileChange(id, "md5-"+id)
+	item.File.MimeType = mimeType
+	item.File.Parents = []*client.ParentReference{{Id: parentId}}
+	return item
+}
+
+func (s *SyncerSuite) TestFilesAreFilteredByMimeType(c *T.C) {
+	var err error
+	s.syncer.opts.MimeTypes, err = ParseMimeTypes("image/*, application/pdf")
+	c.Assert(err, T.IsNil)
+	s.syncer.opts.ExcludeMimeTypes = []string{"image/gif"}
+	_, err = ParseMimeTypes("image/[")
+	c.Assert(err, T.NotNil)
+
+	s.drive.addChange(folderChange("photos", "rootId"))
+	s.drive.addChange(typedChange("photo", "image/PNG", "photos"))
+	s.drive.addChange(typedChange("animation", "image/gif", "photos"))
+	s.drive.addChange(typedChange("paper", "application/pdf", "rootId"))
+	s.drive.addChange(typedChange("notes", "text/plain", "photos"))
+	result, err := s.syncer.Sync(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(result.FilesAdded, T.Equals, 3)
+	c.Assert(result.FilesFiltered, T.Equals, 2)
+	for _, p := range []string{"photos/photo", "paper"} {
+		_, err = s.metaService.Resolve(p)
+		c.Assert(err, T.IsNil, T.Commentf(p))
+	}
+	for _, id := range []string{"animation", "notes"} {
+		_, err = s.metaService.Get(id)
+		c.Assert(err, T.NotNil)
+	}
+	c.Assert(s.downloads(c), T.DeepEquals, []string{"photo", "paper"})
+
+	// a synced file turning into a filtered out type is removed
+	s.drive.addChange(typedChange("photo", "video/mp4", "photos"))
+	result, err = s.syncer.Sync(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(result.FilesFiltered, T.Equals, 1)
+	c.Assert(result.FilesDeleted, T.Equals, 1)
+	_, err = s.metaService.Get("photo")
+	c.Assert(err, T.NotNil)
+}
+
+func (s *SyncerSuite) TestEmptyFoldersArePruned(c *T.C) {
+	s.syncer.opts.MimeTypes = []string{"image/*"}
+	s.syncer.opts.PruneEmptyFolders = true
+	for _, item := range []*client.Change{
+		folderChange("docs", "rootId"),
+		typedChange("notes", "text/plain", "docs"),
+		folderChange("photos", "rootId"),
+		folderChange("2024", "photos"),
+		typedChange("photo", "image/png", "2024"),
+		folderChange("empty", "rootId"),
+		folderChange("inner", "empty"),
+	} {
+		s.drive.files[item.FileId] = item.File
+		s.drive.addChange(item)
+	}
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	_, err := s.metaService.Resolve("photos/2024/photo")
+	c.Assert(err, T.IsNil)
+	for _, id := range []string{"docs", "empty", "inner"} {
+		_, err = s.metaService.Get(id)
+		c.Assert(err, T.NotNil, T.Commentf(id))
+	}
+
+	// the pruned folders are restored for the files synced into them
+	s.drive.files["nested"] = folderChange("nested", "empty").File
+	s.drive.addChange(typedChange("scan", "image/jpeg", "docs"))
+	s.drive.addChange(folderChange("nested", "empty"))
+	s.drive.addChange(typedChange("drawing", "image/svg+xml", "inner"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	for _, p := range []string{"docs/scan", "empty/inner/drawing"} {
+		_, err = s.metaService.Resolve(p)
+		c.Assert(err, T.IsNil, T.Commentf(p))
+	}
+	_, err = s.metaService.Get("nested")
+	c.Assert(err, T.NotNil)
+
+	// and pruned again once they are emptied
+	s.drive.addChange(typedChange("drawing", "text/plain", "inner"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	_, err = s.metaService.Get("empty")
+	c.Assert(err, T.NotNil)
+	_, err = s.metaService.Get("docs")
+	c.Assert(err, T.IsNil)
+}
+
+func (s *SyncerSuite) TestChangeListOptions(c *T.C) {
+	var queries []url.Values
+	s.drive.setOnChanges(func(query url.Values) {
+		queries = append(queries, query)
+	})
+	s.drive.addChange(folderChange("folder", "rootId"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(queries, T.HasLen, 2)
+	// the initial sync lists no deletions, subscribed files are left out
+	c.Assert(queries[0].Get("includeDeleted"), T.Equals, "false")
+	c.Assert(queries[0].Get("includeSubscribed"), T.Equals, "false")
+	c.Assert(queries[1].Get("includeDeleted"), T.Equals, "")
+
+	s.syncer.opts.IncludeSubscribed = true
+	s.syncer.opts.IncludeDeletedInitially = true
+	c.Assert(s.syncer.Reset(), T.IsNil)
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(queries, T.HasLen, 3)
+	c.Assert(queries[2].Get("includeDeleted"), T.Equals, "")
+	c.Assert(queries[2].Get("includeSubscribed"), T.Equals, "true")
+}
+
+func (s *SyncerSuite) TestConcurrentSyncsDontWait(c *T.C) {
+	s.drive.addChange(folderChange("folder", "rootId"))
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	s.drive.setOnChanges(func(query url.Values) {
+		select {
+		case started <- true:
+		default:
+		}
+		<-release
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- syncErr(s.syncer.Sync(false))
+	}()
+	<-started
+
+	result, err := s.syncer.Sync(true)
+	c.Assert(err, T.Equals, ErrSyncInProgress)
+	c.Assert(result, T.DeepEquals, &SyncResult{})
+	close(release)
+	c.Assert(<-done, T.IsNil)
+
+	s.drive.setOnChanges(nil)
+	c.Assert(syncErr(s.syncer.Sync(true)), T.IsNil)
+}
+
+func (s *SyncerSuite) TestSyncOnce(c *T.C) {
+	var _ Syncer = s.syncer
+	s.drive.addChange(folderChange("folder", "rootId"))
+	result, err := s.syncer.SyncOnce(context.Background())
+	c.Assert(err, T.IsNil)
+	c.Assert(result.FilesAdded, T.Equals, 1)
+
+	// incremental, only the new changes are merged
+	s.drive.addChange(fileChange("file", "md5-1"))
+	result, err = s.syncer.SyncOnce(context.Background())
+	c.Assert(err, T.IsNil)
+	c.Assert(result.ChangesProcessed, T.Equals, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.drive.addChange(fileChange("other", "md5-2"))
+	_, err = s.syncer.SyncOnce(ctx)
+	c.Assert(err, T.Equals, context.Canceled)
+}
+
+func (s *SyncerSuite) TestResetAndResync(c *T.C) {
+	s.drive.addChange(folderChange("folder", "rootId"))
+	s.drive.addChange(fileChange("file", "md5-1"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	blobs := s.syncer.blobManager
+	c.Assert(blobs.Save("file", "md5-1", ioutil.NopCloser(strings.NewReader("file"))), T.IsNil)
+
+	var starts []string
+	s.drive.setOnChanges(func(query url.Values) {
+		starts = append(starts, query.Get("startChangeId"))
+	})
+	result, err := s.syncer.ResetAndResync(context.Background(), false)
+	c.Assert(err, T.IsNil)
+	// synced from the start again
+	c.Assert(starts, T.DeepEquals, []string{""})
+	c.Assert(result, T.DeepEquals, &SyncResult{
+		FilesAdded:       2,
+		BytesQueued:      int64(len("file")),
+		ChangesProcessed: 2,
+		Classes:          map[FileClass]int{ClassFolder: 1, ClassDownloadable: 1},
+		NewChangeId:      2,
+	})
+	_, ok := blobs.Stat("file")
+	c.Assert(ok, T.Equals, true)
+
+	result, err = s.syncer.ResetAndResync(context.Background(), true)
+	c.Assert(err, T.IsNil)
+	c.Assert(result.FilesAdded, T.Equals, 2)
+	_, ok = blobs.Stat("file")
+	c.Assert(ok, T.Equals, false)
+	c.Assert(blobs.CacheSize(), T.Equals, int64(0))
+	_, err = s.metaService.Resolve("folder")
+	c.Assert(err, T.IsNil)
+
+	s.syncer.SetOffline(true)
+	_, err = s.syncer.ResetAndResync(context.Background(), true)
+	c.Assert(err, T.Equals, ErrOffline)
+	_, err = s.metaService.Resolve("folder")
+	c.Assert(err, T.IsNil)
+}
+
+// Makes the first failures batches fail as if the database was locked.
+func (s *SyncerSuite) lockBatches(failures int) (delays *[]time.Duration) {
+	delays = &[]time.Duration{}
+	s.syncer.sleep = func(d time.Duration) {
+		*delays = append(*delays, d)
+	}
+	s.syncer.batch = func(fn func(b *metadata.Batch) error) error {
+		if failures > 0 {
+			failures--
+			return sqlite3.ErrBusy
+		}
+		return s.syncer.pageBatch(fn)
+	}
+	return
+}
+
+func (s *SyncerSuite) TestSyncResult(c *T.C) {
+	s.drive.addChange(folderChange("folder", "rootId"))
+	s.drive.addChange(fileChange("file", "md5-1"))
+	s.drive.addChange(fileChange("other", "md5-2"))
+	result, err := s.syncer.Sync(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(result, T.DeepEquals, &SyncResult{
+		FilesAdded:       3,
+		BytesQueued:      int64(len("file") + len("other")),
+		ChangesProcessed: 3,
+		Classes:          map[FileClass]int{ClassFolder: 1, ClassDownloadable: 2},
+		NewChangeId:      3,
+	})
+
+	s.drive.addChange(fileChange("file", "md5-3"))
+	s.drive.addChange(&client.Change{FileId: "folder", Deleted: true})
+	// never synced, nothing to delete
+	s.drive.addChange(&client.Change{FileId: "unknown", Deleted: true})
+	result, err = s.syncer.Sync(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(result, T.DeepEquals, &SyncResult{
+		FilesUpdated:     1,
+		FilesDeleted:     1,
+		BytesQueued:      int64(len("file")),
+		ChangesProcessed: 3,
+		Classes:          map[FileClass]int{ClassDownloadable: 1},
+		NewChangeId:      6,
+	})
+}
+
+func (s *SyncerSuite) TestSyncStats(c *T.C) {
+	c.Assert(s.syncer.Stats(), T.DeepEquals, SyncStats{})
+	s.drive.addChange(folderChange("folder", "rootId"))
+	s.drive.addChange(fileChange("file", "md5-1"))
+	s.drive.addChange(fileChange("other", "md5-2"))
+	before := time.Now()
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	stats := s.syncer.Stats()
+	c.Assert(stats.Syncs, T.Equals, int64(1))
+	c.Assert(stats.Failures, T.Equals, int64(0))
+	c.Assert(stats.FilesQueued, T.Equals, int64(2))
+	c.Assert(stats.BytesQueued, T.Equals, int64(len("file")+len("other")))
+	c.Assert(stats.ChangeId, T.Equals, int64(3))
+	c.Assert(stats.LastSuccess.Before(before), T.Equals, false)
+
+	s.drive.addChange(fileChange("file", "md5-3"))
+	s.drive.mu.Lock()
+	s.drive.changeFailures = []fakeFailure{{code: http.StatusForbidden, reason: "insufficientPermissions"}}
+	s.drive.mu.Unlock()
+	c.Assert(syncErr(s.syncer.Sync(false)), T.NotNil)
+	failed := s.syncer.Stats()
+	c.Assert(failed.Syncs, T.Equals, int64(2))
+	c.Assert(failed.Failures, T.Equals, int64(1))
+	c.Assert(failed.FilesQueued, T.Equals, int64(2))
+	c.Assert(failed.ChangeId, T.Equals, int64(3))
+	c.Assert(failed.LastSuccess, T.Equals, stats.LastSuccess)
+
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	stats = s.syncer.Stats()
+	c.Assert(stats.Syncs, T.Equals, int64(3))
+	c.Assert(stats.FilesQueued, T.Equals, int64(3))
+	c.Assert(stats.ChangeId, T.Equals, int64(4))
+	metrics := stats.Metrics()
+	c.Assert(metrics["drivefuse_syncs_total"], T.Equals, float64(3))
+	c.Assert(metrics["drivefuse_sync_failures_total"], T.Equals, float64(1))
+}
+
+func (s *SyncerSuite) TestQuotaIsCheckedByFullSyncs(c *T.C) {
+	s.syncer.blobManager = blob.New(c.MkDir(), &blob.Options{MaxSize: 1000})
+	s.drive.mu.Lock()
+	s.drive.quotaTotal, s.drive.quotaUsed, s.drive.quotaInTrash = 1e6, 5000, 3000
+	s.drive.mu.Unlock()
+	warnings := func() []SyncEvent {
+		found := []SyncEvent{}
+		for _, e := range s.events() {
+			if e.Kind == QuotaWarning {
+				found = append(found, e)
+			}
+		}
+		return found
+	}
+	s.drive.addChange(fileChange("file", "md5-1"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	stats := s.syncer.Stats()
+	c.Assert(stats.QuotaTotal, T.Equals, int64(1e6))
+	c.Assert(stats.QuotaUsed, T.Equals, int64(2000))
+	found := warnings()
+	c.Assert(found, T.HasLen, 1)
+	c.Assert(found[0].Bytes, T.Equals, int64(2000))
+	c.Assert(found[0].Total, T.Equals, int64(1000))
+
+	// incremental syncs don't fetch the quota again
+	s.drive.mu.Lock()
+	s.drive.quotaUsed = 9000
+	s.drive.mu.Unlock()
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(s.syncer.Stats().QuotaUsed, T.Equals, int64(2000))
+	c.Assert(warnings(), T.HasLen, 0)
+
+	// the cache fits the contents
+	s.drive.mu.Lock()
+	s.drive.quotaUsed = 3500
+	s.drive.mu.Unlock()
+	c.Assert(syncErr(s.syncer.Sync(true)), T.IsNil)
+	c.Assert(s.syncer.Stats().QuotaUsed, T.Equals, int64(500))
+	c.Assert(warnings(), T.HasLen, 0)
+}
+
+func (s *SyncerSuite) TestOtherErrorsAreReported(c *T.C) {
+	pending := []error{errors.New("hook failed")}
+	s.syncer.opts.Errors = func() []error {
+		errs := pending
+		pending = nil
+		return errs
+	}
+	s.drive.addChange(fileChange("file", "md5-1"))
+	result, err := s.syncer.Sync(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(result.Errors, T.DeepEquals, []error{errors.New("hook failed")})
+
+	result, err = s.syncer.Sync(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(result.Errors, T.HasLen, 0)
+}
+
+func (s *SyncerSuite) TestChangedContentIsReadStale(c *T.C) {
+	s.drive.addChange(fileChange("file", "md5-1"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(s.syncer.blobManager.Save("file", "md5-1", ioutil.NopCloser(strings.NewReader("file"))), T.IsNil)
+	c.Assert(s.metaService.InitFile("file"), T.IsNil)
+	c.Assert(s.metaService.DequeueFromIO("download", "file"), T.IsNil)
+
+	s.drive.addChange(fileChange("file", "md5-2"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(s.downloads(c), T.DeepEquals, []string{"file"})
+	// still listed, with the content cached before
+	file, err := s.metaService.LookUp(metadata.IdRootFolder, "file")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Md5Checksum, T.Equals, "md5-2")
+	c.Assert(file.ActiveChecksum(), T.Equals, "md5-1")
+	c.Assert(s.syncer.blobManager.Exists("file", "md5-1"), T.Equals, true)
+
+	// changed again before it is downloaded
+	s.drive.addChange(fileChange("file", "md5-3"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	file, err = s.metaService.Get("file")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.ActiveChecksum(), T.Equals, "md5-1")
+
+	// nothing cached to read meanwhile
+	s.drive.addChange(fileChange("other", "md5-4"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	s.drive.addChange(fileChange("other", "md5-5"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	file, err = s.metaService.Get("other")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.StaleChecksum, T.Equals, "")
+}
+
+func (s *SyncerSuite) TestDryRunsChangeNothing(c *T.C) {
+	s.drive.addChange(fileChange("kept", "md5-1"))
+	s.drive.addChange(fileChange("gone", "md5-2"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(s.syncer.blobManager.Save("gone", "md5-2", ioutil.NopCloser(strings.NewReader("gone"))), T.IsNil)
+	c.Assert(s.metaService.InitFile("gone"), T.IsNil)
+	downloads := s.downloads(c)
+
+	s.drive.addChange(fileChange("kept", "md5-3"))
+	s.drive.addChange(&client.Change{FileId: "gone", Deleted: true})
+	s.drive.addChange(folderChange("folder", "rootId"))
+	child := fileChange("child", "md5-4")
+	child.File.Parents = []*client.ParentReference{{Id: "folder"}}
+	s.drive.addChange(child)
+	s.drive.pageSize = 2
+	s.syncer.opts.DryRun = true
+	result, err := s.syncer.Sync(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(result, T.DeepEquals, &SyncResult{
+		FilesAdded:       2,
+		FilesUpdated:     1,
+		FilesDeleted:     1,
+		BytesQueued:      int64(len("kept") + len("child")),
+		ChangesProcessed: 4,
+		Classes:          map[FileClass]int{ClassFolder: 1, ClassDownloadable: 2},
+		NewChangeId:      2,
+	})
+	kept, err := s.metaService.Get("kept")
+	c.Assert(err, T.IsNil)
+	c.Assert(kept.Md5Checksum, T.Equals, "md5-1")
+	_, err = s.metaService.Get("gone")
+	c.Assert(err, T.IsNil)
+	c.Assert(s.syncer.blobManager.Exists("gone", "md5-2"), T.Equals, true)
+	_, err = s.metaService.Get("folder")
+	c.Assert(err, T.NotNil)
+	c.Assert(s.downloads(c), T.DeepEquals, downloads)
+	token, err := s.metaService.GetPageToken("")
+	c.Assert(err, T.IsNil)
+	c.Assert(token, T.Equals, "")
+
+	s.syncer.opts.DryRun = false
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	_, err = s.metaService.Get("child")
+	c.Assert(err, T.IsNil)
+	id, _ := s.metaService.GetLargestChangeId()
+	c.Assert(id, T.Equals, int64(6))
+}
+
+// Returns the events published so far.
+func (s *SyncerSuite) events() []SyncEvent {
+	events := []SyncEvent{}
+	for {
+		select {
+		case e := <-s.syncer.Events():
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func (s *SyncerSuite) TestSyncEvents(c *T.C) {
+	s.drive.addChange(folderChange("folder", "rootId"))
+	s.drive.addChange(fileChange("file", "md5-1"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	s.drive.addChange(&client.Change{FileId: "folder", Deleted: true})
+	result, err := s.syncer.Sync(false)
+	c.Assert(err, T.IsNil)
+
+	c.Assert(s.events(), T.DeepEquals, []SyncEvent{
+		{Kind: SyncStarted},
+		{Kind: FileSynced, Id: "folder", Name: "folder"},
+		{Kind: FileSynced, Id: "file", Name: "file", Bytes: int64(len("file"))},
+		{Kind: PageProcessed, ChangeId: 2, Progress: SyncProgress{Initial: true, Processed: 2, Total: 2}},
+		{Kind: SyncFinished, Result: &SyncResult{FilesAdded: 2, BytesQueued: 4, ChangesProcessed: 2, Classes: map[FileClass]int{ClassFolder: 1, ClassDownloadable: 1}, NewChangeId: 2}},
+		{Kind: SyncStarted},
+		{Kind: FileDeleted, Id: "folder", Name: "folder"},
+		{Kind: PageProcessed, ChangeId: 3, Progress: SyncProgress{Processed: 1}},
+		{Kind: SyncFinished, Result: result},
+	})
+}
+
+func (s *SyncerSuite) TestInitialSyncReportsProgress(c *T.C) {
+	for i := 0; i < 10; i++ {
+		s.drive.addChange(fileChange(fmt.Sprintf("file%d", i), "md5"))
+	}
+	s.drive.pageSize = 3
+	var during []SyncProgress
+	s.drive.setOnChanges(func(query url.Values) {
+		during = append(during, s.syncer.Stats().Progress)
+	})
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(during, T.DeepEquals, []SyncProgress{
+		{Initial: true},
+		{Initial: true, Processed: 3, Total: 10},
+		{Initial: true, Processed: 6, Total: 10},
+		{Initial: true, Processed: 9, Total: 10},
+	})
+	progress := []SyncProgress{}
+	for _, e := range s.events() {
+		if e.Kind == PageProcessed {
+			progress = append(progress, e.Progress)
+		}
+	}
+	c.Assert(progress[len(progress)-1], T.DeepEquals, SyncProgress{Initial: true, Processed: 10, Total: 10})
+	fraction, ok := progress[0].Fraction()
+	c.Assert(ok, T.Equals, true)
+	c.Assert(fraction, T.Equals, 0.3)
+	c.Assert(s.syncer.Stats().Progress, T.DeepEquals, SyncProgress{})
+
+	// the total of the later syncs is unknown
+	s.drive.setOnChanges(nil)
+	s.drive.addChange(fileChange("file0", "md5-2"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	for _, e := range s.events() {
+		if e.Kind == PageProcessed {
+			c.Assert(e.Progress, T.DeepEquals, SyncProgress{Processed: 1})
+			_, ok = e.Progress.Fraction()
+			c.Assert(ok, T.Equals, false)
+		}
+	}
+}
+
+func (s *SyncerSuite) invalidations() []InvalidateEvent {
+	invalidations := []InvalidateEvent{}
+	for {
+		select {
+		case e := <-s.syncer.Invalidations():
+			invalidations = append(invalidations, e)
+		default:
+			return invalidations
+		}
+	}
+}
+
+func (s *SyncerSuite) TestMergedChangesAreInvalidated(c *T.C) {
+	s.drive.addChange(folderChange("folder", "rootId"))
+	s.drive.addChange(fileChange("file", "md5-1"))
+	s.drive.addChange(fileChange("other", "md5-2"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(s.invalidations(), T.DeepEquals, []InvalidateEvent{
+		{FileId: "folder", ParentId: metadata.IdRootFolder, Kind: InvalidateEntry},
+		{FileId: "file", ParentId: metadata.IdRootFolder, Kind: InvalidateEntry},
+		{FileId: "other", ParentId: metadata.IdRootFolder, Kind: InvalidateEntry},
+	})
+
+	s.drive.addChange(fileChange("file", "md5-3"))
+	moved := fileChange("other", "md5-2")
+	moved.File.Parents = []*client.ParentReference{{Id: "folder"}}
+	s.drive.addChange(moved)
+	s.drive.addChange(&client.Change{FileId: "folder", Deleted: true})
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(s.invalidations(), T.DeepEquals, []InvalidateEvent{
+		{FileId: "file", ParentId: metadata.IdRootFolder, Kind: InvalidateAttr},
+		{FileId: "other", ParentId: "folder", Kind: InvalidateAttr},
+		{FileId: "other", ParentId: metadata.IdRootFolder, Kind: InvalidateEntry},
+		{FileId: "other", ParentId: "folder", Kind: InvalidateEntry},
+		{FileId: "folder", ParentId: metadata.IdRootFolder, Kind: InvalidateEntry},
+	})
+}
+
+func (s *SyncerSuite) TestEventsDontBlockTheSync(c *T.C) {
+	s.syncer.events = make(chan SyncEvent, 1)
+	for i := 0; i < 5; i++ {
+		s.drive.addChange(folderChange("folder"+strconv.Itoa(i), "rootId"))
+	}
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(s.events(), T.DeepEquals, []SyncEvent{{Kind: SyncStarted}})
+}
+
+func (s *SyncerSuite) TestFailedChangesAreSkipped(c *T.C) {
+	s.drive.addChange(folderChange("folder", "rootId"))
+	s.drive.addChange(fileChange("file", "md5-1"))
+	s.drive.addChange(fileChange("other", "md5-2"))
+	failure := errors.New("disk I/O error")
+	batches := 0
+	s.syncer.batch = func(fn func(b *metadata.Batch) error) error {
+		// the first batch saves the root folder
+		if batches++; batches == 3 {
+			return failure
+		}
+		return s.syncer.pageBatch(fn)
+	}
+	result, err := s.syncer.Sync(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(result.FilesAdded, T.Equals, 2)
+	c.Assert(result.NewChangeId, T.Equals, int64(3))
+	c.Assert(result.Errors, T.HasLen, 1)
+	c.Assert(errors.Is(result.Errors[0], failure), T.Equals, true)
+	_, err = s.metaService.Get("file")
+	c.Assert(err, T.NotNil)
+	_, err = s.metaService.Get("other")
+	c.Assert(err, T.IsNil)
+}
+
+func (s *SyncerSuite) TestFailedPagesAreRolledBack(c *T.C) {
+	s.drive.addChange(folderChange("folder", "rootId"))
+	s.drive.addChange(fileChange("file", "md5-1"))
+	s.drive.addChange(fileChange("other", "md5-2"))
+	s.syncer.sleep = func(time.Duration) {}
+	locked, batches := true, 0
+	s.syncer.batch = func(fn func(b *metadata.Batch) error) error {
+		if batches++; locked && batches > 1 {
+			// stays locked for the changes after the first one
+			return sqlite3.ErrBusy
+		}
+		return s.syncer.pageBatch(fn)
+	}
+	c.Assert(syncErr(s.syncer.Sync(false)), T.Equals, sqlite3.ErrBusy)
+	_, err := s.metaService.Get("folder")
+	c.Assert(err, T.NotNil)
+	id, _ := s.metaService.GetLargestChangeId()
+	c.Assert(id, T.Equals, int64(0))
+
+	locked = false
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	for _, id := range []string{"folder", "file", "other"} {
+		_, err = s.metaService.Get(id)
+		c.Assert(err, T.IsNil)
+	}
+	id, _ = s.metaService.GetLargestChangeId()
+	c.Assert(id, T.Equals, int64(3))
+}
+
+func (s *SyncerSuite) TestSyncRetriesWhileMetadataIsLocked(c *T.C) {
+	delays := s.lockBatches(2)
+	s.drive.addChange(folderChange("folder", "rootId"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	_, err := s.metaService.Get("folder")
+	c.Assert(err, T.IsNil)
+	c.Assert(*delays, T.DeepEquals, []time.Duration{busyRetryDelay, 2 * busyRetryDelay})
+}
+
+func (s *SyncerSuite) TestSyncFailsOnceMetadataLockRetriesRunOut(c *T.C) {
+	s.syncer.opts.BusyAttempts = 2
+	delays := s.lockBatches(2)
+	s.drive.addChange(folderChange("folder", "rootId"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.Equals, sqlite3.ErrBusy)
+	c.Assert(*delays, T.HasLen, 1)
+	_, err := s.metaService.Get("folder")
+	c.Assert(err, T.NotNil)
+}
+
+func (s *SyncerSuite) TestSyncOfFileIds(c *T.C) {
+	s.syncer.opts.FileIds = []string{"wanted", "removed", "unknown"}
+	for _, id := range []string{"wanted", "removed", "other"} {
+		change := fileChange(id, "md5")
+		change.File.Parents = []*client.ParentReference{{Id: "folder"}}
+		s.drive.files[id] = change.File
+	}
+	s.drive.addChange(fileChange("other", "md5"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	for _, req := range s.drive.requests {
+		c.Assert(req.Path, T.Not(T.Equals), "/drive/v2/changes")
+	}
+	c.Assert(s.downloads(c), T.DeepEquals, []string{"wanted", "removed"})
+	file, err := s.metaService.Get("wanted")
+	c.Assert(err, T.IsNil)
+	// their folders are not synced
+	c.Assert(file.ParentId, T.Equals, metadata.IdRootFolder)
+	_, err = s.metaService.Get("other")
+	c.Assert(err, T.NotNil)
+
+	s.drive.mu.Lock()
+	s.drive.files["wanted"].Md5Checksum = "updated"
+	delete(s.drive.files, "removed")
+	s.drive.mu.Unlock()
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	file, err = s.metaService.Get("wanted")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Md5Checksum, T.Equals, "updated")
+	_, err = s.metaService.Get("removed")
+	c.Assert(err, T.NotNil)
+}
+
+func (s *SyncerSuite) TestFilesAreFetchedInBatches(c *T.C) {
+	s.syncer.opts.BatchClient = &http.Client{Transport: s.drive}
+	s.syncer.opts.BatchSize = 2
+	s.syncer.opts.FileIds = []string{"first", "second", "third", "unknown"}
+	for _, id := range []string{"first", "second", "third"} {
+		s.drive.files[id] = fileChange(id, "md5").File
+	}
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	paths := []string{}
+	for _, req := range s.drive.requests {
+		paths = append(paths, req.Path)
+	}
+	c.Assert(paths, T.DeepEquals, []string{"/drive/v2/about", "/drive/v2/files/root", "/drive/v2/about", "/batch/drive/v2", "/batch/drive/v2"})
+	for _, id := range []string{"first", "second", "third"} {
+		_, err := s.metaService.Get(id)
+		c.Assert(err, T.IsNil)
+	}
+	_, err := s.metaService.Get("unknown")
+	c.Assert(err, T.NotNil)
+
+	// the files are fetched one by one if the batch endpoint fails
+	s.drive.mu.Lock()
+	s.drive.batchUnavailable = true
+	s.drive.files["first"].Md5Checksum = "updated"
+	delete(s.drive.files, "second")
+	s.drive.requests = nil
+	s.drive.mu.Unlock()
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	file, err := s.metaService.Get("first")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Md5Checksum, T.Equals, "updated")
+	_, err = s.metaService.Get("second")
+	c.Assert(err, T.NotNil)
+	paths = []string{}
+	for _, req := range s.drive.requests {
+		paths = append(paths, req.Path)
+	}
+	c.Assert(paths, T.DeepEquals, []string{"/drive/v2/about", "/drive/v2/files/root", "/drive/v2/about", "/batch/drive/v2", "/batch/drive/v2", "/drive/v2/files/first", "/drive/v2/files/second", "/drive/v2/files/third", "/drive/v2/files/unknown"})
+}
+
+func (s *SyncerSuite) TestRootIsSavedOnlyOnceChanged(c *T.C) {
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	root, err := s.metaService.Get(metadata.IdRootFolder)
+	c.Assert(err, T.IsNil)
+	c.Assert(root.Name, T.Equals, "My Drive")
+
+	// Drive tells no modification date, the cached one is kept
+	time.Sleep(2 * time.Millisecond)
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	again, err := s.metaService.Get(metadata.IdRootFolder)
+	c.Assert(err, T.IsNil)
+	c.Assert(again.LastMod.Equal(root.LastMod), T.Equals, true, T.Commentf("%v != %v", again.LastMod, root.LastMod))
+
+	s.drive.mu.Lock()
+	s.drive.files["root"].Title = "Drive"
+	s.drive.files["root"].ModifiedDate = "2013-06-01T10:00:00.000Z"
+	s.drive.mu.Unlock()
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	root, err = s.metaService.Get(metadata.IdRootFolder)
+	c.Assert(err, T.IsNil)
+	c.Assert(root.Name, T.Equals, "Drive")
+	c.Assert(root.LastMod, T.Equals, time.Date(2013, 6, 1, 10, 0, 0, 0, time.UTC))
+}
+
+func (s *SyncerSuite) TestMinimalChangesAreFetched(c *T.C) {
+	s.syncer.opts.BatchClient = &http.Client{Transport: s.drive}
+	s.drive.addChange(fileChange("gone", "md5"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+
+	s.drive.files["full"] = fileChange("full", "md5").File
+	s.drive.addChange(&client.Change{FileId: "full"})
+	s.drive.addChange(&client.Change{FileId: "gone"})
+	s.drive.requests = nil
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	file, err := s.metaService.Get("full")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Title, T.Equals, "full")
+	// not found anymore
+	_, err = s.metaService.Get("gone")
+	c.Assert(err, T.NotNil)
+	batches := 0
+	for _, req := range s.drive.requests {
+		if req.Path == "/batch/drive/v2" {
+			batches++
+		}
+	}
+	c.Assert(batches, T.Equals, 1)
+}
+
+func (s *SyncerSuite) TestDiffBetweenCheckpoints(c *T.C) {
+	s.drive.addChange(folderChange("kept", "rootId"))
+	s.drive.addChange(folderChange("removed", "rootId"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	from, err := s.metaService.GetLargestChangeId()
+	c.Assert(err, T.IsNil)
+
+	s.drive.addChange(folderChange("created", "rootId"))
+	s.drive.addChange(folderChange("transient", "rootId"))
+	s.drive.addChange(folderChange("kept", "created"))
+	s.drive.addChange(&client.Change{FileId: "removed", Deleted: true})
+	s.drive.addChange(&client.Change{FileId: "transient", Deleted: true})
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	to, err := s.metaService.GetLargestChangeId()
+	c.Assert(err, T.IsNil)
+
+	diff, err := s.metaService.Diff(from, to)
+	c.Assert(err, T.IsNil)
+	c.Assert(diff, T.DeepEquals, []*metadata.JournalEntry{
+		{ChangeId: 3, Id: "created", Kind: metadata.ChangeCreated},
+		{ChangeId: 5, Id: "kept", Kind: metadata.ChangeModified},
+		{ChangeId: 6, Id: "removed", Kind: metadata.ChangeDeleted},
+	})
+
+	all, err := s.metaService.Diff(0, to)
+	c.Assert(err, T.IsNil)
+	c.Assert(all, T.HasLen, 2)
+
+	// deleting a file that was never synced changes nothing
+	s.drive.addChange(&client.Change{FileId: "unknown", Deleted: true})
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	latest, err := s.metaService.GetLargestChangeId()
+	c.Assert(err, T.IsNil)
+	diff, err = s.metaService.Diff(to, latest)
+	c.Assert(err, T.IsNil)
+	c.Assert(diff, T.HasLen, 0)
+}
+
+func (s *SyncerSuite) TestTriggersAreSerializedAndCoalesced(c *T.C) {
+	s.syncer = NewCachedSyncer(s.drive.service(), s.metaService, s.syncer.blobManager, &SyncOptions{Interval: time.Hour})
+
+	var mu sync.Mutex
+	syncs, running, maxRunning := 0, 0, 0
+	first := make(chan bool)
+	release := make(chan bool)
+	s.drive.setOnChanges(func(query url.Values) {
+		mu.Lock()
+		syncs++
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		n := syncs
+		mu.Unlock()
+		if n == 1 {
+			first <- true
+			<-release
+		}
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.syncer.Start(ctx)
+	<-first
+
+	// triggers fired during the first sync coalesce into one sync
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			s.syncer.Trigger()
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return syncs
+	}
+	close(release)
+	for count() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// no more syncs until the next trigger or interval
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(count(), T.Equals, 2)
+
+	s.syncer.Trigger()
+	for count() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(count(), T.Equals, 3)
+	mu.Lock()
+	c.Assert(maxRunning, T.Equals, 1)
+	mu.Unlock()
+}
+
+func (s *SyncerSuite) TestCancelStopsTheSyncLoop(c *T.C) {
+	s.syncer = NewCachedSyncer(s.drive.service(), s.metaService, s.syncer.blobManager, &SyncOptions{Interval: time.Hour})
+	var mu sync.Mutex
+	syncs := 0
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	defer close(release)
+	s.drive.setOnChanges(func(query url.Values) {
+		mu.Lock()
+		syncs++
+		mu.Unlock()
+		started <- true
+		<-release
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	s.syncer.Start(ctx)
+	<-started
+
+	// the in-flight sync returns without waiting for the changes
+	cancel()
+	stopped := make(chan bool)
+	go func() {
+		s.syncer.mu.Lock()
+		s.syncer.mu.Unlock()
+		stopped <- true
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		c.Fatal("sync is not cancelled")
+	}
+
+	// nor are there any more syncs
+	s.syncer.Trigger()
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(syncs, T.Equals, 1)
+}
+
+func (s *SyncerSuite) TestOfflineSyncsAreNoOps(c *T.C) {
+	s.drive.addChange(fileChange("file1", "sum1"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	requests := len(s.drive.requests)
+
+	s.syncer.SetOffline(true)
+	c.Assert(s.syncer.IsOffline(), T.Equals, true)
+	s.drive.addChange(fileChange("file2", "sum2"))
+	result, err := s.syncer.Sync(false)
+	c.Assert(err, T.Equals, ErrOffline)
+	c.Assert(result, T.DeepEquals, &SyncResult{})
+	c.Assert(s.drive.requests, T.HasLen, requests)
+	// the cached metadata is still served
+	_, err = s.metaService.Get("file1")
+	c.Assert(err, T.IsNil)
+
+	s.syncer.SetOffline(false)
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	_, err = s.metaService.Get("file2")
+	c.Assert(err, T.IsNil)
+
+	// or starts offline
+	s.syncer = NewCachedSyncer(s.drive.service(), s.metaService, s.syncer.blobManager, &SyncOptions{Offline: true})
+	c.Assert(syncErr(s.syncer.Sync(false)), T.Equals, ErrOffline)
+}
+
+func (s *SyncerSuite) TestPausedSyncsResume(c *T.C) {
+	s.syncer = NewCachedSyncer(s.drive.service(), s.metaService, s.syncer.blobManager, &SyncOptions{Interval: time.Hour})
+	var mu sync.Mutex
+	syncs := 0
+	s.drive.setOnChanges(func(query url.Values) {
+		mu.Lock()
+		syncs++
+		mu.Unlock()
+	})
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return syncs
+	}
+	s.syncer.Pause()
+	c.Assert(s.syncer.IsPaused(), T.Equals, true)
+	c.Assert(s.syncer.Stats().Paused, T.Equals, true)
+	c.Assert(syncErr(s.syncer.Sync(false)), T.Equals, ErrPaused)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.syncer.Start(ctx)
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(count(), T.Equals, 0)
+
+	// catches up right away
+	s.drive.addChange(fileChange("file", "md5"))
+	next := s.syncer.NextSync()
+	s.syncer.Resume()
+	select {
+	case <-next:
+	case <-time.After(2 * time.Second):
+		c.Fatal("no sync after the resume")
+	}
+	_, err := s.metaService.Get("file")
+	c.Assert(err, T.IsNil)
+	c.Assert(s.syncer.Stats().Paused, T.Equals, false)
+}
+
+func (s *SyncerSuite) TestSyncsPauseWhileDriveIsUnreachable(c *T.C) {
+	s.syncer = NewCachedSyncer(s.drive.service(), s.metaService, s.syncer.blobManager, &SyncOptions{Interval: time.Hour, ConnectivityInterval: 10 * time.Millisecond})
+	var mu sync.Mutex
+	syncs, pings := 0, 0
+	s.drive.setOnChanges(func(query url.Values) {
+		mu.Lock()
+		syncs++
+		mu.Unlock()
+	})
+	ping := s.syncer.ping
+	s.syncer.ping = func(ctx context.Context) error {
+		mu.Lock()
+		pings++
+		mu.Unlock()
+		return ping(ctx)
+	}
+	counts := func() (int, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return syncs, pings
+	}
+	s.drive.mu.Lock()
+	s.drive.unreachable = true
+	s.drive.mu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.syncer.Start(ctx)
+
+	for _, p := counts(); p < 3; _, p = counts() {
+		time.Sleep(time.Millisecond)
+	}
+	// checked cheaply instead of syncing every interval
+	c.Assert(s.syncer.IsOffline(), T.Equals, true)
+	c.Assert(syncErr(s.syncer.Sync(false)), T.Equals, ErrOffline)
+	synced, _ := counts()
+	c.Assert(synced, T.Equals, 0)
+
+	s.drive.addChange(fileChange("file1", "sum1"))
+	s.drive.mu.Lock()
+	s.drive.unreachable = false
+	s.drive.mu.Unlock()
+	for synced, _ = counts(); synced < 1; synced, _ = counts() {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 1000 && s.syncer.IsOffline(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(s.syncer.IsOffline(), T.Equals, false)
+	s.syncer.WaitReady()
+	_, err := s.metaService.Get("file1")
+	c.Assert(err, T.IsNil)
+}
+
+// countingTransport counts the requests it sends through another
+// transport.
+type countingTransport struct {
+	mu       sync.Mutex
+	requests int
+	next     http.RoundTripper
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.requests++
+	t.mu.Unlock()
+	return t.next.RoundTrip(req)
+}
+
+func (s *SyncerSuite) TestSyncerWithClient(c *T.C) {
+	transport := &countingTransport{next: s.drive}
+	syncer, err := NewCachedSyncerWithClient(&http.Client{Transport: transport}, s.metaService, s.syncer.blobManager, &SyncOptions{ResumableThreshold: 1})
+	c.Assert(err, T.IsNil)
+	c.Assert(syncer.opts.UploadClient.Transport.(*limitedTransport).base, T.Equals, transport)
+	s.drive.addChange(fileChange("file1", "sum1"))
+	c.Assert(syncErr(syncer.Sync(false)), T.IsNil)
+	_, err = s.metaService.Get("file1")
+	c.Assert(err, T.IsNil)
+	c.Assert(transport.requests > 0, T.Equals, true)
+
+	_, err = NewCachedSyncerWithClient(nil, s.metaService, s.syncer.blobManager, nil)
+	c.Assert(err, T.NotNil)
+}
+
+// blockingTransport records the number of requests in flight through
+// it, which are blocked until release is closed.
+type blockingTransport struct {
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+	release     chan struct{}
+}
+
+func (t *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.inFlight++
+	t.maxInFlight = max(t.maxInFlight, t.inFlight)
+	t.mu.Unlock()
+	<-t.release
+	t.mu.Lock()
+	t.inFlight--
+	t.mu.Unlock()
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func (s *SyncerSuite) TestRequestsAreLimited(c *T.C) {
+	transport := &blockingTransport{release: make(chan struct{})}
+	syncer, err := NewCachedSyncerWithClient(&http.Client{Transport: transport}, s.metaService, s.syncer.blobManager, &SyncOptions{MaxConcurrentRequests: 2})
+	c.Assert(err, T.IsNil)
+	// shared by the clients of the syncer
+	clients := []*http.Client{syncer.LimitClient(&http.Client{Transport: transport}), syncer.opts.UploadClient}
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(client *http.Client) {
+			defer wg.Done()
+			if res, err := client.Get("https://example.com/"); err == nil {
+				res.Body.Close()
+			}
+		}(clients[i%len(clients)])
+	}
+	time.Sleep(50 * time.Millisecond)
+	// a request waiting for a slot gives up with its context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://example.com/", nil)
+	_, err = clients[0].Do(req)
+	c.Assert(errors.Is(err, context.DeadlineExceeded), T.Equals, true)
+	close(transport.release)
+	wg.Wait()
+	c.Assert(transport.maxInFlight, T.Equals, 2)
+}
+
+// recordingLogger records the first argument of each log by level.
+type recordingLogger struct {
+	mu      sync.Mutex
+	verbose []string
+	debug   []string
+}
+
+func (l *recordingLogger) V(args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.verbose = append(l.verbose, fmt.Sprint(args[0]))
+}
+
+func (l *recordingLogger) D(args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.debug = append(l.debug, fmt.Sprint(args[0]))
+}
+
+func (s *SyncerSuite) TestRepeatedChangesAreMergedOnce(c *T.C) {
+	s.drive.pageSize = 2
+	for _, item := range []*client.Change{fileChange("file1", "sum1"), fileChange("file2", "sum2"), fileChange("file1", "sum3"), fileChange("file1", "sum4")} {
+		s.drive.addChange(item)
+	}
+	result, err := s.syncer.Sync(false)
+	c.Assert(err, T.IsNil)
+	// the first change of file1 is merged before the page of its later
+	// changes is fetched, only the last of which is merged
+	c.Assert(result.ChangesProcessed, T.Equals, 3)
+	c.Assert(result.NewChangeId, T.Equals, int64(4))
+	file, err := s.metaService.Get("file1")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Md5Checksum, T.Equals, "sum4")
+	id, err := s.metaService.GetLargestChangeId()
+	c.Assert(err, T.IsNil)
+	c.Assert(id, T.Equals, int64(4))
+}
+
+func (s *SyncerSuite) TestLogsAreRouted(c *T.C) {
+	log := &recordingLogger{}
+	s.syncer.opts.Logger = log
+	s.drive.addChange(fileChange("file1", "sum1"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(log.verbose[0], T.Equals, "Started syncer...")
+	c.Assert(log.verbose[len(log.verbose)-1], T.Equals, "Done syncing...")
+	// the logs of each page are details
+	c.Assert(log.debug, T.DeepEquals, []string{"merging changes of"})
+}
+
+func (s *SyncerSuite) TestOrphanedBlobsAreCollected(c *T.C) {
+	c.Assert(s.syncer.mergeChange("rootId", fileChange("file1", "sum1")), T.IsNil)
+	c.Assert(s.syncer.mergeChange("rootId", fileChange("file2", "sum2")), T.IsNil)
+	blobs := s.syncer.blobManager
+	old := time.Now().Add(-2 * DefaultCollectGrace)
+	for _, b := range [][]string{{"file1", "sum1"}, {"file2", "stale"}, {"deleted", "sum3"}} {
+		c.Assert(blobs.Save(b[0], b[1], ioutil.NopCloser(strings.NewReader("content"))), T.IsNil)
+	}
+	blobs.ForEach(func(e *blob.Entry) error {
+		return os.Chtimes(e.Path, old, old)
+	})
+	// nothing is collected before the first sync
+	reclaimed, err := s.syncer.CollectBlobs()
+	c.Assert(err, T.IsNil)
+	c.Assert(reclaimed, T.Equals, int64(0))
+
+	c.Assert(s.metaService.SaveSyncAttempt(time.Now(), nil), T.IsNil)
+	reclaimed, err = s.syncer.CollectBlobs()
+	c.Assert(err, T.IsNil)
+	c.Assert(reclaimed, T.Equals, int64(2*len("content")))
+	c.Assert(blobs.Exists("file1", "sum1"), T.Equals, true)
+	c.Assert(blobs.Exists("file2", "stale"), T.Equals, false)
+	c.Assert(blobs.Exists("deleted", "sum3"), T.Equals, false)
+}
+
+func (s *SyncerSuite) TestOrphansArePruned(c *T.C) {
+	c.Assert(s.syncer.mergeChange("rootId", fileChange("file", "sum1")), T.IsNil)
+	blobs := s.syncer.blobManager
+	for _, b := range [][]string{{"file", "sum1"}, {"file", "stale"}, {"deleted", "sum2"}, {"deleted", "sum3"}, {"other", "sum4"}, {"restored", "sum5"}} {
+		c.Assert(blobs.Save(b[0], b[1], ioutil.NopCloser(strings.NewReader("content"))), T.IsNil)
+	}
+	orphans, err := s.syncer.Orphans()
+	c.Assert(err, T.IsNil)
+	c.Assert(orphans, T.DeepEquals, []string{"deleted", "other", "restored"})
+
+	// synced again since it was listed
+	c.Assert(s.syncer.mergeChange("rootId", fileChange("restored", "sum5")), T.IsNil)
+	c.Assert(s.syncer.Prune("deleted", "restored"), T.IsNil)
+	c.Assert(blobs.Exists("deleted", "sum2"), T.Equals, false)
+	c.Assert(blobs.Exists("deleted", "sum3"), T.Equals, false)
+	c.Assert(blobs.Exists("restored", "sum5"), T.Equals, true)
+	c.Assert(blobs.Exists("file", "stale"), T.Equals, true)
+	orphans, err = s.syncer.Orphans()
+	c.Assert(err, T.IsNil)
+	c.Assert(orphans, T.DeepEquals, []string{"other"})
+}
+
+func (s *SyncerSuite) TestCopiesAreNotDownloaded(c *T.C) {
+	sum := fmt.Sprintf("%x", md5.Sum([]byte("content")))
+	c.Assert(s.syncer.mergeChange("rootId", fileChange("original", sum)), T.IsNil)
+	c.Assert(s.syncer.blobManager.Save("original", sum, ioutil.NopCloser(strings.NewReader("content"))), T.IsNil)
+	c.Assert(s.metaService.InitFile("original"), T.IsNil)
+	s.metaService.DequeueFromIO("download", "original")
+
+	c.Assert(s.syncer.mergeChange("rootId", fileChange("copy", sum)), T.IsNil)
+	c.Assert(s.downloads(c), T.DeepEquals, []string{})
+	file, err := s.metaService.LookUp(metadata.IdRootFolder, "copy")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Id, T.Equals, "copy")
+	data, size, err := s.syncer.blobManager.Read("copy", sum, 0, 16)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, "content")
+
+	// other contents are downloaded
+	c.Assert(s.syncer.mergeChange("rootId", fileChange("other", "other sum")), T.IsNil)
+	c.Assert(s.downloads(c), T.DeepEquals, []string{"other"})
+}
+
+func (s *SyncerSuite) TestRevokedAuthorizationIsReported(c *T.C) {
+	s.drive.mu.Lock()
+	s.drive.unauthorized = true
+	s.drive.mu.Unlock()
+	err := syncErr(s.syncer.Sync(false))
+	c.Assert(errors.Is(err, auth.ErrAuth), T.Equals, true)
+	// Drive is reachable, the syncs go on
+	c.Assert(isNetworkError(err), T.Equals, false)
+}
+
+// Sends a notification of the channel to the handler of the syncer.
+func (s *SyncerSuite) notify(channel *client.Channel, state string) {
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("X-Goog-Channel-ID", channel.Id)
+	req.Header.Set("X-Goog-Channel-Token", channel.Token)
+	req.Header.Set("X-Goog-Resource-State", state)
+	s.syncer.NotificationHandler().ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func (s *SyncerSuite) TestNotificationsTriggerSyncs(c *T.C) {
+	s.syncer = NewCachedSyncer(s.drive.service(), s.metaService, s.syncer.blobManager, &SyncOptions{Interval: time.Hour, WebhookAddress: "https://example.com/hook", WatchTTL: time.Second})
+	// not watched yet
+	s.notify(&client.Channel{Id: "other"}, "change")
+	c.Assert(s.syncer.trigger, T.HasLen, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.syncer.Start(ctx)
+	s.syncer.WaitReady()
+	watched, _ := s.drive.channels()
+	for ; len(watched) == 0; watched, _ = s.drive.channels() {
+		time.Sleep(time.Millisecond)
+	}
+	s.drive.mu.Lock()
+	channel := *s.drive.watches[0]
+	s.drive.mu.Unlock()
+	c.Assert(channel.Address, T.Equals, "https://example.com/hook")
+	c.Assert(channel.Type, T.Equals, "web_hook")
+	c.Assert(s.syncer.watching(), T.Equals, true)
+
+	s.drive.addChange(fileChange("file1", "sum1"))
+	s.notify(&client.Channel{Id: channel.Id, Token: "forged"}, "change")
+	s.notify(&channel, "sync")
+	c.Assert(s.syncer.trigger, T.HasLen, 0)
+	s.notify(&channel, "change")
+	var err error
+	for i := 0; i < 1000; i++ {
+		if _, err = s.metaService.Get("file1"); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(err, T.IsNil)
+
+	// renewed before it expires, the previous channel is stopped
+	watched, stopped := s.drive.channels()
+	for ; len(stopped) == 0; watched, stopped = s.drive.channels() {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(len(watched) >= 2, T.Equals, true)
+	c.Assert(stopped[0], T.Equals, channel.Id)
+
+	cancel()
+	for i := 0; i < 1000 && s.syncer.watching(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(s.syncer.watching(), T.Equals, false)
+}
+
+func (s *SyncerSuite) TestIntervalAdaptsToChanges(c *T.C) {
+	opts := (&SyncOptions{Interval: 10 * time.Second, MaxInterval: 40 * time.Second}).withDefaults()
+	interval := opts.Interval
+	for _, expected := range []time.Duration{20, 40, 40} {
+		interval = opts.nextInterval(interval, false)
+		c.Assert(interval, T.Equals, expected*time.Second)
+	}
+	for _, expected := range []time.Duration{20, 10, 10} {
+		interval = opts.nextInterval(interval, true)
+		c.Assert(interval, T.Equals, expected*time.Second)
+	}
+
+	// without a longer max, the interval is fixed
+	opts = (&SyncOptions{Interval: time.Hour}).withDefaults()
+	c.Assert(opts.nextInterval(time.Hour, false), T.Equals, time.Hour)
+}
+
+func (s *SyncerSuite) TestSyncsAreJittered(c *T.C) {
+	opts := (&SyncOptions{Interval: 10 * time.Second, StartJitter: time.Second, IntervalJitter: 0.2}).withDefaults()
+	for i := 0; i < 100; i++ {
+		wait := opts.jittered(10 * time.Second)
+		c.Assert(wait >= 8*time.Second && wait <= 12*time.Second, T.Equals, true)
+		delay := opts.startDelay()
+		c.Assert(delay >= 0 && delay <= time.Second, T.Equals, true)
+	}
+	opts = (&SyncOptions{IntervalJitter: 3}).withDefaults()
+	c.Assert(opts.IntervalJitter, T.Equals, 1.0)
+	opts = (&SyncOptions{}).withDefaults()
+	c.Assert(opts.jittered(time.Minute), T.Equals, time.Minute)
+	c.Assert(opts.startDelay(), T.Equals, time.Duration(0))
+
+	// the first sync waits for its delay, unless triggered
+	s.syncer = NewCachedSyncer(s.drive.service(), s.metaService, s.syncer.blobManager, &SyncOptions{Interval: time.Hour, StartJitter: time.Hour})
+	synced := make(chan bool, 1)
+	s.drive.setOnChanges(func(url.Values) {
+		synced <- true
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.syncer.Start(ctx)
+	select {
+	case <-synced:
+		c.Fatal("synced before the start delay")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.syncer.Trigger()
+	select {
+	case <-synced:
+	case <-time.After(5 * time.Second):
+		c.Fatal("not synced once triggered")
+	}
+}
+
+func (s *SyncerSuite) TestSyncReportsChanges(c *T.C) {
+	changed, err := s.syncer.syncChanged(context.Background())
+	c.Assert(err, T.IsNil)
+	c.Assert(changed, T.Equals, false)
+
+	s.drive.addChange(fileChange("file", "md5"))
+	changed, err = s.syncer.syncChanged(context.Background())
+	c.Assert(err, T.IsNil)
+	c.Assert(changed, T.Equals, true)
+
+	changed, err = s.syncer.syncChanged(context.Background())
+	c.Assert(err, T.IsNil)
+	c.Assert(changed, T.Equals, false)
+}
+
+func (s *SyncerSuite) TestDeletedFileIsResurrected(c *T.C) {
+	c.Assert(s.syncer.mergeChange("rootId", fileChange("restored", "md5")), T.IsNil)
+	blobs := s.syncer.blobManager
+	c.Assert(blobs.Save("restored", "md5", ioutil.NopCloser(strings.NewReader("content"))), T.IsNil)
+	c.Assert(s.metaService.InitFile("restored"), T.IsNil)
+	c.Assert(s.metaService.DequeueFromIO("download", "restored"), T.IsNil)
+
+	c.Assert(s.syncer.mergeChange("rootId", &client.Change{FileId: "restored", Deleted: true}), T.IsNil)
+	_, err := s.metaService.Get("restored")
+	c.Assert(err, T.NotNil)
+	_, _, err = blobs.Read("restored", "md5", 0, 1)
+	c.Assert(err, T.NotNil)
+
+	// restored from the trash elsewhere, with the same content
+	c.Assert(s.syncer.mergeChange("rootId", fileChange("restored", "md5")), T.IsNil)
+	file, err := s.metaService.Get("restored")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.ParentId, T.Equals, metadata.IdRootFolder)
+	c.Assert(file.Md5Checksum, T.Equals, "md5")
+	c.Assert(s.downloads(c), T.DeepEquals, []string{"restored"})
+
+	// not visible until its content is fetched again
+	children, err := s.metaService.GetChildren(metadata.IdRootFolder)
+	c.Assert(err, T.IsNil)
+	c.Assert(children, T.HasLen, 0)
+}
+
+func (s *SyncerSuite) TestEditedDocIsExportedAgain(c *T.C) {
+	s.drive.addChange(docChange("doc", "2013-06-01T10:00:00.000Z"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(s.downloads(c), T.DeepEquals, []string{"doc"})
+	c.Assert(s.metaService.DequeueFromIO("download", "doc"), T.IsNil)
+
+	// synced again without changes, the export is still fresh
+	c.Assert(s.syncer.mergeChange("rootId", docChange("doc", "2013-06-01T10:00:00.000Z")), T.IsNil)
+	c.Assert(s.downloads(c), T.HasLen, 0)
+
+	s.drive.addChange(docChange("doc", "2013-06-02T10:00:00.000Z"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(s.downloads(c), T.DeepEquals, []string{"doc"})
+	file, err := s.metaService.Get("doc")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Version, T.Equals, "2013-06-02T10:00:00.000Z")
+}
+
+func (s *SyncerSuite) TestChecksumlessFilesAreVersionedByRevision(c *T.C) {
+	revised := func(revision string, modifiedDate string) *client.Change {
+		item := fileChange("video", "")
+		item.File.HeadRevisionId, item.File.ModifiedDate = revision, modifiedDate
+		return item
+	}
+	s.drive.addChange(revised("rev-1", "2013-06-01T10:00:00.000Z"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(s.downloads(c), T.DeepEquals, []string{"video"})
+	c.Assert(s.metaService.DequeueFromIO("download", "video"), T.IsNil)
+
+	// renamed, the content of the same revision is not fetched again
+	renamed := revised("rev-1", "2013-06-02T10:00:00.000Z")
+	renamed.File.Title = "clip"
+	s.drive.addChange(renamed)
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(s.downloads(c), T.HasLen, 0)
+
+	s.drive.addChange(revised("rev-2", "2013-06-03T10:00:00.000Z"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(s.downloads(c), T.DeepEquals, []string{"video"})
+	file, err := s.metaService.Get("video")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Version, T.Equals, "rev-2")
+}
+
+// Waits until the exported content of the doc is cached and its
+// download is completed.
+func (s *SyncerSuite) waitExported(c *T.C, downloader *fileio.Downloader, id string, content string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, size, _ := s.syncer.blobManager.Read(id, "", 0, len(content)+1)
+		if string(data[:size]) == content && len(s.downloads(c)) == 0 && len(downloader.InFlight()) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			c.Fatalf("%v is not exported, got %q", id, data[:size])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *SyncerSuite) TestDocsAreExportedThroughTheSync(c *T.C) {
+	// rendering the export fails twice
+	s.drive.setExport("doc", "first draft", 2)
+	s.drive.addChange(docChange("doc", "2013-06-01T10:00:00.000Z"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+
+	downloader := fileio.NewDownloader(&http.Client{Transport: s.drive}, s.metaService, s.syncer.blobManager, &fileio.Options{
+		BinaryRetry: &fileio.RetryPolicy{Attempts: 1},
+		ExportRetry: &fileio.RetryPolicy{Attempts: 3, Delay: time.Millisecond},
+	})
+	defer downloader.Stop()
+	s.waitExported(c, downloader, "doc", "first draft")
+
+	// edited, the export is regenerated
+	s.drive.setExport("doc", "second draft", 0)
+	s.drive.addChange(docChange("doc", "2013-06-02T10:00:00.000Z"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(s.downloads(c), T.DeepEquals, []string{"doc"})
+	c.Assert(downloader.Prefetch("doc.docx"), T.IsNil)
+	s.waitExported(c, downloader, "doc", "second draft")
+}
+
+func (s *SyncerSuite) TestDocsAreNamedByTheirExportFormat(c *T.C) {
+	s.syncer.opts.ExportFormats = map[string]string{"application/vnd.google-apps.spreadsheet": "text/csv"}
+	budget := docChange("budget", "2013-06-01T10:00:00.000Z")
+	budget.File.Title, budget.File.MimeType = "Budget", "application/vnd.google-apps.spreadsheet"
+	budget.File.ExportLinks = map[string]string{"text/csv": "csv link", "application/pdf": "pdf link"}
+	notes := docChange("notes", "2013-06-01T10:00:00.000Z")
+	notes.File.Title = "Notes.docx"
+	// the default format isn't offered
+	slides := docChange("slides", "2013-06-01T10:00:00.000Z")
+	slides.File.Title, slides.File.MimeType = "Slides", "application/vnd.google-apps.presentation"
+	slides.File.ExportLinks = map[string]string{"application/pdf": "pdf link"}
+	for _, item := range []*client.Change{budget, notes, slides} {
+		c.Assert(s.syncer.mergeChange("rootId", item), T.IsNil)
+	}
+
+	for id, want := range map[string][]string{
+		"budget": {"Budget.csv", "text/csv"},
+		"notes":  {"Notes.docx", "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		"slides": {"Slides.pdf", "application/pdf"},
+	} {
+		file, err := s.metaService.Get(id)
+		c.Assert(err, T.IsNil)
+		c.Assert(file.Name, T.Equals, want[0])
+		c.Assert(file.ExportMimeType(), T.Equals, want[1])
+	}
+
+	// exported again once the format changes
+	for _, id := range []string{"budget", "notes", "slides"} {
+		c.Assert(s.metaService.DequeueFromIO("download", id), T.IsNil)
+	}
+	s.syncer.opts.ExportFormats = nil
+	c.Assert(s.syncer.mergeChange("rootId", budget), T.IsNil)
+	c.Assert(s.syncer.mergeChange("rootId", notes), T.IsNil)
+	c.Assert(s.downloads(c), T.DeepEquals, []string{"budget"})
+	file, err := s.metaService.Get("budget")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Name, T.Equals, "Budget.pdf")
+}
+
+func (s *SyncerSuite) TestDocsCanBeLinked(c *T.C) {
+	s.syncer.opts.ExportFormats = map[string]string{
+		"application/vnd.google-apps.document": metadata.MimeTypeLink,
+		"application/vnd.google-apps.form":     metadata.MimeTypeLink,
+	}
+	notes := docChange("notes", "2013-06-01T10:00:00.000Z")
+	notes.File.Title = "Notes"
+	notes.File.AlternateLink = "https://docs.google.com/document/d/notes/edit"
+	notes.File.ExportLinks = map[string]string{"application/pdf": "pdf link"}
+	// forms can't be exported, but they can be linked
+	survey := docChange("survey", "2013-06-01T10:00:00.000Z")
+	survey.File.Title, survey.File.MimeType = "Survey", "application/vnd.google-apps.form"
+	for _, item := range []*client.Change{notes, survey} {
+		c.Assert(s.syncer.mergeChange("rootId", item), T.IsNil)
+	}
+	c.Assert(s.downloads(c), T.DeepEquals, []string{})
+
+	for id, want := range map[string][]string{
+		"notes":  {"Notes.gdoc", `{"url":"https://docs.google.com/document/d/notes/edit","doc_id":"notes"}` + "\n"},
+		"survey": {"Survey.gform", `{"url":"https://drive.google.com/open?id=survey","doc_id":"survey"}` + "\n"},
+	} {
+		file, err := s.metaService.LookUp(metadata.IdRootFolder, want[0])
+		c.Assert(err, T.IsNil)
+		c.Assert(file.Id, T.Equals, id)
+		c.Assert(file.IsLink(), T.Equals, true)
+		c.Assert(file.FileSize, T.Equals, int64(len(want[1])))
+		data, size, err := s.syncer.blobManager.Read(id, file.Md5Checksum, 0, 200)
+		c.Assert(err, T.IsNil)
+		c.Assert(string(data[:size]), T.Equals, want[1])
+	}
+
+	// exported once links are not configured anymore
+	s.syncer.opts.ExportFormats = nil
+	c.Assert(s.syncer.mergeChange("rootId", notes), T.IsNil)
+	c.Assert(s.downloads(c), T.DeepEquals, []string{"notes"})
+	file, err := s.metaService.Get("notes")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Name, T.Equals, "Notes.pdf")
+}
+
+func (s *SyncerSuite) TestFilesAreClassified(c *T.C) {
+	app := docChange("app", "2013-06-01T10:00:00.000Z")
+	app.File.Title, app.File.MimeType, app.File.FileSize = "App file", "application/vnd.google-apps.drive-sdk.1234", 10
+	survey := docChange("survey", "2013-06-01T10:00:00.000Z")
+	survey.File.Title, survey.File.MimeType = "Survey", "application/vnd.google-apps.form"
+	for _, item := range []*client.Change{folderChange("folder", "rootId"), fileChange("file1", "sum1"), docChange("notes", "2013-06-01T10:00:00.000Z"), app, survey} {
+		s.drive.addChange(item)
+	}
+	result, err := s.syncer.Sync(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(result.Classes, T.DeepEquals, map[FileClass]int{ClassFolder: 1, ClassDownloadable: 1, ClassExportable: 1, ClassUnsupported: 2})
+	c.Assert(s.downloads(c), T.DeepEquals, []string{"file1", "notes"})
+
+	// listed as empty files
+	for id, name := range map[string]string{"app": "App file", "survey": "Survey"} {
+		file, err := s.metaService.LookUp(metadata.IdRootFolder, name)
+		c.Assert(err, T.IsNil)
+		c.Assert(file.Id, T.Equals, id)
+		c.Assert(file.Unsupported, T.Equals, true)
+		c.Assert(file.FileSize, T.Equals, int64(0))
+		_, size, err := s.syncer.blobManager.Read(id, file.Md5Checksum, 0, 10)
+		c.Assert(err, T.IsNil)
+		c.Assert(size, T.Equals, int64(0))
+	}
+	file, err := s.metaService.Get("notes")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Unsupported, T.Equals, false)
+}
+
+func (s *SyncerSuite) TestParseExportFormats(c *T.C) {
+	formats, err := ParseExportFormats("document=pdf, spreadsheet=.ods,drawing=image/svg+xml,form=link")
+	c.Assert(err, T.IsNil)
+	c.Assert(formats, T.DeepEquals, map[string]string{
+		"application/vnd.google-apps.document":    "application/pdf",
+		"application/vnd.google-apps.spreadsheet": "application/vnd.oasis.opendocument.spreadsheet",
+		"application/vnd.google-apps.drawing":     "image/svg+xml",
+		"application/vnd.google-apps.form":        metadata.MimeTypeLink,
+	})
+	_, err = ParseExportFormats("document")
+	c.Assert(err, T.NotNil)
+	_, err = ParseExportFormats("document=unknown")
+	c.Assert(err, T.NotNil)
+}
+
+func (s *SyncerSuite) TestFilesAreNamedByTheirMimeType(c *T.C) {
+	s.syncer.opts.Extensions = map[string]string{"image/jpeg": ".jpg", "application/pdf": ".pdf", "text/plain": ".txt"}
+	photo := fileChange("photo", "sum1")
+	photo.File.Title, photo.File.MimeType = "Photo.JPEG", "image/jpeg"
+	scan := fileChange("scan", "sum2")
+	scan.File.Title, scan.File.MimeType = "Scan", "application/pdf"
+	notes := fileChange("notes", "sum3")
+	notes.File.Title = "notes.md"
+	archive := fileChange("archive", "sum4")
+	archive.File.Title, archive.File.MimeType = "archive", "application/zip"
+	folder := folderChange("folder", "rootId")
+	for _, item := range []*client.Change{photo, scan, notes, archive, folder} {
+		c.Assert(s.syncer.mergeChange("rootId", item), T.IsNil)
+	}
+
+	for id, want := range map[string]string{
+		"photo":   "Photo.JPEG",
+		"scan":    "Scan.pdf",
+		"notes":   "notes.md.txt",
+		"archive": "archive",
+		"folder":  "folder",
+	} {
+		file, err := s.metaService.Get(id)
+		c.Assert(err, T.IsNil)
+		c.Assert(file.Name, T.Equals, want)
+	}
+	file, err := s.metaService.Get("scan")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Title, T.Equals, "Scan")
+}
+
+func (s *SyncerSuite) TestParseExtensions(c *T.C) {
+	exts, err := ParseExtensions("image/heic=heic, text/plain=.text,application/pdf=")
+	c.Assert(err, T.IsNil)
+	c.Assert(exts, T.DeepEquals, map[string]string{"image/heic": ".heic", "text/plain": ".text", "application/pdf": ""})
+	exts, err = ParseExtensions("default,image/jpeg=jpeg")
+	c.Assert(err, T.IsNil)
+	c.Assert(exts["image/jpeg"], T.Equals, ".jpeg")
+	c.Assert(exts["application/pdf"], T.Equals, ".pdf")
+	_, err = ParseExtensions("pdf")
+	c.Assert(err, T.NotNil)
+	_, err = ParseExtensions("pdf=.pdf")
+	c.Assert(err, T.NotNil)
+}
+
+// fakeThumbnails records the thumbnails it is asked to fetch.
+type fakeThumbnails struct {
+	mu      sync.Mutex
+	links   map[string]string
+	fetches int
+
+	// If set, fetches block until it is closed.
+	release chan struct{}
+	fetched chan string
+}
+
+func newFakeThumbnails() *fakeThumbnails {
+	return &fakeThumbnails{links: make(map[string]string), fetched: make(chan string, 10)}
+}
+
+func (t *fakeThumbnails) Fetch(id string, link string) error {
+	if t.release != nil {
+		<-t.release
+	}
+	t.mu.Lock()
+	t.links[id] = link
+	t.fetches++
+	t.mu.Unlock()
+	t.fetched <- id
+	return nil
+}
+
+func (t *fakeThumbnails) Delete(id string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.links, id)
+	return nil
+}
+
+// Returns the fetched links and the number of fetches.
+func (t *fakeThumbnails) state() (map[string]string, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	links := make(map[string]string)
+	for id, link := range t.links {
+		links[id] = link
+	}
+	return links, t.fetches
+}
+
+func (s *SyncerSuite) TestThumbnailsAreFetched(c *T.C) {
+	thumbnails := newFakeThumbnails()
+	s.syncer = NewCachedSyncer(s.drive.service(), s.metaService, s.syncer.blobManager, &SyncOptions{Thumbnails: thumbnails})
+
+	photo := fileChange("photo", "md5")
+	photo.File.ThumbnailLink = "https://example.com/thumb/photo"
+	c.Assert(s.syncer.mergeChange("rootId", photo), T.IsNil)
+	c.Assert(s.syncer.mergeChange("rootId", fileChange("text", "md5")), T.IsNil)
+	c.Assert(<-thumbnails.fetched, T.Equals, "photo")
+	links, _ := thumbnails.state()
+	c.Assert(links, T.DeepEquals, map[string]string{"photo": "https://example.com/thumb/photo"})
+
+	// renamed, the content and so the thumbnail are the same
+	photo = fileChange("photo", "md5")
+	photo.File.Title = "renamed"
+	photo.File.ThumbnailLink = "https://example.com/thumb/photo?renamed"
+	c.Assert(s.syncer.mergeChange("rootId", photo), T.IsNil)
+	// edited
+	photo = fileChange("photo", "md5-edited")
+	photo.File.ThumbnailLink = "https://example.com/thumb/photo?edited"
+	c.Assert(s.syncer.mergeChange("rootId", photo), T.IsNil)
+	c.Assert(<-thumbnails.fetched, T.Equals, "photo")
+	links, fetches := thumbnails.state()
+	c.Assert(fetches, T.Equals, 2)
+	c.Assert(links["photo"], T.Equals, "https://example.com/thumb/photo?edited")
+
+	c.Assert(s.syncer.mergeChange("rootId", &client.Change{FileId: "photo", Deleted: true}), T.IsNil)
+	links, _ = thumbnails.state()
+	c.Assert(links, T.HasLen, 0)
+}
+
+func (s *SyncerSuite) TestThumbnailsDontBlockTheSync(c *T.C) {
+	thumbnails := newFakeThumbnails()
+	thumbnails.release = make(chan struct{})
+	s.syncer = NewCachedSyncer(s.drive.service(), s.metaService, s.syncer.blobManager, &SyncOptions{Thumbnails: thumbnails})
+	for _, id := range []string{"a", "b"} {
+		photo := fileChange(id, "md5")
+		photo.File.ThumbnailLink = "https://example.com/thumb/" + id
+		s.drive.addChange(photo)
+	}
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	_, fetches := thumbnails.state()
+	c.Assert(fetches, T.Equals, 0)
+
+	close(thumbnails.release)
+	fetched := []string{<-thumbnails.fetched, <-thumbnails.fetched}
+	sort.Strings(fetched)
+	c.Assert(fetched, T.DeepEquals, []string{"a", "b"})
+}
+
+func (s *SyncerSuite) TestMetadataCallsHonorTheirTimeout(c *T.C) {
+	s.syncer = NewCachedSyncer(s.drive.service(), s.metaService, s.syncer.blobManager, &SyncOptions{MetadataTimeout: 20 * time.Millisecond})
+	s.drive.addChange(folderChange("folder", "rootId"))
+	s.drive.setOnChanges(func(query url.Values) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	start := time.Now()
+	c.Assert(syncErr(s.syncer.Sync(false)), T.Equals, context.DeadlineExceeded)
+	c.Assert(time.Since(start) < 150*time.Millisecond, T.Equals, true)
+
+	// the timeout applies to each call, not the whole sync
+	s.drive.setOnChanges(func(query url.Values) {
+		time.Sleep(10 * time.Millisecond)
+	})
+	s.drive.pageSize = 1
+	for i := 0; i < 5; i++ {
+		s.drive.addChange(folderChange("folder"+strconv.Itoa(i), "rootId"))
+	}
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+}
+
+func (s *SyncerSuite) TestMissingFilesAreDeleted(c *T.C) {
+	s.syncer.opts.SharedDrives = []string{"team"}
+	s.drive.files["team"] = &client.File{Id: "team", Title: "Team", MimeType: metadata.MimeTypeFolder, Labels: &client.FileLabels{}}
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	_, err := s.metaService.Resolve("Team")
+	c.Assert(err, T.IsNil)
+
+	// the drive is deleted, My Drive is still synced
+	delete(s.drive.files, "team")
+	s.drive.addChange(folderChange("mine", "rootId"))
+	result, err := s.syncer.Sync(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(result.FilesDeleted, T.Equals, 1)
+	_, err = s.metaService.Get("team")
+	c.Assert(err, T.NotNil)
+	_, err = s.metaService.Resolve("mine")
+	c.Assert(err, T.IsNil)
+
+	// but not the root folder
+	delete(s.drive.files, "root")
+	_, err = s.syncer.Sync(false)
+	c.Assert(isNotFound(err), T.Equals, true)
+}
+
+func (s *SyncerSuite) TestSharedDrives(c *T.C) {
+	s.syncer.opts.SharedDrives = []string{"team"}
+	s.drive.files["team"] = &client.File{Id: "team", Title: "Team", MimeType: metadata.MimeTypeFolder, Labels: &client.FileLabels{}}
+	s.drive.addChange(folderChange("mine", "rootId"))
+	s.drive.addDriveChange("team", folderChange("plans", "team"))
+	s.drive.addDriveChange("team", folderChange("budgets", "plans"))
+	var driveQueries []url.Values
+	s.drive.setOnChanges(func(query url.Values) {
+		if query.Get("driveId") != "" {
+			driveQueries = append(driveQueries, query)
+		}
+	})
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	for _, p := range []string{"mine", "Team", "Team/plans", "Team/plans/budgets"} {
+		_, err := s.metaService.Resolve(p)
+		c.Assert(err, T.IsNil, T.Commentf("%v", p))
+	}
+	c.Assert(driveQueries, T.HasLen, 1)
+	c.Assert(driveQueries[0].Get("supportsAllDrives"), T.Equals, "true")
+	c.Assert(driveQueries[0].Get("includeItemsFromAllDrives"), T.Equals, "true")
+
+	// the feeds are followed from their own positions
+	id, err := s.metaService.GetLargestChangeId()
+	c.Assert(err, T.IsNil)
+	c.Assert(id, T.Equals, int64(1))
+	id, err = s.metaService.GetDriveChangeId("team")
+	c.Assert(err, T.IsNil)
+	c.Assert(id, T.Equals, int64(2))
+	s.drive.addDriveChange("team", folderChange("notes", "team"))
+	driveQueries = nil
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(driveQueries, T.HasLen, 1)
+	c.Assert(driveQueries[0].Get("startChangeId"), T.Equals, "3")
+	_, err = s.metaService.Resolve("Team/notes")
+	c.Assert(err, T.IsNil)
+
+	// journaled at the sync position of My Drive
+	entries, err := s.metaService.Diff(0, 1)
+	c.Assert(err, T.IsNil)
+	ids := []string{}
+	for _, entry := range entries {
+		ids = append(ids, entry.Id)
+	}
+	sort.Strings(ids)
+	c.Assert(ids, T.DeepEquals, []string{"budgets", "mine", "notes", "plans", "team"})
+}
+
+func (s *SyncerSuite) TestMyDriveOnlyWithoutSharedDrives(c *T.C) {
+	s.drive.addDriveChange("team", folderChange("plans", "team"))
+	s.drive.setOnChanges(func(query url.Values) {
+		c.Check(query.Get("driveId"), T.Equals, "")
+		c.Check(query.Get("supportsAllDrives"), T.Equals, "")
+	})
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	_, err := s.metaService.Get("plans")
+	c.Assert(err, T.NotNil)
+}
+
+// Records the delays before the retries of the Drive calls instead of
+// waiting.
+func (s *SyncerSuite) recordApiRetries() (delays *[]time.Duration) {
+	delays = &[]time.Duration{}
+	s.syncer.wait = func(ctx context.Context, d time.Duration) error {
+		*delays = append(*delays, d)
+		return ctx.Err()
+	}
+	return
+}
+
+func (s *SyncerSuite) TestRateLimitedCallsAreRetried(c *T.C) {
+	delays := s.recordApiRetries()
+	s.drive.addChange(folderChange("folder", "rootId"))
+	s.drive.changeFailures = []fakeFailure{
+		{code: http.StatusForbidden, reason: "userRateLimitExceeded", retryAfter: "7"},
+		{code: http.StatusServiceUnavailable, reason: "backendError"},
+		{code: http.StatusForbidden, reason: "rateLimitExceeded"},
+	}
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	_, err := s.metaService.Get("folder")
+	c.Assert(err, T.IsNil)
+
+	c.Assert(*delays, T.HasLen, 3)
+	c.Assert((*delays)[0], T.Equals, 7*time.Second)
+	// backs off exponentially by the attempt, jittered by up to a half
+	for i, base := range []time.Duration{2 * DefaultApiRetryDelay, 4 * DefaultApiRetryDelay} {
+		d := (*delays)[i+1]
+		c.Assert(d >= base && d <= base*3/2, T.Equals, true, T.Commentf("delay %v of %v", d, base))
+	}
+}
+
+func (s *SyncerSuite) TestRetryAfterDatesAreHonoredUpToTheMax(c *T.C) {
+	delays := s.recordApiRetries()
+	s.drive.addChange(folderChange("folder", "rootId"))
+	s.drive.changeFailures = []fakeFailure{
+		{code: http.StatusForbidden, reason: "userRateLimitExceeded", retryAfter: time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)},
+		{code: http.StatusTooManyRequests, retryAfter: "86400"},
+	}
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(*delays, T.HasLen, 2)
+	// the date is rounded down to the second
+	c.Assert((*delays)[0] > 58*time.Second && (*delays)[0] <= time.Minute, T.Equals, true, T.Commentf("delay %v", (*delays)[0]))
+	c.Assert((*delays)[1], T.Equals, DefaultMaxRetryAfter)
+}
+
+func (s *SyncerSuite) TestRetriesOfDriveCallsRunOut(c *T.C) {
+	delays := s.recordApiRetries()
+	s.syncer.opts.ApiAttempts = 3
+	s.drive.addChange(folderChange("folder", "rootId"))
+	for i := 0; i < 3; i++ {
+		s.drive.changeFailures = append(s.drive.changeFailures, fakeFailure{code: http.StatusInternalServerError})
+	}
+	_, err := s.syncer.Sync(false)
+	apiErr, ok := err.(*googleapi.Error)
+	c.Assert(ok, T.Equals, true, T.Commentf("%v", err))
+	c.Assert(apiErr.Code, T.Equals, http.StatusInternalServerError)
+	c.Assert(*delays, T.HasLen, 2)
+}
+
+func (s *SyncerSuite) TestForbiddenCallsAreNotRetried(c *T.C) {
+	delays := s.recordApiRetries()
+	s.drive.changeFailures = []fakeFailure{{code: http.StatusForbidden, reason: "insufficientPermissions"}}
+	c.Assert(syncErr(s.syncer.Sync(false)), T.NotNil)
+	c.Assert(*delays, T.HasLen, 0)
+}
+
+func (s *SyncerSuite) TestCancelStopsTheRetries(c *T.C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.syncer.wait = func(waitCtx context.Context, d time.Duration) error {
+		cancel()
+		return sleepContext(waitCtx, time.Hour)
+	}
+	s.drive.changeFailures = []fakeFailure{{code: http.StatusServiceUnavailable}}
+	c.Assert(syncErr(s.syncer.SyncContext(ctx, false)), T.Equals, context.Canceled)
+}
+
+// Saves the root folder and the given files and folders as cached,
+// the ones with upload set queued for upload. Files are saved with
+// their contents cached.
+func (s *SyncerSuite) saveTree(c *T.C, files []*metadata.CachedDriveFile, upload map[string]bool, contents map[string]string) {
+	root := &metadata.CachedDriveFile{Id: metadata.IdRootFolder, Name: "My Drive", MimeType: metadata.MimeTypeFolder}
+	c.Assert(s.metaService.Save("", metadata.IdRootFolder, root, false, false), T.IsNil)
+	for _, file := range files {
+		if content, ok := contents[file.Id]; ok {
+			file.FileSize = int64(len(content))
+			c.Assert(s.syncer.blobManager.Save(file.Id, file.Md5Checksum, ioutil.NopCloser(strings.NewReader(content))), T.IsNil)
+		}
+		c.Assert(s.metaService.Save(file.ParentId, file.Id, file, false, upload[file.Id]), T.IsNil)
+	}
+}
+
+// Returns true if the file is waiting to be pushed.
+func (s *SyncerSuite) queuedForUpload(c *T.C, id string) bool {
+	queued, err := s.metaService.IsQueuedForIO("upload", id)
+	c.Assert(err, T.IsNil)
+	return queued
+}
+
+func (s *SyncerSuite) TestSyncOutbound(c *T.C) {
+	s.drive.files["edited"] = &client.File{Id: "edited", Title: "edited.txt", MimeType: "text/plain", Md5Checksum: "remote"}
+	s.drive.files["clean"] = &client.File{Id: "clean", Title: "clean.txt", MimeType: "text/plain", Md5Checksum: "remote"}
+	s.saveTree(c, []*metadata.CachedDriveFile{
+		{Id: "local:dir", ParentId: metadata.IdRootFolder, Name: "dir", MimeType: metadata.MimeTypeFolder},
+		{Id: "local:new", ParentId: "local:dir", Name: "new.txt", MimeType: "text/plain", Md5Checksum: "local"},
+		{Id: "edited", ParentId: metadata.IdRootFolder, Name: "edited.txt", Title: "edited.txt", MimeType: "text/plain", Md5Checksum: "local"},
+		{Id: "clean", ParentId: metadata.IdRootFolder, Name: "clean.txt", Title: "clean.txt", MimeType: "text/plain", Md5Checksum: "remote"},
+	}, map[string]bool{"local:dir": true, "local:new": true, "edited": true}, map[string]string{
+		"local:new": "new content",
+		"edited":    "edited content",
+		"clean":     "clean content",
+	})
+
+	c.Assert(s.syncer.syncOutbound(context.Background(), metadata.IdRootFolder, true, false), T.IsNil)
+	c.Assert(s.drive.uploads, T.DeepEquals, map[string]string{
+		"pushed-2": "new content",
+		"edited":   "edited content",
+	})
+	folder := s.drive.files["pushed-1"]
+	c.Assert(folder.Title, T.Equals, "dir")
+	c.Assert(folder.MimeType, T.Equals, metadata.MimeTypeFolder)
+	c.Assert(folder.Parents[0].Id, T.Equals, metadata.IdRootFolder)
+	c.Assert(s.drive.files["pushed-2"].Parents[0].Id, T.Equals, "pushed-1")
+
+	// the local files are re-keyed by their ids on Drive
+	_, err := s.metaService.Get("local:dir")
+	c.Assert(err, T.NotNil)
+	_, err = s.metaService.Get("local:new")
+	c.Assert(err, T.NotNil)
+	pushed, err := s.metaService.Resolve("dir/new.txt")
+	c.Assert(err, T.IsNil)
+	c.Assert(pushed.Id, T.Equals, "pushed-2")
+	c.Assert(pushed.Md5Checksum, T.Equals, s.drive.files["pushed-2"].Md5Checksum)
+	data, size, err := s.syncer.blobManager.Read("pushed-2", pushed.Md5Checksum, 0, 100)
+	c.Assert(string(data[:size]), T.Equals, "new content")
+	_, ok := s.syncer.blobManager.Stat("local:new")
+	c.Assert(ok, T.Equals, false)
+	for _, id := range []string{"pushed-1", "pushed-2", "edited"} {
+		c.Assert(s.queuedForUpload(c, id), T.Equals, false)
+	}
+}
+
+func (s *SyncerSuite) TestSyncOutboundOptions(c *T.C) {
+	s.drive.files["clean"] = &client.File{Id: "clean", Title: "clean.txt", MimeType: "text/plain", Md5Checksum: "remote"}
+	s.drive.files["dir"] = &client.File{Id: "dir", Title: "dir", MimeType: metadata.MimeTypeFolder}
+	s.drive.failingUploads["broken.txt"] = true
+	s.saveTree(c, []*metadata.CachedDriveFile{
+		{Id: "clean", ParentId: metadata.IdRootFolder, Name: "clean.txt", Title: "clean.txt", MimeType: "text/plain", Md5Checksum: "remote"},
+		{Id: "dir", ParentId: metadata.IdRootFolder, Name: "dir", Title: "dir", MimeType: metadata.MimeTypeFolder},
+		{Id: "local:nested", ParentId: "dir", Name: "nested.txt", MimeType: "text/plain", Md5Checksum: "local"},
+		{Id: "local:broken", ParentId: metadata.IdRootFolder, Name: "broken.txt", MimeType: "text/plain", Md5Checksum: "local"},
+		{Id: "local:uncached", ParentId: metadata.IdRootFolder, Name: "uncached.txt", MimeType: "text/plain", Md5Checksum: "local", FileSize: 10},
+	}, map[string]bool{"local:nested": true, "local:broken": true, "local:uncached": true}, map[string]string{
+		"clean":        "clean content",
+		"local:nested": "nested content",
+		"local:broken": "broken content",
+	})
+
+	// the failures are reported once the others are pushed
+	err := s.syncer.syncOutbound(context.Background(), metadata.IdRootFolder, false, true)
+	c.Assert(err, T.ErrorMatches, "failed to push 2 files: .*")
+	c.Assert(s.drive.uploads, T.DeepEquals, map[string]string{"clean": "clean content"})
+	c.Assert(s.queuedForUpload(c, "local:broken"), T.Equals, true)
+	c.Assert(s.queuedForUpload(c, "local:uncached"), T.Equals, true)
+	c.Assert(s.queuedForUpload(c, "local:nested"), T.Equals, true)
+
+	// a sync pushes the queued changes of the whole tree
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(s.drive.uploads["pushed-1"], T.Equals, "nested content")
+	c.Assert(s.queuedForUpload(c, "local:broken"), T.Equals, true)
+}
+
+func (s *SyncerSuite) TestLargeFilesAreUploadedInChunks(c *T.C) {
+	s.syncer.opts.UploadClient = &http.Client{Transport: s.drive}
+	s.syncer.opts.ResumableThreshold = 10
+	s.syncer.opts.UploadChunkSize = uploadChunkUnit
+	s.drive.files["edited"] = &client.File{Id: "edited", Title: "edited.txt", MimeType: "text/plain", Md5Checksum: "remote"}
+	large := strings.Repeat("0123456789", 60000)
+	s.saveTree(c, []*metadata.CachedDriveFile{
+		{Id: "local:large", ParentId: metadata.IdRootFolder, Name: "large.txt", MimeType: "text/plain", Md5Checksum: "local"},
+		{Id: "edited", ParentId: metadata.IdRootFolder, Name: "edited.txt", Title: "edited.txt", MimeType: "text/plain", Md5Checksum: "local"},
+		{Id: "local:small", ParentId: metadata.IdRootFolder, Name: "small.txt", MimeType: "text/plain", Md5Checksum: "local"},
+	}, map[string]bool{"local:large": true, "edited": true, "local:small": true}, map[string]string{
+		"local:large": large,
+		"edited":      "edited content",
+		"local:small": "small",
+	})
+
+	// the second chunk of the first upload fails, the push of the
+	// others goes on
+	s.drive.chunkFailures = 1
+	c.Assert(s.syncer.syncOutbound(context.Background(), metadata.IdRootFolder, false, false), T.NotNil)
+	c.Assert(s.queuedForUpload(c, "local:large"), T.Equals, true)
+	session, err := s.metaService.GetUploadSession("local:large")
+	c.Assert(err, T.IsNil)
+	c.Assert(session, T.NotNil)
+	c.Assert(s.drive.uploads["edited"], T.Equals, "edited content")
+	progress := []int64{}
+	for _, e := range s.events() {
+		if e.Kind == UploadProgress && e.Id == "local:large" {
+			c.Assert(e.Total, T.Equals, int64(len(large)))
+			progress = append(progress, e.Bytes)
+		}
+	}
+	c.Assert(progress, T.DeepEquals, []int64{uploadChunkUnit})
+
+	// resumed from the chunk Drive received
+	c.Assert(s.syncer.syncOutbound(context.Background(), metadata.IdRootFolder, false, false), T.IsNil)
+	c.Assert(s.drive.sessions, T.HasLen, 2)
+	pushed, err := s.metaService.Resolve("large.txt")
+	c.Assert(err, T.IsNil)
+	c.Assert(s.drive.uploads[pushed.Id], T.Equals, large)
+	c.Assert(pushed.Md5Checksum, T.Equals, fmt.Sprintf("%x", md5.Sum([]byte(large))))
+	session, err = s.metaService.GetUploadSession("local:large")
+	c.Assert(err, T.IsNil)
+	c.Assert(session, T.IsNil)
+	progress = []int64{}
+	for _, e := range s.events() {
+		if e.Kind == UploadProgress && e.Id == "local:large" {
+			progress = append(progress, e.Bytes)
+		}
+	}
+	c.Assert(progress, T.DeepEquals, []int64{2 * uploadChunkUnit, int64(len(large))})
+}
+
+// Edits the cached content of the file identified by id locally, as
+// if it was written through the mount, and queues it for upload.
+func (s *SyncerSuite) editLocally(c *T.C, id string, checksum string, content string) {
+	c.Assert(s.syncer.blobManager.Save(id, checksum, ioutil.NopCloser(strings.NewReader(id))), T.IsNil)
+	c.Assert(s.syncer.blobManager.WriteAt(id, checksum, 0, []byte(content)), T.IsNil)
+	c.Assert(s.metaService.EnqueueForIO("upload", id), T.IsNil)
+}
+
+func (s *SyncerSuite) TestConflictingEdits(c *T.C) {
+	for _, id := range []string{"both", "local", "remote", "renamed"} {
+		s.drive.addChange(fileChange(id, "md5-1"))
+	}
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	// the files are not on the fake drive, pushing the edits fails and
+	// they stay queued
+	for _, id := range []string{"both", "local", "remote", "renamed"} {
+		s.editLocally(c, id, "md5-1", "local edit")
+	}
+
+	merge := func(policy ConflictPolicy, change *client.Change) *SyncResult {
+		s.syncer.opts.Conflicts = policy
+		s.drive.addChange(change)
+		result, err := s.syncer.Sync(false)
+		c.Assert(err, T.IsNil)
+		return result
+	}
+	read := func(id string) string {
+		entry, ok := s.syncer.blobManager.Stat(id)
+		c.Assert(ok, T.Equals, true)
+		data, size, err := s.syncer.blobManager.Read(id, entry.Checksum, 0, 100)
+		c.Assert(err, T.IsNil)
+		return string(data[:size])
+	}
+
+	// the local edit is kept as a new file, pushed by the next syncs
+	result := merge(ConflictKeepBoth, fileChange("both", "md5-2"))
+	c.Assert(result.Conflicts, T.DeepEquals, []string{"both"})
+	copied, err := s.metaService.Resolve("both (conflicted copy)")
+	c.Assert(err, T.IsNil)
+	c.Assert(copied.IsLocal(), T.Equals, true)
+	c.Assert(s.queuedForUpload(c, copied.Id), T.Equals, true)
+	c.Assert(read(copied.Id), T.Equals, "local edit")
+	_, ok := s.syncer.blobManager.Stat("both")
+	c.Assert(ok, T.Equals, false)
+	c.Assert(s.queuedForUpload(c, "both"), T.Equals, false)
+
+	result = merge(ConflictPreferLocal, fileChange("local", "md5-2"))
+	c.Assert(result.Conflicts, T.DeepEquals, []string{"local"})
+	c.Assert(read("local"), T.Equals, "local edit")
+	c.Assert(s.queuedForUpload(c, "local"), T.Equals, true)
+
+	result = merge(ConflictPreferRemote, fileChange("remote", "md5-2"))
+	c.Assert(result.Conflicts, T.DeepEquals, []string{"remote"})
+	_, ok = s.syncer.blobManager.Stat("remote")
+	c.Assert(ok, T.Equals, false)
+	c.Assert(s.queuedForUpload(c, "remote"), T.Equals, false)
+
+	// a change of the metadata only doesn't conflict
+	renamed := fileChange("renamed", "md5-1")
+	renamed.File.Title = "new name"
+	result = merge(ConflictPreferRemote, renamed)
+	c.Assert(result.Conflicts, T.HasLen, 0)
+	c.Assert(read("renamed"), T.Equals, "local edit")
+	c.Assert(s.queuedForUpload(c, "renamed"), T.Equals, true)
+	for _, file := range []string{"local", "remote", "new name"} {
+		_, err = s.metaService.Resolve(file + " (conflicted copy)")
+		c.Assert(err, T.NotNil)
+	}
+}
+
+func (s *SyncerSuite) TestPendingChangesAreFlushed(c *T.C) {
+	for _, id := range []string{"renamed", "edited", "deleted"} {
+		change := fileChange(id, "md5-1")
+		s.drive.files[id] = change.File
+		s.drive.addChange(change)
+	}
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+
+	// the child is recorded before the folder it is created in
+	s.saveTree(c, []*metadata.CachedDriveFile{
+		{Id: "local:child", ParentId: "local:dir", Name: "child.txt", MimeType: "text/plain"},
+		{Id: "local:dir", ParentId: metadata.IdRootFolder, Name: "dir", MimeType: metadata.MimeTypeFolder},
+	}, nil, map[string]string{"local:child": "child content"})
+	c.Assert(s.metaService.MarkPending("local:child", metadata.PendingCreate), T.IsNil)
+	c.Assert(s.metaService.MarkPending("local:dir", metadata.PendingCreate), T.IsNil)
+	renamed, err := s.metaService.Get("renamed")
+	c.Assert(err, T.IsNil)
+	renamed.Name, renamed.Title = "new name", "new name"
+	c.Assert(s.metaService.Save(metadata.IdRootFolder, "renamed", renamed, false, false), T.IsNil)
+	c.Assert(s.metaService.MarkPending("renamed", metadata.PendingRename), T.IsNil)
+	s.editLocally(c, "edited", "md5-1", "local edit")
+	c.Assert(s.metaService.MarkPending("edited", metadata.PendingUpdate), T.IsNil)
+	c.Assert(s.metaService.Delete("deleted"), T.IsNil)
+	c.Assert(s.metaService.MarkPending("deleted", metadata.PendingDelete), T.IsNil)
+
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(s.drive.files["pushed-1"].Title, T.Equals, "dir")
+	c.Assert(s.drive.files["pushed-2"].Parents[0].Id, T.Equals, "pushed-1")
+	c.Assert(s.drive.uploads, T.DeepEquals, map[string]string{
+		"pushed-2": "child content",
+		"edited":   "local edit",
+	})
+	c.Assert(s.drive.files["renamed"].Title, T.Equals, "new name")
+	c.Assert(s.drive.files["deleted"].Labels.Trashed, T.Equals, true)
+	pushed, err := s.metaService.Resolve("dir/child.txt")
+	c.Assert(err, T.IsNil)
+	c.Assert(pushed.Id, T.Equals, "pushed-2")
+	changes, err := s.metaService.ListPending()
+	c.Assert(err, T.IsNil)
+	c.Assert(changes, T.HasLen, 0)
+	c.Assert(s.queuedForUpload(c, "edited"), T.Equals, false)
+}
+
+func (s *SyncerSuite) TestFlushConflictsFollowThePolicy(c *T.C) {
+	for _, id := range []string{"both", "local", "remote"} {
+		change := fileChange(id, "md5-1")
+		s.drive.files[id] = change.File
+		s.drive.addChange(change)
+	}
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	flush := func(policy ConflictPolicy, id string) *SyncResult {
+		s.syncer.opts.Conflicts = policy
+		s.editLocally(c, id, "md5-1", "local edit")
+		c.Assert(s.metaService.MarkPending(id, metadata.PendingUpdate), T.IsNil)
+		// edited on Drive too, the change is not merged yet
+		s.drive.files[id].Md5Checksum = "md5-2"
+		result, err := s.syncer.Sync(false)
+		c.Assert(err, T.IsNil)
+		return result
+	}
+
+	result := flush(ConflictKeepBoth, "both")
+	c.Assert(result.Conflicts, T.DeepEquals, []string{"both"})
+	c.Assert(s.drive.uploads["both"], T.Equals, "")
+	copied, err := s.metaService.Resolve("both (conflicted copy)")
+	c.Assert(err, T.IsNil)
+	c.Assert(s.drive.uploads[copied.Id], T.Equals, "local edit")
+	_, ok := s.syncer.blobManager.Stat("both")
+	c.Assert(ok, T.Equals, false)
+
+	result = flush(ConflictPreferLocal, "local")
+	c.Assert(result.Conflicts, T.DeepEquals, []string{"local"})
+	c.Assert(s.drive.uploads["local"], T.Equals, "local edit")
+
+	result = flush(ConflictPreferRemote, "remote")
+	c.Assert(result.Conflicts, T.DeepEquals, []string{"remote"})
+	c.Assert(s.drive.uploads["remote"], T.Equals, "")
+	c.Assert(s.queuedForUpload(c, "remote"), T.Equals, false)
+	_, err = s.metaService.Resolve("remote (conflicted copy)")
+	c.Assert(err, T.NotNil)
+	changes, err := s.metaService.ListPending()
+	c.Assert(err, T.IsNil)
+	c.Assert(changes, T.HasLen, 0)
+}
+
+func (s *SyncerSuite) TestLastSyncTimeIsRecorded(c *T.C) {
+	before := time.Now()
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	synced, err := s.metaService.GetLastSyncTime()
+	c.Assert(err, T.IsNil)
+	c.Assert(synced.Before(before), T.Equals, false)
+
+	// a failed sync is an attempt only
+	s.drive.changeFailures = []fakeFailure{{code: http.StatusForbidden, reason: "insufficientPermissions"}}
+	c.Assert(syncErr(s.syncer.Sync(false)), T.NotNil)
+	last, err := s.metaService.GetLastSyncTime()
+	c.Assert(err, T.IsNil)
+	c.Assert(last.Equal(synced), T.Equals, true)
+	at, message, err := s.metaService.GetLastSyncAttempt()
+	c.Assert(err, T.IsNil)
+	c.Assert(at.After(synced), T.Equals, true)
+	c.Assert(message, T.Not(T.Equals), "")
+}
+
+func (s *SyncerSuite) TestTrashedFilesLoseTheirBlobs(c *T.C) {
+	s.drive.addChange(fileChange("file", "md5-1"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(s.syncer.blobManager.Save("file", "md5-1", ioutil.NopCloser(strings.NewReader("file"))), T.IsNil)
+
+	trashed := fileChange("file", "md5-1")
+	trashed.File.Labels.Trashed = true
+	s.drive.addChange(trashed)
+	result, err := s.syncer.Sync(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(result.FilesDeleted, T.Equals, 1)
+	_, err = s.metaService.Get("file")
+	c.Assert(err, T.NotNil)
+	_, ok := s.syncer.blobManager.Stat("file")
+	c.Assert(ok, T.Equals, false)
+	_, _, err = s.syncer.blobManager.Read("file", "md5-1", 0, 4)
+	c.Assert(err, T.NotNil)
+}
+
+func (s *SyncerSuite) TestDeletedFilesAreTrashed(c *T.C) {
+	s.syncer.opts.TrashRetention = time.Hour
+	sum := fmt.Sprintf("%x", md5.Sum([]byte("content")))
+	c.Assert(s.syncer.mergeChange("rootId", fileChange("file", sum)), T.IsNil)
+	c.Assert(s.syncer.blobManager.Save("file", sum, ioutil.NopCloser(strings.NewReader("content"))), T.IsNil)
+	c.Assert(s.metaService.InitFile("file"), T.IsNil)
+	s.metaService.DequeueFromIO("download", "file")
+
+	c.Assert(s.syncer.mergeChange("rootId", &client.Change{FileId: "file", Deleted: true}), T.IsNil)
+	_, err := s.metaService.Get("file")
+	c.Assert(err, T.Equals, metadata.ErrNotFound)
+	trashed, err := s.metaService.GetTrashed("file")
+	c.Assert(err, T.IsNil)
+	c.Assert(trashed.Md5Checksum, T.Equals, sum)
+	c.Assert(s.syncer.blobManager.Exists("file", sum), T.Equals, false)
+
+	// the content of the file reappearing is not downloaded again
+	c.Assert(s.syncer.mergeChange("rootId", fileChange("file", sum)), T.IsNil)
+	c.Assert(s.downloads(c), T.DeepEquals, []string{})
+	data, size, err := s.syncer.blobManager.Read("file", sum, 0, 16)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, "content")
+	_, err = s.metaService.GetTrashed("file")
+	c.Assert(err, T.Equals, metadata.ErrNotFound)
+
+	// the files trashed within the retention are kept
+	c.Assert(s.syncer.mergeChange("rootId", &client.Change{FileId: "file", Deleted: true}), T.IsNil)
+	c.Assert(s.syncer.EmptyTrash(time.Hour), T.IsNil)
+	_, err = s.metaService.GetTrashed("file")
+	c.Assert(err, T.IsNil)
+	c.Assert(s.syncer.EmptyTrash(0), T.IsNil)
+	_, err = s.metaService.GetTrashed("file")
+	c.Assert(err, T.Equals, metadata.ErrNotFound)
+	c.Assert(s.syncer.Restore(context.Background(), "file"), T.Equals, ErrNotInTrash)
+
+	// deleted right away unless the trash is enabled
+	s.syncer.opts.TrashRetention = 0
+	c.Assert(s.syncer.mergeChange("rootId", fileChange("other", sum)), T.IsNil)
+	c.Assert(s.syncer.mergeChange("rootId", &client.Change{FileId: "other", Deleted: true}), T.IsNil)
+	_, err = s.metaService.GetTrashed("other")
+	c.Assert(err, T.Equals, metadata.ErrNotFound)
+}
+
+func (s *SyncerSuite) TestTrashedFilesAreRestored(c *T.C) {
+	s.syncer.opts.TrashRetention = time.Hour
+	sum := fmt.Sprintf("%x", md5.Sum([]byte("content")))
+	for _, id := range []string{"untrashed", "gone"} {
+		change := fileChange(id, sum)
+		s.drive.files[id] = change.File
+		s.drive.addChange(change)
+	}
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	for _, id := range []string{"untrashed", "gone"} {
+		c.Assert(s.syncer.blobManager.Save(id, sum, ioutil.NopCloser(strings.NewReader("content"))), T.IsNil)
+		c.Assert(s.metaService.InitFile(id), T.IsNil)
+		s.metaService.DequeueFromIO("download", id)
+		s.drive.addChange(&client.Change{FileId: id, Deleted: true})
+	}
+	s.drive.mu.Lock()
+	delete(s.drive.files, "gone")
+	s.drive.mu.Unlock()
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	_, err := s.metaService.Get("untrashed")
+	c.Assert(err, T.Equals, metadata.ErrNotFound)
+
+	// untrashed on Drive, the next sync restores it
+	c.Assert(s.syncer.Restore(context.Background(), "untrashed"), T.IsNil)
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	file, err := s.metaService.LookUp(metadata.IdRootFolder, "untrashed")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Id, T.Equals, "untrashed")
+	c.Assert(s.syncer.blobManager.Exists("untrashed", sum), T.Equals, true)
+
+	// gone from Drive, restored as a new file to upload
+	c.Assert(s.syncer.Restore(context.Background(), "gone"), T.IsNil)
+	file, err = s.metaService.LookUp(metadata.IdRootFolder, "gone")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.Id, T.Equals, metadata.LocalIdPrefix+"gone")
+	queued, err := s.metaService.IsQueuedForIO("upload", file.Id)
+	c.Assert(err, T.IsNil)
+	c.Assert(queued, T.Equals, true)
+	data, size, err := s.syncer.blobManager.Read(file.Id, sum, 0, 16)
+	c.Assert(err, T.IsNil)
+	c.Assert(string(data[:size]), T.Equals, "content")
+	_, err = s.metaService.GetTrashed("gone")
+	c.Assert(err, T.Equals, metadata.ErrNotFound)
+}
+
+func (s *SyncerSuite) TestLargeFilesAreNotCached(c *T.C) {
+	s.syncer.opts.MaxBlobSize = int64(len("small"))
+	for _, id := range []string{"small", "larger", "largest"} {
+		s.drive.addChange(fileChange(id, "md5"+id))
+	}
+	result, err := s.syncer.Sync(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(result.FilesAdded, T.Equals, 3)
+	c.Assert(result.FilesSkipped, T.Equals, 2)
+	c.Assert(result.BytesSkipped, T.Equals, int64(len("larger")+len("largest")))
+	c.Assert(result.BytesQueued, T.Equals, int64(len("small")))
+	c.Assert(s.downloads(c), T.DeepEquals, []string{"small"})
+
+	// listed with their size, but not cached
+	file, err := s.metaService.LookUp(metadata.IdRootFolder, "largest")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.FileSize, T.Equals, int64(len("largest")))
+	c.Assert(file.Uncached, T.Equals, true)
+	cached := []string{}
+	err = s.metaService.EachCached(func(file *metadata.CachedDriveFile) error {
+		cached = append(cached, file.Id)
+		return nil
+	})
+	c.Assert(err, T.IsNil)
+	c.Assert(cached, T.DeepEquals, []string{})
+
+	// cached once the limit is raised and the file changes
+	s.syncer.opts.MaxBlobSize = 0
+	s.drive.addChange(fileChange("larger", "md5larger2"))
+	result, err = s.syncer.Sync(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(result.FilesSkipped, T.Equals, 0)
+	c.Assert(s.downloads(c), T.DeepEquals, []string{"small", "larger"})
+}
+
+func (s *SyncerSuite) TestManifestOfTheCachedTree(c *T.C) {
+	var buf bytes.Buffer
+	c.Assert(s.syncer.ExportManifest(&buf), T.NotNil) // nothing synced yet
+
+	s.drive.addChange(folderChange("docs", "rootId"))
+	report := fileChange("report", "sum")
+	report.File.Parents = []*client.ParentReference{{Id: "docs"}, {Id: "rootId"}}
+	s.drive.addChange(report)
+	s.drive.addChange(fileChange("notes", "other sum"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	c.Assert(s.syncer.blobManager.Save("report", "sum", ioutil.NopCloser(strings.NewReader("report"))), T.IsNil)
+
+	buf.Reset()
+	c.Assert(s.syncer.ExportManifest(&buf), T.IsNil)
+	entries := []ManifestEntry{}
+	c.Assert(json.Unmarshal(buf.Bytes(), &entries), T.IsNil, T.Commentf(buf.String()))
+	byId := make(map[string]ManifestEntry)
+	for _, e := range entries {
+		byId[e.Id] = e
+	}
+	// once, although linked under two folders
+	c.Assert(entries, T.HasLen, 3)
+	c.Assert(byId["docs"].Path, T.Equals, "docs")
+	c.Assert(byId["docs"].MimeType, T.Equals, metadata.MimeTypeFolder)
+	c.Assert(byId["docs"].Cached, T.Equals, false)
+	doc := byId["report"]
+	c.Assert(doc.ParentIds, T.DeepEquals, []string{metadata.IdRootFolder, "docs"})
+	c.Assert(doc.Checksum, T.Equals, "sum")
+	c.Assert(doc.Size, T.Equals, int64(len("report")))
+	c.Assert(doc.Cached, T.Equals, true)
+	notes := byId["notes"]
+	c.Assert(notes.Path, T.Equals, "notes")
+	c.Assert(notes.ParentIds, T.DeepEquals, []string{metadata.IdRootFolder})
+	c.Assert(notes.Cached, T.Equals, false)
+}
+
+func (s *SyncerSuite) TestPerFileSyncState(c *T.C) {
+	sum := fmt.Sprintf("%x", md5.Sum([]byte("content")))
+	s.drive.addChange(fileChange("other", sum))
+	s.drive.addChange(fileChange("tracked", sum))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	file, err := s.metaService.Get("tracked")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.ChangeId, T.Equals, int64(2))
+
+	// the blobs verified recently are not read again
+	c.Assert(s.metaService.InitFile("tracked"), T.IsNil)
+	s.metaService.DequeueFromIO("download", "tracked")
+	c.Assert(s.syncer.blobManager.Save("tracked", sum, ioutil.NopCloser(strings.NewReader("content"))), T.IsNil)
+	s.syncer.opts.VerifyInterval = time.Hour
+	report, err := s.syncer.Verify(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(report.Skipped, T.Equals, 0)
+	file, err = s.metaService.Get("tracked")
+	c.Assert(err, T.IsNil)
+	c.Assert(time.Since(file.VerifiedAt) < time.Minute, T.Equals, true)
+	report, err = s.syncer.Verify(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(report.Blobs, T.Equals, 1)
+	c.Assert(report.Skipped, T.Equals, 1)
+
+	// kept while the content is unchanged
+	renamed := fileChange("tracked", sum)
+	renamed.File.Title = "renamed"
+	s.drive.addChange(renamed)
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	file, err = s.metaService.Get("tracked")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.ChangeId, T.Equals, int64(3))
+	c.Assert(file.VerifiedAt.IsZero(), T.Equals, false)
+	s.drive.addChange(fileChange("tracked", "newsum"))
+	c.Assert(syncErr(s.syncer.Sync(false)), T.IsNil)
+	file, err = s.metaService.Get("tracked")
+	c.Assert(err, T.IsNil)
+	c.Assert(file.VerifiedAt.IsZero(), T.Equals, true)
+
+	// the files failing to download are reported until they are retried
+	_, err = s.metaService.AddDownloadFailure("tracked", "download failed")
+	c.Assert(err, T.IsNil)
+	c.Assert(s.metaService.Quarantine("tracked", time.Now().Add(time.Hour)), T.IsNil)
+	result, err := s.syncer.Sync(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(result.Errors, T.HasLen, 1)
+	c.Assert(errors.Is(result.Errors[0], ErrDownloadsStopped), T.Equals, true)
+	c.Assert(result.Errors[0], T.ErrorMatches, ".*tracked after 1 failed downloads.*download failed")
+	c.Assert(s.metaService.Unquarantine("tracked"), T.IsNil)
+	result, err = s.syncer.Sync(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(result.Errors, T.HasLen, 0)
+}
+
+func (s *SyncerSuite) TestVerify(c *T.C) {
+	sum := fmt.Sprintf("%x", md5.Sum([]byte("content")))
+	for _, id := range []string{"sound", "corrupt", "stale", "missing"} {
+		c.Assert(s.syncer.mergeChange("rootId", fileChange(id, sum)), T.IsNil)
+		c.Assert(s.metaService.InitFile(id), T.IsNil)
+		s.metaService.DequeueFromIO("download", id)
+	}
+	blobs := s.syncer.blobManager
+	for _, id := range []string{"sound", "corrupt", "orphan"} {
+		c.Assert(blobs.Save(id, sum, ioutil.NopCloser(strings.NewReader("content"))), T.IsNil)
+	}
+	c.Assert(blobs.Save("stale", "old", ioutil.NopCloser(strings.NewReader("old content"))), T.IsNil)
+	corrupt, ok := blobs.Stat("corrupt")
+	c.Assert(ok, T.Equals, true)
+	c.Assert(ioutil.WriteFile(corrupt.Path, []byte("tampered"), 0640), T.IsNil)
+
+	report, err := s.syncer.Verify(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(report.OK(), T.Equals, false)
+	c.Assert(report.Blobs, T.Equals, 4)
+	ids := func(entries []blob.Entry) []string {
+		ids := []string{}
+		for _, e := range entries {
+			ids = append(ids, e.Id)
+		}
+		return ids
+	}
+	c.Assert(ids(report.Corrupt), T.DeepEquals, []string{"corrupt"})
+	c.Assert(ids(report.Orphans), T.DeepEquals, []string{"orphan"})
+	c.Assert(ids(report.Stale), T.DeepEquals, []string{"stale"})
+	// the blob of its checksum is missing too
+	c.Assert(report.Missing, T.DeepEquals, []string{"stale", "missing"})
+	// only reported
+	c.Assert(blobs.Exists("orphan", sum), T.Equals, true)
+	c.Assert(s.downloads(c), T.DeepEquals, []string{})
+
+	report, err = s.syncer.Verify(true)
+	c.Assert(err, T.IsNil)
+	c.Assert(report.OK(), T.Equals, false)
+	for _, id := range []string{"corrupt", "orphan"} {
+		c.Assert(blobs.Exists(id, sum), T.Equals, false)
+	}
+	c.Assert(blobs.Exists("stale", "old"), T.Equals, false)
+	c.Assert(blobs.Exists("sound", sum), T.Equals, true)
+	c.Assert(s.downloads(c), T.DeepEquals, []string{"corrupt", "stale", "missing"})
+
+	report, err = s.syncer.Verify(false)
+	c.Assert(err, T.IsNil)
+	c.Assert(report.OK(), T.Equals, true)
+	c.Assert(report.Blobs, T.Equals, 1)
+}
@@ -0,0 +1,147 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rakyll/drivefuse/metadata"
+)
+
+var (
+	// The file is not in the local trash, or its content isn't, see
+	// CachedSyncer.Restore.
+	ErrNotInTrash = errors.New("syncer: the file is not in the local trash")
+)
+
+// Restores the file identified by id from the local trash, see
+// SyncOptions.TrashRetention. The file is untrashed on Drive, the next
+// sync, triggered right away, restores its metadata and its content.
+// If Drive doesn't have the file anymore, it is deleted for good, the
+// file is restored locally as a new file under its former folder, or
+// the root folder if the folder is gone, and uploaded by the next sync.
+// Returns ErrNotInTrash if the file, or its content to upload, is not
+// in the trash.
+func (d *CachedSyncer) Restore(ctx context.Context, id string) error {
+	trashed, err := d.metaService.GetTrashed(id)
+	if err == metadata.ErrNotFound {
+		return ErrNotInTrash
+	}
+	if err != nil {
+		return err
+	}
+	err = d.doWithRetry(ctx, func() error {
+		_, err := d.remoteService.Files.Untrash(id).Do()
+		return err
+	})
+	if err == nil {
+		d.opts.Logger.V("untrashed", id, "on Drive")
+		d.Trigger()
+		return nil
+	}
+	if !isNotFound(err) {
+		return err
+	}
+	return d.restoreLocally(trashed)
+}
+
+// Restores the trashed file as a new local file, queued for upload.
+func (d *CachedSyncer) restoreLocally(trashed *metadata.CachedDriveFile) error {
+	newId := metadata.LocalIdPrefix + trashed.Id
+	ok, err := d.blobManager.Untrash(trashed.Id, newId, trashed.Md5Checksum)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotInTrash
+	}
+	d.opts.Logger.V("restoring", trashed.Id, "locally as", newId)
+	data := *trashed
+	data.Id = newId
+	if _, err := d.metaService.Get(data.ParentId); err != nil {
+		data.ParentId = metadata.IdRootFolder
+	}
+	// apart from the page of changes a sync may be merging
+	err = d.retryBusy(func() error {
+		return d.metaService.Batch(func(b *metadata.Batch) error {
+			if err := d.resolveConflicts(b, []string{data.ParentId}, newId, &data); err != nil {
+				return err
+			}
+			if err := b.Save(data.ParentId, newId, &data, false, true); err != nil {
+				return err
+			}
+			return b.DeleteTrashed(trashed.Id)
+		})
+	})
+	if err != nil {
+		d.blobManager.Delete(newId)
+		return err
+	}
+	if err = d.metaService.InitFile(newId); err != nil {
+		return err
+	}
+	d.invalidate([]InvalidateEvent{{FileId: newId, ParentId: data.ParentId, Kind: InvalidateEntry}})
+	return nil
+}
+
+// Purges the files trashed olderThan ago or earlier from the local
+// trash, their metadata and their contents. Zero empties the trash.
+func (d *CachedSyncer) EmptyTrash(olderThan time.Duration) error {
+	files, err := d.metaService.ListTrash(time.Now().Add(-olderThan))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = d.blobManager.DeleteTrashed(file.Id); err != nil {
+			return err
+		}
+		if err = d.metaService.DeleteTrashed(file.Id); err != nil {
+			return err
+		}
+	}
+	if len(files) > 0 {
+		d.opts.Logger.V("Purged", len(files), "files from the trash")
+	}
+	return nil
+}
+
+// Restores the content of the file, if requested by restore, from the
+// local trash rather than downloading it again, if the file was trashed
+// with the same checksum, e.g. once it is untrashed on Drive. Returns
+// false if it isn't restored, the other trashed contents of the file
+// are deleted then.
+func (d *CachedSyncer) untrashContent(data *metadata.CachedDriveFile, restore bool) bool {
+	if d.opts.TrashRetention <= 0 || d.opts.DryRun {
+		return false
+	}
+	if _, err := d.getTrashed(data.Id); err != nil {
+		return false
+	}
+	if restore && data.Md5Checksum != "" {
+		ok, err := d.blobManager.Untrash(data.Id, data.Id, data.Md5Checksum)
+		if err != nil {
+			d.opts.Logger.V("can't restore the content of", data.Id, "from the trash", err)
+		}
+		if ok {
+			return true
+		}
+	}
+	if err := d.blobManager.DeleteTrashed(data.Id); err != nil {
+		d.opts.Logger.V("error deleting the trashed content of", data.Id, err)
+	}
+	return false
+}
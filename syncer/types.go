@@ -14,12 +14,140 @@
 
 package syncer
 
+import (
+	"context"
+
+	"github.com/rakyll/drivefuse/metadata"
+)
+
 type Syncer interface {
-	// Starts a periodic syncing, returns immediately.
-	Start()
+	// Starts a periodic syncing until ctx is done, returns
+	// immediately.
+	Start(ctx context.Context)
+
+	// Starts a sync if no syncing, returns ErrSyncInProgress
+	// immediately otherwise. Ignores incremental syncs if isForce
+	// is set. Returns what the sync did.
+	Sync(isForce bool) (*SyncResult, error)
+
+	// Runs a single incremental sync, as the periodic syncing does,
+	// until ctx is done. Returns what the sync did.
+	SyncOnce(ctx context.Context) (*SyncResult, error)
+
+	// Requests an out-of-band sync from the periodic syncing,
+	// returns immediately. Pending requests are coalesced.
+	Trigger()
+
+	// Pauses the syncing if offline is set, syncs return ErrOffline
+	// until it is resumed.
+	SetOffline(offline bool)
+
+	// Pauses the syncing until it is resumed, syncs return ErrPaused
+	// in between. Resuming triggers a sync.
+	Pause()
+	Resume()
+
+	// Blocks until the first sync has completed successfully.
+	WaitReady()
+
+	// Returns a channel that is closed once the next sync
+	// completes successfully.
+	NextSync() <-chan struct{}
+}
+
+// FileClass is how the content of a file is fetched, if it has any.
+type FileClass int
+
+const (
+	ClassFolder FileClass = iota + 1
+	ClassShortcut
+	// Downloaded from Drive, through its download url if it has one.
+	ClassDownloadable
+	// Native docs, exported to the format of SyncOptions.ExportFormats.
+	ClassExportable
+	// Native docs stored as links to open them online.
+	ClassLink
+	// Files that can be neither downloaded nor exported, such as the
+	// files of third-party apps, listed as empty files.
+	ClassUnsupported
+)
+
+func (c FileClass) String() string {
+	switch c {
+	case ClassFolder:
+		return "folder"
+	case ClassShortcut:
+		return "shortcut"
+	case ClassDownloadable:
+		return "downloadable"
+	case ClassExportable:
+		return "exportable"
+	case ClassLink:
+		return "link"
+	case ClassUnsupported:
+		return "unsupported"
+	}
+	return "unknown"
+}
+
+// Returns the class of the file of the metadata.
+func classify(data *metadata.CachedDriveFile) FileClass {
+	switch {
+	case data.IsFolder():
+		return ClassFolder
+	case data.IsShortcut():
+		return ClassShortcut
+	case data.IsLink():
+		return ClassLink
+	case data.IsNativeDoc() && data.ExportMimeType() != "":
+		return ClassExportable
+	case data.IsNativeDoc():
+		return ClassUnsupported
+	}
+	return ClassDownloadable
+}
+
+// SyncResult describes what a sync did. A failed sync reports what it
+// did before failing.
+type SyncResult struct {
+	// Number of files and folders added to, updated in and deleted
+	// from the cached metadata.
+	FilesAdded   int
+	FilesUpdated int
+	FilesDeleted int
+
+	// Total size of the contents queued for download. Contents are
+	// downloaded in the background by the download queues, see
+	// fileio.Downloader.
+	BytesQueued int64
+
+	// Number and total size of the files whose contents are not
+	// downloaded, they are larger than SyncOptions.MaxBlobSize.
+	FilesSkipped int
+	BytesSkipped int64
+
+	// Number of the files that are not synced, their MIME types are
+	// filtered out, see SyncOptions.MimeTypes.
+	FilesFiltered int
+
+	// Number of remote changes merged, including the ones that didn't
+	// change anything.
+	ChangesProcessed int
+
+	// Ids of the files edited both locally and on Drive since the last
+	// sync, merged according to SyncOptions.Conflicts.
+	Conflicts []string
+
+	// Number of the files and folders added or updated, by class.
+	Classes map[FileClass]int
+
+	// Largest change id synchronized after the sync, see
+	// metadata.MetaService.GetLargestChangeId.
+	NewChangeId int64
 
-	// Starts a sync if no syncing ,waits for the existing
-	// sync process to be finished. Ignores incremental syncs
-	// if isForce is set.
-	Sync(isForce bool) (err error)
+	// Errors that didn't fail the sync, such as failed uploads, the
+	// changes of files that couldn't be merged and the errors of
+	// SyncOptions.Errors. The skipped changes are not retried by the
+	// next syncs.
+	Errors []error
 }
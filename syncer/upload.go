@@ -0,0 +1,218 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/rakyll/drivefuse/metadata"
+	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/googleapi"
+)
+
+const (
+	uploadUrl = "https://www.googleapis.com/upload/drive/v2/files"
+
+	// Status of the responses to the chunks of a resumable upload but
+	// the last one.
+	statusResumeIncomplete = 308
+)
+
+// Returns the checksum and the size of the cached content of the file
+// if it is to be uploaded in chunks, see SyncOptions.ResumableThreshold.
+func (d *CachedSyncer) resumable(file *metadata.CachedDriveFile) (checksum string, size int64, ok bool) {
+	if d.opts.UploadClient == nil {
+		return "", 0, false
+	}
+	entry, ok := d.blobManager.Stat(file.Id)
+	if !ok {
+		return "", 0, false
+	}
+	size, err := d.blobManager.Size(file.Id, entry.Checksum)
+	if err != nil || size < d.opts.ResumableThreshold {
+		return "", 0, false
+	}
+	return entry.Checksum, size, true
+}
+
+// Uploads the cached content of the file with the checksum, of size
+// bytes, and its metadata in remote, in chunks. The session of the
+// upload is persisted, so that an upload interrupted by a failure or
+// a restart resumes from the last chunk Drive received, unless the
+// content changed since. Returns the file Drive created or updated.
+func (d *CachedSyncer) uploadResumable(ctx context.Context, file *metadata.CachedDriveFile, remote *client.File, checksum string, size int64) (*client.File, error) {
+	content, err := d.blobManager.Open(file.Id, checksum)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	hash := md5.New()
+	if _, err = io.Copy(hash, content); err != nil {
+		return nil, err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	offset := int64(0)
+	session, err := d.metaService.GetUploadSession(file.Id)
+	if err != nil {
+		return nil, err
+	}
+	if session != nil && session.Md5 == sum {
+		var done *client.File
+		offset, done, err = d.putChunk(ctx, session.Uri, nil, 0, 0, size)
+		switch {
+		case done != nil:
+			return d.uploaded(file, done)
+		case isNotFound(err) || isGone(err):
+			d.opts.Logger.V("upload session of", file.Id, "expired, starting over")
+			session = nil
+		case err != nil:
+			return nil, err
+		}
+	}
+	if session == nil || session.Md5 != sum {
+		uri, err := d.startUpload(ctx, file, remote, size)
+		if err != nil {
+			return nil, err
+		}
+		session, offset = &metadata.UploadSession{Uri: uri, Md5: sum}, 0
+		if err = d.metaService.SaveUploadSession(file.Id, session); err != nil {
+			return nil, err
+		}
+	}
+	for {
+		if _, err = content.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		n := min(d.opts.UploadChunkSize, size-offset)
+		prev := offset
+		var done *client.File
+		if offset, done, err = d.putChunk(ctx, session.Uri, content, offset, n, size); err != nil {
+			return nil, err
+		}
+		if done == nil && offset <= prev {
+			return nil, fmt.Errorf("upload of %v made no progress", file.Id)
+		}
+		d.publish(SyncEvent{Kind: UploadProgress, Id: file.Id, Name: file.Name, Bytes: offset, Total: size})
+		if done != nil {
+			return d.uploaded(file, done)
+		}
+	}
+}
+
+// Starts a resumable upload of size bytes creating the file on Drive,
+// or updating it if it is there already, with the metadata in remote.
+// Returns the uri of the session.
+func (d *CachedSyncer) startUpload(ctx context.Context, file *metadata.CachedDriveFile, remote *client.File, size int64) (string, error) {
+	body, err := json.Marshal(remote)
+	if err != nil {
+		return "", err
+	}
+	method, u := "POST", uploadUrl
+	if !file.IsLocal() {
+		method, u = "PUT", uploadUrl+"/"+url.PathEscape(file.Id)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u+"?uploadType=resumable", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", remote.MimeType)
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	res, err := d.opts.UploadClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if err = googleapi.CheckResponse(res); err != nil {
+		return "", err
+	}
+	uri := res.Header.Get("Location")
+	if uri == "" {
+		return "", fmt.Errorf("no session uri in the response to the upload of %v", file.Id)
+	}
+	return uri, nil
+}
+
+// Uploads n bytes read from r at offset of the content of size bytes
+// to the session at uri. If r is nil, only queries the progress of the
+// upload. Returns the offset the upload resumes from, and the file
+// Drive returns once it received the whole content.
+func (d *CachedSyncer) putChunk(ctx context.Context, uri string, r io.Reader, offset int64, n int64, size int64) (int64, *client.File, error) {
+	var body io.Reader = http.NoBody
+	contentRange := fmt.Sprintf("bytes */%d", size)
+	if r != nil {
+		body = io.LimitReader(r, n)
+		if n > 0 {
+			contentRange = fmt.Sprintf("bytes %d-%d/%d", offset, offset+n-1, size)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", uri, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.ContentLength = n
+	req.Header.Set("Content-Range", contentRange)
+	res, err := d.opts.UploadClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == statusResumeIncomplete {
+		// the range received so far, none if there is no header
+		received := strings.TrimPrefix(res.Header.Get("Range"), "bytes=0-")
+		if received == "" {
+			return 0, nil, nil
+		}
+		last, err := strconv.ParseInt(received, 10, 64)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid range %q of upload session", res.Header.Get("Range"))
+		}
+		return last + 1, nil, nil
+	}
+	if err = googleapi.CheckResponse(res); err != nil {
+		return 0, nil, err
+	}
+	done := &client.File{}
+	if err = json.NewDecoder(res.Body).Decode(done); err != nil {
+		return 0, nil, err
+	}
+	return size, done, nil
+}
+
+// Forgets the session of the upload of the file, now that it is done.
+func (d *CachedSyncer) uploaded(file *metadata.CachedDriveFile, remote *client.File) (*client.File, error) {
+	if err := d.metaService.DeleteUploadSession(file.Id); err != nil {
+		d.opts.Logger.V("error removing the upload session of", file.Id, err)
+	}
+	return remote, nil
+}
+
+// Returns true if err is a response of Drive to a session that
+// expired.
+func isGone(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && apiErr.Code == http.StatusGone
+}
@@ -0,0 +1,186 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rakyll/drivefuse/blob"
+	"github.com/rakyll/drivefuse/metadata"
+)
+
+// VerifyReport lists what CachedSyncer.Verify found wrong with the
+// cached contents.
+type VerifyReport struct {
+	// Number of blobs checked.
+	Blobs int
+
+	// Number of the blobs checked whose content was not read, it was
+	// verified recently, see SyncOptions.VerifyInterval.
+	Skipped int
+
+	// Blobs whose content doesn't match the checksum they are named
+	// after, e.g. truncated by a crash.
+	Corrupt []blob.Entry
+
+	// Blobs of the files that are not synced, and the ones of another
+	// checksum than the one of their file.
+	Orphans []blob.Entry
+	Stale   []blob.Entry
+
+	// Ids of the files listed as cached whose blobs are missing.
+	Missing []string
+}
+
+// Returns true if nothing is wrong with the cache.
+func (r *VerifyReport) OK() bool {
+	return len(r.Corrupt) == 0 && len(r.Orphans) == 0 && len(r.Stale) == 0 && len(r.Missing) == 0
+}
+
+// What is wrong with a blob, see CachedSyncer.verifyBlob.
+type blobProblem int
+
+const (
+	blobSound blobProblem = iota
+	blobCorrupt
+	blobOrphan
+	blobStale
+	blobSkipped // verified recently, sound
+)
+
+// Verifies the whole cache: the content of each blob against the md5
+// checksum it is named after, see blob.Manager.Verify, and the blobs
+// against the metadata of their files. If repair is set, the corrupt,
+// orphan and stale blobs are removed, and the files of the corrupt and
+// the missing blobs are queued for download again. All of the blobs
+// are read, but the ones verified recently, see
+// SyncOptions.VerifyInterval; it takes a while on large caches. The
+// blobs found sound are recorded as verified. Nothing is cached in
+// pass-through mode, there is nothing to verify.
+func (d *CachedSyncer) Verify(repair bool) (*VerifyReport, error) {
+	report := &VerifyReport{}
+	if d.blobManager.IsPassThrough() {
+		return report, nil
+	}
+	var mu sync.Mutex
+	err := d.blobManager.ForEach(func(e *blob.Entry) error {
+		problem, err := d.verifyBlob(e)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		report.Blobs++
+		switch problem {
+		case blobCorrupt:
+			report.Corrupt = append(report.Corrupt, *e)
+		case blobOrphan:
+			report.Orphans = append(report.Orphans, *e)
+		case blobStale:
+			report.Stale = append(report.Stale, *e)
+		case blobSkipped:
+			report.Skipped++
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	err = d.metaService.EachCached(func(file *metadata.CachedDriveFile) error {
+		// nothing is stored for the files without content
+		if file.Unsupported || file.IsShortcut() || (file.IsLocal() && file.FileSize == 0) {
+			return nil
+		}
+		if !d.blobManager.Exists(file.Id, file.Md5Checksum) && !d.blobManager.IsSparse(file.Id, file.Md5Checksum) {
+			report.Missing = append(report.Missing, file.Id)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	// the blobs are listed concurrently
+	for _, entries := range [][]blob.Entry{report.Corrupt, report.Orphans, report.Stale} {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Path < entries[j].Path
+		})
+	}
+	d.opts.Logger.V("Verified", report.Blobs, "blobs:", len(report.Corrupt), "corrupt,", len(report.Orphans), "orphans,", len(report.Stale), "stale,", len(report.Missing), "missing,", report.Skipped, "skipped")
+	if repair {
+		err = d.repair(report)
+	}
+	return report, err
+}
+
+// Checks the blob of the entry against the metadata of its file, then
+// its content.
+func (d *CachedSyncer) verifyBlob(e *blob.Entry) (blobProblem, error) {
+	file, err := d.metaService.Get(e.Id)
+	if err == metadata.ErrNotFound {
+		return blobOrphan, nil
+	}
+	if err != nil {
+		return blobSound, err
+	}
+	// the edits of the file, not pushed yet, are of no checksum
+	if !e.IsDirty() && !strings.EqualFold(e.Checksum, file.Md5Checksum) && !strings.EqualFold(e.Checksum, file.StaleChecksum) {
+		return blobStale, nil
+	}
+	current := !e.IsDirty() && e.IsVerifiable() && strings.EqualFold(e.Checksum, file.Md5Checksum)
+	if current && d.opts.VerifyInterval > 0 && time.Since(file.VerifiedAt) < d.opts.VerifyInterval {
+		return blobSkipped, nil
+	}
+	err = d.blobManager.Verify(e)
+	switch {
+	case err == nil && current:
+		if err = d.metaService.SetVerified(file, time.Now()); err != nil {
+			d.opts.Logger.V("error recording the verification of", e.Id, err)
+		}
+		return blobSound, nil
+	case err == nil, os.IsNotExist(err):
+		// removed since it was listed, e.g. evicted
+		return blobSound, nil
+	default:
+		d.opts.Logger.V("blob", e.Id, e.Checksum, "is corrupt", err)
+		return blobCorrupt, nil
+	}
+}
+
+// Removes the bad blobs of the report and queues the files of the
+// corrupt and the missing ones for download.
+func (d *CachedSyncer) repair(report *VerifyReport) error {
+	for _, entries := range [][]blob.Entry{report.Corrupt, report.Orphans, report.Stale} {
+		for i := range entries {
+			if err := d.blobManager.Remove(&entries[i]); err != nil {
+				return err
+			}
+		}
+	}
+	for _, e := range report.Corrupt {
+		if err := d.metaService.EnqueueForIO("download", e.Id); err != nil {
+			return err
+		}
+	}
+	for _, id := range report.Missing {
+		if err := d.metaService.EnqueueForIO("download", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	client "github.com/rakyll/drivefuse/third_party/code.google.com/p/google-api-go-client/drive/v2"
+)
+
+const (
+	// Type of the watch channels notifying a webhook.
+	webhookChannel = "web_hook"
+
+	// Watch channels are renewed this long before they expire, or
+	// halfway through if they are shorter lived.
+	watchRenewMargin = 5 * time.Minute
+
+	// State of the first notification of a channel, sent once it is
+	// watched, rather than of a change.
+	resourceStateSync = "sync"
+)
+
+// Watches the changes of Drive until ctx is done, see
+// SyncOptions.WebhookAddress. A new channel is watched shortly before
+// the current one expires, and the current one is stopped then. Failed
+// watches are retried every SyncOptions.ConnectivityInterval, Drive is
+// polled in between.
+func (d *CachedSyncer) watchChanges(ctx context.Context) {
+	for ctx.Err() == nil {
+		wait := d.opts.ConnectivityInterval
+		channel, err := d.watch(ctx)
+		if err == nil {
+			d.opts.Logger.V("Watching the changes of Drive until", channelExpiration(channel))
+			d.stopChannel(d.setChannel(channel))
+			wait = renewAfter(channel)
+		} else if ctx.Err() == nil {
+			d.opts.Logger.V("error watching the changes, polling them instead", err)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+	}
+	d.stopChannel(d.setChannel(nil))
+}
+
+// Requests the notifications of the changes on a new channel.
+func (d *CachedSyncer) watch(ctx context.Context) (*client.Channel, error) {
+	channel := &client.Channel{
+		Id:         randomToken(),
+		Token:      randomToken(),
+		Type:       webhookChannel,
+		Address:    d.opts.WebhookAddress,
+		Expiration: time.Now().Add(d.opts.WatchTTL).UnixNano() / int64(time.Millisecond),
+	}
+	var watched *client.Channel
+	err := d.doWithRetry(ctx, func() (err error) {
+		watched, err = d.remoteService.Changes.Watch(channel).IncludeSubscribed(d.opts.IncludeSubscribed).Do()
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the token is not echoed, and Drive may shorten the lifetime
+	watched.Token = channel.Token
+	if watched.Expiration == 0 {
+		watched.Expiration = channel.Expiration
+	}
+	return watched, nil
+}
+
+// Stops the notifications of the channel, if any.
+func (d *CachedSyncer) stopChannel(channel *client.Channel) {
+	if channel == nil {
+		return
+	}
+	err := d.withTimeout(context.Background(), func() error {
+		return d.remoteService.Channels.Stop(&client.Channel{Id: channel.Id, ResourceId: channel.ResourceId}).Do()
+	})
+	if err != nil {
+		d.opts.Logger.V("error stopping watch channel", channel.Id, err)
+	}
+}
+
+// Makes the channel the current one, returns the previous one.
+func (d *CachedSyncer) setChannel(channel *client.Channel) *client.Channel {
+	d.muWatch.Lock()
+	defer d.muWatch.Unlock()
+	prev := d.channel
+	d.channel = channel
+	return prev
+}
+
+// Returns true if a watch channel notifies the changes, the notified
+// ones don't need to be polled.
+func (d *CachedSyncer) watching() bool {
+	d.muWatch.Lock()
+	defer d.muWatch.Unlock()
+	return d.channel != nil && time.Now().Before(channelExpiration(d.channel))
+}
+
+// NotificationHandler returns the handler of the notifications Drive
+// sends to SyncOptions.WebhookAddress, which triggers a sync on each
+// change. The notifications of other channels, e.g. channels of a
+// previous run, are ignored.
+func (d *CachedSyncer) NotificationHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id, token := req.Header.Get("X-Goog-Channel-ID"), req.Header.Get("X-Goog-Channel-Token")
+		d.muWatch.Lock()
+		current := d.channel != nil && d.channel.Id == id && d.channel.Token == token
+		d.muWatch.Unlock()
+		if current && req.Header.Get("X-Goog-Resource-State") != resourceStateSync {
+			d.Trigger()
+		}
+		// anything else is retried by Drive
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func channelExpiration(channel *client.Channel) time.Time {
+	return time.Unix(0, channel.Expiration*int64(time.Millisecond))
+}
+
+// Returns the time until the channel is renewed.
+func renewAfter(channel *client.Channel) time.Duration {
+	until := time.Until(channelExpiration(channel))
+	return until - min(watchRenewMargin, until/2)
+}
+
+// Returns a random token, unique to a channel.
+func randomToken() string {
+	p := make([]byte, 16)
+	rand.Read(p)
+	return hex.EncodeToString(p)
+}
@@ -756,8 +756,9 @@ type File struct {
 	// file is trashed.
 	ExplicitlyTrashed bool `json:"explicitlyTrashed,omitempty"`
 
-	// ExportLinks: Links for exporting Google Docs to specific formats.
-	ExportLinks *FileExportLinks `json:"exportLinks,omitempty"`
+	// ExportLinks: Links for exporting Google Docs to specific formats,
+	// keyed by the mime type of the format.
+	ExportLinks map[string]string `json:"exportLinks,omitempty"`
 
 	// FileExtension: The file extension used when downloading this file.
 	// This field is read only. To set the extension, include it in the
@@ -864,6 +865,11 @@ type File struct {
 	// (formatted RFC 3339 timestamp).
 	SharedWithMeDate string `json:"sharedWithMeDate,omitempty"`
 
+	// ShortcutDetails: Shortcut file details. Only populated for shortcut
+	// files, which have the mimeType field set to
+	// application/vnd.google-apps.shortcut.
+	ShortcutDetails *FileShortcutDetails `json:"shortcutDetails,omitempty"`
+
 	// Thumbnail: Thumbnail for the file. Only accepted on upload and for
 	// files that are not already thumbnailed by Google.
 	Thumbnail *FileThumbnail `json:"thumbnail,omitempty"`
@@ -894,9 +900,6 @@ type File struct {
 	WritersCanShare bool `json:"writersCanShare,omitempty"`
 }
 
-type FileExportLinks struct {
-}
-
 type FileImageMediaMetadata struct {
 	// Aperture: The aperture used to create the photo (f-number).
 	Aperture float64 `json:"aperture,omitempty"`
@@ -1001,6 +1004,15 @@ type FileLabels struct {
 type FileOpenWithLinks struct {
 }
 
+type FileShortcutDetails struct {
+	// TargetId: The ID of the file that this shortcut points to.
+	TargetId string `json:"targetId,omitempty"`
+
+	// TargetMimeType: The MIME type of the file that this shortcut points
+	// to.
+	TargetMimeType string `json:"targetMimeType,omitempty"`
+}
+
 type FileThumbnail struct {
 	// Image: The URL-safe Base64 encoded bytes of the thumbnail image.
 	Image string `json:"image,omitempty"`
@@ -1594,6 +1606,29 @@ func (r *ChangesService) List() *ChangesListCall {
 	return c
 }
 
+// DriveId sets the optional parameter "driveId": The shared drive from
+// which changes are returned.
+func (c *ChangesListCall) DriveId(driveId string) *ChangesListCall {
+	c.opt_["driveId"] = driveId
+	return c
+}
+
+// IncludeItemsFromAllDrives sets the optional parameter
+// "includeItemsFromAllDrives": Whether both My Drive and shared drive
+// items should be included in results.
+func (c *ChangesListCall) IncludeItemsFromAllDrives(includeItemsFromAllDrives bool) *ChangesListCall {
+	c.opt_["includeItemsFromAllDrives"] = includeItemsFromAllDrives
+	return c
+}
+
+// SupportsAllDrives sets the optional parameter "supportsAllDrives":
+// Whether the requesting application supports both My Drives and
+// shared drives.
+func (c *ChangesListCall) SupportsAllDrives(supportsAllDrives bool) *ChangesListCall {
+	c.opt_["supportsAllDrives"] = supportsAllDrives
+	return c
+}
+
 // IncludeDeleted sets the optional parameter "includeDeleted": Whether
 // to include deleted items.
 func (c *ChangesListCall) IncludeDeleted(includeDeleted bool) *ChangesListCall {
@@ -1635,6 +1670,15 @@ func (c *ChangesListCall) Do() (*ChangeList, error) {
 	var body io.Reader = nil
 	params := make(url.Values)
 	params.Set("alt", "json")
+	if v, ok := c.opt_["driveId"]; ok {
+		params.Set("driveId", fmt.Sprintf("%v", v))
+	}
+	if v, ok := c.opt_["includeItemsFromAllDrives"]; ok {
+		params.Set("includeItemsFromAllDrives", fmt.Sprintf("%v", v))
+	}
+	if v, ok := c.opt_["supportsAllDrives"]; ok {
+		params.Set("supportsAllDrives", fmt.Sprintf("%v", v))
+	}
 	if v, ok := c.opt_["includeDeleted"]; ok {
 		params.Set("includeDeleted", fmt.Sprintf("%v", v))
 	}
@@ -3098,6 +3142,14 @@ func (c *FilesGetCall) Projection(projection string) *FilesGetCall {
 	return c
 }
 
+// SupportsAllDrives sets the optional parameter "supportsAllDrives":
+// Whether the requesting application supports both My Drives and
+// shared drives.
+func (c *FilesGetCall) SupportsAllDrives(supportsAllDrives bool) *FilesGetCall {
+	c.opt_["supportsAllDrives"] = supportsAllDrives
+	return c
+}
+
 // UpdateViewedDate sets the optional parameter "updateViewedDate":
 // Whether to update the view date after successfully retrieving the
 // file.
@@ -3113,6 +3165,9 @@ func (c *FilesGetCall) Do() (*File, error) {
 	if v, ok := c.opt_["projection"]; ok {
 		params.Set("projection", fmt.Sprintf("%v", v))
 	}
+	if v, ok := c.opt_["supportsAllDrives"]; ok {
+		params.Set("supportsAllDrives", fmt.Sprintf("%v", v))
+	}
 	if v, ok := c.opt_["updateViewedDate"]; ok {
 		params.Set("updateViewedDate", fmt.Sprintf("%v", v))
 	}
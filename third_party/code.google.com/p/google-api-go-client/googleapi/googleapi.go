@@ -31,7 +31,18 @@ type ContentTyper interface {
 const Version = "0.5"
 
 type Error struct {
-	Code    int    `json:"code"`
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Errors  []ErrorItem `json:"errors,omitempty"`
+
+	// Header of the response, e.g. holding a Retry-After.
+	Header http.Header `json:"-"`
+}
+
+// ErrorItem is a detailed error, such as one of reason
+// "rateLimitExceeded".
+type ErrorItem struct {
+	Reason  string `json:"reason"`
 	Message string `json:"message"`
 }
 
@@ -52,6 +63,7 @@ func CheckResponse(res *http.Response) error {
 		jerr := new(errorReply)
 		err = json.Unmarshal(slurp, jerr)
 		if err == nil && jerr.Error != nil {
+			jerr.Error.Header = res.Header
 			return jerr.Error
 		}
 	}